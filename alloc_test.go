@@ -0,0 +1,164 @@
+package raytracer
+
+import (
+	"testing"
+
+	"github.com/timdestan/go-raytracer/internal/gml"
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+// allocTestScene has one of each kind of object, with constant, compiled
+// and per-face surface functions, and a compiled one that builds a
+// material, lit by a point light so that shadow rays are traced too. The sphere and cylinder are in an instance.
+const allocTestScene = `
+	{ /v /u /face 1.0 0.0 0.0 point 1.0 0.0 1.0 } sphere
+	-3.0 0.0 0.0 translate
+	{ /v /u /face face 0 eqi { 1.0 } { 0.0 } if 1.0 0.0 point 1.0 0.0 1.0 } cylinder
+	union 1.5 0.0 5.0 translate
+	{ /v /u /face u v 0.0 point 0.0 0.0 0.0 1.0 1.0 0.0 1.0 material } cube
+	0.0 0.0 5.0 translate union
+	{ /v /u /face 0.5 0.5 0.5 point 1.0 0.0 1.0 } plane
+	0.0 -1.0 0.0 translate union /scene
+	0.2 0.2 0.2 point [ 0.0 5.0 0.0 point 1.0 1.0 1.0 point pointlight ]
+	scene 3 90.0 16 16 "out.ppm" render`
+
+// movingAllocTestScene is allocTestScene with the instance moving and
+// turning while the shutter is open.
+const movingAllocTestScene = `
+	{ /v /u /face 1.0 0.0 0.0 point 1.0 0.0 1.0 } sphere
+	-3.0 0.0 0.0 translate
+	{ /v /u /face face 0 eqi { 1.0 } { 0.0 } if 1.0 0.0 point 1.0 0.0 1.0 } cylinder
+	union /tree
+	tree 1.5 0.0 5.0 translate
+	tree 10.0 rotatey 1.5 0.2 5.0 translate motion
+	{ /v /u /face u v 0.0 point 0.0 0.0 0.0 1.0 1.0 0.0 1.0 material } cube
+	0.0 0.0 5.0 translate union
+	{ /v /u /face 0.5 0.5 0.5 point 1.0 0.0 1.0 } plane
+	0.0 -1.0 0.0 translate union /scene
+	0.2 0.2 0.2 point [ 0.0 5.0 0.0 point 1.0 1.0 1.0 point pointlight ]
+	scene 3 90.0 16 16 "out.ppm" render`
+
+func newAllocTestScene(tb testing.TB) *Scene {
+	tb.Helper()
+	return newAllocTestSceneFrom(tb, allocTestScene)
+}
+
+func newAllocTestSceneFrom(tb testing.TB, program string) *Scene {
+	tb.Helper()
+	var scene *Scene
+	state := gml.NewEvalState()
+	state.Render = func(state *gml.EvalState, args *gml.RenderArgs) error {
+		var err error
+		scene, err = ConvertRenderArgsToScene(args, state)
+		return err
+	}
+	if err := state.ParseAndEval(program); err != nil {
+		tb.Fatalf("ParseAndEval: %v", err)
+	}
+	return scene
+}
+
+// primaryRays returns rays from the eye towards each object in the alloc
+// test scene, and one that misses everything.
+func primaryRays() []Ray {
+	var rays []Ray
+	for _, target := range []prim.Vec3{
+		{X: -1.5, Z: 5},         // sphere
+		{X: 0.25, Y: 0.5, Z: 5}, // cube
+		{X: 1.5, Y: 0.5, Z: 5},  // cylinder
+		{Y: -1, Z: 3},           // plane
+		{Y: 1},                  // sky
+	} {
+		rays = append(rays, Ray{Direction: target.Normalize()})
+	}
+	return rays
+}
+
+func TestIntersectAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are not reliable with the race detector")
+	}
+	scene := newAllocTestScene(t)
+	threadState := &scene.PerThreadStates[0]
+	rays := primaryRays()
+	for i, ray := range rays {
+		wantHit := i < len(rays)-1
+		if hit := threadState.closestHit(scene.Objects, ray); (hit != nil) != wantHit {
+			t.Errorf("closestHit(%v) = %+v, want hit: %v", ray.Direction, hit, wantHit)
+		}
+		allocs := testing.AllocsPerRun(100, func() {
+			threadState.closestHit(scene.Objects, ray)
+		})
+		if allocs != 0 {
+			t.Errorf("closestHit(%v) allocated %v times, want 0", ray.Direction, allocs)
+		}
+	}
+}
+
+func TestPrimaryRayAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are not reliable with the race detector")
+	}
+	scene := newAllocTestScene(t)
+	threadState := &scene.PerThreadStates[0]
+	for _, ray := range primaryRays() {
+		allocs := testing.AllocsPerRun(100, func() {
+			traceRay(scene, threadState, ray, scene.RecursionDepth)
+		})
+		if allocs != 0 {
+			t.Errorf("traceRay(%v) allocated %v times, want 0", ray.Direction, allocs)
+		}
+	}
+}
+
+// TestMovingRayAllocs checks that rays through a scene with a moving
+// instance don't allocate, whether or not the thread has already placed the
+// instance at the ray's time.
+func TestMovingRayAllocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocation counts are not reliable with the race detector")
+	}
+	scene := newAllocTestSceneFrom(t, movingAllocTestScene)
+	if !scene.MotionBlur {
+		t.Fatal("the scene does not move")
+	}
+	threadState := &scene.PerThreadStates[0]
+	for _, ray := range primaryRays() {
+		allocs := testing.AllocsPerRun(100, func() {
+			for _, time := range []float64{0.25, 0.75} {
+				ray.Time = time
+				threadState.closestHit(scene.Objects, ray)
+				traceRay(scene, threadState, ray, scene.RecursionDepth)
+			}
+		})
+		if allocs != 0 {
+			t.Errorf("tracing %v allocated %v times, want 0", ray.Direction, allocs)
+		}
+	}
+}
+
+func BenchmarkPrimaryRay(b *testing.B) {
+	scene := newAllocTestScene(b)
+	threadState := &scene.PerThreadStates[0]
+	rays := primaryRays()
+	b.ReportAllocs()
+	for b.Loop() {
+		for _, ray := range rays {
+			traceRay(scene, threadState, ray, scene.RecursionDepth)
+		}
+	}
+}
+
+func BenchmarkMovingPrimaryRay(b *testing.B) {
+	scene := newAllocTestSceneFrom(b, movingAllocTestScene)
+	threadState := &scene.PerThreadStates[0]
+	rays := primaryRays()
+	b.ReportAllocs()
+	for i := 0; b.Loop(); i++ {
+		for _, ray := range rays {
+			// A new time for each sample, as when rendering.
+			ray.Time = float64(i%64) / 64
+			traceRay(scene, threadState, ray, scene.RecursionDepth)
+		}
+	}
+}
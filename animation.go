@@ -0,0 +1,143 @@
+package raytracer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"sync"
+
+	"github.com/timdestan/go-raytracer/internal/gml"
+)
+
+// Animation describes the frames of an animation rendered from one GML
+// program.
+//
+// The program is run once for each frame, with frame bound to the number
+// of the frame, from 0 to Frames-1, and time bound to frame/(Frames-1), so
+// that it goes from 0.0 on the first frame to 1.0 on the last. A frame
+// renders the same image whether it is rendered alone or as part of the
+// animation.
+type Animation struct {
+	Frames int
+	// Parallel is the number of frames that are evaluated and rendered at
+	// once. If it is 0, 2 frames are, so that evaluating one frame overlaps
+	// with rendering another. Only this many frames are kept, so frames
+	// are not rendered further ahead of the one frameDone is given next.
+	Parallel int
+}
+
+// frameTime returns the value of time for the frame.
+func (anim *Animation) frameTime(frame int) float64 {
+	if anim.Frames <= 1 {
+		return 0
+	}
+	return float64(frame) / float64(anim.Frames-1)
+}
+
+// ParseAndRenderGMLFileAnimation renders the frames of the animation from
+// the GML program at path, calling frameDone with each frame's image in
+// order. It stops at the first error, including one from frameDone, and
+// returns the statistics of all the frames. Frames are rendered at the same
+// time, so they can't share a checkpoint, and opts.CheckpointFile must not
+// be set.
+func ParseAndRenderGMLFileAnimation(ctx context.Context, path string, anim Animation, opts RenderOptions, frameDone func(frame int, img image.Image) error) (*RenderStats, error) {
+	return renderAnimation(ctx, anim, opts, frameDone, func(state *gml.EvalState) (gml.TokenList, error) {
+		return state.ParseFile(path)
+	})
+}
+
+// ParseAndRenderGMLAnimation is ParseAndRenderGMLFileAnimation for a
+// program given as text.
+func ParseAndRenderGMLAnimation(ctx context.Context, programText string, anim Animation, opts RenderOptions, frameDone func(frame int, img image.Image) error) (*RenderStats, error) {
+	return renderAnimation(ctx, anim, opts, frameDone, func(state *gml.EvalState) (gml.TokenList, error) {
+		return state.Parse(programText)
+	})
+}
+
+type frameResult struct {
+	img   image.Image
+	stats *RenderStats
+	err   error
+}
+
+func renderAnimation(ctx context.Context, anim Animation, opts RenderOptions, frameDone func(int, image.Image) error, parse func(*gml.EvalState) (gml.TokenList, error)) (*RenderStats, error) {
+	if anim.Frames <= 0 {
+		return nil, errors.New("an animation needs at least one frame")
+	}
+	if opts.CheckpointFile != "" {
+		return nil, errors.New("animations can't be checkpointed")
+	}
+	parallel := anim.Parallel
+	if parallel <= 0 {
+		parallel = 2
+	}
+	ctx, cancel := context.WithCancel(ctx)
+
+	// Frames finish out of order, so each has its own channel for its
+	// result, which is read in order.
+	results := make([]chan frameResult, anim.Frames)
+	for i := range results {
+		results[i] = make(chan frameResult, 1)
+	}
+	// Workers only start a frame once there are fewer than parallel frames
+	// ahead of the one being waited for, so a slow frame doesn't leave the
+	// rest of the animation waiting in memory.
+	ahead := make(chan struct{}, parallel)
+	frames := make(chan int)
+	var wg sync.WaitGroup
+	for range min(parallel, anim.Frames) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for frame := range frames {
+				state := gml.NewEvalState()
+				state.Bind("frame", gml.VInt(frame))
+				state.Bind("time", gml.VReal(anim.frameTime(frame)))
+				img, stats, err := renderFromEvalState(ctx, state, opts, func() (gml.TokenList, error) {
+					return parse(state)
+				})
+				results[frame] <- frameResult{img, stats, err}
+			}
+		}()
+	}
+	go func() {
+		defer close(frames)
+		for frame := range anim.Frames {
+			select {
+			case ahead <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			select {
+			case frames <- frame:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	// Stop the workers before returning, even on errors.
+	defer func() {
+		cancel()
+		wg.Wait()
+	}()
+
+	total := &RenderStats{}
+	for frame, result := range results {
+		var r frameResult
+		select {
+		case r = <-result:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		if r.err != nil {
+			return nil, fmt.Errorf("frame %d: %w", frame, r.err)
+		}
+		total.Add(r.stats)
+		if err := frameDone(frame, r.img); err != nil {
+			return nil, err
+		}
+		<-ahead
+	}
+	return total, nil
+}
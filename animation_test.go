@@ -0,0 +1,150 @@
+package raytracer
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/timdestan/go-raytracer/internal/gml"
+)
+
+// animationTestScene moves the sphere from left to right as time goes from
+// 0 to 1, and makes it blue on the first frame.
+const animationTestScene = `
+	{ /v /u /face frame 0 eqi { 0.0 0.0 1.0 point } { u v 0.5 point } if 1.0 0.3 1.0 }
+	sphere time 2.0 mulf 1.0 subf 0.0 4.0 translate /scene
+	0.2 0.2 0.2 point [ 0.0 5.0 0.0 point 1.0 1.0 1.0 point pointlight ]
+	scene 3 90.0 32 24 "out.ppm" render`
+
+func renderAnimationFrames(t *testing.T, anim Animation) []image.Image {
+	t.Helper()
+	var frames []image.Image
+	_, err := ParseAndRenderGMLAnimation(context.Background(), animationTestScene, anim, RenderOptions{}, func(frame int, img image.Image) error {
+		if frame != len(frames) {
+			t.Errorf("got frame %d, want frame %d", frame, len(frames))
+		}
+		frames = append(frames, img)
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ParseAndRenderGMLAnimation: %v", err)
+	}
+	return frames
+}
+
+func TestAnimationFramesMatchStillRenders(t *testing.T) {
+	frames := renderAnimationFrames(t, Animation{Frames: 5, Parallel: 3})
+	if len(frames) != 5 {
+		t.Fatalf("got %d frames, want 5", len(frames))
+	}
+	for frame, img := range frames {
+		// The same program with frame and time bound at the start.
+		program := fmt.Sprintf("%d /frame %v /time %s", frame, gml.VReal(float64(frame)/4), animationTestScene)
+		want, err := ParseAndRenderGML(program)
+		if err != nil {
+			t.Fatalf("ParseAndRenderGML(frame %d): %v", frame, err)
+		}
+		if !bytes.Equal(img.(*image.RGBA).Pix, want.(*image.RGBA).Pix) {
+			t.Errorf("frame %d differs from rendering it on its own", frame)
+		}
+	}
+	if bytes.Equal(frames[1].(*image.RGBA).Pix, frames[2].(*image.RGBA).Pix) {
+		t.Error("frames 1 and 2 are the same, want the sphere to move")
+	}
+}
+
+func TestAnimationIsIndependentOfParallelism(t *testing.T) {
+	want := renderAnimationFrames(t, Animation{Frames: 4, Parallel: 1})
+	got := renderAnimationFrames(t, Animation{Frames: 4, Parallel: 4})
+	for frame := range want {
+		if !bytes.Equal(got[frame].(*image.RGBA).Pix, want[frame].(*image.RGBA).Pix) {
+			t.Errorf("frame %d differs when frames are rendered in parallel", frame)
+		}
+	}
+}
+
+func TestAnimationBoundsFramesAhead(t *testing.T) {
+	// Each frame is a single tile, so TileDone counts rendered frames.
+	var rendered atomic.Int32
+	opts := RenderOptions{TileSize: 64, TileDone: func(*image.RGBA) { rendered.Add(1) }}
+	_, err := ParseAndRenderGMLAnimation(context.Background(), animationTestScene, Animation{Frames: 8, Parallel: 2}, opts, func(frame int, img image.Image) error {
+		if frame == 0 {
+			// Give the workers time to render frames they shouldn't.
+			time.Sleep(100 * time.Millisecond)
+			if n := rendered.Load(); n > 2 {
+				t.Errorf("%d frames rendered while frame 0 was consumed, want at most 2", n)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("ParseAndRenderGMLAnimation: %v", err)
+	}
+}
+
+func TestAnimationErrors(t *testing.T) {
+	errStop := errors.New("stop")
+	_, err := ParseAndRenderGMLAnimation(context.Background(), animationTestScene, Animation{Frames: 10}, RenderOptions{}, func(frame int, img image.Image) error {
+		if frame == 1 {
+			return errStop
+		}
+		return nil
+	})
+	if !errors.Is(err, errStop) {
+		t.Errorf("error = %v, want %v", err, errStop)
+	}
+
+	// The program fails on frame 2.
+	failing := "frame 2 eqi { 1 addi } { } if " + animationTestScene
+	_, err = ParseAndRenderGMLAnimation(context.Background(), failing, Animation{Frames: 4}, RenderOptions{}, func(int, image.Image) error { return nil })
+	if err == nil || !strings.HasPrefix(err.Error(), "frame 2:") {
+		t.Errorf("error = %v, want an error for frame 2", err)
+	}
+
+	// Frames rendered at the same time would overwrite each other's
+	// checkpoints.
+	opts := RenderOptions{CheckpointFile: filepath.Join(t.TempDir(), "anim.ckpt")}
+	_, err = ParseAndRenderGMLAnimation(context.Background(), animationTestScene, Animation{Frames: 2}, opts, func(int, image.Image) error { return nil })
+	if err == nil {
+		t.Error("animation with a checkpoint file succeeded, want an error")
+	}
+}
+
+func TestParseAndRenderGMLFileImages(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "two.gml")
+	program := `
+		{ /v /u /face u v 0.5 point 1.0 0.3 1.0 } sphere /s
+		s -0.5 0.0 4.0 translate /scene
+		0.2 0.2 0.2 point [ ] scene 3 90.0 16 12 "a.ppm" render
+		s 0.5 0.0 4.0 translate /scene
+		0.2 0.2 0.2 point [ ] scene 3 90.0 16 12 "b.ppm" render`
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	images, _, err := ParseAndRenderGMLFileImages(context.Background(), path, RenderOptions{})
+	if err != nil {
+		t.Fatalf("ParseAndRenderGMLFileImages: %v", err)
+	}
+	if len(images) != 2 {
+		t.Fatalf("got %d images, want 2", len(images))
+	}
+	// The images are in the order they were rendered.
+	first, err := ParseAndRenderGML(program[:strings.Index(program, "render")+len("render")])
+	if err != nil {
+		t.Fatalf("ParseAndRenderGML: %v", err)
+	}
+	if !bytes.Equal(images[0].(*image.RGBA).Pix, first.(*image.RGBA).Pix) {
+		t.Error("first image differs from the first render")
+	}
+	if _, err := ParseAndRenderGMLFile(path); err == nil {
+		t.Error("ParseAndRenderGMLFile succeeded for a program that renders two images, want an error")
+	}
+}
@@ -0,0 +1,90 @@
+package raytracer
+
+import (
+	"math"
+
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+// bounds is an axis aligned bounding box.
+type bounds struct {
+	min, max prim.Vec3
+}
+
+// emptyBounds contains nothing, and is where unions of bounds start.
+var emptyBounds = bounds{
+	min: prim.Vec3{X: math.Inf(1), Y: math.Inf(1), Z: math.Inf(1)},
+	max: prim.Vec3{X: math.Inf(-1), Y: math.Inf(-1), Z: math.Inf(-1)},
+}
+
+// infiniteBounds contains everything, for unbounded objects like planes.
+var infiniteBounds = bounds{
+	min: prim.Vec3{X: math.Inf(-1), Y: math.Inf(-1), Z: math.Inf(-1)},
+	max: prim.Vec3{X: math.Inf(1), Y: math.Inf(1), Z: math.Inf(1)},
+}
+
+func (b bounds) isInfinite() bool {
+	for _, x := range [6]float64{b.min.X, b.min.Y, b.min.Z, b.max.X, b.max.Y, b.max.Z} {
+		if math.IsInf(x, 0) {
+			return true
+		}
+	}
+	return false
+}
+
+// union returns the bounds of b and other.
+func (b bounds) union(other bounds) bounds {
+	return bounds{
+		min: prim.Vec3{X: min(b.min.X, other.min.X), Y: min(b.min.Y, other.min.Y), Z: min(b.min.Z, other.min.Z)},
+		max: prim.Vec3{X: max(b.max.X, other.max.X), Y: max(b.max.Y, other.max.Y), Z: max(b.max.Z, other.max.Z)},
+	}
+}
+
+// transform returns bounds that contain b transformed by m. Bounds that are
+// infinite in any direction stay infinite, since a rotation could turn that
+// direction into any other.
+func (b bounds) transform(m *prim.Mat4) bounds {
+	if b.isInfinite() {
+		return infiniteBounds
+	}
+	result := emptyBounds
+	for _, x := range [2]float64{b.min.X, b.max.X} {
+		for _, y := range [2]float64{b.min.Y, b.max.Y} {
+			for _, z := range [2]float64{b.min.Z, b.max.Z} {
+				corner := m.MulPoint(prim.Vec3{X: x, Y: y, Z: z})
+				result = result.union(bounds{min: corner, max: corner})
+			}
+		}
+	}
+	return result
+}
+
+// hit reports whether the ray passes through the bounds in front of its
+// origin.
+func (b *bounds) hit(ray Ray) bool {
+	slabs := [3]struct{ origin, dir, lo, hi float64 }{
+		{ray.Origin.X, ray.Direction.X, b.min.X, b.max.X},
+		{ray.Origin.Y, ray.Direction.Y, b.min.Y, b.max.Y},
+		{ray.Origin.Z, ray.Direction.Z, b.min.Z, b.max.Z},
+	}
+
+	tMin, tMax := 0.0, math.Inf(1)
+	for _, slab := range slabs {
+		if slab.dir == 0 {
+			// Parallel to the slab, so either always or never inside it.
+			if slab.origin < slab.lo || slab.origin > slab.hi {
+				return false
+			}
+			continue
+		}
+		t0, t1 := (slab.lo-slab.origin)/slab.dir, (slab.hi-slab.origin)/slab.dir
+		if t0 > t1 {
+			t0, t1 = t1, t0
+		}
+		tMin, tMax = max(tMin, t0), min(tMax, t1)
+		if tMin > tMax {
+			return false
+		}
+	}
+	return true
+}
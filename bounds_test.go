@@ -0,0 +1,42 @@
+package raytracer
+
+import (
+	"testing"
+
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+func TestBoundsHit(t *testing.T) {
+	unit := bounds{max: prim.Vec3{X: 1, Y: 1, Z: 1}}
+	for _, tt := range []struct {
+		name string
+		b    bounds
+		ray  Ray
+		want bool
+	}{
+		{"through", unit, Ray{Origin: prim.Vec3{X: 0.5, Y: 0.5, Z: -1}, Direction: prim.Vec3{Z: 1}}, true},
+		{"inside", unit, Ray{Origin: prim.Vec3{X: 0.5, Y: 0.5, Z: 0.5}, Direction: prim.Vec3{X: -1, Y: 2}}, true},
+		{"beside", unit, Ray{Origin: prim.Vec3{X: 2, Y: 0.5, Z: -1}, Direction: prim.Vec3{Z: 1}}, false},
+		{"behind", unit, Ray{Origin: prim.Vec3{X: 0.5, Y: 0.5, Z: 2}, Direction: prim.Vec3{Z: 1}}, false},
+		{"diagonal miss", unit, Ray{Origin: prim.Vec3{X: -1, Y: 1.5, Z: 0.5}, Direction: prim.Vec3{X: 1, Y: 1}}, false},
+		{"infinite", infiniteBounds, Ray{Origin: prim.Vec3{Z: 5}, Direction: prim.Vec3{Y: -1}}, true},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.b.hit(tt.ray); got != tt.want {
+				t.Errorf("%+v.hit(%+v) = %v, want %v", tt.b, tt.ray, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestBoundsTransform(t *testing.T) {
+	unit := bounds{max: prim.Vec3{X: 1, Y: 1, Z: 1}}
+	got := unit.transform(prim.Mat4Scale(2, 3, 4).MulMat(prim.Mat4Translate(prim.Vec3{X: -1})))
+	want := bounds{min: prim.Vec3{X: -2}, max: prim.Vec3{X: 0, Y: 3, Z: 4}}
+	if got != want {
+		t.Errorf("transform = %+v, want %+v", got, want)
+	}
+	if got := infiniteBounds.transform(prim.Mat4RotateY(0.5)); got != infiniteBounds {
+		t.Errorf("infinite bounds transformed to %+v, want infinite bounds", got)
+	}
+}
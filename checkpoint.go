@@ -0,0 +1,215 @@
+package raytracer
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/timdestan/go-raytracer/internal/gml"
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+// framebuffer accumulates the samples of each pixel of a checkpointed render.
+//
+// Workers add to distinct pixels while holding the read lock, so that a
+// checkpoint can take the write lock to get a consistent copy.
+type framebuffer struct {
+	mu     sync.RWMutex
+	width  int
+	sums   []prim.Vec3
+	counts []int32
+}
+
+func newFramebuffer(width, height int) *framebuffer {
+	return &framebuffer{
+		width:  width,
+		sums:   make([]prim.Vec3, width*height),
+		counts: make([]int32, width*height),
+	}
+}
+
+func (fb *framebuffer) index(x, y int) int {
+	return y*fb.width + x
+}
+
+// color returns the average of the samples of the pixel at x, y.
+func (fb *framebuffer) color(x, y int) prim.Vec3 {
+	i := fb.index(x, y)
+	return fb.sums[i].Scale(1.0 / float64(fb.counts[i]))
+}
+
+// checkpoint is the state of a partly finished render, which is written to
+// RenderOptions.CheckpointFile.
+type checkpoint struct {
+	Version   int
+	SceneHash string
+	Options   RenderOptions
+	Width     int
+	Height    int
+	Sums      []prim.Vec3
+	Counts    []int32
+}
+
+// checkpointVersion is incremented whenever the checkpoint format or the
+// sampling changes, so old checkpoints are not resumed.
+const checkpointVersion = 1
+
+// writeCheckpoint writes the framebuffer to the scene's checkpoint file.
+func (scene *Scene) writeCheckpoint(fb *framebuffer, sceneHash string) error {
+	fb.mu.Lock()
+	cp := checkpoint{
+		Version:   checkpointVersion,
+		SceneHash: sceneHash,
+		Options:   scene.RenderOptions,
+		Width:     scene.WidthPx,
+		Height:    scene.HeightPx,
+		Sums:      append([]prim.Vec3(nil), fb.sums...),
+		Counts:    append([]int32(nil), fb.counts...),
+	}
+	fb.mu.Unlock()
+
+	// Write to a temporary file first, so that a render that is killed
+	// while writing keeps the previous checkpoint.
+	path := scene.CheckpointFile
+	f, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(f.Name())
+	if err := gob.NewEncoder(f).Encode(&cp); err != nil {
+		f.Close()
+		return fmt.Errorf("writing checkpoint: %w", err)
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// loadCheckpoint returns the framebuffer saved in the scene's checkpoint
+// file, or a nil framebuffer if there is no checkpoint file. It is an error
+// if the checkpoint is for a different scene, a different part of the
+// image, or a different number of samples per pixel.
+func (scene *Scene) loadCheckpoint(sceneHash string) (*framebuffer, error) {
+	f, err := os.Open(scene.CheckpointFile)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var cp checkpoint
+	if err := gob.NewDecoder(f).Decode(&cp); err != nil {
+		return nil, fmt.Errorf("reading checkpoint %s: %w", scene.CheckpointFile, err)
+	}
+	if cp.Version != checkpointVersion {
+		return nil, fmt.Errorf("checkpoint %s has version %d, want %d", scene.CheckpointFile, cp.Version, checkpointVersion)
+	}
+	if cp.SceneHash != sceneHash {
+		return nil, fmt.Errorf("checkpoint %s is for a different scene", scene.CheckpointFile)
+	}
+	if cp.Width != scene.WidthPx || cp.Height != scene.HeightPx || len(cp.Sums) != cp.Width*cp.Height || len(cp.Counts) != len(cp.Sums) {
+		return nil, fmt.Errorf("checkpoint %s is for a %dx%d image, want %dx%d", scene.CheckpointFile, cp.Width, cp.Height, scene.WidthPx, scene.HeightPx)
+	}
+	if !sameRegion(cp.Options.Region, scene.Region) || cp.Options.Crop != scene.Crop {
+		return nil, fmt.Errorf("checkpoint %s is for a different region of the image", scene.CheckpointFile)
+	}
+	if cp.Options.samples() != scene.samples() {
+		return nil, fmt.Errorf("checkpoint %s has %d samples per pixel, want %d", scene.CheckpointFile, cp.Options.samples(), scene.samples())
+	}
+	return &framebuffer{width: cp.Width, sums: cp.Sums, counts: cp.Counts}, nil
+}
+
+func sameRegion(a, b *Region) bool {
+	if a == nil || b == nil {
+		return a == b
+	}
+	return *a == *b
+}
+
+// checkResume returns an error if the scene is set to resume from a
+// checkpoint that cannot be used.
+func (scene *Scene) checkResume() error {
+	if !scene.Resume || scene.CheckpointFile == "" {
+		return nil
+	}
+	_, err := scene.loadCheckpoint(scene.Hash())
+	return err
+}
+
+// Hash returns a hash of everything in the scene that affects the rendered
+// image, so that checkpoints are only resumed for the same scene.
+func (scene *Scene) Hash() string {
+	h := sha256.New()
+	fmt.Fprintf(h, "size %d %d fov %v depth %v\n", scene.WidthPx, scene.HeightPx, scene.Fov, scene.RecursionDepth)
+	fmt.Fprintf(h, "lens %v %v motion %v\n", scene.ApertureRadius, scene.FocalDistance, scene.MotionBlur)
+	for _, light := range scene.Lights {
+		fmt.Fprintf(h, "light %v\n", *light)
+	}
+	for _, light := range scene.DirectionalLights {
+		fmt.Fprintf(h, "directional light %v\n", light)
+	}
+	fmt.Fprintf(h, "ambient %v background %v %v\n", scene.AmbientLight, scene.BgColorStart, scene.BgColorEnd)
+	if scene.EnvMap != nil {
+		fmt.Fprintf(h, "envmap %v %v %v %v %v\n", scene.EnvMap.Rotation, scene.EnvMap.AmbientScale,
+			scene.EnvMap.Image.Width, scene.EnvMap.Image.Height, scene.EnvMap.Image.Pix)
+	}
+	if scene.Sky != nil {
+		fmt.Fprintf(h, "sky %v %v\n", scene.Sky.SunDirection, scene.Sky.Turbidity)
+	}
+	for _, obj := range scene.Objects {
+		hashObject(h, obj)
+	}
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+func hashObject(h hash.Hash, obj SceneObject) {
+	switch obj := obj.(type) {
+	case *Sphere:
+		fmt.Fprintf(h, "sphere %v ", obj.ObjectToWorld)
+		hashSurfaceFn(h, &obj.SurfaceFn)
+	case *Plane:
+		fmt.Fprintf(h, "plane %v %v ", obj.ObjectToWorld, obj.NormalWorld)
+		hashSurfaceFn(h, &obj.SurfaceFn)
+	case *Cube:
+		fmt.Fprintf(h, "cube %v ", obj.ObjectToWorld)
+		hashSurfaceFn(h, &obj.SurfaceFn)
+	case *Cylinder:
+		fmt.Fprintf(h, "cylinder %v ", obj.ObjectToWorld)
+		hashSurfaceFn(h, &obj.SurfaceFn)
+	case *Instance:
+		fmt.Fprintf(h, "instance %v", obj.ObjectToWorld)
+		if obj.Motion != nil {
+			fmt.Fprintf(h, " moving %v %v", obj.Motion.ObjectToWorld(0), obj.Motion.ObjectToWorld(1))
+		}
+		fmt.Fprintf(h, " {\n")
+		for _, child := range obj.Prototype.Objects {
+			hashObject(h, child)
+		}
+		fmt.Fprintf(h, "}")
+	default:
+		fmt.Fprintf(h, "%T", obj)
+	}
+	fmt.Fprintf(h, "\n")
+}
+
+func hashSurfaceFn(h hash.Hash, fn *gml.VSurfaceFn) {
+	if fn.Material != nil {
+		fmt.Fprintf(h, "material %+v ", *fn.Material)
+	}
+	if len(fn.Faces) > 0 {
+		fmt.Fprintf(h, "faces %+v ", fn.Faces)
+	}
+	if fn.Closure != nil {
+		fmt.Fprintf(h, "closure %v", *fn.Closure)
+	}
+}
@@ -0,0 +1,144 @@
+package raytracer
+
+import (
+	"bytes"
+	"context"
+	"encoding/gob"
+	"image"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+const checkpointTestScene = `
+	{ /v /u /face u v 0.5 point 1.0 0.3 1.0 } sphere 0.0 0.0 4.0 translate
+	{ /v /u /face 0.5 0.5 0.5 point 1.0 0.0 1.0 } plane 0.0 -1.0 0.0 translate
+	union /scene
+	0.2 0.2 0.2 point [ 0.0 5.0 0.0 point 1.0 1.0 1.0 point pointlight ]
+	scene 3 90.0 32 24 "out.ppm" 0.05 4.0 renderWithLens`
+
+func readCheckpointFile(t *testing.T, path string) *checkpoint {
+	t.Helper()
+	f, err := os.Open(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	var cp checkpoint
+	if err := gob.NewDecoder(f).Decode(&cp); err != nil {
+		t.Fatalf("decoding checkpoint: %v", err)
+	}
+	return &cp
+}
+
+func writeCheckpointFile(t *testing.T, path string, cp *checkpoint) {
+	t.Helper()
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(cp); err != nil {
+		t.Fatalf("encoding checkpoint: %v", err)
+	}
+	if err := os.WriteFile(path, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestResumeMatchesUninterruptedRender(t *testing.T) {
+	want, _, err := ParseAndRenderGMLWithOptions(context.Background(), checkpointTestScene, RenderOptions{})
+	if err != nil {
+		t.Fatalf("ParseAndRenderGMLWithOptions: %v", err)
+	}
+
+	path := filepath.Join(t.TempDir(), "render.checkpoint")
+	opts := RenderOptions{CheckpointFile: path, Workers: 3}
+	got, _, err := ParseAndRenderGMLWithOptions(context.Background(), checkpointTestScene, opts)
+	if err != nil {
+		t.Fatalf("ParseAndRenderGMLWithOptions: %v", err)
+	}
+	if !bytes.Equal(got.(*image.RGBA).Pix, want.(*image.RGBA).Pix) {
+		t.Fatal("image rendered with checkpoints differs from the image rendered without")
+	}
+
+	// Pretend the render was killed before it got to the bottom half of
+	// the image.
+	cp := readCheckpointFile(t, path)
+	for i := len(cp.Counts) / 2; i < len(cp.Counts); i++ {
+		cp.Sums[i], cp.Counts[i] = prim.Vec3{}, 0
+	}
+	writeCheckpointFile(t, path, cp)
+
+	opts.Resume = true
+	opts.Workers = 5
+	got, stats, err := ParseAndRenderGMLWithOptions(context.Background(), checkpointTestScene, opts)
+	if err != nil {
+		t.Fatalf("ParseAndRenderGMLWithOptions(resume): %v", err)
+	}
+	if !bytes.Equal(got.(*image.RGBA).Pix, want.(*image.RGBA).Pix) {
+		t.Error("resumed image differs from the uninterrupted render")
+	}
+	if wantRays := int64(len(cp.Counts)-len(cp.Counts)/2) * defaultSamples; stats.PrimaryRays != wantRays {
+		t.Errorf("resumed render traced %d primary rays, want %d", stats.PrimaryRays, wantRays)
+	}
+
+	// The finished render is checkpointed too.
+	for i, n := range readCheckpointFile(t, path).Counts {
+		if n != defaultSamples {
+			t.Fatalf("final checkpoint has %d samples for pixel %d, want %d", n, i, defaultSamples)
+		}
+	}
+}
+
+func TestResumeErrors(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "render.checkpoint")
+	if _, _, err := ParseAndRenderGMLWithOptions(context.Background(), checkpointTestScene, RenderOptions{CheckpointFile: path}); err != nil {
+		t.Fatalf("ParseAndRenderGMLWithOptions: %v", err)
+	}
+
+	// The sphere is moved.
+	other := `
+		{ /v /u /face u v 0.5 point 1.0 0.3 1.0 } sphere 0.0 0.5 4.0 translate /scene
+		0.2 0.2 0.2 point [ ] scene 3 90.0 32 24 "out.ppm" render`
+	if _, _, err := ParseAndRenderGMLWithOptions(context.Background(), other, RenderOptions{CheckpointFile: path, Resume: true}); err == nil {
+		t.Error("resuming a different scene succeeded, want an error")
+	}
+
+	region := Region{X0: 0, Y0: 0, X1: 8, Y1: 8}
+	if _, _, err := ParseAndRenderGMLWithOptions(context.Background(), checkpointTestScene, RenderOptions{CheckpointFile: path, Resume: true, Region: &region}); err == nil {
+		t.Error("resuming a different region succeeded, want an error")
+	}
+
+	if err := os.WriteFile(path, []byte("not a checkpoint"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := ParseAndRenderGMLWithOptions(context.Background(), checkpointTestScene, RenderOptions{CheckpointFile: path, Resume: true}); err == nil {
+		t.Error("resuming from a corrupt checkpoint succeeded, want an error")
+	}
+}
+
+func TestSceneHash(t *testing.T) {
+	hash := func(program string) string {
+		t.Helper()
+		scene, err := ParseGMLScene(program)
+		if err != nil {
+			t.Fatalf("ParseGMLScene: %v", err)
+		}
+		return scene.Hash()
+	}
+
+	base := hash(checkpointTestScene)
+	if again := hash(checkpointTestScene); again != base {
+		t.Errorf("hashes of the same scene differ: %s vs %s", base, again)
+	}
+	for _, change := range []struct{ old, new string }{
+		{"u v 0.5 point", "u v 0.6 point"},
+		{"0.0 -1.0 0.0 translate", "0.0 -1.5 0.0 translate"},
+		{"1.0 1.0 1.0 point pointlight", "1.0 0.0 1.0 point pointlight"},
+		{"0.05 4.0 renderWithLens", "0.05 5.0 renderWithLens"},
+	} {
+		if hash(strings.Replace(checkpointTestScene, change.old, change.new, 1)) == base {
+			t.Errorf("changing %q to %q did not change the hash", change.old, change.new)
+		}
+	}
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"image"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+
+	"github.com/timdestan/go-raytracer/internal/anim"
+)
+
+// isAnimated reports whether the file should be written as an animation,
+// which is decided by its extension.
+func isAnimated(filename string) bool {
+	switch strings.ToLower(filepath.Ext(filename)) {
+	case ".gif", ".apng":
+		return true
+	}
+	return false
+}
+
+// writeAnimation writes the frames to filename, as a GIF or an APNG
+// depending on its extension.
+func writeAnimation(frames []image.Image, filename string) error {
+	palette, err := anim.ParsePalette(*gifPalette)
+	if err != nil {
+		return err
+	}
+	opts := anim.Options{
+		Delay:   *frameDelay,
+		Loops:   *loops,
+		Palette: palette,
+		Dither:  *dither,
+	}
+	encode := anim.EncodeAPNG
+	if strings.ToLower(filepath.Ext(filename)) == ".gif" {
+		encode = anim.EncodeGIF
+	}
+
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	if err := encode(f, frames, opts); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
+
+// readFrames reads the images matching the glob pattern, in the order of
+// their names.
+func readFrames(pattern string) ([]image.Image, error) {
+	names, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	if len(names) == 0 {
+		return nil, fmt.Errorf("no files match %q", pattern)
+	}
+	slices.Sort(names)
+	var frames []image.Image
+	for _, name := range names {
+		img, err := readImage(name)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %w", name, err)
+		}
+		frames = append(frames, img)
+	}
+	return frames, nil
+}
+
+func readImage(filename string) (image.Image, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	img, _, err := image.Decode(f)
+	return img, err
+}
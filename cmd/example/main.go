@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"image"
@@ -9,13 +10,42 @@ import (
 	"os"
 	"path/filepath"
 	"strings"
+	"time"
 
 	rt "github.com/timdestan/go-raytracer"
+	"github.com/timdestan/go-raytracer/internal/distributed"
+	"github.com/timdestan/go-raytracer/internal/gml"
 )
 
 var (
 	gmlFile = flag.String("gml_file", "", "gml filename to run")
-	outFile = flag.String("out_file", "", "png filename to write")
+	outFile = flag.String("out_file", "", "filename to write, a .png image or, for programs that render several images or with --frames, a .gif or .apng animation")
+	stats   = flag.String("stats", "", "if set, print render statistics as \"text\" or \"json\"")
+
+	workers   = flag.Int("workers", 0, "number of render threads, defaults to GOMAXPROCS")
+	tileSize  = flag.Int("tile_size", 0, "width and height of render tiles in pixels, defaults to 16")
+	tileOrder = flag.String("tile_order", "scanline", "order to render tiles in: scanline, hilbert or spiral")
+
+	region = flag.String("region", "", "only render this region of the image, as x0,y0,x1,y1 in pixels or, with decimal points, in normalised coordinates")
+	crop   = flag.Bool("crop", false, "with --region, write only the region instead of a full-size image with the rest transparent")
+
+	checkpointFile     = flag.String("checkpoint", "", "file to periodically save the render's progress to")
+	checkpointInterval = flag.Duration("checkpoint_interval", time.Minute, "how often to save a checkpoint")
+	resume             = flag.Bool("resume", false, "continue the render from the --checkpoint file, if it exists")
+
+	remoteWorkers = flag.String("remote_workers", "", "comma-separated host:port addresses of renderworker processes to render on")
+
+	frames         = flag.Int("frames", 0, "if set, render an animation with this many frames, binding frame and time in the GML program, and write numbered images")
+	parallelFrames = flag.Int("parallel_frames", 0, "with --frames, the number of frames to render at once, defaults to 2")
+
+	inputFrames = flag.String("input_frames", "", "instead of rendering, assemble the PNG images matching this glob, in name order, into the --out_file animation")
+	frameDelay  = flag.Duration("frame_delay", 100*time.Millisecond, "how long each frame of a .gif or .apng animation is shown")
+	loops       = flag.Int("loops", 0, "number of times a .gif or .apng animation plays, 0 for forever")
+	gifPalette  = flag.String("gif_palette", "global", "colors of a .gif animation: \"global\" for one palette, or \"adaptive\" for one per frame")
+	dither      = flag.Bool("dither", false, "dither the colors of a .gif animation")
+
+	watch   = flag.Bool("watch", false, "keep running, and render again whenever the GML file or a file it includes changes")
+	preview = flag.String("preview", "", "if set, serve a live preview of the render on this address, like localhost:8080, and render again whenever the GML file or a file it includes changes")
 )
 
 func writeImage(img image.Image, filename string) error {
@@ -27,16 +57,58 @@ func writeImage(img image.Image, filename string) error {
 	return png.Encode(f, img)
 }
 
-func renderFromGMLFile(filename string) (image.Image, error) {
-	return rt.ParseAndRenderGMLFile(filename)
+// frameFileName returns the file to write a frame of an animation to. If
+// outFile has a format verb, like "out-%03d.png", it is formatted with the
+// frame number. Otherwise the frame number is added before the extension.
+func frameFileName(outFile string, frame int) string {
+	if strings.Contains(outFile, "%") {
+		return fmt.Sprintf(outFile, frame)
+	}
+	ext := filepath.Ext(outFile)
+	return fmt.Sprintf("%s-%04d%s", strings.TrimSuffix(outFile, ext), frame, ext)
+}
+
+// renderOnWorkers renders the GML file on renderworker processes. The
+// render options other than the tile size do not apply.
+func renderOnWorkers(filename string, workers []string) (image.Image, error) {
+	program, err := gml.ResolveIncludes(filename)
+	if err != nil {
+		return nil, err
+	}
+	// File names like the program's environment map are resolved against
+	// the file's directory here, and against their --dir on the workers,
+	// which needs to hold the same files.
+	dir, err := filepath.Abs(filepath.Dir(filename))
+	if err != nil {
+		return nil, err
+	}
+	c := &distributed.Coordinator{Workers: workers, TileSize: *tileSize, Dir: dir}
+	return c.Render(context.Background(), program)
 }
 
 func main() {
 	flag.Parse()
 
+	if *inputFrames != "" {
+		if !isAnimated(*outFile) {
+			log.Fatal("--input_frames requires an --out_file ending in .gif or .apng")
+		}
+		frames, err := readFrames(*inputFrames)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeAnimation(frames, *outFile); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("wrote %s\n", *outFile)
+		return
+	}
 	if len(*gmlFile) == 0 {
 		log.Fatal("--gml_file is required")
 	}
+	if *stats != "" && *stats != "text" && *stats != "json" {
+		log.Fatalf("--stats must be \"text\" or \"json\", got %q", *stats)
+	}
 	if len(*outFile) == 0 {
 		base := filepath.Base(*gmlFile)
 		base, found := strings.CutSuffix(base, ".gml")
@@ -47,7 +119,117 @@ func main() {
 		log.Printf("Using derived output path: %s", *outFile)
 	}
 
-	img, err := renderFromGMLFile(*gmlFile)
+	order, err := rt.ParseTileOrder(*tileOrder)
+	if err != nil {
+		log.Fatal(err)
+	}
+	opts := rt.RenderOptions{
+		Workers:   *workers,
+		TileSize:  *tileSize,
+		TileOrder: order,
+		Crop:      *crop,
+
+		CheckpointFile:     *checkpointFile,
+		CheckpointInterval: *checkpointInterval,
+		Resume:             *resume,
+	}
+	if *resume && *checkpointFile == "" {
+		log.Fatal("--resume requires --checkpoint")
+	}
+	if *region != "" {
+		r, err := rt.ParseRegion(*region)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opts.Region = &r
+	}
+
+	if *frames > 0 {
+		if *preview != "" || *watch || *remoteWorkers != "" || *checkpointFile != "" {
+			log.Fatal("--frames does not support --preview, --watch, --remote_workers or --checkpoint")
+		}
+		anim := rt.Animation{Frames: *frames, Parallel: *parallelFrames}
+		var images []image.Image
+		renderStats, err := rt.ParseAndRenderGMLFileAnimation(context.Background(), *gmlFile, anim, opts, func(frame int, img image.Image) error {
+			if isAnimated(*outFile) {
+				images = append(images, img)
+				return nil
+			}
+			name := frameFileName(*outFile, frame)
+			if err := writeImage(img, name); err != nil {
+				return err
+			}
+			fmt.Printf("wrote %s\n", name)
+			return nil
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+		if isAnimated(*outFile) {
+			if err := writeAnimation(images, *outFile); err != nil {
+				log.Fatal(err)
+			}
+			fmt.Printf("wrote %s\n", *outFile)
+		}
+		if *stats != "" {
+			if err := renderStats.Format(os.Stdout, *stats); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+
+	if isAnimated(*outFile) {
+		if *preview != "" || *watch || *remoteWorkers != "" {
+			log.Fatal("--preview, --watch and --remote_workers do not support animated output")
+		}
+		images, renderStats, err := rt.ParseAndRenderGMLFileImages(context.Background(), *gmlFile, opts)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err := writeAnimation(images, *outFile); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("wrote %s\n", *outFile)
+		if *stats != "" {
+			if err := renderStats.Format(os.Stdout, *stats); err != nil {
+				log.Fatal(err)
+			}
+		}
+		return
+	}
+
+	if *preview != "" {
+		if *remoteWorkers != "" {
+			log.Fatal("--preview does not support --remote_workers")
+		}
+		runPreview(*preview, *gmlFile, *outFile, opts)
+	}
+	if *watch {
+		if *remoteWorkers != "" {
+			log.Fatal("--watch does not support --remote_workers")
+		}
+		started := func() { log.Printf("rendering %s", *gmlFile) }
+		finished := func(result *renderResult) { writeResult(result, *outFile) }
+		watchAndRender(*gmlFile, opts, started, finished)
+	}
+
+	if *remoteWorkers != "" {
+		if *region != "" || *checkpointFile != "" || *stats != "" {
+			log.Fatal("--remote_workers does not support --region, --checkpoint or --stats")
+		}
+		img, err := renderOnWorkers(*gmlFile, strings.Split(*remoteWorkers, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+		if err = writeImage(img, *outFile); err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("wrote %s\n", *outFile)
+		return
+	}
+
+	img, renderStats, err := rt.ParseAndRenderGMLFileWithOptions(context.Background(), *gmlFile, opts)
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -56,4 +238,10 @@ func main() {
 		log.Fatal(err)
 	}
 	fmt.Printf("wrote %s\n", *outFile)
+
+	if *stats != "" {
+		if err := renderStats.Format(os.Stdout, *stats); err != nil {
+			log.Fatal(err)
+		}
+	}
 }
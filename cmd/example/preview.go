@@ -0,0 +1,186 @@
+package main
+
+import (
+	"bytes"
+	_ "embed"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+
+	rt "github.com/timdestan/go-raytracer"
+	"github.com/timdestan/go-raytracer/internal/gml"
+)
+
+//go:embed preview.html
+var previewPage []byte
+
+// previewHub sends the events of the current render to the browsers
+// showing the preview, as Server-Sent Events.
+type previewHub struct {
+	mu sync.Mutex
+	// events are the events of the current render so far, so that a
+	// browser that connects mid-render can catch up.
+	events  []string
+	clients map[chan string]bool
+}
+
+func newPreviewHub() *previewHub {
+	return &previewHub{clients: make(map[chan string]bool)}
+}
+
+// publish sends an event, whose data is v encoded as JSON. A "start" event
+// begins a new render, so the events before it are forgotten.
+func (h *previewHub) publish(name string, v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		log.Printf("WARN: encoding %s event: %v\n", name, err)
+		return
+	}
+	event := fmt.Sprintf("event: %s\ndata: %s\n\n", name, data)
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if name == "start" {
+		h.events = nil
+	}
+	h.events = append(h.events, event)
+	for ch := range h.clients {
+		select {
+		case ch <- event:
+		default:
+			// The browser is not keeping up. Disconnecting it makes it
+			// reconnect and catch up from the start of the render.
+			delete(h.clients, ch)
+			close(ch)
+		}
+	}
+}
+
+func (h *previewHub) subscribe() (backlog []string, ch chan string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	ch = make(chan string, 256)
+	h.clients[ch] = true
+	return append([]string(nil), h.events...), ch
+}
+
+func (h *previewHub) unsubscribe(ch chan string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.clients[ch] {
+		delete(h.clients, ch)
+		close(ch)
+	}
+}
+
+func (h *previewHub) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	flusher, ok := rw.(http.Flusher)
+	if !ok {
+		http.Error(rw, "streaming is not supported", http.StatusInternalServerError)
+		return
+	}
+	rw.Header().Set("Content-Type", "text/event-stream")
+	rw.Header().Set("Cache-Control", "no-cache")
+
+	backlog, ch := h.subscribe()
+	defer h.unsubscribe(ch)
+	for _, event := range backlog {
+		io.WriteString(rw, event)
+	}
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case event, ok := <-ch:
+			if !ok {
+				return
+			}
+			io.WriteString(rw, event)
+			flusher.Flush()
+		}
+	}
+}
+
+type tileEvent struct {
+	X      int    `json:"x"`
+	Y      int    `json:"y"`
+	Width  int    `json:"width"`
+	Height int    `json:"height"`
+	PNG    string `json:"png"` // base64
+}
+
+type doneEvent struct {
+	Parse   string `json:"parse"`
+	Eval    string `json:"eval"`
+	Convert string `json:"convert"`
+	Render  string `json:"render"`
+	Total   string `json:"total"`
+}
+
+type errorEvent struct {
+	Error string `json:"error"`
+	Line  int    `json:"line,omitempty"`
+	Col   int    `json:"col,omitempty"`
+}
+
+func (h *previewHub) publishTile(tile *image.RGBA) {
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, tile); err != nil {
+		log.Printf("WARN: encoding tile: %v\n", err)
+		return
+	}
+	b := tile.Bounds()
+	h.publish("tile", &tileEvent{
+		X: b.Min.X, Y: b.Min.Y, Width: b.Dx(), Height: b.Dy(),
+		PNG: base64.StdEncoding.EncodeToString(buf.Bytes()),
+	})
+}
+
+// runPreview serves a page on addr that shows the GML file being rendered,
+// tile by tile, and renders it again whenever it changes. It writes each
+// finished image to outFile, and never returns.
+func runPreview(addr, gmlFile, outFile string, opts rt.RenderOptions) {
+	hub := newPreviewHub()
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /{$}", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("Content-Type", "text/html; charset=utf-8")
+		rw.Write(previewPage)
+	})
+	mux.Handle("GET /events", hub)
+	go func() {
+		log.Fatal(http.ListenAndServe(addr, mux))
+	}()
+	log.Printf("previewing %s on http://%s/", gmlFile, addr)
+
+	opts.TileDone = hub.publishTile
+	started := func() {
+		hub.publish("start", map[string]string{"file": gmlFile})
+	}
+	finished := func(result *renderResult) {
+		if result.err != nil {
+			event := errorEvent{Error: result.err.Error()}
+			if pos, ok := gml.ErrorPosition(result.err); ok {
+				event.Line, event.Col = pos.Line, pos.Col
+			}
+			hub.publish("failed", &event)
+		} else {
+			phases := result.stats.Phases
+			hub.publish("done", &doneEvent{
+				Parse:   phases.Parse.String(),
+				Eval:    phases.Eval.String(),
+				Convert: phases.Convert.String(),
+				Render:  phases.Render.String(),
+				Total:   result.elapsed.String(),
+			})
+		}
+		writeResult(result, outFile)
+	}
+	watchAndRender(gmlFile, opts, started, finished)
+}
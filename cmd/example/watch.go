@@ -0,0 +1,178 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"image"
+	"log"
+	"maps"
+	"os"
+	"time"
+
+	rt "github.com/timdestan/go-raytracer"
+	"github.com/timdestan/go-raytracer/internal/gml"
+)
+
+const (
+	// watchInterval is how often the watched files are checked.
+	watchInterval = 100 * time.Millisecond
+	// watchDebounce is how long the files have to stay the same after a
+	// change before it is reported, so that an editor saving several
+	// times in a row only causes one render.
+	watchDebounce = 300 * time.Millisecond
+)
+
+// watchSources returns a channel that receives a value whenever the GML
+// file at path, or any file it includes, changes.
+func watchSources(path string) <-chan struct{} {
+	w := newSourceWatcher(path, modTime)
+	changed := make(chan struct{}, 1)
+	go func() {
+		for now := range time.Tick(watchInterval) {
+			if w.check(now) {
+				select {
+				case changed <- struct{}{}:
+				default:
+				}
+			}
+		}
+	}()
+	return changed
+}
+
+func modTime(file string) (time.Time, error) {
+	info, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}, err
+	}
+	return info.ModTime(), nil
+}
+
+// sourceWatcher checks a GML file, and the files it includes, for changes.
+// The included files are found again after every change, so files that
+// start or stop being included are noticed.
+type sourceWatcher struct {
+	path string
+	// stat returns the modification time of a file.
+	stat func(file string) (time.Time, error)
+
+	files      []string
+	modTimes   map[string]time.Time
+	lastChange time.Time
+	pending    bool
+}
+
+func newSourceWatcher(path string, stat func(string) (time.Time, error)) *sourceWatcher {
+	w := &sourceWatcher{path: path, stat: stat}
+	w.files = sourceFiles(path)
+	w.modTimes = w.statFiles(w.files)
+	return w
+}
+
+// check checks the files at time now, and reports whether they changed and
+// then stayed the same for watchDebounce.
+func (w *sourceWatcher) check(now time.Time) bool {
+	if current := w.statFiles(w.files); !maps.Equal(current, w.modTimes) {
+		w.files = sourceFiles(w.path)
+		w.modTimes = w.statFiles(w.files)
+		w.lastChange, w.pending = now, true
+		return false
+	}
+	if w.pending && now.Sub(w.lastChange) >= watchDebounce {
+		w.pending = false
+		return true
+	}
+	return false
+}
+
+// sourceFiles returns the files to watch for the GML file at path. Errors
+// are ignored, since they are reported by the render.
+func sourceFiles(path string) []string {
+	files, _ := gml.SourceFiles(path)
+	if len(files) == 0 {
+		files = []string{path}
+	}
+	return files
+}
+
+// statFiles returns the modification times of the files. Missing files
+// have the zero time.
+func (w *sourceWatcher) statFiles(files []string) map[string]time.Time {
+	modTimes := make(map[string]time.Time, len(files))
+	for _, file := range files {
+		// On errors, t is the zero time.
+		t, _ := w.stat(file)
+		modTimes[file] = t
+	}
+	return modTimes
+}
+
+type renderResult struct {
+	img     image.Image
+	stats   *rt.RenderStats
+	err     error
+	elapsed time.Duration
+}
+
+// watchAndRender renders the GML file, then renders it again whenever it or
+// a file it includes changes, and never returns. A change in the middle of
+// a render cancels it. started is called before each render, and finished
+// after each render that is not cancelled.
+func watchAndRender(gmlFile string, opts rt.RenderOptions, started func(), finished func(*renderResult)) {
+	render := func(ctx context.Context) *renderResult {
+		start := time.Now()
+		img, stats, err := rt.ParseAndRenderGMLFileWithOptions(ctx, gmlFile, opts)
+		return &renderResult{img: img, stats: stats, err: err, elapsed: time.Since(start)}
+	}
+	renderOnChange(gmlFile, watchSources(gmlFile), render, started, finished)
+}
+
+// renderOnChange is watchAndRender, rendering with render whenever changed
+// receives a value. It returns once changed is closed.
+func renderOnChange(gmlFile string, changed <-chan struct{}, render func(context.Context) *renderResult, started func(), finished func(*renderResult)) {
+	for {
+		started()
+		ctx, cancel := context.WithCancel(context.Background())
+		results := make(chan *renderResult, 1)
+		go func() {
+			results <- render(ctx)
+		}()
+
+		select {
+		case _, ok := <-changed:
+			// Start again once the workers have stopped.
+			cancel()
+			<-results
+			if !ok {
+				return
+			}
+			log.Printf("%s changed, restarting the render", gmlFile)
+			continue
+		case result := <-results:
+			cancel()
+			finished(result)
+		}
+		if _, ok := <-changed; !ok {
+			return
+		}
+	}
+}
+
+// writeResult reports the outcome of a render in watch mode, which keeps
+// going after errors.
+func writeResult(result *renderResult, outFile string) {
+	if result.err != nil {
+		log.Printf("ERROR: %v\n", result.err)
+		return
+	}
+	if err := writeImage(result.img, outFile); err != nil {
+		log.Printf("ERROR: %v\n", err)
+		return
+	}
+	fmt.Printf("wrote %s in %v\n", outFile, result.elapsed)
+	if *stats != "" {
+		if err := result.stats.Format(os.Stdout, *stats); err != nil {
+			log.Printf("ERROR: %v\n", err)
+		}
+	}
+}
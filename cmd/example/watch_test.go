@@ -0,0 +1,161 @@
+package main
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// fakeSources is a sourceWatcher's clock and file system. File contents are
+// real, so that includes are found, but modification times are fake.
+type fakeSources struct {
+	t        *testing.T
+	now      time.Time
+	modTimes map[string]time.Time
+}
+
+func newFakeSources(t *testing.T) *fakeSources {
+	return &fakeSources{
+		t:        t,
+		now:      time.Date(2000, 9, 1, 0, 0, 0, 0, time.UTC),
+		modTimes: map[string]time.Time{},
+	}
+}
+
+func (f *fakeSources) stat(file string) (time.Time, error) {
+	t, ok := f.modTimes[file]
+	if !ok {
+		return time.Time{}, os.ErrNotExist
+	}
+	return t, nil
+}
+
+// write writes the file, and makes it modified now.
+func (f *fakeSources) write(path, content string) {
+	f.t.Helper()
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		f.t.Fatal(err)
+	}
+	f.modTimes[path] = f.now
+}
+
+// advance moves the clock forward by d, checking the files every
+// watchInterval, and returns the number of changes reported.
+func (f *fakeSources) advance(w *sourceWatcher, d time.Duration) int {
+	n := 0
+	for end := f.now.Add(d); f.now.Before(end); {
+		f.now = f.now.Add(watchInterval)
+		if w.check(f.now) {
+			n++
+		}
+	}
+	return n
+}
+
+func TestWatchSourcesDebounces(t *testing.T) {
+	f := newFakeSources(t)
+	path := filepath.Join(t.TempDir(), "main.gml")
+	f.write(path, "1\n")
+	w := newSourceWatcher(path, f.stat)
+
+	if n := f.advance(w, time.Second); n != 0 {
+		t.Fatalf("got %d changes before the file changed, want 0", n)
+	}
+
+	// Saving twice in a row is one change, reported once the file has
+	// stayed the same for watchDebounce.
+	f.write(path, "2\n")
+	f.advance(w, watchInterval)
+	f.write(path, "3\n")
+	if n := f.advance(w, watchDebounce); n != 0 {
+		t.Fatalf("got %d changes before the debounce time, want 0", n)
+	}
+	if n := f.advance(w, watchInterval); n != 1 {
+		t.Fatalf("got %d changes after the debounce time, want 1", n)
+	}
+	if n := f.advance(w, time.Second); n != 0 {
+		t.Errorf("got %d more changes without the file changing, want 0", n)
+	}
+}
+
+func TestWatchSourcesFindsNewIncludes(t *testing.T) {
+	f := newFakeSources(t)
+	dir := t.TempDir()
+	path := filepath.Join(dir, "main.gml")
+	lib := filepath.Join(dir, "lib.gml")
+	f.write(path, "1\n")
+	f.write(lib, "2\n")
+	w := newSourceWatcher(path, f.stat)
+
+	// lib.gml isn't watched until main.gml includes it.
+	f.advance(w, watchInterval)
+	f.write(lib, "3\n")
+	if n := f.advance(w, time.Second); n != 0 {
+		t.Fatalf("got %d changes for a file that isn't included, want 0", n)
+	}
+
+	f.write(path, `#include "lib.gml"`+"\n")
+	if n := f.advance(w, time.Second); n != 1 {
+		t.Fatalf("got %d changes after including lib.gml, want 1", n)
+	}
+
+	f.write(lib, "4\n")
+	if n := f.advance(w, time.Second); n != 1 {
+		t.Errorf("got %d changes after changing the included file, want 1", n)
+	}
+}
+
+func TestRenderOnChangeCancelsRender(t *testing.T) {
+	changed := make(chan struct{})
+	renders := make(chan context.Context)
+	release := make(chan *renderResult)
+	render := func(ctx context.Context) *renderResult {
+		renders <- ctx
+		select {
+		case <-ctx.Done():
+			return &renderResult{err: ctx.Err()}
+		case result := <-release:
+			return result
+		}
+	}
+	finished := make(chan *renderResult, 2)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		renderOnChange("main.gml", changed, render, func() {}, func(result *renderResult) { finished <- result })
+	}()
+
+	// A change in the middle of the first render cancels it, and starts
+	// another one.
+	first := <-renders
+	changed <- struct{}{}
+	select {
+	case <-first.Done():
+	case <-time.After(5 * time.Second):
+		t.Fatal("the first render was not cancelled")
+	}
+	<-renders
+	want := &renderResult{elapsed: time.Second}
+	release <- want
+	if got := <-finished; got != want {
+		t.Errorf("finished with %+v, want the second render's result %+v", got, want)
+	}
+
+	// The next change starts another render once the last one finished.
+	changed <- struct{}{}
+	third := <-renders
+	close(changed)
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("renderOnChange did not return after changed was closed")
+	}
+	if third.Err() == nil {
+		t.Error("the render in progress was not cancelled when renderOnChange returned")
+	}
+	if len(finished) != 0 {
+		t.Errorf("finished called for %d cancelled renders, want 0", len(finished))
+	}
+}
@@ -3,6 +3,7 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"image"
@@ -14,6 +15,7 @@ import (
 	"slices"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/ergochat/readline"
 	"github.com/timdestan/go-raytracer"
@@ -102,14 +104,25 @@ func main() {
 	}
 
 	images := make(map[string]image.Image)
+	stats := make(map[string]*raytracer.RenderStats)
+	scenes := make(map[string]*raytracer.Scene)
 
 	evalState := gml.NewEvalState()
 	evalState.Render = func(e *gml.EvalState, args *gml.RenderArgs) error {
+		start := time.Now()
 		scene, err := raytracer.ConvertRenderArgsToScene(args, e)
 		if err != nil {
 			return err
 		}
-		images[args.File] = raytracer.Render(scene)
+		convertTime := time.Since(start)
+		img, renderStats, err := raytracer.RenderWithContext(context.Background(), scene)
+		if err != nil {
+			return err
+		}
+		renderStats.Phases.Convert = convertTime
+		images[args.File] = img
+		stats[args.File] = &renderStats
+		scenes[args.File] = scene
 		fmt.Printf("Rendered image with name %s\n", args.File)
 		return nil
 	}
@@ -249,7 +262,7 @@ func main() {
 		Run: func(st *State) error {
 			// TODO: Without debug string context, the variable names are only
 			// shown as numeric ids, which is not very useful.
-			fmt.Printf("env: %v\n", st.evalState.Env)
+			fmt.Printf("env: %v\n", &st.evalState.Env)
 			return nil
 		},
 	})
@@ -267,6 +280,61 @@ func main() {
 			return writeImage(img, st.args[1])
 		},
 	})
+	registerCommand(&Command{
+		Symbol:       ":stats",
+		ExpectedArgs: []string{"<imagename>", "[text|json]"},
+		HelpText:     "Prints statistics about how an image was rendered. Parse and eval times are not tracked in the shell.",
+		Run: func(st *State) error {
+			if len(st.args) < 1 || len(st.args) > 2 {
+				return errors.New("usage: :stats <imagename> [text|json]")
+			}
+			s, ok := stats[st.args[0]]
+			if !ok {
+				return fmt.Errorf("no image with name %s", st.args[0])
+			}
+			format := "text"
+			if len(st.args) == 2 {
+				format = st.args[1]
+			}
+			return s.Format(os.Stdout, format)
+		},
+	})
+	registerCommand(&Command{
+		Symbol:       ":render-region",
+		ExpectedArgs: []string{"<imagename>", "<x0,y0,x1,y1>", "[<newname>]"},
+		HelpText:     "Re-renders a region of an image, in pixels or normalised coordinates, as a cropped image named <newname> (default <imagename>-region)",
+		Run: func(st *State) error {
+			if len(st.args) < 2 || len(st.args) > 3 {
+				return errors.New("usage: :render-region <imagename> <x0,y0,x1,y1> [<newname>]")
+			}
+			scene, ok := scenes[st.args[0]]
+			if !ok {
+				return fmt.Errorf("no image with name %s", st.args[0])
+			}
+			region, err := raytracer.ParseRegion(st.args[1])
+			if err != nil {
+				return err
+			}
+			if _, err := region.Pixels(scene.WidthPx, scene.HeightPx); err != nil {
+				return err
+			}
+			name := st.args[0] + "-region"
+			if len(st.args) == 3 {
+				name = st.args[2]
+			}
+
+			scene.Region, scene.Crop = &region, true
+			defer func() { scene.Region, scene.Crop = nil, false }()
+			img, renderStats, err := raytracer.RenderWithContext(context.Background(), scene)
+			if err != nil {
+				return err
+			}
+			images[name] = img
+			stats[name] = &renderStats
+			fmt.Printf("Rendered image with name %s\n", name)
+			return nil
+		},
+	})
 	registerCommand(&Command{
 		Symbol:   ":stack",
 		HelpText: "Print the current stack",
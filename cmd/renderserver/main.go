@@ -0,0 +1,33 @@
+// The renderserver command serves renders of GML programs over HTTP. See
+// the service package for the API.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/timdestan/go-raytracer/internal/service"
+)
+
+var (
+	listen          = flag.String("listen", ":8080", "address to listen for requests on")
+	maxJobs         = flag.Int("max_jobs", 1, "number of programs to render at once")
+	timeout         = flag.Duration("timeout", 0, "how long a request can wait and render for (0 means a minute)")
+	maxProgramBytes = flag.Int64("max_program_bytes", 0, "largest program accepted (0 means 1 MiB)")
+	maxSize         = flag.Int("max_size", 0, "largest width or height of images (0 means 4096)")
+	maxSamples      = flag.Int("max_samples", 0, "most samples per pixel a request can ask for (0 means 64)")
+)
+
+func main() {
+	flag.Parse()
+	s := service.NewServer(service.Options{
+		MaxJobs:         *maxJobs,
+		Timeout:         *timeout,
+		MaxProgramBytes: *maxProgramBytes,
+		MaxSize:         *maxSize,
+		MaxSamples:      *maxSamples,
+	})
+	log.Printf("listening on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, s))
+}
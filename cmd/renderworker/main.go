@@ -0,0 +1,29 @@
+// The renderworker command renders tiles of images for a coordinator, such
+// as the example command run with --remote_workers.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/timdestan/go-raytracer/internal/distributed"
+)
+
+var (
+	listen          = flag.String("listen", "localhost:9000", "address to listen for tiles on")
+	dir             = flag.String("dir", "", "directory programs can read files like environment maps from (empty means none)")
+	maxRequestBytes = flag.Int64("max_request_bytes", 0, "largest request accepted (0 means 16 MiB)")
+	maxPixels       = flag.Int("max_pixels", 0, "most pixels an image can have (0 means 4096*4096)")
+)
+
+func main() {
+	flag.Parse()
+	w := distributed.NewWorker(distributed.WorkerOptions{
+		Dir:             *dir,
+		MaxRequestBytes: *maxRequestBytes,
+		MaxPixels:       *maxPixels,
+	})
+	log.Printf("listening on %s", *listen)
+	log.Fatal(http.ListenAndServe(*listen, w))
+}
@@ -0,0 +1,115 @@
+package raytracer
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/timdestan/go-raytracer/internal/gml"
+)
+
+var strictConformanceFlag = flag.Bool("strict_conformance", false, "If true, fail the conformance tests of scenes that need features listed in internal/gml/testdata/known_gaps.txt")
+
+// missingFeature returns the feature of the specification that err says is
+// missing, if any.
+func missingFeature(err error) (string, bool) {
+	switch {
+	case errors.Is(err, gml.ErrUnboundIdentifier):
+		_, name, _ := strings.Cut(err.Error(), gml.ErrUnboundIdentifier.Error()+": ")
+		return name, true
+	case errors.Is(err, ErrUnsupportedObject):
+		_, name, _ := strings.Cut(err.Error(), "*gml.")
+		return strings.ToLower(name), true
+	}
+	return "", false
+}
+
+// TestConformanceScenes renders the sample scenes from the contest at a small
+// size, and compares them with goldens. Scenes that need a feature listed in
+// internal/gml/testdata/known_gaps.txt are skipped on purpose, naming the
+// feature, so that the known gaps don't fail every test run. The skipped
+// scenes are logged by tier at the end. Run with --strict_conformance to
+// fail them instead.
+func TestConformanceScenes(t *testing.T) {
+	gaps, err := gml.ReadKnownGaps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The skipped scenes, by tier and missing feature.
+	missing := map[int]map[string][]string{}
+	defer func() {
+		if len(missing) == 0 {
+			return
+		}
+		t.Logf("Sample scenes that need features that are not implemented yet, skipped:")
+		for _, tier := range slices.Sorted(maps.Keys(missing)) {
+			for _, feature := range slices.Sorted(maps.Keys(missing[tier])) {
+				t.Logf("  tier %d: %s (%s)", tier, feature, strings.Join(missing[tier][feature], ", "))
+			}
+		}
+	}()
+	for _, name := range []string{
+		"canned", "checked-cube", "chess", "cone", "cone-fractal", "cube",
+		"cube2", "cylinder", "dice", "ellipsoid", "fov", "fractal", "golf",
+		"holes", "house", "intercyl", "large", "pipe", "rotate",
+		"sheared-cylinder", "snowgoon", "sphere", "spheres", "spotlight",
+		"squashed-sphere",
+	} {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join("internal/gml/testdata", name+".gml")
+			images, _, err := ParseAndRenderGMLFileImages(context.Background(), path, RenderOptions{Width: 64, Height: 48, Samples: 1})
+			if feature, ok := missingFeature(err); ok && !*strictConformanceFlag {
+				if gap, known := gaps[feature]; known {
+					if missing[gap.Tier] == nil {
+						missing[gap.Tier] = map[string][]string{}
+					}
+					missing[gap.Tier][feature] = append(missing[gap.Tier][feature], name)
+					t.Skipf("needs tier %d feature %s, which is a known gap", gap.Tier, feature)
+				}
+			}
+			if err != nil {
+				t.Fatalf("%s: %v", path, err)
+			}
+			if len(images) == 0 {
+				t.Fatalf("%s rendered no images", path)
+			}
+			for i, img := range images {
+				golden := fmt.Sprintf("testdata/goldens/conformance_%s.png", name)
+				if len(images) > 1 {
+					golden = fmt.Sprintf("testdata/goldens/conformance_%s_%d.png", name, i)
+				}
+				compareImages(t, img, golden)
+			}
+		})
+	}
+}
+
+// TestConformanceSceneErrors checks that the contest's broken programs fail,
+// at the position of the mistake.
+func TestConformanceSceneErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		wantPos string
+	}{
+		{"syntax1", "5:7"},
+		{"syntax2", "7:1"},
+		{"syntax3", "6:1"},
+		{"illegal", "8:7"},
+	} {
+		path := filepath.Join("internal/gml/testdata", tt.name+".gml")
+		_, _, err := ParseAndRenderGMLFileImages(context.Background(), path, RenderOptions{Width: 64, Height: 48, Samples: 1})
+		if err == nil {
+			t.Errorf("%s: succeeded, want an error", path)
+			continue
+		}
+		if pos, ok := gml.ErrorPosition(err); !ok || pos.String() != tt.wantPos {
+			t.Errorf("%s: error %q is at %v, want %s", path, err, pos, tt.wantPos)
+		}
+	}
+}
@@ -0,0 +1,174 @@
+package raytracer
+
+import (
+	"math"
+	"testing"
+
+	"github.com/timdestan/go-raytracer/internal/gml"
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+func newIdentityCube() *Cube {
+	identity := prim.IdentityMatrix()
+	c := &Cube{
+		SurfaceFn:     gml.VSurfaceFn{Material: &gml.Material{}},
+		ObjectToWorld: identity,
+		WorldToObject: identity,
+	}
+	for i, side := range prim.PlanesForUnitCube() {
+		c.NormalsWorld[i] = side.Normal
+	}
+	return c
+}
+
+func TestIntersectUnitBox(t *testing.T) {
+	tests := []struct {
+		name                string
+		ray                 Ray
+		wantOK              bool
+		wantEnter, wantExit float64
+		wantEnterFace       prim.CubeSide
+		wantExitFace        prim.CubeSide
+	}{
+		{
+			name:          "front to back",
+			ray:           Ray{Origin: prim.Vec3{X: 0.5, Y: 0.5, Z: -1}, Direction: prim.Vec3{Z: 1}},
+			wantOK:        true,
+			wantEnter:     1,
+			wantExit:      2,
+			wantEnterFace: prim.CubeFront,
+			wantExitFace:  prim.CubeBack,
+		},
+		{
+			name:          "right to left",
+			ray:           Ray{Origin: prim.Vec3{X: 3, Y: 0.5, Z: 0.5}, Direction: prim.Vec3{X: -1}},
+			wantOK:        true,
+			wantEnter:     2,
+			wantExit:      3,
+			wantEnterFace: prim.CubeRight,
+			wantExitFace:  prim.CubeLeft,
+		},
+		{
+			name:          "top to bottom",
+			ray:           Ray{Origin: prim.Vec3{X: 0.5, Y: 2, Z: 0.5}, Direction: prim.Vec3{Y: -2}},
+			wantOK:        true,
+			wantEnter:     0.5,
+			wantExit:      1,
+			wantEnterFace: prim.CubeTop,
+			wantExitFace:  prim.CubeBottom,
+		},
+		{
+			name:          "from inside",
+			ray:           Ray{Origin: prim.Vec3{X: 0.5, Y: 0.5, Z: 0.5}, Direction: prim.Vec3{X: 1}},
+			wantOK:        true,
+			wantEnter:     -0.5,
+			wantExit:      0.5,
+			wantEnterFace: prim.CubeLeft,
+			wantExitFace:  prim.CubeRight,
+		},
+		{
+			name:          "diagonal through an edge",
+			ray:           Ray{Origin: prim.Vec3{X: -1, Y: 0.5, Z: -0.5}, Direction: prim.Vec3{X: 1, Z: 1}},
+			wantOK:        true,
+			wantEnter:     1,
+			wantExit:      1.5,
+			wantEnterFace: prim.CubeLeft,
+			wantExitFace:  prim.CubeBack,
+		},
+		{
+			name:   "miss",
+			ray:    Ray{Origin: prim.Vec3{X: 2, Y: 0.5, Z: -1}, Direction: prim.Vec3{Z: 1}},
+			wantOK: false,
+		},
+		{
+			name:   "diagonal miss past a corner",
+			ray:    Ray{Origin: prim.Vec3{X: -1, Y: 0.5, Z: 0.5}, Direction: prim.Vec3{X: 1, Z: 1}},
+			wantOK: false,
+		},
+		{
+			name:          "parallel on a face",
+			ray:           Ray{Origin: prim.Vec3{X: 0, Y: 0.5, Z: -1}, Direction: prim.Vec3{Z: 1}},
+			wantOK:        true,
+			wantEnter:     1,
+			wantExit:      2,
+			wantEnterFace: prim.CubeFront,
+			wantExitFace:  prim.CubeBack,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			tEnter, tExit, enterFace, exitFace, ok := intersectUnitBox(tc.ray)
+			if ok != tc.wantOK {
+				t.Fatalf("ok = %v, want %v", ok, tc.wantOK)
+			}
+			if !ok {
+				return
+			}
+			if math.Abs(tEnter-tc.wantEnter) > 1e-9 || math.Abs(tExit-tc.wantExit) > 1e-9 {
+				t.Errorf("t = [%v, %v], want [%v, %v]", tEnter, tExit, tc.wantEnter, tc.wantExit)
+			}
+			if enterFace != tc.wantEnterFace || exitFace != tc.wantExitFace {
+				t.Errorf("faces = (%d, %d), want (%d, %d)", enterFace, exitFace, tc.wantEnterFace, tc.wantExitFace)
+			}
+		})
+	}
+}
+
+func TestCubeIntersectFaceNumbering(t *testing.T) {
+	c := newIdentityCube()
+	center := prim.Vec3{X: 0.5, Y: 0.5, Z: 0.5}
+	for i, side := range prim.PlanesForUnitCube() {
+		// Shoot a ray from outside the face towards the centre of the cube.
+		origin := center.Add(side.Normal.Scale(2))
+		ray := Ray{Origin: origin, Direction: side.Normal.Scale(-1)}
+
+		var hit Hit
+		if !c.Intersect(ray, &hit) {
+			t.Fatalf("face %d: expected a hit, got none", i)
+		}
+		if hit.Face != i {
+			t.Errorf("face %d: Face = %d", i, hit.Face)
+		}
+		if math.Abs(hit.T-1.5) > 1e-9 {
+			t.Errorf("face %d: T = %v, want 1.5", i, hit.T)
+		}
+		wantPoint := center.Add(side.Normal.Scale(0.5))
+		if hit.PointObj.Sub(wantPoint).Length() > 1e-9 {
+			t.Errorf("face %d: PointObj = %v, want %v", i, hit.PointObj, wantPoint)
+		}
+
+		hitEx, err := c.ComputeSurfaceProps(hit, nil)
+		if err != nil {
+			t.Fatalf("face %d: ComputeSurfaceProps: %v", i, err)
+		}
+		if hitEx.NormalWorld != side.Normal {
+			t.Errorf("face %d: NormalWorld = %v, want %v", i, hitEx.NormalWorld, side.Normal)
+		}
+	}
+}
+
+func TestCubeIntersectFromInside(t *testing.T) {
+	c := newIdentityCube()
+	ray := Ray{Origin: prim.Vec3{X: 0.5, Y: 0.25, Z: 0.5}, Direction: prim.Vec3{Y: -1}}
+
+	var hit Hit
+	if !c.Intersect(ray, &hit) {
+		t.Fatal("expected a hit, got none")
+	}
+	if hit.Face != int(prim.CubeBottom) {
+		t.Errorf("Face = %d, want CubeBottom", hit.Face)
+	}
+	if math.Abs(hit.T-0.25) > 1e-9 {
+		t.Errorf("T = %v, want 0.25", hit.T)
+	}
+}
+
+func TestCubeIntersectBehind(t *testing.T) {
+	c := newIdentityCube()
+	ray := Ray{Origin: prim.Vec3{X: 0.5, Y: 0.5, Z: 2}, Direction: prim.Vec3{Z: 1}}
+
+	var hit Hit
+	if c.Intersect(ray, &hit) {
+		t.Errorf("expected no hit, got %+v", hit)
+	}
+}
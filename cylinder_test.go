@@ -22,9 +22,9 @@ func TestCylinderIntersectSide(t *testing.T) {
 	c := newIdentityCylinder()
 	ray := Ray{Origin: prim.Vec3{X: -2, Y: 0.5, Z: 0}, Direction: prim.Vec3{X: 1, Y: 0, Z: 0}}
 
-	hit := c.Intersect(ray)
-	if hit == nil {
-		t.Fatal("expected a hit, got nil")
+	var hit Hit
+	if !c.Intersect(ray, &hit) {
+		t.Fatal("expected a hit, got none")
 	}
 	if hit.Face != CylinderSide {
 		t.Errorf("Face = %d, want CylinderSide", hit.Face)
@@ -42,9 +42,9 @@ func TestCylinderIntersectTopCap(t *testing.T) {
 	c := newIdentityCylinder()
 	ray := Ray{Origin: prim.Vec3{X: 0, Y: 2, Z: 0}, Direction: prim.Vec3{X: 0, Y: -1, Z: 0}}
 
-	hit := c.Intersect(ray)
-	if hit == nil {
-		t.Fatal("expected a hit, got nil")
+	var hit Hit
+	if !c.Intersect(ray, &hit) {
+		t.Fatal("expected a hit, got none")
 	}
 	if hit.Face != CylinderTop {
 		t.Errorf("Face = %d, want CylinderTop", hit.Face)
@@ -58,9 +58,9 @@ func TestCylinderIntersectBottomCap(t *testing.T) {
 	c := newIdentityCylinder()
 	ray := Ray{Origin: prim.Vec3{X: 0, Y: -2, Z: 0}, Direction: prim.Vec3{X: 0, Y: 1, Z: 0}}
 
-	hit := c.Intersect(ray)
-	if hit == nil {
-		t.Fatal("expected a hit, got nil")
+	var hit Hit
+	if !c.Intersect(ray, &hit) {
+		t.Fatal("expected a hit, got none")
 	}
 	if hit.Face != CylinderBottom {
 		t.Errorf("Face = %d, want CylinderBottom", hit.Face)
@@ -74,9 +74,9 @@ func TestCylinderIntersectFromInsideHitsNearestCap(t *testing.T) {
 	c := newIdentityCylinder()
 	ray := Ray{Origin: prim.Vec3{X: 0, Y: 0.5, Z: 0}, Direction: prim.Vec3{X: 0, Y: 1, Z: 0}}
 
-	hit := c.Intersect(ray)
-	if hit == nil {
-		t.Fatal("expected a hit, got nil")
+	var hit Hit
+	if !c.Intersect(ray, &hit) {
+		t.Fatal("expected a hit, got none")
 	}
 	if hit.Face != CylinderTop {
 		t.Errorf("Face = %d, want CylinderTop", hit.Face)
@@ -91,14 +91,15 @@ func TestCylinderIntersectMiss(t *testing.T) {
 	// A ray well outside the radius, travelling parallel to the axis.
 	ray := Ray{Origin: prim.Vec3{X: 5, Y: -1, Z: 0}, Direction: prim.Vec3{X: 0, Y: 1, Z: 0}}
 
-	if hit := c.Intersect(ray); hit != nil {
+	var hit Hit
+	if c.Intersect(ray, &hit) {
 		t.Errorf("expected no hit, got %+v", hit)
 	}
 
 	// A ray that would hit the infinite lateral surface, but outside [0, 1]
 	// in height, and pointed away from both caps.
 	missRay := Ray{Origin: prim.Vec3{X: -2, Y: 5, Z: 0}, Direction: prim.Vec3{X: 1, Y: 0, Z: 0}}
-	if hit := c.Intersect(missRay); hit != nil {
+	if c.Intersect(missRay, &hit) {
 		t.Errorf("expected no hit, got %+v", hit)
 	}
 }
@@ -108,7 +109,8 @@ func TestCylinderIntersectBehindRay(t *testing.T) {
 	// Cylinder is entirely behind the ray origin.
 	ray := Ray{Origin: prim.Vec3{X: 2, Y: 0.5, Z: 0}, Direction: prim.Vec3{X: 1, Y: 0, Z: 0}}
 
-	if hit := c.Intersect(ray); hit != nil {
+	var hit Hit
+	if c.Intersect(ray, &hit) {
 		t.Errorf("expected no hit, got %+v", hit)
 	}
 }
@@ -121,7 +123,7 @@ func TestCylinderComputeSurfacePropsSide(t *testing.T) {
 		PointObj: prim.Vec3{X: 1, Y: 0.5, Z: 0},
 	}
 
-	hitEx, err := c.ComputeSurfaceProps(hit)
+	hitEx, err := c.ComputeSurfaceProps(hit, nil)
 	if err != nil {
 		t.Fatalf("ComputeSurfaceProps: %v", err)
 	}
@@ -135,7 +137,7 @@ func TestCylinderComputeSurfacePropsCaps(t *testing.T) {
 	c := newIdentityCylinder()
 
 	topHit := Hit{Object: c, Face: CylinderTop, PointObj: prim.Vec3{X: 0.2, Y: 1, Z: 0.3}}
-	topEx, err := c.ComputeSurfaceProps(topHit)
+	topEx, err := c.ComputeSurfaceProps(topHit, nil)
 	if err != nil {
 		t.Fatalf("ComputeSurfaceProps(top): %v", err)
 	}
@@ -145,7 +147,7 @@ func TestCylinderComputeSurfacePropsCaps(t *testing.T) {
 	}
 
 	bottomHit := Hit{Object: c, Face: CylinderBottom, PointObj: prim.Vec3{X: 0.2, Y: 0, Z: 0.3}}
-	bottomEx, err := c.ComputeSurfaceProps(bottomHit)
+	bottomEx, err := c.ComputeSurfaceProps(bottomHit, nil)
 	if err != nil {
 		t.Fatalf("ComputeSurfaceProps(bottom): %v", err)
 	}
@@ -159,7 +161,7 @@ func TestCylinderComputeSurfacePropsInvalidFace(t *testing.T) {
 	c := newIdentityCylinder()
 	hit := Hit{Object: c, Face: 99, PointObj: prim.Vec3{}}
 
-	if _, err := c.ComputeSurfaceProps(hit); err == nil {
+	if _, err := c.ComputeSurfaceProps(hit, nil); err == nil {
 		t.Error("expected an error for an invalid face index, got nil")
 	}
 }
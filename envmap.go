@@ -0,0 +1,187 @@
+package raytracer
+
+import (
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/timdestan/go-raytracer/internal/gml"
+	"github.com/timdestan/go-raytracer/internal/prim"
+
+	_ "image/jpeg"
+	_ "image/png"
+)
+
+// EnvMap is an equirectangular (latitude/longitude) image surrounding the
+// scene at infinity.
+//
+// The center of the image is in the +Z direction (straight ahead of the
+// camera), the top row is +Y and the bottom row is -Y.
+type EnvMap struct {
+	Image *prim.FloatImage
+	// Rotation is the rotation of the map around the Y axis, in radians.
+	Rotation float64
+	// AmbientScale scales the image-based ambient light. If 0, the scene's
+	// flat ambient light is used instead.
+	AmbientScale float64
+
+	// irradiance holds the spherical harmonic coefficients of the map's
+	// irradiance, for image-based ambient light.
+	irradiance [9]prim.Vec3
+}
+
+// NewEnvMap creates an environment map from the given image.
+//
+// rotation is in radians around the Y axis.
+func NewEnvMap(img *prim.FloatImage, rotation, ambientScale float64) *EnvMap {
+	m := &EnvMap{
+		Image:        img,
+		Rotation:     rotation,
+		AmbientScale: ambientScale,
+	}
+	if ambientScale > 0 {
+		m.irradiance = m.projectIrradiance()
+	}
+	return m
+}
+
+// LoadEnvMap loads the environment map described by the GML render arguments.
+//
+// Files ending in .hdr or .pic are decoded as Radiance HDR images; anything
+// else is decoded with the image package. Images with more than
+// prim.MaxImagePixels pixels are rejected before they are decoded.
+func LoadEnvMap(args *gml.EnvironmentMap) (*EnvMap, error) {
+	return loadEnvMap(args, os.Open)
+}
+
+// loadEnvMap is LoadEnvMap, opening the file with open.
+func loadEnvMap(args *gml.EnvironmentMap, open func(name string) (*os.File, error)) (*EnvMap, error) {
+	f, err := open(args.File)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var img *prim.FloatImage
+	switch strings.ToLower(filepath.Ext(args.File)) {
+	case ".hdr", ".pic":
+		img, err = prim.DecodeHDR(f)
+		if err != nil {
+			return nil, err
+		}
+	default:
+		config, _, err := image.DecodeConfig(f)
+		if err != nil {
+			return nil, err
+		}
+		if config.Width > 0 && config.Height > prim.MaxImagePixels/config.Width {
+			return nil, fmt.Errorf("environment map %s: %dx%d image is too large", args.File, config.Width, config.Height)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, err
+		}
+		ldr, _, err := image.Decode(f)
+		if err != nil {
+			return nil, err
+		}
+		img = prim.FloatImageFromImage(ldr)
+	}
+	return NewEnvMap(img, args.Rotation*math.Pi/180.0, args.AmbientScale), nil
+}
+
+// Sample returns the color of the environment in the given direction, which
+// does not need to be normalized.
+func (m *EnvMap) Sample(dir prim.Vec3) prim.Vec3 {
+	dir = dir.Normalize()
+	phi := math.Atan2(dir.X, dir.Z) - m.Rotation
+	theta := math.Acos(max(-1, min(1, dir.Y)))
+
+	u := 0.5 + phi/(2.0*math.Pi)
+	u -= math.Floor(u)
+	v := theta / math.Pi
+
+	// Bilinear interpolation between pixel centers, wrapping around
+	// horizontally.
+	w, h := m.Image.Width, m.Image.Height
+	x := u*float64(w) - 0.5
+	y := min(max(v*float64(h)-0.5, 0), float64(h-1))
+	x0, y0 := math.Floor(x), math.Floor(y)
+	fx, fy := x-x0, y-y0
+	ix0 := (int(x0)%w + w) % w
+	ix1 := (ix0 + 1) % w
+	iy0 := int(y0)
+	iy1 := min(iy0+1, h-1)
+
+	top := m.Image.At(ix0, iy0).Lerp(m.Image.At(ix1, iy0), fx)
+	bottom := m.Image.At(ix0, iy1).Lerp(m.Image.At(ix1, iy1), fx)
+	return top.Lerp(bottom, fy)
+}
+
+// Ambient returns the image-based ambient light for a diffuse surface with
+// the given (unit) normal.
+func (m *EnvMap) Ambient(normal prim.Vec3) prim.Vec3 {
+	// Irradiance is converted to the radiance leaving a white Lambertian
+	// surface, so that a uniform environment yields its own color.
+	var result prim.Vec3
+	for i, y := range shBasis(normal) {
+		result = result.Add(m.irradiance[i].Scale(y))
+	}
+	return result.Scale(m.AmbientScale / math.Pi)
+}
+
+// projectIrradiance projects the map onto the first 9 spherical harmonics
+// and convolves the result with the clamped cosine lobe, giving the
+// irradiance for any normal direction.
+//
+// See Ramamoorthi & Hanrahan, "An Efficient Representation for Irradiance
+// Environment Maps".
+func (m *EnvMap) projectIrradiance() [9]prim.Vec3 {
+	w, h := m.Image.Width, m.Image.Height
+	var coeffs [9]prim.Vec3
+	for y := range h {
+		theta := (float64(y) + 0.5) / float64(h) * math.Pi
+		sinTheta, cosTheta := math.Sincos(theta)
+		// Solid angle of each pixel in this row.
+		dOmega := (2.0 * math.Pi / float64(w)) * (math.Pi / float64(h)) * sinTheta
+		for x := range w {
+			phi := ((float64(x)+0.5)/float64(w)-0.5)*2.0*math.Pi + m.Rotation
+			sinPhi, cosPhi := math.Sincos(phi)
+			dir := prim.Vec3{X: sinTheta * sinPhi, Y: cosTheta, Z: sinTheta * cosPhi}
+			radiance := m.Image.At(x, y).Scale(dOmega)
+			for i, basis := range shBasis(dir) {
+				coeffs[i] = coeffs[i].Add(radiance.Scale(basis))
+			}
+		}
+	}
+
+	// Convolution with the cosine lobe only scales each band.
+	bandScale := [9]float64{
+		math.Pi,
+		2.0 * math.Pi / 3.0, 2.0 * math.Pi / 3.0, 2.0 * math.Pi / 3.0,
+		math.Pi / 4.0, math.Pi / 4.0, math.Pi / 4.0, math.Pi / 4.0, math.Pi / 4.0,
+	}
+	for i := range coeffs {
+		coeffs[i] = coeffs[i].Scale(bandScale[i])
+	}
+	return coeffs
+}
+
+// shBasis evaluates the real spherical harmonics up to l=2 in the given
+// (unit) direction.
+func shBasis(d prim.Vec3) [9]float64 {
+	return [9]float64{
+		0.282095,
+		0.488603 * d.Y,
+		0.488603 * d.Z,
+		0.488603 * d.X,
+		1.092548 * d.X * d.Y,
+		1.092548 * d.Y * d.Z,
+		0.315392 * (3*d.Z*d.Z - 1),
+		1.092548 * d.X * d.Z,
+		0.546274 * (d.X*d.X - d.Y*d.Y),
+	}
+}
@@ -0,0 +1,164 @@
+package raytracer
+
+import (
+	"fmt"
+	"image"
+	"image/color"
+	"math"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+func uniformFloatImage(w, h int, c prim.Vec3) *prim.FloatImage {
+	img := prim.NewFloatImage(w, h)
+	for i := range img.Pix {
+		img.Pix[i] = c
+	}
+	return img
+}
+
+// quadrantFloatImage returns an image whose top half is red, and whose
+// bottom half is green on the left and blue on the right.
+func quadrantFloatImage() *prim.FloatImage {
+	img := prim.NewFloatImage(64, 32)
+	for y := range img.Height {
+		for x := range img.Width {
+			switch {
+			case y < img.Height/2:
+				img.Set(x, y, prim.RGB(1, 0, 0))
+			case x < img.Width/2:
+				img.Set(x, y, prim.RGB(0, 1, 0))
+			default:
+				img.Set(x, y, prim.RGB(0, 0, 1))
+			}
+		}
+	}
+	return img
+}
+
+func TestEnvMapSample(t *testing.T) {
+	downForward := prim.Vec3{Y: -1, Z: 1}
+	downLeft := prim.Vec3{X: -1, Y: -1}
+	downRight := prim.Vec3{X: 1, Y: -1}
+
+	for _, tt := range []struct {
+		name     string
+		rotation float64
+		dir      prim.Vec3
+		want     prim.Vec3
+	}{
+		{"up", 0, prim.Vec3{Y: 1}, prim.RGB(1, 0, 0)},
+		{"down left", 0, downLeft, prim.RGB(0, 1, 0)},
+		{"down right", 0, downRight, prim.RGB(0, 0, 1)},
+		{"unnormalized", 0, downRight.Scale(10), prim.RGB(0, 0, 1)},
+		{"rotated down left", math.Pi, downLeft, prim.RGB(0, 0, 1)},
+		{"rotated down right", math.Pi, downRight, prim.RGB(0, 1, 0)},
+		{"quarter turn left", math.Pi / 2, downForward, prim.RGB(0, 1, 0)},
+		{"quarter turn right", -math.Pi / 2, downForward, prim.RGB(0, 0, 1)},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			m := NewEnvMap(quadrantFloatImage(), tt.rotation, 0)
+			if got := m.Sample(tt.dir); got.Sub(tt.want).Length() > 1e-9 {
+				t.Errorf("Sample(%v) = %v, want %v", tt.dir, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestEnvMapAmbientUniform(t *testing.T) {
+	c := prim.RGB(0.2, 0.4, 0.6)
+	m := NewEnvMap(uniformFloatImage(64, 32, c), 0, 1.0)
+	for _, normal := range []prim.Vec3{
+		{X: 1}, {Y: 1}, {Z: 1}, {Y: -1}, prim.Vec3{X: 1, Y: 1, Z: 1}.Normalize(),
+	} {
+		if got := m.Ambient(normal); got.Sub(c).Length() > 1e-3 {
+			t.Errorf("Ambient(%v) = %v, want %v", normal, got, c)
+		}
+	}
+}
+
+func TestEnvMapAmbientFacesBrightSide(t *testing.T) {
+	// Top half is white, bottom half is black.
+	img := prim.NewFloatImage(64, 32)
+	for y := range img.Height / 2 {
+		for x := range img.Width {
+			img.Set(x, y, prim.RGB(1, 1, 1))
+		}
+	}
+	m := NewEnvMap(img, 0, 1.0)
+	up := m.Ambient(prim.Vec3{Y: 1})
+	side := m.Ambient(prim.Vec3{X: 1})
+	down := m.Ambient(prim.Vec3{Y: -1})
+	if !(up.X > side.X && side.X > down.X) {
+		t.Errorf("expected ambient up (%v) > side (%v) > down (%v)", up, side, down)
+	}
+}
+
+func TestRenderWithEnvMap(t *testing.T) {
+	envFile := filepath.Join(t.TempDir(), "env.png")
+	env := image.NewRGBA(image.Rect(0, 0, 32, 16))
+	for y := range 16 {
+		for x := range 32 {
+			env.Set(x, y, color.RGBA{R: 0, G: 0xff, B: 0, A: 0xff})
+		}
+	}
+	if err := writeImage(env, envFile); err != nil {
+		t.Fatalf("writeImage: %v", err)
+	}
+
+	// A small mirrored sphere in the middle of the frame.
+	program := fmt.Sprintf(`
+		{ /v /u /face 1.0 1.0 1.0 point 0.0 1.0 1.0 } sphere
+		0.0 0.0 10.0 translate /s
+		0.0 0.0 0.0 point [ ] s 3 90.0 16 16 "out.ppm"
+		%q 0.0 0.0 renderWithEnvMap`, envFile)
+	img, err := ParseAndRenderGML(program)
+	if err != nil {
+		t.Fatalf("ParseAndRenderGML: %v", err)
+	}
+
+	// The corner only sees the environment.
+	r, g, b, _ := img.At(0, 0).RGBA()
+	if r != 0 || g != 0xffff || b != 0 {
+		t.Errorf("background color = (%d, %d, %d), want (0, 65535, 0)", r, g, b)
+	}
+	// The sphere reflects the environment.
+	r, g, b, _ = img.At(8, 8).RGBA()
+	if r != 0 || g == 0 || b != 0 {
+		t.Errorf("reflected color = (%d, %d, %d), want pure green", r, g, b)
+	}
+}
+
+func TestRenderWithEnvMapRelativeToFile(t *testing.T) {
+	dir := t.TempDir()
+	env := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	for y := range 2 {
+		for x := range 4 {
+			env.Set(x, y, color.RGBA{R: 0, G: 0xff, B: 0, A: 0xff})
+		}
+	}
+	if err := writeImage(env, filepath.Join(dir, "env.png")); err != nil {
+		t.Fatalf("writeImage: %v", err)
+	}
+	// The environment map is named relative to the program's directory,
+	// which is not the working directory.
+	path := filepath.Join(dir, "scene.gml")
+	program := `
+		{ /v /u /face 1.0 1.0 1.0 point 0.0 1.0 1.0 } sphere
+		0.0 0.0 10.0 translate /s
+		0.0 0.0 0.0 point [ ] s 3 90.0 4 4 "out.ppm"
+		"env.png" 0.0 0.0 renderWithEnvMap`
+	if err := os.WriteFile(path, []byte(program), 0o644); err != nil {
+		t.Fatalf("WriteFile: %v", err)
+	}
+	img, err := ParseAndRenderGMLFile(path)
+	if err != nil {
+		t.Fatalf("ParseAndRenderGMLFile: %v", err)
+	}
+	if r, g, b, _ := img.At(0, 0).RGBA(); r != 0 || g != 0xffff || b != 0 {
+		t.Errorf("background color = (%d, %d, %d), want (0, 65535, 0)", r, g, b)
+	}
+}
@@ -0,0 +1,191 @@
+package raytracer
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/timdestan/go-raytracer/internal/gml"
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+func constantSurfaceFn(r, g, b float64) gml.VSurfaceFn {
+	return gml.VSurfaceFn{Material: &gml.Material{Color: prim.RGB(r, g, b), Kd: 1}}
+}
+
+func TestConvertInstancesSharePrototype(t *testing.T) {
+	tree := &gml.Union{Objects: []gml.SceneObject{
+		(&gml.Sphere{SurfaceFn: constantSurfaceFn(0, 1, 0)}).Transform(prim.Mat4Translate(prim.Vec3{Y: 2})),
+		&gml.Cylinder{SurfaceFn: constantSurfaceFn(1, 1, 0), TransformMat: prim.Mat4Scale(0.2, 2, 0.2)},
+	}}
+	const numTrees = 10
+	forest := &gml.Union{}
+	for i := range numTrees {
+		forest.Objects = append(forest.Objects, tree.Transform(prim.Mat4Translate(prim.Vec3{X: float64(i)})))
+	}
+	// The forest is an instance too, so the trees are nested instances.
+	scene := forest.Transform(prim.Mat4Translate(prim.Vec3{Y: -1}))
+
+	objects, err := convertGMLSceneObjects([]gml.SceneObject{scene})
+	if err != nil {
+		t.Fatalf("convertGMLSceneObjects: %v", err)
+	}
+	if len(objects) != numTrees {
+		t.Fatalf("got %d objects, want %d", len(objects), numTrees)
+	}
+	var prototype *Prototype
+	for i, obj := range objects {
+		inst, ok := obj.(*Instance)
+		if !ok {
+			t.Fatalf("objects[%d] is a %T, want *Instance", i, obj)
+		}
+		if prototype == nil {
+			prototype = inst.Prototype
+		} else if inst.Prototype != prototype {
+			t.Errorf("objects[%d] has a different prototype", i)
+		}
+		wantOrigin := prim.Vec3{X: float64(i), Y: -1}
+		if got := inst.ObjectToWorld.MulPoint(prim.Vec3{}); got != wantOrigin {
+			t.Errorf("objects[%d] origin = %v, want %v", i, got, wantOrigin)
+		}
+	}
+	if len(prototype.Objects) != 2 {
+		t.Errorf("prototype has %d objects, want 2", len(prototype.Objects))
+	}
+}
+
+// TestInstanceMatchesTransformedObjects checks that hitting an instance
+// gives the same results as hitting copies of the prototype's objects with
+// the instance's transforms applied directly.
+func TestInstanceMatchesTransformedObjects(t *testing.T) {
+	sphereXform := prim.Mat4Translate(prim.Vec3{X: -1})
+	cubeXform := prim.Mat4Translate(prim.Vec3{X: 0.5, Y: -0.5, Z: -0.5})
+	instanceXform := prim.Mat4Scale(1, 0.5, 2).
+		MulMat(prim.Mat4RotateY(0.5)).
+		MulMat(prim.Mat4Translate(prim.Vec3{Z: 5}))
+	// outerXform nests the instance in another one.
+	outerXform := prim.Mat4RotateZ(0.3).MulMat(prim.Mat4Translate(prim.Vec3{Y: 0.25}))
+
+	objects := func() []gml.SceneObject {
+		return []gml.SceneObject{
+			&gml.Sphere{SurfaceFn: constantSurfaceFn(1, 0, 0), TransformMat: sphereXform},
+			&gml.Cube{SurfaceFn: constantSurfaceFn(0, 0, 1), TransformMat: cubeXform},
+		}
+	}
+	for _, tt := range []struct {
+		name   string
+		xforms []*prim.Mat4
+	}{
+		{"instance", []*prim.Mat4{instanceXform}},
+		{"nested instance", []*prim.Mat4{instanceXform, outerXform}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			var instance gml.SceneObject = &gml.Union{Objects: objects()}
+			copies := objects()
+			for _, xform := range tt.xforms {
+				instance = (&gml.Union{Objects: []gml.SceneObject{instance}}).Transform(xform)
+				for i := range copies {
+					copies[i] = copies[i].Transform(xform)
+				}
+			}
+			checkSameHits(t, []gml.SceneObject{instance}, copies)
+		})
+	}
+}
+
+// checkSameHits checks that rays hit the instanced objects where they hit
+// the copied objects, with the same surface properties.
+func checkSameHits(t *testing.T, instance, copies []gml.SceneObject) {
+	t.Helper()
+	instanced, err := convertGMLSceneObjects(instance)
+	if err != nil {
+		t.Fatalf("convertGMLSceneObjects: %v", err)
+	}
+	copied, err := convertGMLSceneObjects(copies)
+	if err != nil {
+		t.Fatalf("convertGMLSceneObjects: %v", err)
+	}
+
+	var instancedState, copiedState SceneThreadState
+	hits := 0
+	for x := -1.0; x <= 1.0; x += 0.125 {
+		for y := -0.5; y <= 0.5; y += 0.125 {
+			ray := Ray{Direction: prim.Vec3{X: x, Y: y, Z: 5}.Normalize()}
+			want := copiedState.closestHit(copied, ray)
+			got := instancedState.closestHit(instanced, ray)
+			if (got != nil) != (want != nil) {
+				t.Fatalf("ray %v: got hit %v, want hit %v", ray.Direction, got != nil, want != nil)
+			}
+			if want == nil {
+				continue
+			}
+			hits++
+			if got.Instance == nil {
+				t.Errorf("ray %v: hit has no instance", ray.Direction)
+			}
+			if math.Abs(got.T-want.T) > 1e-9 {
+				t.Errorf("ray %v: T = %v, want %v", ray.Direction, got.T, want.T)
+			}
+			gotEx, err := got.ComputeSurfaceProps(nil)
+			if err != nil {
+				t.Fatalf("ComputeSurfaceProps: %v", err)
+			}
+			wantEx, err := want.ComputeSurfaceProps(nil)
+			if err != nil {
+				t.Fatalf("ComputeSurfaceProps: %v", err)
+			}
+			if gotEx.PointWorld.Sub(wantEx.PointWorld).Length() > 1e-9 {
+				t.Errorf("ray %v: PointWorld = %v, want %v", ray.Direction, gotEx.PointWorld, wantEx.PointWorld)
+			}
+			if gotEx.NormalWorld.Sub(wantEx.NormalWorld).Length() > 1e-9 {
+				t.Errorf("ray %v: NormalWorld = %v, want %v", ray.Direction, gotEx.NormalWorld, wantEx.NormalWorld)
+			}
+			if gotEx.Material != wantEx.Material {
+				t.Errorf("ray %v: Material = %+v, want %+v", ray.Direction, gotEx.Material, wantEx.Material)
+			}
+		}
+	}
+	if hits == 0 {
+		t.Error("no rays hit the scene")
+	}
+}
+
+// TestTransformedUnionRendersLikeTransformedObject checks that transforming
+// a union places its objects where the same transforms place a bare object.
+func TestTransformedUnionRendersLikeTransformedObject(t *testing.T) {
+	const program = `
+		{ /v /u /face 1.0 0.5 0.2 point 1.0 0.2 1.0 } sphere
+		0.5 uscale 0.5 0.0 0.0 translate %s
+		30.0 rotatey 0.0 0.0 4.0 translate /scene
+		0.2 0.2 0.2 point [ 0.0 5.0 0.0 point 1.0 1.0 1.0 point pointlight ]
+		scene 3 90.0 32 32 "out.ppm" render`
+	opts := RenderOptions{Width: 32, Height: 32, Samples: 1}
+	ctx := context.Background()
+	// Unioning the sphere with another one far behind the camera makes it
+	// a transformed union, without changing the image.
+	union, _, err := ParseAndRenderGMLWithOptions(ctx, fmt.Sprintf(program, `{ /v /u /face 0.0 1.0 0.0 point 1.0 0.0 1.0 } sphere 0.0 0.0 -100.0 translate union`), opts)
+	if err != nil {
+		t.Fatalf("rendering the union: %v", err)
+	}
+	bare, _, err := ParseAndRenderGMLWithOptions(ctx, fmt.Sprintf(program, ""), opts)
+	if err != nil {
+		t.Fatalf("rendering the sphere: %v", err)
+	}
+	bounds := bare.Bounds()
+	lit := 0
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			got, want := union.At(x, y), bare.At(x, y)
+			if got != want {
+				t.Fatalf("pixel (%d, %d) = %v, want %v", x, y, got, want)
+			}
+			if r, _, _, _ := want.RGBA(); r > 0 {
+				lit++
+			}
+		}
+	}
+	if lit == 0 {
+		t.Error("the sphere is not in the image")
+	}
+}
@@ -0,0 +1,83 @@
+// Package anim encodes sequences of images as animated GIFs and APNGs.
+package anim
+
+import (
+	"errors"
+	"fmt"
+	"image"
+	"time"
+)
+
+// Palette says how the colors of a GIF are chosen.
+type Palette int
+
+const (
+	// PaletteGlobal uses one palette, chosen from all the frames, which
+	// keeps colors from flickering between frames.
+	PaletteGlobal Palette = iota
+	// PaletteAdaptive chooses a palette for each frame, which suits
+	// animations whose colors change a lot.
+	PaletteAdaptive
+)
+
+var paletteNames = map[Palette]string{
+	PaletteGlobal:   "global",
+	PaletteAdaptive: "adaptive",
+}
+
+func (p Palette) String() string {
+	if name, ok := paletteNames[p]; ok {
+		return name
+	}
+	return fmt.Sprintf("Palette(%d)", int(p))
+}
+
+// ParsePalette parses the name of a Palette.
+func ParsePalette(name string) (Palette, error) {
+	for p, n := range paletteNames {
+		if n == name {
+			return p, nil
+		}
+	}
+	return 0, fmt.Errorf("unknown palette %q, want \"global\" or \"adaptive\"", name)
+}
+
+// Options controls how an animation is encoded.
+type Options struct {
+	// Delay is how long each frame is shown. If it is 0, frames are shown
+	// for 100ms.
+	Delay time.Duration
+	// Loops is the number of times the animation plays. If it is 0, it
+	// plays forever.
+	Loops int
+
+	// Palette and Dither only apply to GIFs, which have at most 256
+	// colors. Dither spreads the error from rounding each pixel to the
+	// palette over its neighbours.
+	Palette Palette
+	Dither  bool
+}
+
+func (opts *Options) delay() time.Duration {
+	if opts.Delay <= 0 {
+		return 100 * time.Millisecond
+	}
+	return opts.Delay
+}
+
+// checkFrames returns the bounds shared by all the frames.
+func checkFrames(frames []image.Image) (image.Rectangle, error) {
+	if len(frames) == 0 {
+		return image.Rectangle{}, errors.New("an animation needs at least one frame")
+	}
+	bounds := frames[0].Bounds()
+	for i, frame := range frames {
+		if frame.Bounds() != bounds {
+			return image.Rectangle{}, fmt.Errorf("frame %d has bounds %v, want %v like frame 0", i, frame.Bounds(), bounds)
+		}
+	}
+	if bounds.Empty() {
+		return image.Rectangle{}, errors.New("frames are empty")
+	}
+	return bounds, nil
+}
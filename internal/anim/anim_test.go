@@ -0,0 +1,223 @@
+package anim
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+// testFrames returns frames of a gradient with a square moving across it.
+// If transparent is set, the top left corner is transparent.
+func testFrames(n int, transparent bool) []image.Image {
+	var frames []image.Image
+	for i := range n {
+		img := image.NewRGBA(image.Rect(0, 0, 40, 30))
+		for y := range 30 {
+			for x := range 40 {
+				c := color.RGBA{uint8(x * 6), uint8(y * 8), 128, 255}
+				if x >= 8*i && x < 8*i+10 && y >= 10 && y < 20 {
+					c = color.RGBA{255, 255, 0, 255}
+				}
+				if transparent && x < 5 && y < 5 {
+					c = color.RGBA{}
+				}
+				img.SetRGBA(x, y, c)
+			}
+		}
+		frames = append(frames, img)
+	}
+	return frames
+}
+
+func TestMedianCut(t *testing.T) {
+	colors := []color.RGBA{{255, 0, 0, 255}, {0, 255, 0, 255}, {0, 0, 255, 255}, {10, 10, 10, 255}, {}}
+	img := image.NewRGBA(image.Rect(0, 0, 50, 10))
+	for x := range 50 {
+		for y := range 10 {
+			img.SetRGBA(x, y, colors[x%len(colors)])
+		}
+	}
+	palette := MedianCut([]image.Image{img}, 16)
+	if len(palette) != len(colors) {
+		t.Errorf("got %d colors, want %d: %v", len(palette), len(colors), palette)
+	}
+	for _, c := range colors {
+		if got := palette.Convert(c); got != c {
+			t.Errorf("%v is drawn as %v, want it in the palette", c, got)
+		}
+	}
+
+	palette = MedianCut(testFrames(3, false), 8)
+	if len(palette) != 8 {
+		t.Errorf("got %d colors for a gradient, want 8", len(palette))
+	}
+}
+
+// meanError returns the mean difference between the channels of the images.
+func meanError(a, b image.Image) float64 {
+	total, n := 0.0, 0
+	bounds := a.Bounds()
+	for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+		for x := bounds.Min.X; x < bounds.Max.X; x++ {
+			ca := color.NRGBAModel.Convert(a.At(x, y)).(color.NRGBA)
+			cb := color.NRGBAModel.Convert(b.At(x, y)).(color.NRGBA)
+			for _, d := range []int{int(ca.R) - int(cb.R), int(ca.G) - int(cb.G), int(ca.B) - int(cb.B), int(ca.A) - int(cb.A)} {
+				total += float64(abs(d))
+				n++
+			}
+		}
+	}
+	return total / float64(n)
+}
+
+func TestEncodeGIF(t *testing.T) {
+	frames := testFrames(4, true)
+	for _, opts := range []Options{
+		{},
+		{Delay: 250 * time.Millisecond, Loops: 3, Palette: PaletteAdaptive},
+		{Loops: 1, Dither: true},
+	} {
+		var buf bytes.Buffer
+		if err := EncodeGIF(&buf, frames, opts); err != nil {
+			t.Fatalf("EncodeGIF(%+v): %v", opts, err)
+		}
+		got, err := gif.DecodeAll(&buf)
+		if err != nil {
+			t.Fatalf("DecodeAll(%+v): %v", opts, err)
+		}
+		if len(got.Image) != len(frames) {
+			t.Fatalf("%+v: got %d frames, want %d", opts, len(got.Image), len(frames))
+		}
+		wantLoopCount := map[int]int{0: 0, 1: -1, 3: 2}[opts.Loops]
+		if got.LoopCount != wantLoopCount {
+			t.Errorf("%+v: LoopCount = %d, want %d", opts, got.LoopCount, wantLoopCount)
+		}
+		wantDelay := int(opts.delay() / (10 * time.Millisecond))
+		for i, frame := range got.Image {
+			if got.Delay[i] != wantDelay {
+				t.Errorf("%+v: frame %d has delay %d, want %d", opts, i, got.Delay[i], wantDelay)
+			}
+			if e := meanError(frame, frames[i]); e > 4 {
+				t.Errorf("%+v: frame %d differs from the original by %.1f on average", opts, i, e)
+			}
+			if _, _, _, a := frame.At(0, 0).RGBA(); a != 0 {
+				t.Errorf("%+v: frame %d is not transparent at 0, 0", opts, i)
+			}
+		}
+	}
+}
+
+type pngChunk struct {
+	name string
+	data []byte
+}
+
+func readChunks(t *testing.T, b []byte) []pngChunk {
+	t.Helper()
+	if string(b[:len(pngSignature)]) != pngSignature {
+		t.Fatal("missing PNG signature")
+	}
+	b = b[len(pngSignature):]
+	var chunks []pngChunk
+	for len(b) > 0 {
+		n := binary.BigEndian.Uint32(b)
+		chunks = append(chunks, pngChunk{string(b[4:8]), b[8 : 8+n]})
+		b = b[12+n:]
+	}
+	return chunks
+}
+
+// frameAsPNG returns a PNG file with the header of the APNG and the given
+// image data, so that the frame can be decoded by image/png.
+func frameAsPNG(ihdr, data []byte) []byte {
+	var buf bytes.Buffer
+	e := &apngEncoder{w: &buf}
+	e.writeString(pngSignature)
+	e.writeChunk("IHDR", ihdr)
+	e.writeChunk("IDAT", data)
+	e.writeChunk("IEND", nil)
+	return buf.Bytes()
+}
+
+func TestEncodeAPNG(t *testing.T) {
+	for _, transparent := range []bool{false, true} {
+		frames := testFrames(3, transparent)
+		var buf bytes.Buffer
+		if err := EncodeAPNG(&buf, frames, Options{Delay: 40 * time.Millisecond, Loops: 2}); err != nil {
+			t.Fatalf("EncodeAPNG: %v", err)
+		}
+
+		// Programs without APNG support see the first frame.
+		first, err := png.Decode(bytes.NewReader(buf.Bytes()))
+		if err != nil {
+			t.Fatalf("png.Decode: %v", err)
+		}
+		if e := meanError(first, frames[0]); e != 0 {
+			t.Errorf("transparent: %v: default image differs from the first frame", transparent)
+		}
+
+		chunks := readChunks(t, buf.Bytes())
+		var names []string
+		for _, c := range chunks {
+			names = append(names, c.name)
+		}
+		wantNames := []string{"IHDR", "acTL", "fcTL", "IDAT", "fcTL", "fdAT", "fcTL", "fdAT", "IEND"}
+		if diff := cmp.Diff(wantNames, names); diff != "" {
+			t.Fatalf("transparent: %v: chunks mismatch (-want +got):\n%s", transparent, diff)
+		}
+		if got, want := chunks[1].data, []byte{0, 0, 0, 3, 0, 0, 0, 2}; !bytes.Equal(got, want) {
+			t.Errorf("transparent: %v: acTL = %v, want %v", transparent, got, want)
+		}
+
+		var seqs []uint32
+		frame := 0
+		for _, c := range chunks {
+			switch c.name {
+			case "fcTL":
+				seqs = append(seqs, binary.BigEndian.Uint32(c.data))
+				if num, den := binary.BigEndian.Uint16(c.data[20:]), binary.BigEndian.Uint16(c.data[22:]); num != 40 || den != 1000 {
+					t.Errorf("transparent: %v: delay = %d/%d, want 40/1000", transparent, num, den)
+				}
+			case "IDAT", "fdAT":
+				data := c.data
+				if c.name == "fdAT" {
+					seqs = append(seqs, binary.BigEndian.Uint32(data))
+					data = data[4:]
+				}
+				img, err := png.Decode(bytes.NewReader(frameAsPNG(chunks[0].data, data)))
+				if err != nil {
+					t.Fatalf("transparent: %v: decoding frame %d: %v", transparent, frame, err)
+				}
+				if e := meanError(img, frames[frame]); e != 0 {
+					t.Errorf("transparent: %v: frame %d differs from the original", transparent, frame)
+				}
+				frame++
+			}
+		}
+		if diff := cmp.Diff([]uint32{0, 1, 2, 3, 4}, seqs); diff != "" {
+			t.Errorf("transparent: %v: sequence numbers mismatch (-want +got):\n%s", transparent, diff)
+		}
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	mixed := []image.Image{image.NewRGBA(image.Rect(0, 0, 4, 4)), image.NewRGBA(image.Rect(0, 0, 4, 5))}
+	for name, encode := range map[string]func(frames []image.Image) error{
+		"gif":  func(frames []image.Image) error { return EncodeGIF(&bytes.Buffer{}, frames, Options{}) },
+		"apng": func(frames []image.Image) error { return EncodeAPNG(&bytes.Buffer{}, frames, Options{}) },
+	} {
+		if err := encode(nil); err == nil {
+			t.Errorf("%s: encoding no frames succeeded, want an error", name)
+		}
+		if err := encode(mixed); err == nil {
+			t.Errorf("%s: encoding frames of different sizes succeeded, want an error", name)
+		}
+	}
+}
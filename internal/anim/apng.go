@@ -0,0 +1,234 @@
+package anim
+
+import (
+	"bytes"
+	"compress/zlib"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"io"
+	"math"
+)
+
+// pngSignature starts every PNG file.
+const pngSignature = "\x89PNG\r\n\x1a\n"
+
+// PNG color types.
+const (
+	pngColorRGB  = 2
+	pngColorRGBA = 6
+)
+
+// PNG row filters.
+const (
+	filterNone = iota
+	filterSub
+	filterUp
+	filterAverage
+	filterPaeth
+	numFilters
+)
+
+// EncodeAPNG writes the frames, which must all have the same bounds, as an
+// animated PNG. Programs that do not support APNG show the first frame.
+//
+// The image/png encoder chooses the color type of each image by itself, but
+// all the frames of an APNG share one, so the frames are encoded here.
+func EncodeAPNG(w io.Writer, frames []image.Image, opts Options) error {
+	bounds, err := checkFrames(frames)
+	if err != nil {
+		return err
+	}
+	colorType := byte(pngColorRGB)
+	for _, frame := range frames {
+		if !opaque(frame) {
+			colorType = pngColorRGBA
+			break
+		}
+	}
+
+	e := &apngEncoder{w: w}
+	e.writeString(pngSignature)
+
+	var ihdr [13]byte
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(bounds.Dx()))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(bounds.Dy()))
+	ihdr[8] = 8 // bits per channel
+	ihdr[9] = colorType
+	e.writeChunk("IHDR", ihdr[:])
+
+	var actl [8]byte
+	binary.BigEndian.PutUint32(actl[0:], uint32(len(frames)))
+	binary.BigEndian.PutUint32(actl[4:], uint32(opts.Loops))
+	e.writeChunk("acTL", actl[:])
+
+	// Delays are fractions of a second, with 16 bit numerators and
+	// denominators.
+	delayNum, delayDen := uint16(min(opts.delay().Milliseconds(), math.MaxUint16)), uint16(1000)
+	var seq uint32
+	for i, frame := range frames {
+		var fctl [26]byte
+		binary.BigEndian.PutUint32(fctl[0:], seq)
+		binary.BigEndian.PutUint32(fctl[4:], uint32(bounds.Dx()))
+		binary.BigEndian.PutUint32(fctl[8:], uint32(bounds.Dy()))
+		// The frame covers the whole image, at offset 0, 0.
+		binary.BigEndian.PutUint16(fctl[20:], delayNum)
+		binary.BigEndian.PutUint16(fctl[22:], delayDen)
+		// The dispose and blend operations are left at 0, which means
+		// each frame replaces the one before, since frames may be
+		// transparent.
+		e.writeChunk("fcTL", fctl[:])
+		seq++
+
+		data, err := compressImage(frame, colorType)
+		if err != nil {
+			return err
+		}
+		if i == 0 {
+			// The first frame is the default image.
+			e.writeChunk("IDAT", data)
+		} else {
+			var seqBytes [4]byte
+			binary.BigEndian.PutUint32(seqBytes[:], seq)
+			e.writeChunk("fdAT", append(seqBytes[:], data...))
+			seq++
+		}
+	}
+	e.writeChunk("IEND", nil)
+	return e.err
+}
+
+// apngEncoder writes chunks, remembering the first error.
+type apngEncoder struct {
+	w   io.Writer
+	err error
+}
+
+func (e *apngEncoder) writeString(s string) {
+	if e.err == nil {
+		_, e.err = io.WriteString(e.w, s)
+	}
+}
+
+func (e *apngEncoder) writeChunk(name string, data []byte) {
+	var header [8]byte
+	binary.BigEndian.PutUint32(header[:4], uint32(len(data)))
+	copy(header[4:], name)
+	crc := crc32.NewIEEE()
+	crc.Write(header[4:])
+	crc.Write(data)
+	var footer [4]byte
+	binary.BigEndian.PutUint32(footer[:], crc.Sum32())
+
+	for _, b := range [][]byte{header[:], data, footer[:]} {
+		if e.err == nil {
+			_, e.err = e.w.Write(b)
+		}
+	}
+}
+
+func opaque(img image.Image) bool {
+	if o, ok := img.(interface{ Opaque() bool }); ok {
+		return o.Opaque()
+	}
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			if _, _, _, a := img.At(x, y).RGBA(); a != 0xffff {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// compressImage returns the filtered and compressed rows of img, in the
+// color type, as stored in IDAT and fdAT chunks.
+func compressImage(img image.Image, colorType byte) ([]byte, error) {
+	bpp := 3
+	if colorType == pngColorRGBA {
+		bpp = 4
+	}
+	b := img.Bounds()
+	rowBytes := bpp * b.Dx()
+
+	var buf bytes.Buffer
+	zw := zlib.NewWriter(&buf)
+	prev := make([]byte, rowBytes)
+	cur := make([]byte, rowBytes)
+	var filtered [numFilters][]byte
+	for f := range filtered {
+		filtered[f] = make([]byte, 1+rowBytes)
+		filtered[f][0] = byte(f)
+	}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			// PNG stores colors that are not premultiplied by alpha.
+			c := color.NRGBAModel.Convert(img.At(x, y)).(color.NRGBA)
+			i := bpp * (x - b.Min.X)
+			cur[i], cur[i+1], cur[i+2] = c.R, c.G, c.B
+			if bpp == 4 {
+				cur[i+3] = c.A
+			}
+		}
+		if _, err := zw.Write(filterRow(&filtered, cur, prev, bpp)); err != nil {
+			return nil, err
+		}
+		prev, cur = cur, prev
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// filterRow applies each filter to the row, and returns the filtered row
+// with the smallest sum of absolute values, which usually compresses best.
+func filterRow(filtered *[numFilters][]byte, cur, prev []byte, bpp int) []byte {
+	for i := range cur {
+		var left, upLeft byte
+		if i >= bpp {
+			left, upLeft = cur[i-bpp], prev[i-bpp]
+		}
+		up := prev[i]
+		filtered[filterNone][1+i] = cur[i]
+		filtered[filterSub][1+i] = cur[i] - left
+		filtered[filterUp][1+i] = cur[i] - up
+		filtered[filterAverage][1+i] = cur[i] - byte((int(left)+int(up))/2)
+		filtered[filterPaeth][1+i] = cur[i] - paeth(left, up, upLeft)
+	}
+	best, bestSum := 0, math.MaxInt
+	for f, row := range filtered {
+		sum := 0
+		for _, v := range row[1:] {
+			sum += abs(int(int8(v)))
+		}
+		if sum < bestSum {
+			best, bestSum = f, sum
+		}
+	}
+	return filtered[best]
+}
+
+// paeth returns whichever of a (left), b (up) and c (up left) is closest to
+// a + b - c.
+func paeth(a, b, c byte) byte {
+	p := int(a) + int(b) - int(c)
+	pa, pb, pc := abs(p-int(a)), abs(p-int(b)), abs(p-int(c))
+	switch {
+	case pa <= pb && pa <= pc:
+		return a
+	case pb <= pc:
+		return b
+	default:
+		return c
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
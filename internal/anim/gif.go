@@ -0,0 +1,54 @@
+package anim
+
+import (
+	"image"
+	"image/color"
+	"image/draw"
+	"image/gif"
+	"io"
+)
+
+// EncodeGIF writes the frames, which must all have the same bounds, as an
+// animated GIF.
+func EncodeGIF(w io.Writer, frames []image.Image, opts Options) error {
+	bounds, err := checkFrames(frames)
+	if err != nil {
+		return err
+	}
+
+	var global color.Palette
+	if opts.Palette == PaletteGlobal {
+		global = MedianCut(frames, 256)
+	}
+	var drawer draw.Drawer = draw.Src
+	if opts.Dither {
+		drawer = draw.FloydSteinberg
+	}
+	// GIF delays are in hundredths of a second.
+	delay := max(1, int(opts.delay().Milliseconds()+5)/10)
+
+	anim := &gif.GIF{Config: image.Config{Width: bounds.Dx(), Height: bounds.Dy()}}
+	// In a GIF, 0 loops forever, -1 plays once and n plays n+1 times.
+	switch opts.Loops {
+	case 0:
+		anim.LoopCount = 0
+	case 1:
+		anim.LoopCount = -1
+	default:
+		anim.LoopCount = opts.Loops - 1
+	}
+	for _, frame := range frames {
+		palette := global
+		if palette == nil {
+			palette = MedianCut([]image.Image{frame}, 256)
+		}
+		paletted := image.NewPaletted(bounds, palette)
+		drawer.Draw(paletted, bounds, frame, bounds.Min)
+		anim.Image = append(anim.Image, paletted)
+		anim.Delay = append(anim.Delay, delay)
+		// Replace the whole frame, rather than drawing the next frame over
+		// it, since frames may be transparent.
+		anim.Disposal = append(anim.Disposal, gif.DisposalBackground)
+	}
+	return gif.EncodeAll(w, anim)
+}
@@ -0,0 +1,162 @@
+package anim
+
+import (
+	"image"
+	"image/color"
+	"slices"
+)
+
+// maxPaletteSamples is the most pixels MedianCut looks at. Larger images are
+// sampled evenly, which hardly changes the palette.
+const maxPaletteSamples = 1 << 20
+
+// MedianCut chooses a palette of at most n colors for the images, by
+// repeatedly splitting the box of colors with the widest range at its
+// median. If any pixel is mostly transparent, the palette has a fully
+// transparent color, which takes one of the n entries.
+func MedianCut(images []image.Image, n int) color.Palette {
+	pixels, transparent := samplePixels(images)
+	if transparent {
+		n--
+	}
+	var palette color.Palette
+	if len(pixels) > 0 && n > 0 {
+		boxes := []colorBox{{pixels: pixels}}
+		for len(boxes) < n {
+			i := widestBox(boxes)
+			if i < 0 {
+				break
+			}
+			a, b := boxes[i].split()
+			boxes[i] = a
+			boxes = append(boxes, b)
+		}
+		for _, box := range boxes {
+			palette = append(palette, box.average())
+		}
+	}
+	if transparent {
+		palette = append(palette, color.RGBA{})
+	}
+	return palette
+}
+
+// samplePixels returns the opaque colors of the images, and whether any
+// pixel is mostly transparent.
+func samplePixels(images []image.Image) (pixels []color.RGBA, transparent bool) {
+	total := 0
+	for _, img := range images {
+		total += img.Bounds().Dx() * img.Bounds().Dy()
+	}
+	step := max(1, total/maxPaletteSamples)
+	i := 0
+	for _, img := range images {
+		b := img.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				i++
+				if i%step != 0 {
+					continue
+				}
+				c := color.RGBAModel.Convert(img.At(x, y)).(color.RGBA)
+				if c.A < 0x80 {
+					transparent = true
+					continue
+				}
+				pixels = append(pixels, c)
+			}
+		}
+	}
+	return pixels, transparent
+}
+
+type colorBox struct {
+	pixels []color.RGBA
+}
+
+// channel returns the value of channel ch (0 for red, 1 for green and 2 for
+// blue) of c.
+func channel(c color.RGBA, ch int) uint8 {
+	switch ch {
+	case 0:
+		return c.R
+	case 1:
+		return c.G
+	default:
+		return c.B
+	}
+}
+
+// widestChannel returns the channel with the widest range in the box, and
+// the width of its range.
+func (box *colorBox) widestChannel() (ch int, width int) {
+	for c := range 3 {
+		lo, hi := uint8(255), uint8(0)
+		for _, p := range box.pixels {
+			v := channel(p, c)
+			lo, hi = min(lo, v), max(hi, v)
+		}
+		if w := int(hi) - int(lo); w > width {
+			ch, width = c, w
+		}
+	}
+	return ch, width
+}
+
+// widestBox returns the index of the box to split next, or -1 if no box
+// can be split.
+func widestBox(boxes []colorBox) int {
+	best, bestScore := -1, 0
+	for i := range boxes {
+		if len(boxes[i].pixels) < 2 {
+			continue
+		}
+		// Weighting by the number of pixels spends more of the palette on
+		// the colors that cover more of the image.
+		_, width := boxes[i].widestChannel()
+		if score := width * len(boxes[i].pixels); width > 0 && score > bestScore {
+			best, bestScore = i, score
+		}
+	}
+	return best
+}
+
+// split splits the box at the median of its widest channel.
+func (box *colorBox) split() (colorBox, colorBox) {
+	ch, _ := box.widestChannel()
+	slices.SortFunc(box.pixels, func(a, b color.RGBA) int {
+		return int(channel(a, ch)) - int(channel(b, ch))
+	})
+	// Split between two different values, so that a box of two colors
+	// splits into one box for each. There is such a place, since the
+	// channel's range is not empty.
+	same := func(i int) bool { return channel(box.pixels[i-1], ch) == channel(box.pixels[i], ch) }
+	mid := len(box.pixels) / 2
+	lo, hi := mid, mid
+	for lo > 0 && same(lo) {
+		lo--
+	}
+	for hi < len(box.pixels) && same(hi) {
+		hi++
+	}
+	switch {
+	case lo == 0:
+		mid = hi
+	case hi == len(box.pixels) || mid-lo <= hi-mid:
+		mid = lo
+	default:
+		mid = hi
+	}
+	return colorBox{box.pixels[:mid]}, colorBox{box.pixels[mid:]}
+}
+
+func (box *colorBox) average() color.RGBA {
+	var r, g, b int
+	for _, p := range box.pixels {
+		r += int(p.R)
+		g += int(p.G)
+		b += int(p.B)
+	}
+	n := len(box.pixels)
+	return color.RGBA{uint8((r + n/2) / n), uint8((g + n/2) / n), uint8((b + n/2) / n), 0xff}
+}
@@ -0,0 +1,269 @@
+package distributed
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timdestan/go-raytracer"
+)
+
+// Coordinator splits renders into tiles and sends them to workers.
+type Coordinator struct {
+	// Workers are the addresses of the workers, either as "host:port" or
+	// as a URL like "http://host:port".
+	Workers []string
+	// Client is used to send requests to workers. If it is nil,
+	// http.DefaultClient is used.
+	Client *http.Client
+	// TileSize is the width and height of the tiles sent to workers. If it
+	// is 0, 64 pixel tiles are used.
+	TileSize int
+	// MaxAttempts is the number of times each tile is tried on each
+	// worker. The render fails once a tile has failed that many times on
+	// every worker that is still being sent tiles, so tiles that only fail
+	// on dead workers are finished by the others. If it is 0, it is 3.
+	MaxAttempts int
+	// MaxWorkerFailures is the number of times in a row a worker can fail
+	// before it is sent no more tiles. If it is 0, it is 3.
+	MaxWorkerFailures int
+	// TileTimeout is how long a worker has to render a tile. Tiles that
+	// take longer fail, and are retried like any other failed tile. If it
+	// is 0, it is 5 minutes.
+	TileTimeout time.Duration
+	// Dir is the directory relative file names in the program, like
+	// environment maps, are resolved against when the program is run
+	// locally. Workers resolve them against their own directory (see
+	// WorkerOptions.Dir). If it is empty, the working directory is used.
+	Dir string
+}
+
+type tileJob struct {
+	tile image.Rectangle
+	// attempts is the number of times the tile failed on each worker, by
+	// index in Workers.
+	attempts []int
+}
+
+// Render renders the GML program, which must not use #include, on the
+// workers and returns the assembled image.
+func (c *Coordinator) Render(ctx context.Context, program string) (*image.RGBA, error) {
+	if len(c.Workers) == 0 {
+		return nil, errors.New("no workers to render on")
+	}
+	// Running the program locally finds the size of the image, and any
+	// errors in the program, before anything is sent to the workers.
+	scene, err := raytracer.ParseGMLSceneInDir(program, c.Dir)
+	if err != nil {
+		return nil, err
+	}
+	img := image.NewRGBA(image.Rect(0, 0, scene.WidthPx, scene.HeightPx))
+	tiles := c.tiles(img.Bounds())
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	// Failed tiles are put back on the queue, which has room for all of
+	// them so that workers never block.
+	queue := make(chan tileJob, len(tiles))
+	for _, tile := range tiles {
+		queue <- tileJob{tile: tile}
+	}
+	var tilesLeft sync.WaitGroup
+	tilesLeft.Add(len(tiles))
+	errs := make(chan error, len(c.Workers))
+
+	// inUse is whether each worker is still being sent tiles.
+	var mu sync.Mutex
+	inUse := make([]bool, len(c.Workers))
+	for i := range inUse {
+		inUse[i] = true
+	}
+	exhausted := func(job *tileJob) bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for i, ok := range inUse {
+			if ok && job.attempts[i] < c.maxAttempts() {
+				return false
+			}
+		}
+		return true
+	}
+
+	var workers sync.WaitGroup
+	for i, addr := range c.Workers {
+		workers.Add(1)
+		go func() {
+			defer workers.Done()
+			failures := 0
+			for {
+				var job tileJob
+				select {
+				case <-ctx.Done():
+					return
+				case job = <-queue:
+				}
+
+				err := c.renderTile(ctx, workerURL(addr), program, img, job.tile)
+				if err == nil {
+					failures = 0
+					tilesLeft.Done()
+					continue
+				}
+				if ctx.Err() != nil {
+					return
+				}
+				if job.attempts == nil {
+					job.attempts = make([]int, len(c.Workers))
+				}
+				job.attempts[i]++
+				failures++
+				if failures >= c.maxWorkerFailures() {
+					mu.Lock()
+					inUse[i] = false
+					mu.Unlock()
+				}
+				if exhausted(&job) {
+					errs <- fmt.Errorf("tile %v failed on every worker, last on %s: %w", job.tile, addr, err)
+					return
+				}
+				log.Printf("WARN: tile %v failed on %s, retrying: %v\n", job.tile, addr, err)
+				queue <- job
+				if failures >= c.maxWorkerFailures() {
+					log.Printf("WARN: %s failed %d times in a row, not sending it any more tiles\n", addr, failures)
+					return
+				}
+			}
+		}()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		tilesLeft.Wait()
+		close(done)
+	}()
+	allWorkersFailed := make(chan struct{})
+	go func() {
+		workers.Wait()
+		close(allWorkersFailed)
+	}()
+
+	select {
+	case <-done:
+		return img, nil
+	case err := <-errs:
+		return nil, err
+	case <-allWorkersFailed:
+		select {
+		case <-done:
+			return img, nil
+		case err := <-errs:
+			return nil, err
+		default:
+			return nil, errors.New("all workers failed")
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (c *Coordinator) tiles(bounds image.Rectangle) []image.Rectangle {
+	size := c.TileSize
+	if size <= 0 {
+		size = 64
+	}
+	var tiles []image.Rectangle
+	for y := bounds.Min.Y; y < bounds.Max.Y; y += size {
+		for x := bounds.Min.X; x < bounds.Max.X; x += size {
+			tiles = append(tiles, image.Rect(x, y, x+size, y+size).Intersect(bounds))
+		}
+	}
+	return tiles
+}
+
+func (c *Coordinator) maxAttempts() int {
+	if c.MaxAttempts <= 0 {
+		return 3
+	}
+	return c.MaxAttempts
+}
+
+func (c *Coordinator) tileTimeout() time.Duration {
+	if c.TileTimeout <= 0 {
+		return 5 * time.Minute
+	}
+	return c.TileTimeout
+}
+
+func (c *Coordinator) maxWorkerFailures() int {
+	if c.MaxWorkerFailures <= 0 {
+		return 3
+	}
+	return c.MaxWorkerFailures
+}
+
+func workerURL(addr string) string {
+	if !strings.Contains(addr, "://") {
+		addr = "http://" + addr
+	}
+	return strings.TrimSuffix(addr, "/") + "/tile"
+}
+
+// renderTile has the worker at url render the tile, and copies it into img.
+// Workers render distinct tiles, so they can copy into img concurrently.
+func (c *Coordinator) renderTile(ctx context.Context, url, program string, img *image.RGBA, tile image.Rectangle) error {
+	body, err := json.Marshal(&tileRequest{Program: program, Tile: tile})
+	if err != nil {
+		return err
+	}
+	tileCtx, cancel := context.WithTimeout(ctx, c.tileTimeout())
+	defer cancel()
+	req, err := http.NewRequestWithContext(tileCtx, http.MethodPost, url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	client := c.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return c.tileError(tileCtx, err)
+	}
+	defer resp.Body.Close()
+	pix, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return c.tileError(tileCtx, err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", resp.Status, strings.TrimSpace(string(pix)))
+	}
+
+	rowBytes := 4 * tile.Dx()
+	if len(pix) != rowBytes*tile.Dy() {
+		return fmt.Errorf("got %d bytes for tile %v, want %d", len(pix), tile, rowBytes*tile.Dy())
+	}
+	for y := tile.Min.Y; y < tile.Max.Y; y++ {
+		row := pix[(y-tile.Min.Y)*rowBytes:][:rowBytes]
+		copy(img.Pix[img.PixOffset(tile.Min.X, y):], row)
+	}
+	return nil
+}
+
+// tileError returns err, or a clearer error if the tile timed out.
+func (c *Coordinator) tileError(tileCtx context.Context, err error) error {
+	if errors.Is(tileCtx.Err(), context.DeadlineExceeded) {
+		return fmt.Errorf("tile took longer than %v", c.tileTimeout())
+	}
+	return err
+}
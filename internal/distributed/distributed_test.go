@@ -0,0 +1,243 @@
+package distributed
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"image"
+	"image/png"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/timdestan/go-raytracer"
+)
+
+// workerModeEnv makes the test binary run as a worker process instead of
+// running the tests. Its value is the mode of the worker.
+const workerModeEnv = "DISTRIBUTED_TEST_WORKER"
+
+func TestMain(m *testing.M) {
+	if mode := os.Getenv(workerModeEnv); mode != "" {
+		runTestWorker(mode)
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// runTestWorker serves tiles on a free port, which it prints on stdout.
+//
+// In "broken" mode, every request fails. In "flaky" mode, every other
+// request fails. In "hung" mode, requests never get a reply.
+func runTestWorker(mode string) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	fmt.Println(ln.Addr())
+
+	var handler http.Handler = NewWorker(WorkerOptions{})
+	var requests atomic.Int64
+	switch mode {
+	case "broken":
+		handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			http.Error(rw, "broken", http.StatusInternalServerError)
+		})
+	case "hung":
+		handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			<-r.Context().Done()
+		})
+	case "flaky":
+		worker := handler
+		handler = http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			if requests.Add(1)%2 == 0 {
+				http.Error(rw, "flaky", http.StatusInternalServerError)
+				return
+			}
+			worker.ServeHTTP(rw, r)
+		})
+	}
+	http.Serve(ln, handler)
+}
+
+// startWorker starts a worker process in the given mode, and returns its
+// address and the process, which is killed when the test ends.
+func startWorker(t *testing.T, mode string) (string, *os.Process) {
+	t.Helper()
+	cmd := exec.Command(os.Args[0], "-test.run=^$")
+	cmd.Env = append(os.Environ(), workerModeEnv+"="+mode)
+	cmd.Stderr = os.Stderr
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmd.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		cmd.Process.Kill()
+		cmd.Wait()
+	})
+	addr, err := bufio.NewReader(stdout).ReadString('\n')
+	if err != nil {
+		t.Fatalf("reading worker address: %v", err)
+	}
+	return addr[:len(addr)-1], cmd.Process
+}
+
+const testProgram = `
+	{ /v /u /face u v 0.5 point 1.0 0.3 1.0 } sphere 0.0 0.0 4.0 translate
+	{ /v /u /face 0.5 0.5 0.5 point 1.0 0.0 1.0 } plane 0.0 -1.0 0.0 translate
+	union /scene
+	0.2 0.2 0.2 point [ 0.0 5.0 0.0 point 1.0 1.0 1.0 point pointlight ]
+	scene 3 90.0 70 50 "out.ppm" 0.05 4.0 renderWithLens`
+
+func renderLocally(t *testing.T) []byte {
+	t.Helper()
+	img, err := raytracer.ParseAndRenderGML(testProgram)
+	if err != nil {
+		t.Fatalf("ParseAndRenderGML: %v", err)
+	}
+	return img.(*image.RGBA).Pix
+}
+
+func TestRenderOnWorkers(t *testing.T) {
+	var workers []string
+	for range 3 {
+		addr, _ := startWorker(t, "ok")
+		workers = append(workers, addr)
+	}
+	c := &Coordinator{Workers: workers, TileSize: 16}
+	got, err := c.Render(context.Background(), testProgram)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if !bytes.Equal(got.Pix, renderLocally(t)) {
+		t.Error("image rendered on workers differs from the image rendered locally")
+	}
+}
+
+func TestRenderRetriesFailedTiles(t *testing.T) {
+	ok, _ := startWorker(t, "ok")
+	flaky, _ := startWorker(t, "flaky")
+	broken, _ := startWorker(t, "broken")
+	dead, process := startWorker(t, "ok")
+	process.Kill()
+
+	// With the default settings, tiles that fail on the broken and dead
+	// workers are finished by the others.
+	c := &Coordinator{Workers: []string{ok, flaky, broken, dead}, TileSize: 16}
+	got, err := c.Render(context.Background(), testProgram)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if !bytes.Equal(got.Pix, renderLocally(t)) {
+		t.Error("image rendered on workers differs from the image rendered locally")
+	}
+}
+
+func TestRenderRetriesTilesBetweenDeadWorkers(t *testing.T) {
+	ok, _ := startWorker(t, "ok")
+	broken, _ := startWorker(t, "broken")
+	dead, process := startWorker(t, "ok")
+	process.Kill()
+
+	// The only tile can fail on the broken and dead workers more than
+	// MaxAttempts times in all before the working worker gets it.
+	c := &Coordinator{Workers: []string{broken, dead, ok}, TileSize: 128}
+	got, err := c.Render(context.Background(), testProgram)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if !bytes.Equal(got.Pix, renderLocally(t)) {
+		t.Error("image rendered on workers differs from the image rendered locally")
+	}
+}
+
+func TestRenderRetriesTimedOutTiles(t *testing.T) {
+	hung, _ := startWorker(t, "hung")
+	ok, _ := startWorker(t, "ok")
+
+	c := &Coordinator{Workers: []string{hung, ok}, TileSize: 16, TileTimeout: 100 * time.Millisecond}
+	got, err := c.Render(context.Background(), testProgram)
+	if err != nil {
+		t.Fatalf("Render: %v", err)
+	}
+	if !bytes.Equal(got.Pix, renderLocally(t)) {
+		t.Error("image rendered on workers differs from the image rendered locally")
+	}
+}
+
+func TestRenderFailsWithoutWorkingWorkers(t *testing.T) {
+	broken, _ := startWorker(t, "broken")
+	c := &Coordinator{Workers: []string{broken}, TileSize: 16}
+	if _, err := c.Render(context.Background(), testProgram); err == nil {
+		t.Error("Render succeeded with only a broken worker, want an error")
+	}
+}
+
+func TestRenderInvalidProgram(t *testing.T) {
+	c := &Coordinator{Workers: []string{"127.0.0.1:1"}}
+	if _, err := c.Render(context.Background(), "1 2 addi"); err == nil {
+		t.Error("Render succeeded for a program that renders nothing, want an error")
+	}
+}
+
+func TestWorkerLimits(t *testing.T) {
+	dir := t.TempDir()
+	envMap := image.NewRGBA(image.Rect(0, 0, 4, 2))
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, envMap); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "env.png"), buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	outside := filepath.Join(t.TempDir(), "outside.png")
+	if err := os.WriteFile(outside, buf.Bytes(), 0o644); err != nil {
+		t.Fatal(err)
+	}
+
+	const scene = `{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere 0.0 0.0 3.0 translate /scene
+		0.2 0.2 0.2 point [ ] scene 1 90.0 `
+	withEnvMap := func(file string) string {
+		return scene + fmt.Sprintf(`8 8 "out.ppm" %q 0.0 1.0 renderWithEnvMap`, file)
+	}
+	for _, tt := range []struct {
+		name    string
+		opts    WorkerOptions
+		program string
+		want    int
+	}{
+		{"ok", WorkerOptions{}, scene + `8 8 "out.ppm" render`, http.StatusOK},
+		{"include", WorkerOptions{}, `#include "lib.gml"` + "\n" + scene + `8 8 "out.ppm" render`, http.StatusBadRequest},
+		{"too many pixels", WorkerOptions{MaxPixels: 50}, scene + `8 8 "out.ppm" render`, http.StatusBadRequest},
+		{"too long", WorkerOptions{MaxRequestBytes: 64}, scene + `8 8 "out.ppm" render`, http.StatusRequestEntityTooLarge},
+		{"env map in dir", WorkerOptions{Dir: dir}, withEnvMap("env.png"), http.StatusOK},
+		{"env map without dir", WorkerOptions{}, withEnvMap("env.png"), http.StatusBadRequest},
+		{"absolute env map", WorkerOptions{Dir: dir}, withEnvMap(outside), http.StatusBadRequest},
+		{"env map outside dir", WorkerOptions{Dir: dir}, withEnvMap(filepath.Join("..", filepath.Base(filepath.Dir(outside)), "outside.png")), http.StatusBadRequest},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			body, err := json.Marshal(&tileRequest{Program: tt.program, Tile: image.Rect(0, 0, 4, 4)})
+			if err != nil {
+				t.Fatal(err)
+			}
+			rec := httptest.NewRecorder()
+			NewWorker(tt.opts).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/tile", bytes.NewReader(body)))
+			if rec.Code != tt.want {
+				t.Errorf("got status %d (%s), want %d", rec.Code, strings.TrimSpace(rec.Body.String()), tt.want)
+			}
+		})
+	}
+}
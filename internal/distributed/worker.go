@@ -0,0 +1,134 @@
+// Package distributed splits a render across worker processes, which may be
+// on other machines.
+//
+// The coordinator sends each worker the whole GML program, with includes
+// resolved, and a tile to render in an HTTP POST to /tile. Workers may be
+// sent programs by anyone who can reach them, so they don't read includes,
+// and only read other files, like environment maps, from their own
+// directory. The worker
+// replies with the tile's RGBA pixels. Requests are independent of each
+// other, so a tile that fails can be retried on any worker. Since pixels
+// are sampled the same way wherever they are rendered, the assembled image
+// is identical to one rendered in a single process.
+package distributed
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image"
+	"net/http"
+	"sync"
+
+	"github.com/timdestan/go-raytracer"
+)
+
+// tileRequest is the body of a request to render a tile.
+type tileRequest struct {
+	Program string          `json:"program"`
+	Tile    image.Rectangle `json:"tile"`
+}
+
+// WorkerOptions configures a Worker. Zero fields get the defaults given
+// below.
+type WorkerOptions struct {
+	// Dir is the directory programs can read files from, such as
+	// environment maps. Relative file names are resolved against it, and
+	// other names are errors. If it is empty, programs can't read files.
+	Dir string
+	// MaxRequestBytes is the largest request accepted. It is 16 MiB by
+	// default.
+	MaxRequestBytes int64
+	// MaxPixels is the most pixels an image can have. It is 4096*4096 by
+	// default.
+	MaxPixels int
+}
+
+// Worker is an http.Handler that renders tiles for a Coordinator.
+type Worker struct {
+	opts WorkerOptions
+	mux  *http.ServeMux
+
+	// mu serializes renders, each of which uses all of the worker's
+	// cores.
+	mu sync.Mutex
+	// A coordinator sends many tiles of the same program, so the scene
+	// for the last program is kept to avoid converting it for every tile.
+	programHash [sha256.Size]byte
+	scene       *raytracer.Scene
+}
+
+func NewWorker(opts WorkerOptions) *Worker {
+	if opts.MaxRequestBytes <= 0 {
+		opts.MaxRequestBytes = 16 << 20
+	}
+	if opts.MaxPixels <= 0 {
+		opts.MaxPixels = 4096 * 4096
+	}
+	w := &Worker{opts: opts, mux: http.NewServeMux()}
+	w.mux.HandleFunc("POST /tile", w.handleTile)
+	return w
+}
+
+func (w *Worker) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	w.mux.ServeHTTP(rw, r)
+}
+
+func (w *Worker) handleTile(rw http.ResponseWriter, r *http.Request) {
+	var req tileRequest
+	if err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, w.opts.MaxRequestBytes)).Decode(&req); err != nil {
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			http.Error(rw, fmt.Sprintf("request is longer than %d bytes", maxErr.Limit), http.StatusRequestEntityTooLarge)
+			return
+		}
+		http.Error(rw, fmt.Sprintf("decoding request: %v", err), http.StatusBadRequest)
+		return
+	}
+	img, err := w.renderTile(r.Context(), &req)
+	switch {
+	case errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded):
+		// The coordinator has gone away, or given up on the tile.
+		return
+	case err != nil:
+		http.Error(rw, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rw.Header().Set("Content-Type", "application/octet-stream")
+	rw.Write(img.Pix)
+}
+
+// renderTile renders the requested tile, returning an image with the
+// tile's bounds. The render stops if ctx is done.
+func (w *Worker) renderTile(ctx context.Context, req *tileRequest) (*image.RGBA, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if hash := sha256.Sum256([]byte(req.Program)); w.scene == nil || hash != w.programHash {
+		scene, err := raytracer.ParseGMLSceneWithOptions(req.Program, raytracer.RenderOptions{
+			NoIncludes: true,
+			NoFiles:    w.opts.Dir == "",
+			FilesDir:   w.opts.Dir,
+			MaxPixels:  w.opts.MaxPixels,
+		})
+		if err != nil {
+			return nil, err
+		}
+		w.scene, w.programHash = scene, hash
+	}
+
+	region := raytracer.Region{
+		X0: float64(req.Tile.Min.X), Y0: float64(req.Tile.Min.Y),
+		X1: float64(req.Tile.Max.X), Y1: float64(req.Tile.Max.Y),
+	}
+	if _, err := region.Pixels(w.scene.WidthPx, w.scene.HeightPx); err != nil {
+		return nil, err
+	}
+	w.scene.RenderOptions = raytracer.RenderOptions{Region: &region, Crop: true}
+	img, _, err := raytracer.RenderWithContext(ctx, w.scene)
+	if err != nil {
+		return nil, err
+	}
+	return img.(*image.RGBA), nil
+}
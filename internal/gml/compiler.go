@@ -0,0 +1,724 @@
+package gml
+
+import (
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"sync"
+
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+// This file implements a compiler from GML surface functions to native Go
+// closures.
+//
+// Evaluating a surface function in the interpreter means walking its tokens,
+// boxing every intermediate value, looking builtins up by name, and cloning
+// the environment for every closure call. Surface functions are run at every
+// ray hit, so this adds up.
+//
+// Surface functions are usually simple, so we can do much better: the types
+// of everything on the stack are known statically (face is an int, u and v
+// are reals), so we can type check the function once up front and then run
+// it on an unboxed stack machine. Variables become slots in a flat array,
+// captured variables become constants, and calls to known closures (via
+// apply and if) are inlined.
+//
+// Anything we can't handle (e.g. constructing scene objects, or calling
+// closures that aren't known at compile time) fails to compile, and we fall
+// back to the interpreter.
+//
+// Along the way, we track which of the arguments (face, u and v) each value
+// depends on. Surface functions whose result doesn't depend on u and v can
+// then be precomputed (see maybeSimplifySurfaceFn).
+
+// CompiledSurfaceFn is a surface function compiled to native code.
+//
+// It is safe to call concurrently from multiple goroutines.
+type CompiledSurfaceFn func(face int, u, v float64) (Material, error)
+
+var ErrNotCompilable = errors.New("surface function is not compilable")
+
+// maxInlineDepth bounds the nesting of inlined closures, since recursion
+// (by passing closures on the stack) can't be compiled.
+const maxInlineDepth = 32
+
+type cKind int
+
+const (
+	kInt cKind = iota
+	kReal
+	kBool
+	kPoint
+	kMaterial
+	kArray
+	// kClosure is a closure known at compile time. It takes up a stack slot
+	// at runtime, but the value in the slot is not used.
+	kClosure
+)
+
+// argSet is a set of surface function arguments.
+type argSet uint8
+
+const (
+	argFace argSet = 1 << iota
+	argU
+	argV
+)
+
+// cType is the static type of a value on the stack or in a variable.
+type cType struct {
+	kind cKind
+	// elem is the type of every element of an array, or nil if the elements
+	// have different types (in which case, the array can't be indexed).
+	elem *cType
+	// fn is the closure, for kClosure.
+	fn *closureLit
+	// deps is the set of arguments that the value may depend on.
+	deps argSet
+}
+
+// depsOf returns the union of the dependencies of the given types.
+func depsOf(ts []cType) argSet {
+	var deps argSet
+	for _, t := range ts {
+		deps |= t.deps
+	}
+	return deps
+}
+
+// equal reports whether the types are the same, ignoring dependencies.
+func (t cType) equal(other cType) bool {
+	if t.kind != other.kind || t.fn != other.fn {
+		return false
+	}
+	if t.elem == nil || other.elem == nil {
+		return t.elem == other.elem
+	}
+	return t.elem.equal(*other.elem)
+}
+
+// cValue is an unboxed value. Its type is known statically, so only the
+// field for that type is used.
+type cValue struct {
+	i   int // Also used for bools
+	f   float64
+	vec prim.Vec3
+	arr []Value
+	// mat is held by value, so that building a material in a surface
+	// function doesn't allocate.
+	mat Material
+}
+
+// closureLit is a closure known at compile time, along with the variables
+// it captured.
+type closureLit struct {
+	body  TokenList
+	scope scope
+}
+
+type local struct {
+	slot int
+	typ  cType
+}
+
+// scope maps variables to their storage: either a slot (for variables bound
+// in the compiled code) or a constant from the environment captured by the
+// original closure.
+type scope struct {
+	locals  map[int]local
+	closure *VClosure
+}
+
+func (s scope) clone() scope {
+	return scope{locals: maps.Clone(s.locals), closure: s.closure}
+}
+
+type op func(m *machine) error
+
+type machine struct {
+	stack  []cValue
+	sp     int
+	locals []cValue
+}
+
+func (m *machine) push(v cValue) {
+	m.stack[m.sp] = v
+	m.sp++
+}
+
+func run(m *machine, ops []op) error {
+	for _, o := range ops {
+		if err := o(m); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+type compiler struct {
+	stack    []cType
+	maxStack int
+	numSlots int
+	depth    int
+
+	// low is the lowest the stack has been since it was last reset, which
+	// tells us which stack entries an if branch may have changed.
+	low int
+	// fallible counts the compiled operations that may fail at runtime.
+	fallible int
+	// errDeps is the set of arguments that may determine whether the
+	// function fails.
+	errDeps argSet
+}
+
+// CompileSurfaceFn compiles the closure to native code, or returns an error
+// wrapping ErrNotCompilable if that's not possible.
+func CompileSurfaceFn(closure *VClosure) (CompiledSurfaceFn, error) {
+	fn, _, err := compileSurfaceFn(closure)
+	return fn, err
+}
+
+// compileSurfaceFn is like CompileSurfaceFn, but also returns the set of
+// arguments that the result may depend on.
+func compileSurfaceFn(closure *VClosure) (CompiledSurfaceFn, argSet, error) {
+	c := &compiler{
+		// Arguments: face u v
+		stack: []cType{{kind: kInt, deps: argFace}, {kind: kReal, deps: argU}, {kind: kReal, deps: argV}},
+	}
+	c.maxStack = len(c.stack)
+	c.low = len(c.stack)
+	ops, err := c.compileBody(closure.Code, scope{locals: map[int]local{}, closure: closure})
+	if err != nil {
+		return nil, 0, err
+	}
+	result, deps, err := c.compileResult()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	stackSize, numSlots := c.maxStack, c.numSlots
+	pool := sync.Pool{
+		New: func() any {
+			return &machine{
+				stack:  make([]cValue, stackSize),
+				locals: make([]cValue, numSlots),
+			}
+		},
+	}
+	return func(face int, u, v float64) (Material, error) {
+		m := pool.Get().(*machine)
+		defer pool.Put(m)
+		m.sp = 3
+		m.stack[0] = cValue{i: face}
+		m.stack[1] = cValue{f: u}
+		m.stack[2] = cValue{f: v}
+		if err := run(m, ops); err != nil {
+			return Material{}, err
+		}
+		return result(m), nil
+	}, deps | c.errDeps, nil
+}
+
+func notCompilable(token TokenGroup, format string, args ...any) error {
+	return errorAt(token.Position(), "%w: %s", ErrNotCompilable, fmt.Sprintf(format, args...))
+}
+
+// compileResult checks that the stack has the shape expected by
+// EvalSurfaceFn, and returns a function to extract the material along with
+// the arguments it depends on.
+func (c *compiler) compileResult() (func(m *machine) Material, argSet, error) {
+	n := len(c.stack)
+	if n >= 1 && c.stack[n-1].kind == kMaterial {
+		return func(m *machine) Material {
+			return m.stack[m.sp-1].mat
+		}, c.stack[n-1].deps, nil
+	}
+	// color kd ks n
+	if n >= 4 && c.stack[n-4].kind == kPoint && c.stack[n-3].kind == kReal &&
+		c.stack[n-2].kind == kReal && c.stack[n-1].kind == kReal {
+		return func(m *machine) Material {
+			s := m.stack[m.sp-4 : m.sp]
+			return Material{
+				Color:            s[0].vec,
+				Kd:               s[1].f,
+				Ks:               s[2].f,
+				SpecularExponent: s[3].f,
+				Reflectivity:     s[2].f,
+			}
+		}, depsOf(c.stack[n-4:]), nil
+	}
+	return nil, 0, fmt.Errorf("%w: unexpected result types %v", ErrNotCompilable, c.stack)
+}
+
+func (c *compiler) push(t cType) {
+	c.stack = append(c.stack, t)
+	c.maxStack = max(c.maxStack, len(c.stack))
+}
+
+// pop pops the given kinds off the compile-time stack, with the last kind
+// on the top of the stack.
+func (c *compiler) pop(token TokenGroup, kinds ...cKind) ([]cType, error) {
+	n := len(kinds)
+	if len(c.stack) < n {
+		return nil, notCompilable(token, "stack underflow")
+	}
+	popped := c.stack[len(c.stack)-n:]
+	for i, k := range kinds {
+		if popped[i].kind != k {
+			return nil, notCompilable(token, "type mismatch")
+		}
+	}
+	c.stack = c.stack[:len(c.stack)-n]
+	c.low = min(c.low, len(c.stack))
+	return popped, nil
+}
+
+func (c *compiler) compileBody(body TokenList, sc scope) ([]op, error) {
+	c.depth++
+	defer func() { c.depth-- }()
+	if c.depth > maxInlineDepth {
+		return nil, fmt.Errorf("%w: closures nested too deeply", ErrNotCompilable)
+	}
+
+	var ops []op
+	for _, token := range body {
+		o, err := c.compileToken(token, sc)
+		if err != nil {
+			return nil, err
+		}
+		if o != nil {
+			ops = append(ops, o)
+		}
+	}
+	return ops, nil
+}
+
+func (c *compiler) compileToken(token TokenGroup, sc scope) (op, error) {
+	switch token := token.(type) {
+	case *IntLiteral:
+		c.push(cType{kind: kInt})
+		v := cValue{i: int(token.Value)}
+		return func(m *machine) error { m.push(v); return nil }, nil
+	case *FloatLiteral:
+		c.push(cType{kind: kReal})
+		v := cValue{f: token.Value}
+		return func(m *machine) error { m.push(v); return nil }, nil
+	case *BoolLiteral:
+		c.push(cType{kind: kBool})
+		v := cValue{i: boolToInt(token.Value)}
+		return func(m *machine) error { m.push(v); return nil }, nil
+	case *Function:
+		c.push(cType{kind: kClosure, fn: &closureLit{body: token.Body, scope: sc.clone()}})
+		return pushPlaceholder, nil
+	case *Binder:
+		if len(c.stack) == 0 {
+			return nil, notCompilable(token, "stack underflow")
+		}
+		t := c.stack[len(c.stack)-1]
+		c.stack = c.stack[:len(c.stack)-1]
+		c.low = min(c.low, len(c.stack))
+		// Every binding gets a fresh slot, so that closures that captured
+		// an earlier binding of the same name are unaffected.
+		slot := c.numSlots
+		c.numSlots++
+		sc.locals[token.ID] = local{slot: slot, typ: t}
+		return func(m *machine) error {
+			m.sp--
+			m.locals[slot] = m.stack[m.sp]
+			return nil
+		}, nil
+	case *Identifier:
+		if b := builtins[token.Name]; b != nil {
+			return c.compileBuiltin(token, sc)
+		}
+		if l, ok := sc.locals[token.ID]; ok {
+			c.push(l.typ)
+			slot := l.slot
+			return func(m *machine) error { m.push(m.locals[slot]); return nil }, nil
+		}
+		if val := sc.closure.captured(token.ID); val != nil {
+			t, v, err := constantValue(val)
+			if err != nil {
+				return nil, notCompilable(token, "%s: %v", token.Name, err)
+			}
+			c.push(t)
+			return func(m *machine) error { m.push(v); return nil }, nil
+		}
+		return nil, notCompilable(token, "unbound identifier %s", token.Name)
+	default:
+		return nil, notCompilable(token, "unsupported token %s", TokenGroupDebugString(token))
+	}
+}
+
+func pushPlaceholder(m *machine) error {
+	m.sp++
+	return nil
+}
+
+func boolToInt(b bool) int {
+	if b {
+		return 1
+	}
+	return 0
+}
+
+// constantValue converts a captured value from the environment.
+func constantValue(val Value) (cType, cValue, error) {
+	switch val := val.(type) {
+	case VInt:
+		return cType{kind: kInt}, cValue{i: int(val)}, nil
+	case VReal:
+		return cType{kind: kReal}, cValue{f: float64(val)}, nil
+	case VBool:
+		return cType{kind: kBool}, cValue{i: boolToInt(bool(val))}, nil
+	case *prim.Vec3:
+		return cType{kind: kPoint}, cValue{vec: *val}, nil
+	case Material:
+		return cType{kind: kMaterial}, cValue{mat: val}, nil
+	case VArray:
+		t, err := arrayType(val)
+		if err != nil {
+			return cType{}, cValue{}, err
+		}
+		return t, cValue{arr: val.Elements}, nil
+	case VClosure:
+		lit := &closureLit{
+			body:  val.Code,
+			scope: scope{locals: map[int]local{}, closure: &val},
+		}
+		return cType{kind: kClosure, fn: lit}, cValue{}, nil
+	default:
+		return cType{}, cValue{}, fmt.Errorf("unsupported value type %T", val)
+	}
+}
+
+// arrayType infers the type of an array from its elements.
+func arrayType(arr VArray) (cType, error) {
+	var elem *cType
+	for i, e := range arr.Elements {
+		if _, ok := e.(VClosure); ok {
+			return cType{}, errors.New("arrays of closures are not supported")
+		}
+		t, _, err := constantValue(e)
+		if err != nil {
+			return cType{}, err
+		}
+		if i == 0 {
+			elem = &t
+		} else if !elem.equal(t) {
+			// Heterogeneous arrays can still be passed around, but not
+			// indexed.
+			return cType{kind: kArray}, nil
+		}
+	}
+	return cType{kind: kArray, elem: elem}, nil
+}
+
+func (c *compiler) compileBuiltin(token *Identifier, sc scope) (op, error) {
+	realBinOp := func(f func(a, b float64) float64) (op, error) {
+		popped, err := c.pop(token, kReal, kReal)
+		if err != nil {
+			return nil, err
+		}
+		c.push(cType{kind: kReal, deps: depsOf(popped)})
+		return func(m *machine) error {
+			m.sp--
+			m.stack[m.sp-1].f = f(m.stack[m.sp-1].f, m.stack[m.sp].f)
+			return nil
+		}, nil
+	}
+	intBinOp := func(f func(a, b int) int) (op, error) {
+		popped, err := c.pop(token, kInt, kInt)
+		if err != nil {
+			return nil, err
+		}
+		c.push(cType{kind: kInt, deps: depsOf(popped)})
+		return func(m *machine) error {
+			m.sp--
+			m.stack[m.sp-1].i = f(m.stack[m.sp-1].i, m.stack[m.sp].i)
+			return nil
+		}, nil
+	}
+	realCmp := func(f func(a, b float64) bool) (op, error) {
+		popped, err := c.pop(token, kReal, kReal)
+		if err != nil {
+			return nil, err
+		}
+		c.push(cType{kind: kBool, deps: depsOf(popped)})
+		return func(m *machine) error {
+			m.sp--
+			m.stack[m.sp-1] = cValue{i: boolToInt(f(m.stack[m.sp-1].f, m.stack[m.sp].f))}
+			return nil
+		}, nil
+	}
+	intCmp := func(f func(a, b int) bool) (op, error) {
+		popped, err := c.pop(token, kInt, kInt)
+		if err != nil {
+			return nil, err
+		}
+		c.push(cType{kind: kBool, deps: depsOf(popped)})
+		return func(m *machine) error {
+			m.sp--
+			m.stack[m.sp-1] = cValue{i: boolToInt(f(m.stack[m.sp-1].i, m.stack[m.sp].i))}
+			return nil
+		}, nil
+	}
+	realUnOp := func(f func(a float64) float64) (op, error) {
+		popped, err := c.pop(token, kReal)
+		if err != nil {
+			return nil, err
+		}
+		c.push(cType{kind: kReal, deps: depsOf(popped)})
+		return func(m *machine) error {
+			m.stack[m.sp-1].f = f(m.stack[m.sp-1].f)
+			return nil
+		}, nil
+	}
+	getComponent := func(f func(v prim.Vec3) float64) (op, error) {
+		popped, err := c.pop(token, kPoint)
+		if err != nil {
+			return nil, err
+		}
+		c.push(cType{kind: kReal, deps: depsOf(popped)})
+		return func(m *machine) error {
+			m.stack[m.sp-1] = cValue{f: f(m.stack[m.sp-1].vec)}
+			return nil
+		}, nil
+	}
+
+	switch token.Name {
+	case "addf":
+		return realBinOp(func(a, b float64) float64 { return a + b })
+	case "subf":
+		return realBinOp(func(a, b float64) float64 { return a - b })
+	case "mulf":
+		return realBinOp(func(a, b float64) float64 { return a * b })
+	case "divf":
+		return realBinOp(func(a, b float64) float64 { return a / b })
+	case "addi":
+		return intBinOp(func(a, b int) int { return a + b })
+	case "subi":
+		return intBinOp(func(a, b int) int { return a - b })
+	case "muli":
+		return intBinOp(func(a, b int) int { return a * b })
+	case "divi":
+		return intBinOp(func(a, b int) int { return a / b })
+	case "modi":
+		return intBinOp(func(a, b int) int { return a % b })
+	case "eqf":
+		return realCmp(func(a, b float64) bool { return a == b })
+	case "lessf":
+		return realCmp(func(a, b float64) bool { return a < b })
+	case "eqi":
+		return intCmp(func(a, b int) bool { return a == b })
+	case "lessi":
+		return intCmp(func(a, b int) bool { return a < b })
+	case "negf":
+		return realUnOp(func(a float64) float64 { return -a })
+	case "sqrt":
+		return realUnOp(math.Sqrt)
+	case "sin":
+		return realUnOp(func(a float64) float64 { return math.Sin(DEG_TO_RAD * a) })
+	case "cos":
+		return realUnOp(func(a float64) float64 { return math.Cos(DEG_TO_RAD * a) })
+	case "frac":
+		return realUnOp(func(a float64) float64 { return a - float64(int(a)) })
+	case "clampf":
+		return realUnOp(func(a float64) float64 {
+			if a < 0 {
+				return 0
+			} else if a > 1 {
+				return 1
+			}
+			return a
+		})
+	case "negi":
+		popped, err := c.pop(token, kInt)
+		if err != nil {
+			return nil, err
+		}
+		c.push(cType{kind: kInt, deps: depsOf(popped)})
+		return func(m *machine) error {
+			m.stack[m.sp-1].i = -m.stack[m.sp-1].i
+			return nil
+		}, nil
+	case "floor":
+		popped, err := c.pop(token, kReal)
+		if err != nil {
+			return nil, err
+		}
+		c.push(cType{kind: kInt, deps: depsOf(popped)})
+		return func(m *machine) error {
+			m.stack[m.sp-1] = cValue{i: int(math.Floor(m.stack[m.sp-1].f))}
+			return nil
+		}, nil
+	case "getx":
+		return getComponent(func(v prim.Vec3) float64 { return v.X })
+	case "gety":
+		return getComponent(func(v prim.Vec3) float64 { return v.Y })
+	case "getz":
+		return getComponent(func(v prim.Vec3) float64 { return v.Z })
+	case "point":
+		popped, err := c.pop(token, kReal, kReal, kReal)
+		if err != nil {
+			return nil, err
+		}
+		c.push(cType{kind: kPoint, deps: depsOf(popped)})
+		return func(m *machine) error {
+			m.sp -= 2
+			s := m.stack[m.sp-1 : m.sp+2]
+			s[0] = cValue{vec: prim.Vec3{X: s[0].f, Y: s[1].f, Z: s[2].f}}
+			return nil
+		}, nil
+	case "material":
+		popped, err := c.pop(token, kPoint, kReal, kReal, kReal, kReal, kReal, kReal, kReal)
+		if err != nil {
+			return nil, err
+		}
+		c.push(cType{kind: kMaterial, deps: depsOf(popped)})
+		return func(m *machine) error {
+			m.sp -= 7
+			s := m.stack[m.sp-1 : m.sp+7]
+			s[0] = cValue{mat: Material{
+				Color:            s[0].vec,
+				Reflectivity:     s[1].f,
+				Fuzziness:        s[2].f,
+				Transparency:     s[3].f,
+				RefractiveIndex:  s[4].f,
+				Kd:               s[5].f,
+				Ks:               s[6].f,
+				SpecularExponent: s[7].f,
+			}}
+			return nil
+		}, nil
+	case "length":
+		popped, err := c.pop(token, kArray)
+		if err != nil {
+			return nil, err
+		}
+		c.push(cType{kind: kInt, deps: depsOf(popped)})
+		return func(m *machine) error {
+			m.stack[m.sp-1] = cValue{i: len(m.stack[m.sp-1].arr)}
+			return nil
+		}, nil
+	case "get":
+		popped, err := c.pop(token, kArray, kInt)
+		if err != nil {
+			return nil, err
+		}
+		elem := popped[0].elem
+		if elem == nil {
+			return nil, notCompilable(token, "indexing array of unknown type")
+		}
+		t := *elem
+		t.deps = depsOf(popped)
+		c.push(t)
+		// Whether the index is in bounds depends on the same arguments.
+		c.fallible++
+		c.errDeps |= t.deps
+		convert := elementConverter(*elem)
+		pos := token.Pos
+		return func(m *machine) error {
+			m.sp--
+			arr, i := m.stack[m.sp-1].arr, m.stack[m.sp].i
+			if i < 0 || i >= len(arr) {
+				return errorAt(pos, "%w: %d vs %d", ErrArrayIndexOutOfBounds, i, len(arr))
+			}
+			m.stack[m.sp-1] = convert(arr[i])
+			return nil
+		}, nil
+	case "apply":
+		popped, err := c.pop(token, kClosure)
+		if err != nil {
+			return nil, err
+		}
+		body, err := c.compileBody(popped[0].fn.body, popped[0].fn.scope.clone())
+		if err != nil {
+			return nil, err
+		}
+		return func(m *machine) error {
+			m.sp--
+			return run(m, body)
+		}, nil
+	case "if":
+		return c.compileIf(token)
+	default:
+		return nil, notCompilable(token, "unsupported builtin %s", token.Name)
+	}
+}
+
+// elementConverter returns a function to unbox array elements of the given
+// type.
+func elementConverter(t cType) func(Value) cValue {
+	switch t.kind {
+	case kInt:
+		return func(v Value) cValue { return cValue{i: int(v.(VInt))} }
+	case kReal:
+		return func(v Value) cValue { return cValue{f: float64(v.(VReal))} }
+	case kBool:
+		return func(v Value) cValue { return cValue{i: boolToInt(bool(v.(VBool)))} }
+	case kPoint:
+		return func(v Value) cValue { return cValue{vec: *v.(*prim.Vec3)} }
+	case kMaterial:
+		return func(v Value) cValue { return cValue{mat: v.(Material)} }
+	case kArray:
+		return func(v Value) cValue { return cValue{arr: v.(VArray).Elements} }
+	default:
+		panic(fmt.Sprintf("no element converter for kind %d", t.kind))
+	}
+}
+
+func (c *compiler) compileIf(token *Identifier) (op, error) {
+	popped, err := c.pop(token, kBool, kClosure, kClosure)
+	if err != nil {
+		return nil, err
+	}
+	cond, trueLit, falseLit := popped[0], popped[1].fn, popped[2].fn
+
+	// Both branches start from the same stack, and must leave the stack
+	// with the same types.
+	start := c.stack
+	low, fallible := c.low, c.fallible
+	c.stack = append([]cType(nil), start...)
+	c.low = len(start)
+	trueOps, err := c.compileBody(trueLit.body, trueLit.scope.clone())
+	if err != nil {
+		return nil, err
+	}
+	trueStack, trueLow := c.stack, c.low
+	c.stack = append([]cType(nil), start...)
+	c.low = len(start)
+	falseOps, err := c.compileBody(falseLit.body, falseLit.scope.clone())
+	if err != nil {
+		return nil, err
+	}
+	if len(trueStack) != len(c.stack) {
+		return nil, notCompilable(token, "if branches have different stack effects")
+	}
+	for i := range trueStack {
+		if !trueStack[i].equal(c.stack[i]) {
+			return nil, notCompilable(token, "if branches have different result types")
+		}
+	}
+
+	// Anything that either branch may have changed depends on the condition,
+	// as does whether a branch fails.
+	changed := min(trueLow, c.low)
+	for i := changed; i < len(c.stack); i++ {
+		c.stack[i].deps |= trueStack[i].deps | cond.deps
+	}
+	c.low = min(low, changed)
+	if c.fallible != fallible {
+		c.errDeps |= cond.deps
+	}
+
+	return func(m *machine) error {
+		m.sp -= 3
+		if m.stack[m.sp].i != 0 {
+			return run(m, trueOps)
+		}
+		return run(m, falseOps)
+	}, nil
+}
@@ -0,0 +1,380 @@
+package gml
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+// surfaceFns returns the surface functions of all objects in the scene.
+func surfaceFns(obj SceneObject) []VSurfaceFn {
+	switch obj := obj.(type) {
+	case *Sphere:
+		return []VSurfaceFn{obj.SurfaceFn}
+	case *Cube:
+		return []VSurfaceFn{obj.SurfaceFn}
+	case *Cylinder:
+		return []VSurfaceFn{obj.SurfaceFn}
+	case *Plane:
+		return []VSurfaceFn{obj.SurfaceFn}
+	case *Union:
+		var fns []VSurfaceFn
+		for _, o := range obj.Objects {
+			fns = append(fns, surfaceFns(o)...)
+		}
+		return fns
+	case *Instance:
+		return surfaceFns(obj.Prototype)
+	case *Motion:
+		return surfaceFns(obj.Start)
+	case *Difference:
+		return append(surfaceFns(obj.A), surfaceFns(obj.B)...)
+	default:
+		panic(fmt.Sprintf("unknown scene object type %T", obj))
+	}
+}
+
+// closureSurfaceFns evaluates the program in the given testdata file, and
+// returns the (non-constant) surface functions of everything rendered.
+func closureSurfaceFns(t testing.TB, name string) []*VClosure {
+	t.Helper()
+	var closures []*VClosure
+	st := NewEvalState()
+	st.Render = func(e *EvalState, args *RenderArgs) error {
+		for _, fn := range surfaceFns(args.Scene) {
+			if fn.Closure != nil {
+				closures = append(closures, fn.Closure)
+			}
+		}
+		return nil
+	}
+	if err := st.ParseAndEvalFile("testdata/" + name); err != nil {
+		t.Fatalf("ParseAndEvalFile(%s): %v", name, err)
+	}
+	return closures
+}
+
+func TestCompileSurfaceFnMatchesInterpreter(t *testing.T) {
+	for _, tt := range []struct {
+		file string
+		// wantCompiled is the number of surface functions we expect to be
+		// able to compile.
+		wantCompiled int
+	}{
+		{file: "sphere.gml", wantCompiled: 2},
+		{file: "cube.gml", wantCompiled: 1},
+		{file: "checked-cube.gml", wantCompiled: 1},
+		{file: "cylinder.gml", wantCompiled: 4},
+	} {
+		t.Run(tt.file, func(t *testing.T) {
+			compiled := 0
+			for _, closure := range closureSurfaceFns(t, tt.file) {
+				fn, err := CompileSurfaceFn(closure)
+				if errors.Is(err, ErrNotCompilable) {
+					t.Logf("not compilable: %v", err)
+					continue
+				}
+				if err != nil {
+					t.Fatalf("CompileSurfaceFn: %v", err)
+				}
+				compiled++
+
+				state := NewEvalState()
+				for face := range 6 {
+					for i := range 11 {
+						for j := range 11 {
+							u, v := float64(i)/10, float64(j)/10
+							want, wantErr := EvalSurfaceFn(face, u, v, state, &VSurfaceFn{Closure: closure})
+							got, gotErr := fn(face, u, v)
+							if (wantErr == nil) != (gotErr == nil) {
+								t.Fatalf("(%d, %v, %v): got error %v, want %v", face, u, v, gotErr, wantErr)
+							}
+							if diff := cmp.Diff(want, got); diff != "" {
+								t.Fatalf("(%d, %v, %v): mismatch (-want +got):\n%s", face, u, v, diff)
+							}
+						}
+					}
+				}
+			}
+			if compiled != tt.wantCompiled {
+				t.Errorf("compiled %d surface functions, want %d", compiled, tt.wantCompiled)
+			}
+		})
+	}
+}
+
+func TestCompileSurfaceFn(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		program string
+		want    Material
+	}{
+		{
+			name:    "color kd ks n",
+			program: `{ /v /u /face u v 0.5 point 1.0 0.5 2.0 }`,
+			want:    Material{Color: prim.RGB(0.25, 0.75, 0.5), Kd: 1.0, Ks: 0.5, Reflectivity: 0.5, SpecularExponent: 2.0},
+		},
+		{
+			name:    "material",
+			program: `{ /v /u /face 1.0 0.0 0.0 point 0.1 0.2 0.3 1.5 0.4 0.5 6.0 material }`,
+			want: Material{
+				Color: prim.RGB(1, 0, 0), Reflectivity: 0.1, Fuzziness: 0.2, Transparency: 0.3,
+				RefractiveIndex: 1.5, Kd: 0.4, Ks: 0.5, SpecularExponent: 6.0,
+			},
+		},
+		{
+			name: "captured values",
+			program: `0.5 /half 3 /three [ 1.0 2.0 ] /arr
+				{ /v /u /face
+				  half three 2 modi 1 eqi { 1.0 } { 0.0 } if 0.0 point
+				  arr 0 get 0.0 half }`,
+			want: Material{Color: prim.RGB(0.5, 1, 0), Kd: 1.0, Ks: 0.0, SpecularExponent: 0.5},
+		},
+		{
+			name: "inlined closures",
+			program: `{ /x x x mulf } /sq
+				{ /v /u /face
+				  u sq apply /u2
+				  { /y y 2.0 mulf } /double
+				  u2 double apply v double apply 0.0 point
+				  1.0 0.0 1.0 }`,
+			want: Material{Color: prim.RGB(0.125, 1.5, 0), Kd: 1.0, Ks: 0.0, SpecularExponent: 1.0},
+		},
+		{
+			name: "rebinding",
+			program: `{ /v /u /face
+				  1.0 /x
+				  { x } /f
+				  2.0 /x
+				  f apply x 0.0 point 1.0 0.0 1.0 }`,
+			want: Material{Color: prim.RGB(1, 2, 0), Kd: 1.0, Ks: 0.0, SpecularExponent: 1.0},
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			st := NewEvalState()
+			if err := st.ParseAndEval(tt.program); err != nil {
+				t.Fatalf("ParseAndEval: %v", err)
+			}
+			closure, err := PopValue[VClosure](st)
+			if err != nil {
+				t.Fatalf("PopValue: %v", err)
+			}
+			fn, err := CompileSurfaceFn(&closure)
+			if err != nil {
+				t.Fatalf("CompileSurfaceFn: %v", err)
+			}
+			got, err := fn(0, 0.25, 0.75)
+			if err != nil {
+				t.Fatalf("compiled surface fn: %v", err)
+			}
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestCompileSurfaceFnNotCompilable(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		program string
+	}{
+		{"array of closures", `[ { 1.0 } ] /arr { /v /u /face arr 0 get apply 0.0 0.0 point 1.0 0.0 1.0 }`},
+		{"scene objects", `{ /v /u /face { } sphere 1.0 0.0 1.0 }`},
+		{"if branch types differ", `{ /v /u /face true { 1 } { 1.0 } if 0.0 0.0 point 1.0 0.0 1.0 }`},
+		{"type mismatch", `{ /v /u /face u v addi 0.0 0.0 point 1.0 0.0 1.0 }`},
+		{"bad result", `{ /v /u /face 1.0 }`},
+		{"unbound", `{ /v /u /face nope 1.0 0.0 1.0 }`},
+		{"recursion", `{ /v /u /face { /self self self apply } /f f f apply }`},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			st := NewEvalState()
+			if err := st.ParseAndEval(tt.program); err != nil {
+				t.Fatalf("ParseAndEval: %v", err)
+			}
+			closure, err := PopValue[VClosure](st)
+			if err != nil {
+				t.Fatalf("PopValue: %v", err)
+			}
+			if _, err := CompileSurfaceFn(&closure); !errors.Is(err, ErrNotCompilable) {
+				t.Errorf("CompileSurfaceFn error = %v, want %v", err, ErrNotCompilable)
+			}
+		})
+	}
+}
+
+func TestCompileSurfaceFnIndexOutOfBounds(t *testing.T) {
+	st := NewEvalState()
+	if err := st.ParseAndEval(`[ 1.0 ] /arr { /v /u /face arr face get 0.0 0.0 point 1.0 0.0 1.0 }`); err != nil {
+		t.Fatalf("ParseAndEval: %v", err)
+	}
+	closure, err := PopValue[VClosure](st)
+	if err != nil {
+		t.Fatalf("PopValue: %v", err)
+	}
+	fn, err := CompileSurfaceFn(&closure)
+	if err != nil {
+		t.Fatalf("CompileSurfaceFn: %v", err)
+	}
+	if _, err := fn(0, 0, 0); err != nil {
+		t.Errorf("face 0: unexpected error %v", err)
+	}
+	if _, err := fn(1, 0, 0); !errors.Is(err, ErrArrayIndexOutOfBounds) {
+		t.Errorf("face 1: error = %v, want %v", err, ErrArrayIndexOutOfBounds)
+	}
+}
+
+func BenchmarkEvalSurfaceFn(b *testing.B) {
+	// The checkerboard plane from cube.gml, which indexes into a captured
+	// texture via an inlined helper closure.
+	closures := closureSurfaceFns(b, "cube.gml")
+	if len(closures) != 1 {
+		b.Fatalf("got %d surface functions, want 1", len(closures))
+	}
+	closure := closures[0]
+	compiled, err := CompileSurfaceFn(closure)
+	if err != nil {
+		b.Fatalf("CompileSurfaceFn: %v", err)
+	}
+
+	for _, bb := range []struct {
+		name string
+		fn   VSurfaceFn
+	}{
+		{"interpreted", VSurfaceFn{Closure: closure}},
+		{"compiled", VSurfaceFn{Closure: closure, Compiled: compiled}},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			state := NewEvalState()
+			for b.Loop() {
+				if _, err := EvalSurfaceFn(1, 0.3, 0.7, state, &bb.fn); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func TestCompileSurfaceFnDeps(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		program string
+		want    argSet
+	}{
+		{"constant", `{ /v /u /face 1.0 0.0 0.0 point 1.0 0.0 1.0 }`, 0},
+		{"arguments left on stack", `{ 1.0 0.0 0.0 point 1.0 0.0 1.0 }`, 0},
+		{"argument consumed from stack", `{ /v 0.0 0.0 point 1.0 0.0 1.0 }`, argU},
+		{"captured constants", `0.5 /half { /v /u /face half half half point 1.0 0.0 half }`, 0},
+		{"rebound argument", `{ /v /u /face 0.5 /u u u u point 1.0 0.0 1.0 }`, 0},
+		{"face", `[ 0.0 1.0 ] /reds { /v /u /face reds face 2 modi get 0.0 0.0 point 1.0 0.0 1.0 }`, argFace},
+		{"u and v", `{ /v /u /face u v 0.0 point 1.0 0.0 1.0 }`, argU | argV},
+		{"if on face", `{ /v /u /face face 0 eqi { 1.0 } { 0.0 } if 0.0 0.0 point 1.0 0.0 1.0 }`, argFace},
+		{"if with constant result", `{ /v /u /face u 0.5 lessf { 1.0 } { 1.0 } if /r r r r point 1.0 0.0 1.0 }`, argU},
+		{"if below result", `{ /v /u /face u 0.5 lessf { 1 } { 2 } if /unused 1.0 1.0 1.0 point 1.0 0.0 1.0 }`, 0},
+		{
+			name:    "index error depends on argument",
+			program: `[ 1.0 ] /arr { /v /u /face arr u floor get /unused 1.0 1.0 1.0 point 1.0 0.0 1.0 }`,
+			want:    argU,
+		},
+		{
+			name:    "index error in branch",
+			program: `[ 1.0 ] /arr { /v /u /face v 0.5 lessf { arr 0 get } { 1.0 } if /unused 1.0 1.0 1.0 point 1.0 0.0 1.0 }`,
+			want:    argV,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			st := NewEvalState()
+			if err := st.ParseAndEval(tt.program); err != nil {
+				t.Fatalf("ParseAndEval: %v", err)
+			}
+			closure, err := PopValue[VClosure](st)
+			if err != nil {
+				t.Fatalf("PopValue: %v", err)
+			}
+			_, got, err := compileSurfaceFn(&closure)
+			if err != nil {
+				t.Fatalf("compileSurfaceFn: %v", err)
+			}
+			if got != tt.want {
+				t.Errorf("deps = %03b, want %03b", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestMaybeSimplifySurfaceFn(t *testing.T) {
+	simplify := func(t *testing.T, program string, numFaces int) VSurfaceFn {
+		t.Helper()
+		st := NewEvalState()
+		if err := st.ParseAndEval(program); err != nil {
+			t.Fatalf("ParseAndEval: %v", err)
+		}
+		closure, err := PopValue[VClosure](st)
+		if err != nil {
+			t.Fatalf("PopValue: %v", err)
+		}
+		fn, err := maybeSimplifySurfaceFn(&closure, numFaces, st)
+		if err != nil {
+			t.Fatalf("maybeSimplifySurfaceFn: %v", err)
+		}
+		return fn
+	}
+
+	t.Run("constant", func(t *testing.T) {
+		fn := simplify(t, `0.5 /half { /v /u /face half 0.0 0.0 point 1.0 0.0 1.0 }`, 1)
+		want := &Material{Color: prim.RGB(0.5, 0, 0), Kd: 1.0, SpecularExponent: 1.0}
+		if diff := cmp.Diff(VSurfaceFn{Material: want}, fn); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("per face", func(t *testing.T) {
+		fn := simplify(t, `{ /v /u /face face 0 eqi { 1.0 } { 0.0 } if 0.0 0.0 point 1.0 0.0 1.0 }`, 6)
+		if fn.Closure == nil || fn.Material != nil {
+			t.Fatalf("got %v, want a closure", fn)
+		}
+		if len(fn.Faces) != 6 {
+			t.Fatalf("got %d faces, want 6", len(fn.Faces))
+		}
+		for face := range 6 {
+			got, err := EvalSurfaceFn(face, 0.5, 0.5, nil, &fn)
+			if err != nil {
+				t.Fatalf("EvalSurfaceFn: %v", err)
+			}
+			want := prim.RGB(0, 0, 0)
+			if face == 0 {
+				want = prim.RGB(1, 0, 0)
+			}
+			if got.Color != want {
+				t.Errorf("face %d: color = %v, want %v", face, got.Color, want)
+			}
+		}
+	})
+
+	t.Run("constant but not compilable", func(t *testing.T) {
+		// The compiler does not support arrays, so this is folded by the
+		// interpreter instead.
+		fn := simplify(t, `{ /v /u /face [ 0.25 0.5 ] 1 get 0.0 0.0 point 1.0 0.0 1.0 }`, 1)
+		want := &Material{Color: prim.RGB(0.5, 0, 0), Kd: 1.0, SpecularExponent: 1.0}
+		if diff := cmp.Diff(VSurfaceFn{Material: want}, fn); diff != "" {
+			t.Errorf("mismatch (-want +got):\n%s", diff)
+		}
+	})
+
+	t.Run("not compilable", func(t *testing.T) {
+		fn := simplify(t, `{ /v /u /face [ u 0.5 ] 1 get 0.0 0.0 point 1.0 0.0 1.0 }`, 1)
+		if fn.Material != nil || fn.Compiled != nil || fn.Closure == nil {
+			t.Errorf("got %+v, want an interpreted surface function", fn)
+		}
+	})
+
+	t.Run("depends on u", func(t *testing.T) {
+		fn := simplify(t, `{ /v 0.0 0.0 point 1.0 0.0 1.0 }`, 1)
+		if fn.Material != nil || fn.Faces != nil || fn.Compiled == nil {
+			t.Errorf("got %+v, want a compiled surface function", fn)
+		}
+	})
+}
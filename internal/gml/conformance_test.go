@@ -0,0 +1,332 @@
+package gml
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"maps"
+	"math"
+	"slices"
+	"strings"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+// The conformance tests check the operators in the operator table of the
+// ICFP 2000 task description ("The Programming Language GML"). Operators
+// that are not implemented yet are listed in testdata/known_gaps.txt. Their
+// tests are skipped on purpose, so that the known gaps don't fail every test
+// run, and the skipped operators are logged by tier at the end of the tests.
+// Run with --strict_conformance to fail them instead. An operator that is
+// implemented but still listed does fail, so the list can't go stale.
+
+var flagStrictConformance = flag.Bool("strict_conformance", false, "If true, fail the conformance tests of operators listed in testdata/known_gaps.txt")
+
+// logMissingByTier logs the skipped features, grouped by tier.
+func logMissingByTier(t *testing.T, what string, missing map[int][]string) {
+	if len(missing) == 0 {
+		return
+	}
+	t.Logf("%s that are not implemented yet, skipped:", what)
+	for _, tier := range slices.Sorted(maps.Keys(missing)) {
+		t.Logf("  tier %d: %s", tier, strings.Join(missing[tier], ", "))
+	}
+}
+
+// Sample arguments of each type, used to check the type, arity and stack
+// effect of the operators.
+//
+//	i: integer, r: real, b: boolean, s: string, p: point, a: array,
+//	c: closure, f: surface function, o: object, l: light, L: array of lights
+var sampleArgs = map[byte]string{
+	'i': "1",
+	'r': "2.0",
+	'b': "true",
+	's': `"out.ppm"`,
+	'p': "1.0 2.0 3.0 point",
+	'a': "[ 1 2 ]",
+	'c': "{ }",
+	'f': "{ /v /u /face 1.0 1.0 1.0 point 0.5 0.0 1.0 }",
+	'o': "{ /v /u /face 1.0 1.0 1.0 point 0.5 0.0 1.0 } sphere",
+	'l': "1.0 1.0 1.0 point 1.0 1.0 1.0 point pointlight",
+	'L': "[ 1.0 1.0 1.0 point 1.0 1.0 1.0 point pointlight ]",
+}
+
+// hasType reports whether v is a value of the type with the letter t, as in
+// sampleArgs.
+func hasType(v Value, t byte) bool {
+	switch t {
+	case 'i':
+		_, ok := v.(VInt)
+		return ok
+	case 'r':
+		_, ok := v.(VReal)
+		return ok
+	case 'b':
+		_, ok := v.(VBool)
+		return ok
+	case 'p':
+		_, ok := v.(*prim.Vec3)
+		return ok
+	case 'o':
+		_, ok := v.(SceneObject)
+		return ok
+	case 'l':
+		_, ok := v.(*PointLight)
+		return ok
+	}
+	return false
+}
+
+// conformanceExample is a program, and the stack it leaves, or the error
+// it fails with. If wantErr is errAny, any error is accepted.
+type conformanceExample struct {
+	program string
+	want    []Value
+	wantErr error
+}
+
+var errAny = errors.New("any error")
+
+type conformanceOperator struct {
+	name string
+	// tier is the tier of the specification that the operator is part of.
+	tier int
+	// args and results are the types of the values the operator pops and
+	// pushes, as letters of sampleArgs, in the order they are on the stack.
+	args, results string
+	examples      []conformanceExample
+}
+
+func ok(program string, want ...Value) conformanceExample {
+	return conformanceExample{program: program, want: want}
+}
+
+func fails(program string, wantErr error) conformanceExample {
+	return conformanceExample{program: program, wantErr: wantErr}
+}
+
+var conformanceOperators = []conformanceOperator{
+	// Numbers.
+	{"acos", 1, "r", "r", []conformanceExample{ok("1.0 acos", VReal(0)), ok("0.5 acos", VReal(60))}},
+	{"addi", 1, "ii", "i", []conformanceExample{ok("1 2 addi", VInt(3)), ok("-1 1 addi", VInt(0))}},
+	{"addf", 1, "rr", "r", []conformanceExample{ok("1.5 2.25 addf", VReal(3.75))}},
+	{"asin", 1, "r", "r", []conformanceExample{ok("0.0 asin", VReal(0)), ok("0.5 asin", VReal(30))}},
+	{"clampf", 1, "r", "r", []conformanceExample{ok("-0.5 clampf", VReal(0)), ok("0.25 clampf", VReal(0.25)), ok("1.5 clampf", VReal(1))}},
+	{"cos", 1, "r", "r", []conformanceExample{ok("0.0 cos", VReal(1)), ok("60.0 cos", VReal(0.5))}},
+	{"divi", 1, "ii", "i", []conformanceExample{ok("7 2 divi", VInt(3)), ok("-7 2 divi", VInt(-3))}},
+	{"divf", 1, "rr", "r", []conformanceExample{ok("7.0 2.0 divf", VReal(3.5))}},
+	{"eqi", 1, "ii", "b", []conformanceExample{ok("1 1 eqi", VBool(true)), ok("1 2 eqi", VBool(false))}},
+	{"eqf", 1, "rr", "b", []conformanceExample{ok("1.5 1.5 eqf", VBool(true)), ok("1.5 2.5 eqf", VBool(false))}},
+	{"floor", 1, "r", "i", []conformanceExample{ok("2.5 floor", VInt(2)), ok("-2.5 floor", VInt(-3))}},
+	{"frac", 1, "r", "r", []conformanceExample{ok("2.5 frac", VReal(0.5)), ok("-2.5 frac", VReal(-0.5))}},
+	{"lessi", 1, "ii", "b", []conformanceExample{ok("1 2 lessi", VBool(true)), ok("2 2 lessi", VBool(false))}},
+	{"lessf", 1, "rr", "b", []conformanceExample{ok("1.0 2.0 lessf", VBool(true)), ok("2.0 1.0 lessf", VBool(false))}},
+	{"modi", 1, "ii", "i", []conformanceExample{ok("7 3 modi", VInt(1)), ok("-7 3 modi", VInt(-1))}},
+	{"muli", 1, "ii", "i", []conformanceExample{ok("6 -7 muli", VInt(-42))}},
+	{"mulf", 1, "rr", "r", []conformanceExample{ok("1.5 -2.0 mulf", VReal(-3))}},
+	{"negi", 1, "i", "i", []conformanceExample{ok("3 negi", VInt(-3))}},
+	{"negf", 1, "r", "r", []conformanceExample{ok("-1.5 negf", VReal(1.5))}},
+	{"real", 1, "i", "r", []conformanceExample{ok("3 real", VReal(3)), ok("-2 real", VReal(-2))}},
+	{"sin", 1, "r", "r", []conformanceExample{ok("0.0 sin", VReal(0)), ok("30.0 sin", VReal(0.5))}},
+	{"sqrt", 1, "r", "r", []conformanceExample{ok("16.0 sqrt", VReal(4))}},
+	{"subi", 1, "ii", "i", []conformanceExample{ok("1 3 subi", VInt(-2))}},
+	{"subf", 1, "rr", "r", []conformanceExample{ok("1.0 0.25 subf", VReal(0.75))}},
+
+	// Points.
+	{"getx", 1, "p", "r", []conformanceExample{ok("1.0 2.0 3.0 point getx", VReal(1))}},
+	{"gety", 1, "p", "r", []conformanceExample{ok("1.0 2.0 3.0 point gety", VReal(2))}},
+	{"getz", 1, "p", "r", []conformanceExample{ok("1.0 2.0 3.0 point getz", VReal(3))}},
+	{"point", 1, "rrr", "p", []conformanceExample{ok("1.0 2.0 3.0 point", &prim.Vec3{X: 1, Y: 2, Z: 3})}},
+
+	// Arrays.
+	{"get", 1, "ai", "i", []conformanceExample{
+		ok("[ 1 2.0 ] 1 get", VReal(2)),
+		fails("[ 1 2 ] 2 get", ErrArrayIndexOutOfBounds),
+		fails("[ 1 2 ] -1 get", ErrArrayIndexOutOfBounds),
+	}},
+	{"length", 1, "a", "i", []conformanceExample{ok("[ 1 2 3 ] length", VInt(3)), ok("[ ] length", VInt(0))}},
+
+	// Control operators.
+	{"apply", 1, "c", "", []conformanceExample{ok("1 { 2 addi } apply", VInt(3)), ok("1 /x { /x x } /f 2 f apply x", VInt(2), VInt(1))}},
+	{"if", 1, "bcc", "", []conformanceExample{
+		ok("true { 1 } { 2 } if", VInt(1)),
+		ok("false { 1 } { 2 } if", VInt(2)),
+		fails("1 { 1 } { 2 } if", errAny),
+	}},
+
+	// Primitive objects.
+	{"sphere", 1, "f", "o", nil},
+	{"plane", 1, "f", "o", nil},
+	{"cube", 2, "f", "o", nil},
+	{"cylinder", 2, "f", "o", nil},
+	{"cone", 2, "f", "o", nil},
+
+	// Transformations.
+	{"translate", 1, "orrr", "o", nil},
+	{"scale", 1, "orrr", "o", nil},
+	{"uscale", 1, "or", "o", nil},
+	{"rotatex", 1, "or", "o", nil},
+	{"rotatey", 1, "or", "o", nil},
+	{"rotatez", 1, "or", "o", nil},
+
+	// Constructive solid geometry.
+	{"union", 1, "oo", "o", nil},
+	{"intersect", 3, "oo", "o", nil},
+	{"difference", 3, "oo", "o", nil},
+
+	// Lights.
+	{"light", 1, "pp", "l", nil},
+	{"pointlight", 2, "pp", "l", nil},
+	{"spotlight", 3, "ppprr", "l", nil},
+
+	// Rendering: amb lights obj depth fov wid ht file.
+	{"render", 1, "pLoiriis", "", nil},
+}
+
+// approxReals compares reals that differ by rounding as equal, since the
+// trigonometric operators work in degrees.
+var approxReals = cmp.Comparer(func(a, b VReal) bool { return math.Abs(float64(a-b)) < 1e-9 })
+
+// conformanceEval evaluates the program, turning a panic into an error so
+// that one broken operator doesn't stop the others from being checked.
+func conformanceEval(program string) (st *EvalState, err error) {
+	st = NewEvalState()
+	st.Render = func(*EvalState, *RenderArgs) error { return nil }
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return st, st.ParseAndEval(program)
+}
+
+// sampleProgram returns the sample arguments for the types in args.
+func sampleProgram(args string) string {
+	var parts []string
+	for i := range len(args) {
+		parts = append(parts, sampleArgs[args[i]])
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestConformanceOperators(t *testing.T) {
+	gaps, err := ReadKnownGaps()
+	if err != nil {
+		t.Fatal(err)
+	}
+	missing := map[int][]string{}
+	defer logMissingByTier(t, "Operators", missing)
+	for _, op := range conformanceOperators {
+		t.Run(op.name, func(t *testing.T) {
+			gap, known := gaps[op.name]
+			if known && gap.Tier != op.tier {
+				t.Errorf("known_gaps.txt has %s in tier %d, want tier %d", op.name, gap.Tier, op.tier)
+			}
+			_, implemented := builtins[op.name]
+			if implemented && known && !gap.Renderer {
+				t.Errorf("%s is implemented, remove it from known_gaps.txt", op.name)
+			}
+			if !implemented {
+				msg := fmt.Sprintf("tier %d operator %s is not implemented", op.tier, op.name)
+				if known && !*flagStrictConformance {
+					missing[op.tier] = append(missing[op.tier], op.name)
+					t.Skipf("%s, which is a known gap", msg)
+				}
+				t.Fatal(msg)
+			}
+
+			t.Run("stack effect", func(t *testing.T) {
+				// The values below the arguments are left alone.
+				program := fmt.Sprintf(`"below" %s %s`, sampleProgram(op.args), op.name)
+				st, err := conformanceEval(program)
+				if err != nil {
+					t.Fatalf("%s: %v", program, err)
+				}
+				if len(st.Stack) != 1+len(op.results) {
+					t.Fatalf("%s: stack is %v, want %q and %d results", program, st.Stack, "below", len(op.results))
+				}
+				if st.Stack[0] != (VString{Value: "below"}) {
+					t.Errorf("%s: bottom of the stack is %v, want %q", program, st.Stack[0], "below")
+				}
+				for i := range len(op.results) {
+					if v := st.Stack[1+i]; !hasType(v, op.results[i]) {
+						t.Errorf("%s: result %d is %v (%T), want type %c", program, i, v, v, op.results[i])
+					}
+				}
+			})
+
+			t.Run("arity", func(t *testing.T) {
+				_, err := conformanceEval(op.name)
+				if !errors.Is(err, ErrEmptyStack) {
+					t.Errorf("%s with an empty stack: got error %v, want %v", op.name, err, ErrEmptyStack)
+				}
+			})
+
+			t.Run("type mismatch", func(t *testing.T) {
+				if op.args == "" {
+					return
+				}
+				// Replace the argument on top of the stack with one of the
+				// wrong type.
+				wrong := byte('s')
+				if op.args[len(op.args)-1] == 's' {
+					wrong = 'i'
+				}
+				program := fmt.Sprintf("%s %s\n%s", sampleProgram(op.args[:len(op.args)-1]), sampleArgs[wrong], op.name)
+				_, err := conformanceEval(program)
+				if err == nil {
+					t.Fatalf("%q succeeded, want a type error", program)
+				}
+				if pos, ok := ErrorPosition(err); !ok || pos.Line != 2 || pos.Col != 1 {
+					t.Errorf("%q: error %q is at %v, want the position of %s", program, err, pos, op.name)
+				}
+			})
+
+			for _, ex := range op.examples {
+				st, err := conformanceEval(ex.program)
+				switch {
+				case ex.wantErr == errAny:
+					if err == nil {
+						t.Errorf("%s: succeeded, want an error", ex.program)
+					}
+				case ex.wantErr != nil:
+					if !errors.Is(err, ex.wantErr) {
+						t.Errorf("%s: got error %v, want %v", ex.program, err, ex.wantErr)
+					}
+				case err != nil:
+					t.Errorf("%s: %v", ex.program, err)
+				default:
+					if diff := cmp.Diff(ex.want, st.Stack, approxReals); diff != "" {
+						t.Errorf("%s: stack mismatch (-want +got):\n%s", ex.program, diff)
+					}
+				}
+			}
+		})
+	}
+}
+
+// TestConformanceErrors checks the errors that the specification requires
+// of any program, rather than of a particular operator.
+func TestConformanceErrors(t *testing.T) {
+	for _, ex := range []conformanceExample{
+		fails("x", ErrUnboundIdentifier),
+		fails("{ x } /f 1 /x f apply", ErrUnboundIdentifier),
+		fails("notAnOperator", ErrUnboundIdentifier),
+		// There are no implicit conversions between integers and reals.
+		fails("1 2.0 addi", errAny),
+		fails("1.0 2 addf", errAny),
+	} {
+		_, err := conformanceEval(ex.program)
+		switch {
+		case ex.wantErr == errAny:
+			if err == nil {
+				t.Errorf("%s: succeeded, want an error", ex.program)
+			}
+		case !errors.Is(err, ex.wantErr):
+			t.Errorf("%s: got error %v, want %v", ex.program, err, ex.wantErr)
+		}
+	}
+}
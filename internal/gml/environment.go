@@ -3,7 +3,6 @@ package gml
 import (
 	"fmt"
 	"maps"
-	"slices"
 	"strings"
 )
 
@@ -24,34 +23,76 @@ func (b *Binding) DebugStringCtx(ctx DebugStringContext) string {
 	return fmt.Sprintf("%s: %s", symbol, DebugString(b.Value, ctx))
 }
 
+// Environment maps top level variables to values. Variables bound in
+// function bodies are kept in frames instead (see vm.go).
+//
+// Environments are persistent: Clone is O(1), and Store copies only the
+// path to the updated binding, so capturing the environment in a closure
+// is cheap. The bindings are
+// kept in a radix trie indexed by identifier ID, since IDs are small dense
+// integers.
 type Environment struct {
-	bindings map[int]Value
+	root *envBranch
+	// height is the number of branch levels above the leaves.
+	height int
 	// TODO: Should environment just have a pointer to the IDMapping? This
 	// would simplify the need to pass it around when constructing the debug
 	// string.
 }
 
+const (
+	envBits  = 3
+	envWidth = 1 << envBits
+	envMask  = envWidth - 1
+)
+
+// envBranch is an interior node of the trie. Branches at height 1 point to
+// leaves, and all others point to branches.
+type envBranch struct {
+	children [envWidth]*envBranch
+	leaves   [envWidth]*envLeaf
+}
+
+type envLeaf [envWidth]Value
+
 func newEnv() Environment {
-	return Environment{
-		bindings: make(map[int]Value),
-	}
+	return Environment{}
 }
 
 // Bindings returns a slice of the bindings that
 // have been set in the environment.
 func (env *Environment) Bindings() []Binding {
-	bs := make([]Binding, 0, len(env.bindings))
-	for id, v := range env.bindings {
-		bs = append(bs, Binding{id, v})
+	var bs []Binding
+	var walk func(n *envBranch, height, base int)
+	walk = func(n *envBranch, height, base int) {
+		if n == nil {
+			return
+		}
+		shift := envBits * height
+		for i := range envWidth {
+			if height > 1 {
+				walk(n.children[i], height-1, base|i<<shift)
+				continue
+			}
+			leaf := n.leaves[i]
+			if leaf == nil {
+				continue
+			}
+			for j, v := range leaf {
+				if v != nil {
+					bs = append(bs, Binding{base | i<<shift | j, v})
+				}
+			}
+		}
 	}
-	slices.SortFunc(bs, func(a, b Binding) int { return a.ID - b.ID })
+	walk(env.root, env.height, 0)
 	return bs
 }
 
+// Clone returns a copy of the environment. Later changes to either copy
+// do not affect the other.
 func (env *Environment) Clone() Environment {
-	return Environment{
-		bindings: maps.Clone(env.bindings),
-	}
+	return *env
 }
 
 func (env *Environment) String() string {
@@ -79,12 +120,64 @@ func (env *Environment) mkString(fmtBinding func(Binding) string) string {
 	return sb.String()
 }
 
+// capacity returns the number of IDs the trie can hold at its current height.
+func (env *Environment) capacity() int {
+	return 1 << (envBits * (env.height + 1))
+}
+
 func (env *Environment) Store(id int, value Value) {
-	env.bindings[id] = value
+	if env.root == nil {
+		env.root = &envBranch{}
+		env.height = 1
+	}
+	for id >= env.capacity() {
+		env.root = &envBranch{children: [envWidth]*envBranch{env.root}}
+		env.height++
+	}
+
+	// Copy the path from the root to the leaf, since other environments may
+	// share the existing nodes.
+	root := copyBranch(env.root)
+	n := root
+	for shift := envBits * env.height; shift > envBits; shift -= envBits {
+		i := (id >> shift) & envMask
+		n.children[i] = copyBranch(n.children[i])
+		n = n.children[i]
+	}
+	i := (id >> envBits) & envMask
+	leaf := &envLeaf{}
+	if n.leaves[i] != nil {
+		*leaf = *n.leaves[i]
+	}
+	leaf[id&envMask] = value
+	n.leaves[i] = leaf
+	env.root = root
+}
+
+func copyBranch(n *envBranch) *envBranch {
+	if n == nil {
+		return &envBranch{}
+	}
+	c := *n
+	return &c
 }
 
 func (env *Environment) Lookup(id int) Value {
-	return env.bindings[id]
+	if env.root == nil || id < 0 || id >= env.capacity() {
+		return nil
+	}
+	n := env.root
+	for shift := envBits * env.height; shift > envBits; shift -= envBits {
+		n = n.children[(id>>shift)&envMask]
+		if n == nil {
+			return nil
+		}
+	}
+	leaf := n.leaves[(id>>envBits)&envMask]
+	if leaf == nil {
+		return nil
+	}
+	return leaf[id&envMask]
 }
 
 type IDMapping struct {
@@ -0,0 +1,44 @@
+package gml
+
+import (
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestEnvironmentPersistence(t *testing.T) {
+	env := newEnv()
+	env.Store(1, VInt(1))
+	env.Store(2, VInt(2))
+
+	clone := env.Clone()
+	clone.Store(2, VInt(20))
+	clone.Store(3, VInt(30))
+	// Large enough to grow the trie.
+	clone.Store(1000, VInt(1000))
+	env.Store(4, VInt(4))
+
+	if diff := cmp.Diff([]Binding{{1, VInt(1)}, {2, VInt(2)}, {4, VInt(4)}}, env.Bindings()); diff != "" {
+		t.Errorf("original bindings mismatch (-want +got):\n%s", diff)
+	}
+	if diff := cmp.Diff([]Binding{{1, VInt(1)}, {2, VInt(20)}, {3, VInt(30)}, {1000, VInt(1000)}}, clone.Bindings()); diff != "" {
+		t.Errorf("clone bindings mismatch (-want +got):\n%s", diff)
+	}
+	for _, tt := range []struct {
+		env  *Environment
+		id   int
+		want Value
+	}{
+		{&env, 2, VInt(2)},
+		{&env, 3, nil},
+		{&env, 1000, nil},
+		{&clone, 2, VInt(20)},
+		{&clone, 4, nil},
+		{&clone, 1000, VInt(1000)},
+		{&clone, 999, nil},
+	} {
+		if got := tt.env.Lookup(tt.id); got != tt.want {
+			t.Errorf("Lookup(%d) = %v, want %v", tt.id, got, tt.want)
+		}
+	}
+}
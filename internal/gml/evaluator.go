@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"path/filepath"
 	"slices"
 	"strconv"
 	"strings"
@@ -25,6 +26,39 @@ type RenderArgs struct {
 
 	BgColorStart prim.Vec3
 	BgColorEnd   prim.Vec3
+
+	// EnvMap replaces the background gradient if set.
+	EnvMap *EnvironmentMap
+
+	// Sky replaces the background gradient if set, and adds the sun as a
+	// light source.
+	Sky *Sky
+
+	// Lens replaces the pinhole camera with a thin lens if set.
+	Lens *Lens
+}
+
+// Lens is a thin camera lens, which blurs objects that are not at the focal
+// distance.
+type Lens struct {
+	ApertureRadius float64
+	FocalDistance  float64 // From the eye, along the view direction
+}
+
+// Sky is an analytic model of a daylight sky.
+type Sky struct {
+	SunDirection prim.Vec3 // Points towards the sun
+	Turbidity    float64   // Haziness, from about 2 (clear) to 10 (hazy)
+}
+
+// EnvironmentMap is an equirectangular image surrounding the scene, used as
+// the background and as the source of reflected and refracted light.
+type EnvironmentMap struct {
+	File     string
+	Rotation float64 // Degrees around the Y axis
+	// AmbientScale scales the image-based ambient light. If 0, the flat
+	// ambient light from the render arguments is used instead.
+	AmbientScale float64
 }
 
 // TODO: The debugger stuff here is not yet fully baked.
@@ -47,6 +81,19 @@ type EvalState struct {
 	Env       Environment
 	Render    func(*EvalState, *RenderArgs) error
 	Debugger  DebuggerFn
+	// NoIncludes makes Parse and ParseFile reject #include directives.
+	NoIncludes bool
+	// Dir is the directory relative file names in the program, like
+	// environment maps, are resolved against if the program is not from a
+	// file. Names in a file are resolved against the file's directory, as
+	// its #include directives are. If it is empty, the working directory
+	// is used.
+	Dir string
+
+	// callDepth is the number of closures being evaluated, and frame is
+	// the frame of the innermost one.
+	callDepth int
+	frame     *frame
 }
 
 type Value interface {
@@ -71,23 +118,80 @@ func (v VBool) String() string {
 	return strconv.FormatBool(bool(v))
 }
 
-type VString string
+// VString is a string. Dir is the directory of the file its literal is in,
+// if it is from a file, which relative file names in it are resolved
+// against.
+type VString struct {
+	Value string
+	Dir   string
+}
 
 func (v VString) String() string {
-	return strconv.Quote(string(v))
+	return strconv.Quote(v.Value)
+}
+
+// path returns the string as a file name, resolving a relative name against
+// the directory of the string's file, or dir if it is not from a file.
+func (v VString) path(dir string) string {
+	if v.Dir != "" {
+		dir = v.Dir
+	}
+	if dir == "" || filepath.IsAbs(v.Value) {
+		return v.Value
+	}
+	return filepath.Join(dir, v.Value)
 }
 
 type VClosure struct {
 	Code TokenList
-	Env  Environment
+	// Env holds the top level bindings when the closure was created.
+	Env Environment
+
+	// frame is the frame of the function body the closure was created in,
+	// if any, and code is the compiled form of Code, if available.
+	frame *frame
+	code  *bytecode
 }
 
 func (v VClosure) String() string {
-	return fmt.Sprintf("Closure(%v, env=%v)", v.Code, &v.Env)
+	env := v.env()
+	return fmt.Sprintf("Closure(%v, env=%v)", v.Code, &env)
 }
 
 func (v VClosure) DebugStringCtx(ctx DebugStringContext) string {
-	return fmt.Sprintf("Closure(%v, env=%s)", v.Code, v.Env.DebugStringCtx(ctx))
+	env := v.env()
+	return fmt.Sprintf("Closure(%v, env=%s)", v.Code, env.DebugStringCtx(ctx))
+}
+
+// captured returns the value of the variable id where the closure was
+// created, or nil if it was unbound.
+func (v *VClosure) captured(id int) Value {
+	if v.frame != nil {
+		if val := v.frame.lookup(id, v.code.layout.outerLen); val != nil {
+			return val
+		}
+	}
+	return v.Env.Lookup(id)
+}
+
+// env returns all the bindings visible where the closure was created, in
+// one environment.
+func (v *VClosure) env() Environment {
+	env := v.Env.Clone()
+	var visit func(f *frame, n int)
+	visit = func(f *frame, n int) {
+		if f == nil {
+			return
+		}
+		visit(f.outer, f.layout.outerLen)
+		for slot, id := range f.layout.ids[:n] {
+			env.Store(id, f.slots[slot])
+		}
+	}
+	if v.frame != nil {
+		visit(v.frame, v.code.layout.outerLen)
+	}
+	return env
 }
 
 // VSurfaceFn is effectively a union (exactly 1 of Closure and Material
@@ -96,6 +200,12 @@ type VSurfaceFn struct {
 	// Closure is a callback that needs to be evaluated in the GML interpreter
 	// to compute a material.
 	Closure *VClosure
+	// Compiled is an optional native version of Closure. If set, it is used
+	// in place of the interpreter.
+	Compiled CompiledSurfaceFn
+	// Faces optionally holds the material for each face, for surface
+	// functions that depend only on the face.
+	Faces []Material
 	// Material is a constant precomputed material.
 	Material *Material
 }
@@ -259,14 +369,54 @@ func (u Union) String() string {
 	return fmt.Sprintf("Union(%v)", u.Objects)
 }
 
+// Transform returns an instance of the union, rather than transforming
+// every object in it, so that many copies of the same union can share its
+// objects.
 func (u *Union) Transform(m *prim.Mat4) SceneObject {
-	v := &Union{
-		Objects: make([]SceneObject, len(u.Objects)),
+	return &Instance{
+		Prototype:    u,
+		TransformMat: m,
 	}
-	for i := range u.Objects {
-		v.Objects[i] = u.Objects[i].Transform(m)
+}
+
+// Instance is a transformed union. Each object in the union is placed as if
+// the transform had been applied to it directly, so the instance's transform
+// comes after the object's own in the order that Transform composes them.
+type Instance struct {
+	Prototype    *Union
+	TransformMat *prim.Mat4
+}
+
+var _ SceneObject = (*Instance)(nil)
+
+func (i Instance) String() string {
+	return fmt.Sprintf("Instance(%v)", i.Prototype)
+}
+
+func (i *Instance) Transform(m *prim.Mat4) SceneObject {
+	return &Instance{
+		Prototype:    i.Prototype,
+		TransformMat: i.TransformMat.MulMat(m),
+	}
+}
+
+// Motion is an object that moves while the shutter is open. Start and End
+// are the same object with different transforms.
+type Motion struct {
+	Start, End SceneObject
+}
+
+var _ SceneObject = (*Motion)(nil)
+
+func (m Motion) String() string {
+	return fmt.Sprintf("Motion(%v, %v)", m.Start, m.End)
+}
+
+func (m *Motion) Transform(mat *prim.Mat4) SceneObject {
+	return &Motion{
+		Start: m.Start.Transform(mat),
+		End:   m.End.Transform(mat),
 	}
-	return v
 }
 
 type Difference struct {
@@ -300,6 +450,7 @@ var (
 	ErrUnboundIdentifier     = errors.New("unbound identifier")
 	ErrNotImplemented        = errors.New("not implemented")
 	ErrArrayIndexOutOfBounds = errors.New("array index out of bounds")
+	ErrCallDepth             = errors.New("closures applied too deeply")
 )
 
 func NewEvalState() *EvalState {
@@ -311,6 +462,7 @@ func NewEvalState() *EvalState {
 
 func (e *EvalState) Parse(input string) (TokenList, error) {
 	p := NewParserWithIDMapping(input, &e.IDMapping)
+	p.lexer.noIncludes = e.NoIncludes
 	return p.Parse()
 }
 
@@ -321,6 +473,7 @@ func (e *EvalState) ParseFile(path string) (TokenList, error) {
 	if err != nil {
 		return nil, err
 	}
+	p.lexer.noIncludes = e.NoIncludes
 	return p.Parse()
 }
 
@@ -343,74 +496,28 @@ func (e *EvalState) ParseAndEvalFile(path string) error {
 }
 
 func (e *EvalState) evalProgram(program TokenList) error {
-	for _, token := range program {
-		if err := e.EvalOneStep(token); err != nil {
-			return err
-		}
-	}
-	return nil
+	return e.Eval(program)
 }
 
 func (e *EvalState) Eval(program TokenList) error {
-	for _, token := range program {
-		if err := e.EvalOneStep(token); err != nil {
-			return err
-		}
+	code, err := compileBytecode(program, nil)
+	if err != nil {
+		return err
 	}
-	return nil
+	return e.exec(code)
 }
 
 var errAborted = errors.New("evaluation was aborted by the user")
 
-func (e *EvalState) EvalOneStep(token TokenGroup) (finalErr error) {
-	if e.Debugger != nil {
-		defer func() {
-			if e.Debugger() == DbgAbort {
-				finalErr = errAborted
-			}
-		}()
-	}
-	e.CurrToken = token
-	switch token := token.(type) {
-	case *IntLiteral:
-		e.Push(VInt(token.Value))
-	case *FloatLiteral:
-		e.Push(VReal(token.Value))
-	case *BoolLiteral:
-		e.Push(VBool(token.Value))
-	case *StringLiteral:
-		e.Push(VString(token.Value))
-	case *Function:
-		e.Push(VClosure{Code: token.Body, Env: e.Env.Clone()})
-	case *Binder:
-		v, err := e.Pop()
-		if err != nil {
-			return err
-		}
-		e.Env.Store(token.ID, v)
-	case *Identifier:
-		if b := builtins[token.Name]; b != nil {
-			return b.Run(e)
-		}
-		// Else look up a variable in the environment.
-		if val := e.Env.Lookup(token.ID); val != nil {
-			e.Push(val)
-		} else {
-			return fmt.Errorf("%s%w: %s", token.Pos.prefix(), ErrUnboundIdentifier, token.Name)
-		}
-	case *Array:
-		oldStack := e.Stack
-		defer func() { e.Stack = oldStack }()
-		e.Stack = nil
-		err := e.Eval(token.Elements)
-		if err != nil {
-			return err
-		}
-		oldStack = append(oldStack, VArray{Elements: e.Stack})
-	default:
-		return fmt.Errorf("unknown token: %v", token)
-	}
-	return nil
+// EvalOneStep evaluates a single top-level token.
+func (e *EvalState) EvalOneStep(token TokenGroup) error {
+	return e.Eval(TokenList{token})
+}
+
+// Bind binds name to value in the environment, as if the program had
+// started with "value /name".
+func (e *EvalState) Bind(name string, value Value) {
+	e.Env.Store(e.IDMapping.GetOrCreateId(name), value)
 }
 
 func (e *EvalState) Push(value Value) {
@@ -419,8 +526,7 @@ func (e *EvalState) Push(value Value) {
 
 func (e *EvalState) Pop() (Value, error) {
 	if len(e.Stack) == 0 {
-		pos := e.CurrToken.Position()
-		return nil, fmt.Errorf("%s%w: token: %v", pos.prefix(), ErrEmptyStack, TokenGroupDebugString(e.CurrToken))
+		return nil, errorAt(e.CurrToken.Position(), "%w: token: %v", ErrEmptyStack, TokenGroupDebugString(e.CurrToken))
 	}
 	i := len(e.Stack) - 1
 	val := e.Stack[i]
@@ -429,12 +535,29 @@ func (e *EvalState) Pop() (Value, error) {
 	return val, nil
 }
 
+// maxCallDepth is how many closures can be applied inside each other, so
+// that runaway recursion is an error rather than overflowing the Go stack.
+const maxCallDepth = 10000
+
 // EvalClosure evaluates the code in the given closure, then restores the old environment.
 func (e *EvalState) EvalClosure(closure VClosure) error {
-	oldEnv := e.Env
-	defer func() { e.Env = oldEnv }()
+	if e.callDepth >= maxCallDepth {
+		return errorAt(e.CurrToken.Position(), "%w: more than %d", ErrCallDepth, maxCallDepth)
+	}
+	e.callDepth++
+	defer func() { e.callDepth-- }()
+	code := closure.code
+	if code == nil {
+		var err error
+		if code, err = compileFunction(closure.Code, nil); err != nil {
+			return err
+		}
+	}
+	oldEnv, oldFrame := e.Env, e.frame
+	defer func() { e.Env, e.frame = oldEnv, oldFrame }()
 	e.Env = closure.Env.Clone()
-	return e.Eval(closure.Code)
+	e.frame = &frame{slots: make([]Value, len(code.layout.ids)), layout: code.layout, outer: closure.frame}
+	return e.exec(code)
 }
 
 // Clone returns an independent copy of the argument EvalState.
@@ -453,6 +576,7 @@ func (e *EvalState) Clone() *EvalState {
 		CurrToken: e.CurrToken,
 		Stack:     slices.Clone(e.Stack),
 		Env:       e.Env.Clone(),
+		frame:     e.frame,
 		IDMapping: *e.IDMapping.Clone(),
 		Debugger:  e.Debugger,
 	}
@@ -471,6 +595,25 @@ func (e EvalError) Error() string {
 
 func (e EvalError) Unwrap() error { return e.Err }
 
+// ErrorPosition returns the source position of the GML token that caused
+// err, if it is known.
+func ErrorPosition(err error) (Pos, bool) {
+	var evalErr EvalError
+	var evalErrPtr *EvalError
+	var posErr *PosError
+	switch {
+	case errors.As(err, &evalErrPtr) && evalErrPtr != nil:
+		evalErr = *evalErrPtr
+	case errors.As(err, &evalErr):
+	case errors.As(err, &posErr):
+		return posErr.Pos, posErr.Pos.Line != 0
+	default:
+		return Pos{}, false
+	}
+	pos := evalErr.EvalState.CurrToken.Position()
+	return pos, pos.Line != 0
+}
+
 func typeMismatchError[ExpectedType Value](e *EvalState, got Value) error {
 	zero := *new(ExpectedType) // for error message formatting.
 	return &EvalError{
@@ -536,6 +679,9 @@ type stateModifier = func(*EvalState) error
 type Builtin struct {
 	Name string
 	Func func(*EvalState) error
+
+	// opcode is the index of the builtin in builtinTable.
+	opcode int
 }
 
 func (b Builtin) Run(e *EvalState) error {
@@ -545,13 +691,18 @@ func (b Builtin) Run(e *EvalState) error {
 	return b.Func(e)
 }
 
-var builtins map[string]*Builtin
+var (
+	builtins     map[string]*Builtin
+	builtinTable []*Builtin
+)
 
 func init() {
 	builtins = map[string]*Builtin{}
 
 	registerBuiltin := func(name string, f stateModifier) {
-		builtins[name] = &Builtin{Name: name, Func: f}
+		b := &Builtin{Name: name, Func: f, opcode: len(builtinTable)}
+		builtins[name] = b
+		builtinTable = append(builtinTable, b)
 	}
 
 	registerBuiltin("addf", add[VReal])
@@ -578,6 +729,7 @@ func init() {
 	registerBuiltin("lessf", less[VReal])
 	registerBuiltin("material", material)
 	registerBuiltin("modi", modi)
+	registerBuiltin("motion", motion)
 	registerBuiltin("muli", mul[VInt])
 	registerBuiltin("mulf", mul[VReal])
 	registerBuiltin("negi", neg[VInt])
@@ -587,6 +739,9 @@ func init() {
 	registerBuiltin("pointlight", pointlight)
 	registerBuiltin("render", render)
 	registerBuiltin("renderWithBgGradient", renderWithBgGradient)
+	registerBuiltin("renderWithEnvMap", renderWithEnvMap)
+	registerBuiltin("renderWithLens", renderWithLens)
+	registerBuiltin("renderWithSky", renderWithSky)
 	registerBuiltin("rotatex", rotatex)
 	registerBuiltin("rotatey", rotatey)
 	registerBuiltin("rotatez", rotatez)
@@ -632,52 +787,23 @@ func pointlight(e *EvalState) error {
 	return nil
 }
 
-func referencedVars(closure *VClosure) []string {
-	// We don't do any fancy dynamic analysis here, just walk the AST and
-	// find the referenced variables.
-
-	var vars []string
-	toVisit := closure.Code
-
-	for len(toVisit) > 0 {
-		var next TokenList
-
-		for _, tgroup := range toVisit {
-			switch tgroup := tgroup.(type) {
-			case *Identifier:
-				if _, ok := builtins[tgroup.Name]; ok {
-					// Don't consider builtins as vars.
-					continue
-				}
-				vars = append(vars, tgroup.Name)
-			case *Array:
-				for _, elt := range tgroup.Elements {
-					next = append(next, elt)
-				}
-			case *Function:
-				for _, elt := range tgroup.Body {
-					next = append(next, elt)
-				}
-			}
-		}
-
-		toVisit = next
-	}
-
-	return vars
-}
-
 var ErrNilEvalState = errors.New("nil GML eval state")
 
-func EvalSurfaceFn(face int, u, v float64, state *EvalState, surfaceFn *VSurfaceFn) (*Material, error) {
+func EvalSurfaceFn(face int, u, v float64, state *EvalState, surfaceFn *VSurfaceFn) (Material, error) {
 	if surfaceFn.Material != nil {
-		return surfaceFn.Material, nil
+		return *surfaceFn.Material, nil
+	}
+	if face >= 0 && face < len(surfaceFn.Faces) {
+		return surfaceFn.Faces[face], nil
+	}
+	if surfaceFn.Compiled != nil {
+		return surfaceFn.Compiled(face, u, v)
 	}
 	if state == nil {
-		return nil, ErrNilEvalState
+		return Material{}, ErrNilEvalState
 	}
 	if surfaceFn.Closure == nil {
-		return nil, fmt.Errorf("surfaceFn in invalid state: %v", surfaceFn)
+		return Material{}, fmt.Errorf("surfaceFn in invalid state: %v", surfaceFn)
 	}
 
 	state.Push(VInt(face))
@@ -687,16 +813,16 @@ func EvalSurfaceFn(face int, u, v float64, state *EvalState, surfaceFn *VSurface
 	err := state.EvalClosure(*surfaceFn.Closure)
 
 	if err != nil {
-		return nil, err
+		return Material{}, err
 	}
 
 	// Pop one value.
 	firstVal, err := PopValue[Value](state)
 	if err != nil {
-		return nil, err
+		return Material{}, err
 	}
 	if m, ok := firstVal.(Material); ok {
-		return &m, nil
+		return m, nil
 	}
 	// Else, we expect the usual setup:
 
@@ -705,18 +831,18 @@ func EvalSurfaceFn(face int, u, v float64, state *EvalState, surfaceFn *VSurface
 
 	n, ok := firstVal.(VReal)
 	if !ok {
-		return nil, typeMismatchError[VReal](state, n)
+		return Material{}, typeMismatchError[VReal](state, n)
 	}
 
 	kd, ks, err := Pop2[VReal](state)
 	if err != nil {
-		return nil, err
+		return Material{}, err
 	}
 	surfaceColor, err := PopValue[*prim.Vec3](state)
 	if err != nil {
-		return nil, err
+		return Material{}, err
 	}
-	m := &Material{
+	m := Material{
 		Color:            *surfaceColor,
 		Kd:               float64(kd),
 		Ks:               float64(ks),
@@ -726,26 +852,83 @@ func EvalSurfaceFn(face int, u, v float64, state *EvalState, surfaceFn *VSurface
 	return m, nil
 }
 
-func maybeSimplifySurfaceFn(closure *VClosure, evalState *EvalState) (VSurfaceFn, error) {
-	vars := referencedVars(closure)
+func referencedVars(closure *VClosure) []string {
+	// We don't do any fancy dynamic analysis here, just walk the AST and
+	// find the referenced variables.
 
-	// fmt.Printf("Referenced vars for %+v\n\n%v\n", closure.Code, vars)
+	var vars []string
+	toVisit := closure.Code
 
-	surfaceFn := VSurfaceFn{Closure: closure}
+	for len(toVisit) > 0 {
+		var next TokenList
+
+		for _, tgroup := range toVisit {
+			switch tgroup := tgroup.(type) {
+			case *Identifier:
+				if _, ok := builtins[tgroup.Name]; ok {
+					// Don't consider builtins as vars.
+					continue
+				}
+				vars = append(vars, tgroup.Name)
+			case *Array:
+				next = append(next, tgroup.Elements...)
+			case *Function:
+				next = append(next, tgroup.Body...)
+			}
+		}
 
-	if len(vars) == 0 {
-		// If the closure does not reference any variables,
-		// we can precompute it now. Any error here would presumably be
-		// fatal if attempted at runtime as well.
+		toVisit = next
+	}
 
+	return vars
+}
+
+// maybeSimplifySurfaceFn precomputes as much of a surface function as it can,
+// for an object with the given number of faces.
+//
+// Surface functions that don't depend on their arguments are replaced by a
+// constant material, and those that depend only on the face get a table of
+// materials per face. Otherwise, we compile the function if possible, and
+// fall back to the interpreter if not.
+func maybeSimplifySurfaceFn(closure *VClosure, numFaces int, evalState *EvalState) (VSurfaceFn, error) {
+	surfaceFn := VSurfaceFn{Closure: closure}
+	compiled, deps, err := compileSurfaceFn(closure)
+	if err != nil {
+		if len(referencedVars(closure)) > 0 {
+			return surfaceFn, nil
+		}
+		// The closure can't be compiled, but it does not reference any
+		// variables, so we can still precompute it with the interpreter.
+		// Any error here would presumably be fatal if attempted at runtime
+		// as well.
 		mat, err := EvalSurfaceFn(0, 0, 0, evalState, &surfaceFn)
 		if err != nil {
 			return VSurfaceFn{}, fmt.Errorf("error while precomputing closure: %w", err)
 		}
-
-		return VSurfaceFn{Material: mat}, nil
+		return VSurfaceFn{Material: &mat}, nil
 	}
+	surfaceFn.Compiled = compiled
 
+	switch deps {
+	case 0:
+		// Any error here would be fatal if attempted at runtime as well.
+		mat, err := compiled(0, 0, 0)
+		if err != nil {
+			return VSurfaceFn{}, fmt.Errorf("error while precomputing closure: %w", err)
+		}
+		return VSurfaceFn{Material: &mat}, nil
+	case argFace:
+		faces := make([]Material, numFaces)
+		for face := range faces {
+			mat, err := compiled(face, 0, 0)
+			if err != nil {
+				// Leave the error until the face is actually hit.
+				return surfaceFn, nil
+			}
+			faces[face] = mat
+		}
+		surfaceFn.Faces = faces
+	}
 	return surfaceFn, nil
 }
 
@@ -757,7 +940,7 @@ func sphere(e *EvalState) error {
 	if err != nil {
 		return err
 	}
-	compiledSurfaceFn, err := maybeSimplifySurfaceFn(&surfaceFn, e)
+	compiledSurfaceFn, err := maybeSimplifySurfaceFn(&surfaceFn, 1, e)
 	if err != nil {
 		return err
 	}
@@ -776,7 +959,7 @@ func cube(e *EvalState) error {
 	if err != nil {
 		return err
 	}
-	compiledSurfaceFn, err := maybeSimplifySurfaceFn(&surfaceFn, e)
+	compiledSurfaceFn, err := maybeSimplifySurfaceFn(&surfaceFn, 6, e)
 	if err != nil {
 		return err
 	}
@@ -794,7 +977,7 @@ func cylinder(e *EvalState) error {
 	if err != nil {
 		return err
 	}
-	compiledSurfaceFn, err := maybeSimplifySurfaceFn(&surfaceFn, e)
+	compiledSurfaceFn, err := maybeSimplifySurfaceFn(&surfaceFn, 3, e)
 	if err != nil {
 		return err
 	}
@@ -809,7 +992,7 @@ func plane(e *EvalState) error {
 	if err != nil {
 		return err
 	}
-	compiledSurfaceFn, err := maybeSimplifySurfaceFn(&surfaceFn, e)
+	compiledSurfaceFn, err := maybeSimplifySurfaceFn(&surfaceFn, 1, e)
 	if err != nil {
 		return err
 	}
@@ -1101,6 +1284,60 @@ func union(e *EvalState) error {
 	return nil
 }
 
+// motion pairs two transformed copies of an object into one object that
+// moves from the first to the second while the shutter is open:
+//
+//	start end motion
+func motion(e *EvalState) error {
+	start, end, err := Pop2[SceneObject](e)
+	if err != nil {
+		return err
+	}
+	if !sameObject(start, end) {
+		return fmt.Errorf("motion needs two copies of the same object, got %v and %v", start, end)
+	}
+	e.Push(&Motion{Start: start, End: end})
+	return nil
+}
+
+// sameObject reports whether a and b could be transformed copies of the
+// same primitive or union.
+func sameObject(a, b SceneObject) bool {
+	switch a := a.(type) {
+	case *Sphere:
+		b, ok := b.(*Sphere)
+		return ok && sameSurface(&a.SurfaceFn, &b.SurfaceFn)
+	case *Cube:
+		b, ok := b.(*Cube)
+		return ok && sameSurface(&a.SurfaceFn, &b.SurfaceFn)
+	case *Cylinder:
+		b, ok := b.(*Cylinder)
+		return ok && sameSurface(&a.SurfaceFn, &b.SurfaceFn)
+	case *Plane:
+		b, ok := b.(*Plane)
+		return ok && a.Plane == b.Plane && sameSurface(&a.SurfaceFn, &b.SurfaceFn)
+	case *Instance:
+		b, ok := b.(*Instance)
+		return ok && a.Prototype == b.Prototype
+	default:
+		return false
+	}
+}
+
+// sameSurface reports whether a and b give the same materials. Precomputed
+// materials are compared by value, and closures by identity, since
+// transformed copies of an object share its closure.
+func sameSurface(a, b *VSurfaceFn) bool {
+	switch {
+	case a.Material != nil || b.Material != nil:
+		return a.Material != nil && b.Material != nil && *a.Material == *b.Material
+	case a.Faces != nil || b.Faces != nil:
+		return slices.Equal(a.Faces, b.Faces)
+	default:
+		return a.Closure == b.Closure
+	}
+}
+
 func difference(e *EvalState) error {
 	a, b, err := Pop2[SceneObject](e)
 	if err != nil {
@@ -1156,7 +1393,7 @@ func popRenderArgs(e *EvalState) (*RenderArgs, error) {
 	return &RenderArgs{
 		Width:        int(width),
 		Height:       int(height),
-		File:         string(file),
+		File:         file.Value,
 		Fov:          float64(fov),
 		Depth:        int(depth),
 		Scene:        obj,
@@ -1197,3 +1434,91 @@ func renderWithBgGradient(e *EvalState) error {
 	}
 	return e.Render(e, renderArgs)
 }
+
+// renderWithEnvMap is like render, but takes an environment map (see
+// EnvironmentMap) after the usual arguments:
+//
+//	... file envfile rotation ambientscale renderWithEnvMap
+//
+// The environment file may be a Radiance .hdr image, or any image format
+// supported by the image package. A relative file name is resolved against
+// the directory of the file the string is in, like an #include, or Dir.
+func renderWithEnvMap(e *EvalState) error {
+	rotation, ambientScale, err := Pop2[VReal](e)
+	if err != nil {
+		return err
+	}
+	envFile, err := PopValue[VString](e)
+	if err != nil {
+		return err
+	}
+	renderArgs, err := popRenderArgs(e)
+	if err != nil {
+		return err
+	}
+
+	renderArgs.EnvMap = &EnvironmentMap{
+		File:         envFile.path(e.Dir),
+		Rotation:     float64(rotation),
+		AmbientScale: float64(ambientScale),
+	}
+
+	if e.Render == nil {
+		return fmt.Errorf("render function not set")
+	}
+	return e.Render(e, renderArgs)
+}
+
+// renderWithSky is like render, but replaces the background with a daylight
+// sky, lit by a sun in the given direction:
+//
+//	... file sundir turbidity renderWithSky
+func renderWithSky(e *EvalState) error {
+	turbidity, err := PopValue[VReal](e)
+	if err != nil {
+		return err
+	}
+	sunDir, err := PopValue[*prim.Vec3](e)
+	if err != nil {
+		return err
+	}
+	renderArgs, err := popRenderArgs(e)
+	if err != nil {
+		return err
+	}
+
+	renderArgs.Sky = &Sky{
+		SunDirection: *sunDir,
+		Turbidity:    float64(turbidity),
+	}
+
+	if e.Render == nil {
+		return fmt.Errorf("render function not set")
+	}
+	return e.Render(e, renderArgs)
+}
+
+// renderWithLens is like render, but uses a thin lens camera with the given
+// aperture radius, focused at the given distance from the eye:
+//
+//	... file aperture focaldist renderWithLens
+func renderWithLens(e *EvalState) error {
+	aperture, focalDistance, err := Pop2[VReal](e)
+	if err != nil {
+		return err
+	}
+	renderArgs, err := popRenderArgs(e)
+	if err != nil {
+		return err
+	}
+
+	renderArgs.Lens = &Lens{
+		ApertureRadius: float64(aperture),
+		FocalDistance:  float64(focalDistance),
+	}
+
+	if e.Render == nil {
+		return fmt.Errorf("render function not set")
+	}
+	return e.Render(e, renderArgs)
+}
@@ -1,6 +1,7 @@
 package gml
 
 import (
+	"errors"
 	"flag"
 	"fmt"
 	"os"
@@ -54,10 +55,58 @@ func TestEvalErrorPositions(t *testing.T) {
 			if !strings.HasPrefix(err.Error(), tt.wantPrefix) {
 				t.Errorf("error %q does not start with %q", err.Error(), tt.wantPrefix)
 			}
+			if pos, ok := ErrorPosition(err); !ok || pos.String()+":" != tt.wantPrefix {
+				t.Errorf("ErrorPosition(%q) = %v, %v, want %s", err.Error(), pos, ok, tt.wantPrefix)
+			}
+		})
+	}
+}
+
+// TestErrorPositionWrapped verifies that lexer and parser error positions
+// are found even when the error is wrapped.
+func TestErrorPositionWrapped(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		program string
+		want    Pos
+	}{
+		{"lexer", "1 2\n  @", Pos{Line: 2, Col: 3}},
+		{"parser", "1 2\n  }", Pos{Line: 2, Col: 3}},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := NewEvalState().Parse(tt.program)
+			if err == nil {
+				t.Fatalf("Parse(%q) succeeded, want an error", tt.program)
+			}
+			err = fmt.Errorf("rendering scene.gml: %w", err)
+			if pos, ok := ErrorPosition(err); !ok || pos != tt.want {
+				t.Errorf("ErrorPosition(%q) = %v, %v, want %v", err, pos, ok, tt.want)
+			}
 		})
 	}
 }
 
+func TestEvalCallDepth(t *testing.T) {
+	for _, program := range []string{
+		"{ /f f f apply } /f f f apply",
+		"{ /f true { f f apply } { } if } /f f f apply",
+	} {
+		if err := evalError(t, program); !errors.Is(err, ErrCallDepth) {
+			t.Errorf("%s: got error %v, want %v", program, err, ErrCallDepth)
+		}
+	}
+
+	// Recursion that ends is fine.
+	st := NewEvalState()
+	program := "{ /self /n n 0 eqi { 0 } { n 1 subi self self apply 1 addi } if } /count 1000 count count apply"
+	if err := st.ParseAndEval(program); err != nil {
+		t.Fatalf("%s: %v", program, err)
+	}
+	if diff := cmp.Diff([]Value{VInt(1000)}, st.Stack); diff != "" {
+		t.Errorf("%s: stack mismatch (-want +got):\n%s", program, diff)
+	}
+}
+
 // TestSimpleEval tests some simple cases with no render call.
 func TestSimpleEval(t *testing.T) {
 	type testCase struct {
@@ -114,6 +163,29 @@ func TestSimpleEval(t *testing.T) {
 				`,
 			want: VInt(4),
 		},
+		{
+			name: "rebind in function",
+			program: `
+				{ 1 /x { x } /f 2 /x f apply x addi } apply`,
+			want: VInt(3),
+		},
+		{
+			name: "bound after closure",
+			program: `
+				1 /y
+				{ { y } /f 2 /y f apply } apply  % f sees the top level y`,
+			want: VInt(1),
+		},
+		{
+			name:    "outer frames",
+			program: `10 3 { /b /a { { a b subi } apply } apply } apply`,
+			want:    VInt(7),
+		},
+		{
+			name:    "bound in array",
+			program: `{ [ 1 /x x ] x } apply`,
+			want:    VInt(1),
+		},
 	} {
 		t.Run(tt.name, func(t *testing.T) {
 			st := NewEvalState()
@@ -134,6 +206,30 @@ func TestSimpleEval(t *testing.T) {
 	}
 }
 
+// TestBytecodeSlots checks that variables bound in function bodies are
+// loaded from frame slots, and only the rest are looked up by ID.
+func TestBytecodeSlots(t *testing.T) {
+	st := NewEvalState()
+	program, err := st.Parse(`1 /g { /a { /b a b g } } /f`)
+	if err != nil {
+		t.Fatalf("parse error: %v", err)
+	}
+	code, err := compileBytecode(program, nil)
+	if err != nil {
+		t.Fatalf("compileBytecode: %v", err)
+	}
+	inner := code.protos[0].protos[0]
+	want := []instr{
+		{op: opStore, arg: 0},
+		{op: opLoad, depth: 1, arg: 0},
+		{op: opLoad, arg: 0},
+		{op: opLoadGlobal, arg: int32(st.IDMapping.NameIDMap["g"])},
+	}
+	if diff := cmp.Diff(want, inner.instrs, cmp.AllowUnexported(instr{})); diff != "" {
+		t.Errorf("inner function instructions mismatch (-want +got):\n%s", diff)
+	}
+}
+
 func checkRenderArgsVsGolden(got *RenderArgs, st *EvalState, goldenFilePath string) (gotLines []string, err error) {
 	gotLines = RenderArgsToLines(got, &st.IDMapping)
 
@@ -243,3 +339,69 @@ func BenchmarkParse(b *testing.B) {
 		}
 	}
 }
+
+// fibProgram computes fib(18) with naive recursion, which exercises closure
+// calls, variable lookups and builtins.
+const fibProgram = `
+	{ /self /n
+	  n 2 lessi
+	  { n }
+	  { n 1 subi self self apply n 2 subi self self apply addi }
+	  if
+	} /fib
+	18 fib fib apply`
+
+func TestBind(t *testing.T) {
+	st := NewEvalState()
+	st.Bind("frame", VInt(3))
+	st.Bind("time", VReal(0.5))
+	if err := st.ParseAndEval("frame 1 addi time { /time time 2.0 mulf } apply"); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if diff := cmp.Diff(st.Stack, []Value{VInt(4), VReal(1)}); diff != "" {
+		t.Errorf("stack mismatch (-got +want):\n%s", diff)
+	}
+}
+
+func TestEvalFib(t *testing.T) {
+	st := NewEvalState()
+	if err := st.ParseAndEval(fibProgram); err != nil {
+		t.Fatalf("eval error: %v", err)
+	}
+	if diff := cmp.Diff(st.Stack, []Value{VInt(2584)}); diff != "" {
+		t.Errorf("stack mismatch (-got +want):\n%s", diff)
+	}
+}
+
+func BenchmarkEvalFib(b *testing.B) {
+	program, err := NewEvalState().Parse(fibProgram)
+	if err != nil {
+		b.Fatalf("parse error: %v", err)
+	}
+	for b.Loop() {
+		st := NewEvalState()
+		if err := st.Eval(program); err != nil {
+			b.Fatalf("eval error: %v", err)
+		}
+	}
+}
+
+// BenchmarkEvalFibManyBindings is BenchmarkEvalFib with many unrelated
+// variables in scope, which every closure captures.
+func BenchmarkEvalFibManyBindings(b *testing.B) {
+	var sb strings.Builder
+	for i := range 500 {
+		fmt.Fprintf(&sb, "%d /unused%d\n", i, i)
+	}
+	sb.WriteString(fibProgram)
+	program, err := NewEvalState().Parse(sb.String())
+	if err != nil {
+		b.Fatalf("parse error: %v", err)
+	}
+	for b.Loop() {
+		st := NewEvalState()
+		if err := st.Eval(program); err != nil {
+			b.Fatalf("eval error: %v", err)
+		}
+	}
+}
@@ -53,6 +53,21 @@ func RenderArgsToLines(args *RenderArgs, idMapping *IDMapping) []string {
 		add("p2: " + fmt3(&args.BgColorEnd))
 		indent--
 	}
+	if args.EnvMap != nil {
+		add("environment-map:")
+		indent++
+		add("file: " + args.EnvMap.File)
+		add("rotation: " + fmtFloat(args.EnvMap.Rotation))
+		add("ambient-scale: " + fmtFloat(args.EnvMap.AmbientScale))
+		indent--
+	}
+	if args.Sky != nil {
+		add("sky:")
+		indent++
+		add("sun-direction: " + fmt3(&args.Sky.SunDirection))
+		add("turbidity: " + fmtFloat(args.Sky.Turbidity))
+		indent--
+	}
 	add("ambient: " + fmt3(args.AmbientLight))
 	for _, l := range args.Lights {
 		add("light:")
@@ -69,7 +84,8 @@ func RenderArgsToLines(args *RenderArgs, idMapping *IDMapping) []string {
 
 		if fn.Closure != nil {
 			add("code: " + fn.Closure.Code.String())
-			bindings := fn.Closure.Env.Bindings()
+			env := fn.Closure.env()
+			bindings := env.Bindings()
 			if len(bindings) == 0 {
 				return
 			}
@@ -134,6 +150,18 @@ func RenderArgsToLines(args *RenderArgs, idMapping *IDMapping) []string {
 				addSceneObj(o)
 			}
 			indent--
+		case *Instance:
+			add("instance:")
+			indent++
+			addXform(*obj.TransformMat)
+			addSceneObj(obj.Prototype)
+			indent--
+		case *Motion:
+			add("motion:")
+			indent++
+			addSceneObj(obj.Start)
+			addSceneObj(obj.End)
+			indent--
 		default:
 			panic("unknown scene object type")
 		}
@@ -23,6 +23,9 @@ const (
 type Pos struct {
 	Line int
 	Col  int
+	// File is the absolute path of the file, or empty if the program is
+	// not from a file.
+	File string
 }
 
 func (p Pos) String() string {
@@ -41,6 +44,23 @@ func (p Pos) prefix() string {
 	return fmt.Sprintf("%d:%d: ", p.Line, p.Col)
 }
 
+// PosError is an error at a source position, like a lexer, parser or
+// compiler error. Its message starts with the position, if it is known.
+type PosError struct {
+	Pos Pos
+	Err error
+}
+
+// errorAt returns a PosError at pos, with the message formatted like
+// fmt.Errorf.
+func errorAt(pos Pos, format string, args ...any) error {
+	return &PosError{Pos: pos, Err: fmt.Errorf(format, args...)}
+}
+
+func (e *PosError) Error() string { return e.Pos.prefix() + e.Err.Error() }
+
+func (e *PosError) Unwrap() error { return e.Err }
+
 type TokenList []TokenGroup
 
 type TokenGroup interface {
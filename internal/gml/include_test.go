@@ -5,6 +5,8 @@ import (
 	"path/filepath"
 	"strings"
 	"testing"
+
+	"github.com/google/go-cmp/cmp"
 )
 
 func writeTestFile(t *testing.T, dir, name, content string) string {
@@ -162,6 +164,56 @@ func TestLexUnknownDirective(t *testing.T) {
 	}
 }
 
+func TestParseNoIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "lib.gml", "1\n")
+	t.Chdir(dir)
+
+	state := NewEvalState()
+	state.NoIncludes = true
+	_, err := state.Parse("2\n  #include \"lib.gml\"")
+	if err == nil {
+		t.Fatal("Parse succeeded with an #include, want an error")
+	}
+	if pos, ok := ErrorPosition(err); !ok || pos.Line != 2 {
+		t.Errorf("ErrorPosition(%q) = %v, %v, want line 2", err, pos, ok)
+	}
+
+	state.NoIncludes = false
+	if _, err := state.Parse("#include \"lib.gml\""); err != nil {
+		t.Errorf("Parse with includes allowed: %v", err)
+	}
+}
+
+// TestEnvMapRelativeToIncludingFile checks that an environment map's file
+// name is resolved against the directory of the file the name is in, not
+// the directory of the file that renders it.
+func TestEnvMapRelativeToIncludingFile(t *testing.T) {
+	dir := t.TempDir()
+	if err := os.Mkdir(filepath.Join(dir, "sub"), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	writeTestFile(t, dir, "sub/lib.gml", `"sky.hdr" /subEnv`+"\n")
+	mainPath := writeTestFile(t, dir, "main.gml", `#include "sub/lib.gml"
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere /s
+		1.0 1.0 1.0 point [ ] s 1 90.0 4 4 "out.ppm" subEnv 0.0 0.0 renderWithEnvMap
+		1.0 1.0 1.0 point [ ] s 1 90.0 4 4 "out.ppm" "sky.hdr" 0.0 0.0 renderWithEnvMap`)
+
+	var got []string
+	state := NewEvalState()
+	state.Render = func(state *EvalState, args *RenderArgs) error {
+		got = append(got, args.EnvMap.File)
+		return nil
+	}
+	if err := state.ParseAndEvalFile(mainPath); err != nil {
+		t.Fatalf("ParseAndEvalFile: %v", err)
+	}
+	want := []string{filepath.Join(dir, "sub", "sky.hdr"), filepath.Join(dir, "sky.hdr")}
+	if diff := cmp.Diff(want, got); diff != "" {
+		t.Errorf("environment map files mismatch (-want +got):\n%s", diff)
+	}
+}
+
 // realFixturesUsingInclude are testdata/*.gml files known to use #include,
 // carried over from the original GML contest test suite. Before #include
 // support existed, none of these could be parsed.
@@ -184,3 +236,81 @@ func TestParseRealIncludeFixtures(t *testing.T) {
 		})
 	}
 }
+
+func TestResolveIncludes(t *testing.T) {
+	dir := t.TempDir()
+	writeTestFile(t, dir, "lib.gml", "#ifndef _LIB_\n#define _LIB_\n{ /x x 1 addi } /inc % comment\n#endif\n")
+	writeTestFile(t, dir, "mid.gml", `#include "lib.gml"`+"\n")
+	mainPath := writeTestFile(t, dir, "main.gml",
+		"#include \"lib.gml\"\n#include \"mid.gml\"\n41 inc apply\n\"a \\\"quoted\\\"\\n\\tstring\" 2.5 true\n")
+
+	got, err := ResolveIncludes(mainPath)
+	if err != nil {
+		t.Fatalf("ResolveIncludes: %v", err)
+	}
+	// Tokens from different files that are on the same line number end up
+	// on the same line.
+	want := "{ /x x 1 addi } /inc 41 inc apply\n\"a \\\"quoted\\\"\\n\\tstring\" 2.5 true\n"
+	if got != want {
+		t.Errorf("ResolveIncludes() = %q, want %q", got, want)
+	}
+}
+
+func TestResolveIncludesRealFixtures(t *testing.T) {
+	for _, name := range realFixturesUsingInclude {
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join("testdata", name)
+			resolved, err := ResolveIncludes(path)
+			if err != nil {
+				t.Fatalf("ResolveIncludes: %v", err)
+			}
+			if strings.Contains(resolved, "#") {
+				t.Errorf("resolved program still has directives:\n%s", resolved)
+			}
+			fromFile, err := NewEvalState().ParseFile(path)
+			if err != nil {
+				t.Fatalf("ParseFile: %v", err)
+			}
+			fromString, err := NewEvalState().Parse(resolved)
+			if err != nil {
+				t.Fatalf("Parse(resolved): %v", err)
+			}
+			if fromFile.String() != fromString.String() {
+				t.Errorf("resolved program parses differently:\n got: %v\nwant: %v", fromString, fromFile)
+			}
+		})
+	}
+}
+
+func TestResolveIncludesMissingFile(t *testing.T) {
+	dir := t.TempDir()
+	mainPath := writeTestFile(t, dir, "main.gml", "1\n#include \"missing.gml\"\n")
+	if _, err := ResolveIncludes(mainPath); err == nil {
+		t.Error("ResolveIncludes succeeded, want an error for a missing include")
+	}
+}
+
+func TestSourceFiles(t *testing.T) {
+	dir := t.TempDir()
+	libPath := writeTestFile(t, dir, "lib.gml", "#ifndef _LIB_\n#define _LIB_\n42\n#endif\n")
+	midPath := writeTestFile(t, dir, "mid.gml", `#include "lib.gml"`+"\n")
+	mainPath := writeTestFile(t, dir, "main.gml", "#include \"mid.gml\"\n#include \"lib.gml\"\n1\n")
+
+	got, err := SourceFiles(mainPath)
+	if err != nil {
+		t.Fatalf("SourceFiles: %v", err)
+	}
+	if diff := cmp.Diff([]string{mainPath, midPath, libPath}, got); diff != "" {
+		t.Errorf("SourceFiles mismatch (-want +got):\n%s", diff)
+	}
+
+	// A missing file is still a source, so that it can be watched for.
+	writeTestFile(t, dir, "mid.gml", `#include "missing.gml"`+"\n")
+	got, err = SourceFiles(mainPath)
+	if err == nil {
+		t.Error("SourceFiles succeeded, want an error for a missing include")
+	}
+	if diff := cmp.Diff([]string{mainPath, midPath, filepath.Join(dir, "missing.gml")}, got); diff != "" {
+		t.Errorf("SourceFiles with a missing include mismatch (-want +got):\n%s", diff)
+	}
+}
@@ -11,6 +11,7 @@ import (
 	"fmt"
 	"os"
 	"path/filepath"
+	"slices"
 	"strings"
 )
 
@@ -62,6 +63,13 @@ type LexerToken struct {
 	Literal string
 	Line    int
 	Col     int
+	// File is the absolute path of the file the token is in, or empty if
+	// it is not from a file.
+	File string
+}
+
+func (t *LexerToken) pos() Pos {
+	return Pos{Line: t.Line, Col: t.Col, File: t.File}
 }
 
 // lexerFrame holds the position-tracking state for a single source: either
@@ -91,6 +99,12 @@ type Lexer struct {
 	// condDepth counts #ifndef blocks that are currently open (condition
 	// was true) and awaiting a matching #endif.
 	condDepth int
+	// noIncludes makes #include an error, for programs from untrusted
+	// sources that must not read local files.
+	noIncludes bool
+	// files holds the absolute paths of every file this lexer has read or
+	// tried to read, in the order they were first included.
+	files []string
 }
 
 func NewLexer(input string) *Lexer {
@@ -109,6 +123,7 @@ func NewFileLexer(path string) (*Lexer, error) {
 	l := &Lexer{
 		lexerFrame: lexerFrame{input: content, line: 1, file: abs},
 		active:     map[string]bool{abs: true},
+		files:      []string{abs},
 	}
 	l.readChar()
 	return l, nil
@@ -126,6 +141,84 @@ func readFileAbs(path string) (abs string, content string, err error) {
 	return abs, string(b), nil
 }
 
+// ResolveIncludes returns the program in the file at path with its
+// preprocessor directives applied, so that it can be parsed without access
+// to the files it includes. Comments and formatting are not preserved, and
+// line numbers only match within each file. Relative file names in strings
+// are resolved against the directory the result is run in, rather than
+// that of the included file they came from.
+func ResolveIncludes(path string) (string, error) {
+	l, err := NewFileLexer(path)
+	if err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	prevLine := 1
+	for {
+		tk := l.NextToken()
+		switch tk.Type {
+		case TokenEOF:
+			sb.WriteByte('\n')
+			return sb.String(), nil
+		case TokenError, TokenIllegal:
+			return "", fmt.Errorf("%s:%d:%d: %s", l.file, tk.Line, tk.Col, tk.Literal)
+		}
+		if sb.Len() > 0 {
+			if tk.Line != prevLine {
+				sb.WriteByte('\n')
+			} else {
+				sb.WriteByte(' ')
+			}
+		}
+		prevLine = tk.Line
+		if tk.Type == TokenString {
+			writeQuotedString(&sb, tk.Literal)
+		} else {
+			sb.WriteString(tk.Literal)
+		}
+	}
+}
+
+// SourceFiles returns the absolute paths of the file at path and of every
+// file it includes, directly or indirectly. If a directive fails, for
+// example because an included file is missing, it returns the files found
+// so far, including the missing one, along with the error.
+func SourceFiles(path string) ([]string, error) {
+	l, err := NewFileLexer(path)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		switch tk := l.NextToken(); tk.Type {
+		case TokenEOF:
+			return l.files, nil
+		case TokenError:
+			return l.files, fmt.Errorf("%s:%d:%d: %s", l.file, tk.Line, tk.Col, tk.Literal)
+		}
+	}
+}
+
+// writeQuotedString writes s as a GML string literal, using the escapes
+// that readString understands.
+func writeQuotedString(sb *strings.Builder, s string) {
+	sb.WriteByte('"')
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\n':
+			sb.WriteString(`\n`)
+		case '\t':
+			sb.WriteString(`\t`)
+		case '"':
+			sb.WriteString(`\"`)
+		case '\\':
+			sb.WriteString(`\\`)
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	sb.WriteByte('"')
+}
+
 func (l *Lexer) readChar() {
 	if l.ch == '\n' {
 		l.line++
@@ -162,14 +255,14 @@ func (l *Lexer) popFrame() bool {
 // newToken returns a single byte token with the current
 // character and advances the lexer.
 func (l *Lexer) newToken(tokenType LexemeType, line, col int) LexerToken {
-	tk := LexerToken{Type: tokenType, Literal: string(l.ch), Line: line, Col: col}
+	tk := LexerToken{Type: tokenType, Literal: string(l.ch), Line: line, Col: col, File: l.file}
 	l.readChar()
 	return tk
 }
 
 func (l *Lexer) NextToken() LexerToken {
 	l.skipWhitespace()
-	line, col := l.line, l.col
+	line, col, file := l.line, l.col, l.file
 
 	switch l.ch {
 	case '{':
@@ -184,10 +277,10 @@ func (l *Lexer) NextToken() LexerToken {
 		if isLetter(l.peekChar()) {
 			l.readChar()
 			literal := l.readIdentifier()
-			return LexerToken{Type: TokenBinder, Literal: "/" + literal, Line: line, Col: col}
+			return LexerToken{Type: TokenBinder, Literal: "/" + literal, Line: line, Col: col, File: file}
 		} else if l.peekChar() == '*' {
 			if err := l.skipBlockComment(); err != nil {
-				return LexerToken{Type: TokenError, Literal: err.Error(), Line: line, Col: col}
+				return LexerToken{Type: TokenError, Literal: err.Error(), Line: line, Col: col, File: file}
 			}
 			return l.NextToken()
 		} else {
@@ -199,17 +292,17 @@ func (l *Lexer) NextToken() LexerToken {
 		if err != nil {
 			typ = TokenIllegal
 		}
-		return LexerToken{Type: typ, Literal: literal, Line: line, Col: col}
+		return LexerToken{Type: typ, Literal: literal, Line: line, Col: col, File: file}
 	case '%':
 		l.skipComment()
 		return l.NextToken()
 	case '#':
 		if err := l.handleDirective(); err != nil {
-			return LexerToken{Type: TokenError, Literal: err.Error(), Line: line, Col: col}
+			return LexerToken{Type: TokenError, Literal: err.Error(), Line: line, Col: col, File: file}
 		}
 		return l.NextToken()
 	case 0:
-		return LexerToken{Type: TokenEOF, Literal: "", Line: line, Col: col}
+		return LexerToken{Type: TokenEOF, Literal: "", Line: line, Col: col, File: file}
 	default:
 		if isLetter(l.ch) {
 			literal := l.readIdentifier()
@@ -219,10 +312,10 @@ func (l *Lexer) NextToken() LexerToken {
 			} else {
 				tokType = TokenIdent
 			}
-			return LexerToken{Type: tokType, Literal: literal, Line: line, Col: col}
+			return LexerToken{Type: tokType, Literal: literal, Line: line, Col: col, File: file}
 		} else if isDigit(l.ch) || l.ch == '-' {
 			literal, typ := l.readNumber()
-			return LexerToken{Type: typ, Literal: literal, Line: line, Col: col}
+			return LexerToken{Type: typ, Literal: literal, Line: line, Col: col, File: file}
 		} else {
 			return l.newToken(TokenIllegal, line, col)
 		}
@@ -274,6 +367,9 @@ func (l *Lexer) handleDirective() error {
 	word := l.readIdentifier()
 	switch word {
 	case "include":
+		if l.noIncludes {
+			return errors.New("#include is not allowed here")
+		}
 		return l.handleInclude()
 	case "ifndef":
 		return l.handleIfndef()
@@ -307,6 +403,11 @@ func (l *Lexer) pushInclude(name string) error {
 		dir = filepath.Dir(l.file)
 	}
 	path := filepath.Join(dir, name)
+	// Record the file even if it cannot be read, so that a caller watching
+	// the files notices when it is created.
+	if abs, err := filepath.Abs(path); err == nil && !slices.Contains(l.files, abs) {
+		l.files = append(l.files, abs)
+	}
 	abs, content, err := readFileAbs(path)
 	if err != nil {
 		return fmt.Errorf("#include %q: %w", name, err)
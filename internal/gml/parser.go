@@ -1,7 +1,6 @@
 package gml
 
 import (
-	"fmt"
 	"strconv"
 	"strings"
 )
@@ -47,10 +46,10 @@ func (p *Parser) Parse() (TokenList, error) {
 		return nil, err
 	}
 	if p.curr.Type == TokenError {
-		return nil, fmt.Errorf("%d:%d: %s", p.curr.Line, p.curr.Col, p.curr.Literal)
+		return nil, errorAt(p.curr.pos(), "%s", p.curr.Literal)
 	}
 	if p.curr.Type != TokenEOF {
-		return nil, fmt.Errorf("%d:%d: unexpected token: %s, expected end of input", p.curr.Line, p.curr.Col, p.curr.Type)
+		return nil, errorAt(p.curr.pos(), "unexpected token: %s, expected end of input", p.curr.Type)
 	}
 	return l, nil
 }
@@ -63,10 +62,10 @@ func (p *Parser) readAndAdvanceToken() LexerToken {
 
 func (p *Parser) consume(tokenType LexemeType) error {
 	if p.curr.Type == TokenError {
-		return fmt.Errorf("%d:%d: %s", p.curr.Line, p.curr.Col, p.curr.Literal)
+		return errorAt(p.curr.pos(), "%s", p.curr.Literal)
 	}
 	if p.curr.Type != tokenType {
-		return fmt.Errorf("%d:%d: expected %s, got %s", p.curr.Line, p.curr.Col, tokenType, p.curr.Type)
+		return errorAt(p.curr.pos(), "expected %s, got %s", tokenType, p.curr.Type)
 	}
 	p.readAndAdvanceToken()
 	return nil
@@ -136,7 +135,7 @@ func (p *Parser) parseSingleToken() (TokenGroup, error) {
 		return &Identifier{
 			Name: tok.Literal,
 			ID:   p.idMapping.GetOrCreateId(tok.Literal),
-			Pos:  Pos{Line: tok.Line, Col: tok.Col},
+			Pos:  tok.pos(),
 		}, nil
 	case TokenInt:
 		return p.parseIntLiteral()
@@ -144,13 +143,13 @@ func (p *Parser) parseSingleToken() (TokenGroup, error) {
 		return p.parseFloatLiteral()
 	case TokenString:
 		tok := p.readAndAdvanceToken()
-		return &StringLiteral{Value: tok.Literal, Pos: Pos{Line: tok.Line, Col: tok.Col}}, nil
+		return &StringLiteral{Value: tok.Literal, Pos: tok.pos()}, nil
 	case TokenBinder:
 		return p.parseBinder()
 	case TokenBoolean:
 		return p.parseBooleanLiteral()
 	default:
-		return nil, fmt.Errorf("%d:%d: unexpected token: %s", p.curr.Line, p.curr.Col, p.currToken().Type)
+		return nil, errorAt(p.curr.pos(), "unexpected token: %s", p.currToken().Type)
 	}
 }
 
@@ -158,13 +157,13 @@ func (p *Parser) parseBinder() (*Binder, error) {
 	token := p.readAndAdvanceToken()
 	name := token.Literal
 	if !strings.HasPrefix(name, "/") {
-		return nil, fmt.Errorf("%d:%d: binder must start with /, got %s", token.Line, token.Col, token.Type)
+		return nil, errorAt(token.pos(), "binder must start with /, got %s", token.Type)
 	}
 	name = name[1:]
 	return &Binder{
 		Name: name,
 		ID:   p.idMapping.GetOrCreateId(name),
-		Pos:  Pos{Line: token.Line, Col: token.Col},
+		Pos:  token.pos(),
 	}, nil
 }
 
@@ -172,31 +171,31 @@ func (p *Parser) parseFloatLiteral() (TokenGroup, error) {
 	token := p.readAndAdvanceToken()
 	val, err := strconv.ParseFloat(token.Literal, 64)
 	if err != nil {
-		return nil, fmt.Errorf("%d:%d: could not parse number: %s", token.Line, token.Col, token.Literal)
+		return nil, errorAt(token.pos(), "could not parse number: %s", token.Literal)
 	}
-	return &FloatLiteral{Value: val, Pos: Pos{Line: token.Line, Col: token.Col}}, nil
+	return &FloatLiteral{Value: val, Pos: token.pos()}, nil
 }
 
 func (p *Parser) parseIntLiteral() (TokenGroup, error) {
 	token := p.readAndAdvanceToken()
 	val, err := strconv.ParseInt(token.Literal, 10, 64)
 	if err != nil {
-		return nil, fmt.Errorf("%d:%d: could not parse number: %s", token.Line, token.Col, token.Literal)
+		return nil, errorAt(token.pos(), "could not parse number: %s", token.Literal)
 	}
-	return &IntLiteral{Value: val, Pos: Pos{Line: token.Line, Col: token.Col}}, nil
+	return &IntLiteral{Value: val, Pos: token.pos()}, nil
 }
 
 func (p *Parser) parseBooleanLiteral() (TokenGroup, error) {
 	token := p.readAndAdvanceToken()
 	val, err := strconv.ParseBool(token.Literal)
 	if err != nil {
-		return nil, fmt.Errorf("%d:%d: could not parse boolean: %s", token.Line, token.Col, token.Literal)
+		return nil, errorAt(token.pos(), "could not parse boolean: %s", token.Literal)
 	}
-	return &BoolLiteral{Value: val, Pos: Pos{Line: token.Line, Col: token.Col}}, nil
+	return &BoolLiteral{Value: val, Pos: token.pos()}, nil
 }
 
 func (p *Parser) parseArray() (TokenGroup, error) {
-	pos := Pos{Line: p.curr.Line, Col: p.curr.Col}
+	pos := p.curr.pos()
 	if err := p.consume(TokenLBracket); err != nil {
 		return nil, err
 	}
@@ -211,7 +210,7 @@ func (p *Parser) parseArray() (TokenGroup, error) {
 }
 
 func (p *Parser) parseFunction() (TokenGroup, error) {
-	pos := Pos{Line: p.curr.Line, Col: p.curr.Col}
+	pos := p.curr.pos()
 	if err := p.consume(TokenLCurly); err != nil {
 		return nil, err
 	}
@@ -2,6 +2,8 @@ package gml
 
 import (
 	"embed"
+	"fmt"
+	"strings"
 )
 
 var (
@@ -16,3 +18,36 @@ func MustReadTestdataFile(name string) string {
 	}
 	return string(b)
 }
+
+// KnownGap is a feature of the GML specification that is not implemented
+// yet.
+type KnownGap struct {
+	Tier int
+	// Renderer is whether only the renderer is missing the feature, so
+	// that the evaluator has its operator.
+	Renderer bool
+}
+
+// ReadKnownGaps returns the features listed in testdata/known_gaps.txt, by
+// name. The conformance tests of this package and of the renderer skip
+// the tests that need them.
+func ReadKnownGaps() (map[string]KnownGap, error) {
+	data, err := testdataFS.ReadFile("testdata/known_gaps.txt")
+	if err != nil {
+		return nil, err
+	}
+	gaps := map[string]KnownGap{}
+	for line := range strings.Lines(string(data)) {
+		if line = strings.TrimSpace(line); line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		var name, where string
+		var gap KnownGap
+		if _, err := fmt.Sscanf(line, "%s %d %s", &name, &gap.Tier, &where); err != nil || (where != "evaluator" && where != "renderer") {
+			return nil, fmt.Errorf("known_gaps.txt: bad line %q", line)
+		}
+		gap.Renderer = where == "renderer"
+		gaps[name] = gap
+	}
+	return gaps, nil
+}
@@ -0,0 +1,39 @@
+% sheared-cylinder.gml
+%
+% A cylinder scaled non-uniformly after being rotated, which shears it. Its sides and caps should be lit according to their actual
+% orientation.
+%
+% OUTPUTS: sheared-cylinder.ppm
+%
+
+{ /v /u /face
+  face 0 eqi
+  { 0.2 0.6 0.9 point }
+  { face 1 eqi { 0.9 0.3 0.3 point } { 0.3 0.9 0.3 point } if }
+  if
+  0.8 0.3 20.0
+} cylinder
+  0.0 0.0 3.0 translate
+  -20.0 rotatey
+  30.0 rotatex
+  1.0 0.4 1.0 scale
+  45.0 rotatez
+  0.0 -0.5 0.0 translate
+{ /v /u /face
+  0.8 0.8 0.8 point 1.0 0.0 1.0
+} plane
+  0.0 -1.5 0.0 translate
+union
+  /scene
+
+-3.0 4.0 0.0 point
+1.0 1.0 1.0 point pointlight /l
+
+0.2 0.2 0.2 point	% ambient
+[ l ]			% lights
+scene
+2
+90.0
+320 240
+"sheared-cylinder.ppm"
+render
@@ -0,0 +1,34 @@
+% squashed-sphere.gml
+%
+% An ellipsoid made by scaling a sphere non-uniformly and then rotating it,
+% lit from the upper left. The highlight and terminator only land in the
+% right places if normals are transformed by the inverse transpose.
+%
+% OUTPUTS: squashed-sphere.ppm
+%
+
+{ /v /u /face
+  0.9 0.6 0.2 point 0.8 0.3 20.0
+} sphere
+  0.0 0.0 4.0 translate
+  -30.0 rotatey
+  30.0 rotatez
+  2.0 0.6 1.0 scale
+{ /v /u /face
+  0.8 0.8 0.8 point 1.0 0.0 1.0
+} plane
+  0.0 -2.0 0.0 translate
+union
+  /scene
+
+-4.0 4.0 0.0 point
+1.0 1.0 1.0 point pointlight /l
+
+0.2 0.2 0.2 point	% ambient
+[ l ]			% lights
+scene
+2
+90.0
+320 240
+"squashed-sphere.ppm"
+render
@@ -0,0 +1,266 @@
+package gml
+
+import (
+	"fmt"
+	"math"
+	"path/filepath"
+)
+
+// Programs are lowered to a compact bytecode before being evaluated.
+// Identifiers are resolved when the bytecode is compiled: builtins become an
+// index into builtinTable, variables bound in a function body become a slot
+// in the frame of that body or of a body around it, and the rest are
+// looked up by ID among the top level bindings.
+//
+// Every binding in a function body gets a fresh slot, so a slot is only
+// written once in each frame. Closures can then share the frames they were
+// created in, rather than copying them, and still only see the bindings
+// made before they were created.
+
+type opcode uint8
+
+const (
+	opConst       opcode = iota // Push consts[arg]
+	opBuiltin                   // Run builtinTable[arg]
+	opLoad                      // Push slot arg of the frame depth bodies out
+	opStore                     // Pop a value into slot arg of the current frame
+	opLoadGlobal                // Push the top level binding with ID arg
+	opStoreGlobal               // Pop a value into the top level binding with ID arg
+	opClosure                   // Push a closure over protos[arg]
+	opArray                     // Run protos[arg] on an empty stack, and push the result as an array
+)
+
+type instr struct {
+	op    opcode
+	depth uint16
+	arg   int32
+}
+
+// bytecode is a compiled TokenList.
+type bytecode struct {
+	instrs []instr
+	// tokens holds the source token of each instruction, for error messages
+	// and the debugger.
+	tokens []TokenGroup
+	consts []Value
+	// protos holds the code for function bodies and array elements.
+	protos []*bytecode
+	source TokenList
+	// layout is the frame of a function body, or nil for top level code.
+	// Arrays share the layout of the code around them.
+	layout *frameLayout
+}
+
+// frameLayout names the slots in the frames of a function body.
+type frameLayout struct {
+	// ids holds the identifier ID bound in each slot, in the order they are
+	// bound.
+	ids []int
+	// outer is the layout of the function body the function was created
+	// in, or nil if it was created at the top level, and outerLen is the
+	// number of slots that were bound in it at the time.
+	outer    *frameLayout
+	outerLen int
+}
+
+// resolve returns where the variable id is bound, as the number of function
+// bodies out and a slot, if the first n slots of the layout, and those
+// visible in the bodies around it, are bound.
+func (l *frameLayout) resolve(id, n int) (depth, slot int, ok bool) {
+	for ; l != nil; l, n = l.outer, l.outerLen {
+		for slot := n - 1; slot >= 0; slot-- {
+			if l.ids[slot] == id {
+				return depth, slot, true
+			}
+		}
+		depth++
+	}
+	return 0, 0, false
+}
+
+// frame holds the variables bound by one evaluation of a function body.
+type frame struct {
+	slots  []Value
+	layout *frameLayout
+	// outer is the frame the closure being evaluated was created in.
+	outer *frame
+}
+
+// lookup returns the value of the variable id, if the first n slots of f
+// are bound, or nil if no frame binds it.
+func (f *frame) lookup(id, n int) Value {
+	depth, slot, ok := f.layout.resolve(id, n)
+	if !ok {
+		return nil
+	}
+	for range depth {
+		f = f.outer
+	}
+	return f.slots[slot]
+}
+
+func compileBytecode(tokens TokenList, layout *frameLayout) (*bytecode, error) {
+	code := &bytecode{
+		instrs: make([]instr, 0, len(tokens)),
+		tokens: make([]TokenGroup, 0, len(tokens)),
+		source: tokens,
+		layout: layout,
+	}
+	for _, token := range tokens {
+		if err := code.compileToken(token); err != nil {
+			return nil, err
+		}
+	}
+	return code, nil
+}
+
+// compileFunction compiles the body of a function created in code with the
+// given layout, or at the top level if it is nil.
+func compileFunction(body TokenList, outer *frameLayout) (*bytecode, error) {
+	layout := &frameLayout{outer: outer}
+	if outer != nil {
+		layout.outerLen = len(outer.ids)
+	}
+	return compileBytecode(body, layout)
+}
+
+func (c *bytecode) emit(token TokenGroup, op opcode, arg int) {
+	c.instrs = append(c.instrs, instr{op: op, arg: int32(arg)})
+	c.tokens = append(c.tokens, token)
+}
+
+func (c *bytecode) emitConst(token TokenGroup, v Value) {
+	c.emit(token, opConst, len(c.consts))
+	c.consts = append(c.consts, v)
+}
+
+func (c *bytecode) emitProto(token TokenGroup, op opcode, proto *bytecode) {
+	c.emit(token, op, len(c.protos))
+	c.protos = append(c.protos, proto)
+}
+
+func (c *bytecode) compileToken(token TokenGroup) error {
+	switch token := token.(type) {
+	case *IntLiteral:
+		c.emitConst(token, VInt(token.Value))
+	case *FloatLiteral:
+		c.emitConst(token, VReal(token.Value))
+	case *BoolLiteral:
+		c.emitConst(token, VBool(token.Value))
+	case *StringLiteral:
+		v := VString{Value: token.Value}
+		if token.Pos.File != "" {
+			v.Dir = filepath.Dir(token.Pos.File)
+		}
+		c.emitConst(token, v)
+	case *Function:
+		proto, err := compileFunction(token.Body, c.layout)
+		if err != nil {
+			return err
+		}
+		c.emitProto(token, opClosure, proto)
+	case *Binder:
+		if c.layout == nil {
+			c.emit(token, opStoreGlobal, token.ID)
+			break
+		}
+		c.emit(token, opStore, len(c.layout.ids))
+		c.layout.ids = append(c.layout.ids, token.ID)
+	case *Identifier:
+		// Builtins shadow any variable of the same name.
+		if b := builtins[token.Name]; b != nil {
+			c.emit(token, opBuiltin, b.opcode)
+			break
+		}
+		if c.layout != nil {
+			if depth, slot, ok := c.layout.resolve(token.ID, len(c.layout.ids)); ok {
+				if depth > math.MaxUint16 {
+					return errorAt(token.Pos, "functions nested too deeply")
+				}
+				c.emit(token, opLoad, slot)
+				c.instrs[len(c.instrs)-1].depth = uint16(depth)
+				break
+			}
+		}
+		c.emit(token, opLoadGlobal, token.ID)
+	case *Array:
+		proto, err := compileBytecode(token.Elements, c.layout)
+		if err != nil {
+			return err
+		}
+		c.emitProto(token, opArray, proto)
+	default:
+		return fmt.Errorf("unknown token: %v", token)
+	}
+	return nil
+}
+
+// exec runs compiled code against the current stack, frame and
+// environment.
+func (e *EvalState) exec(code *bytecode) error {
+	for pc := range code.instrs {
+		e.CurrToken = code.tokens[pc]
+		err := e.execInstr(code, pc)
+		if e.Debugger != nil && e.Debugger() == DbgAbort {
+			return errAborted
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (e *EvalState) execInstr(code *bytecode, pc int) error {
+	in := code.instrs[pc]
+	switch in.op {
+	case opConst:
+		e.Push(code.consts[in.arg])
+	case opBuiltin:
+		return builtinTable[in.arg].Run(e)
+	case opLoad:
+		f := e.frame
+		for range in.depth {
+			f = f.outer
+		}
+		e.Push(f.slots[in.arg])
+	case opStore:
+		v, err := e.Pop()
+		if err != nil {
+			return err
+		}
+		e.frame.slots[in.arg] = v
+	case opLoadGlobal:
+		val := e.Env.Lookup(int(in.arg))
+		if val == nil {
+			token := code.tokens[pc].(*Identifier)
+			return errorAt(token.Pos, "%w: %s", ErrUnboundIdentifier, token.Name)
+		}
+		e.Push(val)
+	case opStoreGlobal:
+		v, err := e.Pop()
+		if err != nil {
+			return err
+		}
+		e.Env.Store(int(in.arg), v)
+	case opClosure:
+		proto := code.protos[in.arg]
+		e.Push(VClosure{Code: proto.source, Env: e.Env.Clone(), frame: e.frame, code: proto})
+	case opArray:
+		return e.execArray(code.protos[in.arg])
+	default:
+		panic(fmt.Sprintf("unknown opcode %d", in.op))
+	}
+	return nil
+}
+
+func (e *EvalState) execArray(code *bytecode) error {
+	oldStack := e.Stack
+	defer func() { e.Stack = oldStack }()
+	e.Stack = nil
+	if err := e.exec(code); err != nil {
+		return err
+	}
+	oldStack = append(oldStack, VArray{Elements: e.Stack})
+	return nil
+}
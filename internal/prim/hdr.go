@@ -0,0 +1,187 @@
+package prim
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"image"
+	"io"
+	"math"
+	"strings"
+)
+
+// FloatImage is an image with unbounded floating point RGB values, stored
+// in row-major order starting from the top left.
+type FloatImage struct {
+	Width, Height int
+	Pix           []Vec3
+}
+
+func NewFloatImage(width, height int) *FloatImage {
+	return &FloatImage{
+		Width:  width,
+		Height: height,
+		Pix:    make([]Vec3, width*height),
+	}
+}
+
+func (f *FloatImage) At(x, y int) Vec3 {
+	return f.Pix[y*f.Width+x]
+}
+
+func (f *FloatImage) Set(x, y int, c Vec3) {
+	f.Pix[y*f.Width+x] = c
+}
+
+// FloatImageFromImage converts an LDR image to a FloatImage with values in
+// [0.0, 1.0].
+func FloatImageFromImage(img image.Image) *FloatImage {
+	bounds := img.Bounds()
+	f := NewFloatImage(bounds.Dx(), bounds.Dy())
+	for y := range f.Height {
+		for x := range f.Width {
+			r, g, b, _ := img.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			f.Set(x, y, RGB(float64(r)/0xffff, float64(g)/0xffff, float64(b)/0xffff))
+		}
+	}
+	return f
+}
+
+var ErrInvalidHDR = errors.New("invalid Radiance HDR image")
+
+// MaxImagePixels is the largest number of pixels DecodeHDR will allocate an
+// image for. At 24 bytes a pixel, this is 1.5 GiB.
+const MaxImagePixels = 1 << 26
+
+// DecodeHDR decodes an image in the Radiance RGBE (.hdr / .pic) format.
+//
+// Both flat and run-length encoded scanlines are supported, but only the
+// standard "-Y height +X width" orientation.
+//
+// See https://paulbourke.net/dataformats/pic/
+func DecodeHDR(r io.Reader) (*FloatImage, error) {
+	br := bufio.NewReader(r)
+
+	// The header is a list of lines terminated by an empty line.
+	magic, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(magic, "#?") {
+		return nil, fmt.Errorf("%w: missing #? signature", ErrInvalidHDR)
+	}
+	for {
+		line, err := br.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		if format, ok := strings.CutPrefix(line, "FORMAT="); ok && format != "32-bit_rle_rgbe" {
+			return nil, fmt.Errorf("%w: unsupported format %q", ErrInvalidHDR, format)
+		}
+	}
+
+	resolution, err := br.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	var width, height int
+	if _, err := fmt.Sscanf(resolution, "-Y %d +X %d", &height, &width); err != nil {
+		return nil, fmt.Errorf("%w: unsupported resolution line %q", ErrInvalidHDR, strings.TrimSpace(resolution))
+	}
+	if width <= 0 || height <= 0 {
+		return nil, fmt.Errorf("%w: bad dimensions %dx%d", ErrInvalidHDR, width, height)
+	}
+	if width > MaxImagePixels/height {
+		return nil, fmt.Errorf("%w: %dx%d image is too large", ErrInvalidHDR, width, height)
+	}
+
+	img := NewFloatImage(width, height)
+	scanline := make([][4]byte, width)
+	for y := range height {
+		if err := readHDRScanline(br, scanline); err != nil {
+			return nil, fmt.Errorf("scanline %d: %w", y, err)
+		}
+		for x, rgbe := range scanline {
+			img.Set(x, y, rgbeToVec3(rgbe))
+		}
+	}
+	return img, nil
+}
+
+func readHDRScanline(br *bufio.Reader, scanline [][4]byte) error {
+	width := len(scanline)
+
+	var first [4]byte
+	if _, err := io.ReadFull(br, first[:]); err != nil {
+		return err
+	}
+	isRLE := width >= 8 && width < 0x8000 && first[0] == 2 && first[1] == 2 && first[2]&0x80 == 0
+	if !isRLE {
+		// Flat scanline.
+		scanline[0] = first
+		for x := 1; x < width; x++ {
+			if _, err := io.ReadFull(br, scanline[x][:]); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if int(first[2])<<8|int(first[3]) != width {
+		return fmt.Errorf("%w: scanline width mismatch", ErrInvalidHDR)
+	}
+
+	// Each of the 4 components is run-length encoded separately.
+	for c := range 4 {
+		x := 0
+		for x < width {
+			count, err := br.ReadByte()
+			if err != nil {
+				return err
+			}
+			if count > 128 {
+				// A run of the same value.
+				n := int(count - 128)
+				if x+n > width {
+					return fmt.Errorf("%w: run overflows scanline", ErrInvalidHDR)
+				}
+				val, err := br.ReadByte()
+				if err != nil {
+					return err
+				}
+				for range n {
+					scanline[x][c] = val
+					x++
+				}
+			} else {
+				// A literal sequence of values.
+				n := int(count)
+				if n == 0 || x+n > width {
+					return fmt.Errorf("%w: bad literal run length %d", ErrInvalidHDR, n)
+				}
+				for range n {
+					val, err := br.ReadByte()
+					if err != nil {
+						return err
+					}
+					scanline[x][c] = val
+					x++
+				}
+			}
+		}
+	}
+	return nil
+}
+
+func rgbeToVec3(rgbe [4]byte) Vec3 {
+	if rgbe[3] == 0 {
+		return Vec3{}
+	}
+	// The mantissas are 8 bit fractions with a shared exponent (offset by
+	// 128).
+	f := math.Ldexp(1.0, int(rgbe[3])-(128+8))
+	return RGB(float64(rgbe[0])*f, float64(rgbe[1])*f, float64(rgbe[2])*f)
+}
@@ -0,0 +1,86 @@
+package prim
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+const hdrHeader = "#?RADIANCE\nFORMAT=32-bit_rle_rgbe\n\n"
+
+func TestDecodeHDRFlat(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(hdrHeader)
+	buf.WriteString("-Y 2 +X 2\n")
+	buf.Write([]byte{
+		128, 0, 0, 129, // (1, 0, 0)
+		0, 128, 0, 129, // (0, 1, 0)
+		0, 0, 128, 130, // (0, 0, 2)
+		0, 0, 0, 0, // black
+	})
+
+	img, err := DecodeHDR(&buf)
+	if err != nil {
+		t.Fatalf("DecodeHDR: %v", err)
+	}
+	if img.Width != 2 || img.Height != 2 {
+		t.Fatalf("got %dx%d image, want 2x2", img.Width, img.Height)
+	}
+	for _, tt := range []struct {
+		x, y int
+		want Vec3
+	}{
+		{0, 0, RGB(1, 0, 0)},
+		{1, 0, RGB(0, 1, 0)},
+		{0, 1, RGB(0, 0, 2)},
+		{1, 1, RGB(0, 0, 0)},
+	} {
+		if got := img.At(tt.x, tt.y); got != tt.want {
+			t.Errorf("At(%d, %d) = %v, want %v", tt.x, tt.y, got, tt.want)
+		}
+	}
+}
+
+func TestDecodeHDRRunLengthEncoded(t *testing.T) {
+	var buf bytes.Buffer
+	buf.WriteString(hdrHeader)
+	buf.WriteString("-Y 1 +X 8\n")
+	buf.Write([]byte{2, 2, 0, 8})
+	// Red: a literal run of 4 values, then a repeated run of 4.
+	buf.Write([]byte{4, 0, 64, 128, 192, 128 + 4, 255})
+	// Green, blue: all zero.
+	buf.Write([]byte{128 + 8, 0})
+	buf.Write([]byte{128 + 8, 0})
+	// Exponent: all 129, i.e. a scale of 1/128.
+	buf.Write([]byte{128 + 8, 129})
+
+	img, err := DecodeHDR(&buf)
+	if err != nil {
+		t.Fatalf("DecodeHDR: %v", err)
+	}
+	wantRed := []float64{0, 0.5, 1, 1.5, 255.0 / 128, 255.0 / 128, 255.0 / 128, 255.0 / 128}
+	for x, want := range wantRed {
+		if got := img.At(x, 0); got != RGB(want, 0, 0) {
+			t.Errorf("At(%d, 0) = %v, want %v", x, got, RGB(want, 0, 0))
+		}
+	}
+}
+
+func TestDecodeHDRErrors(t *testing.T) {
+	for _, tt := range []struct {
+		name  string
+		input string
+	}{
+		{"missing signature", "RADIANCE\n\n-Y 1 +X 1\n"},
+		{"unsupported format", "#?RADIANCE\nFORMAT=32-bit_rle_xyze\n\n-Y 1 +X 1\n"},
+		{"unsupported orientation", hdrHeader + "+Y 1 +X 1\n"},
+		{"too large", hdrHeader + "-Y 1000000 +X 1000000\n"},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := DecodeHDR(bytes.NewBufferString(tt.input))
+			if !errors.Is(err, ErrInvalidHDR) {
+				t.Errorf("DecodeHDR error = %v, want %v", err, ErrInvalidHDR)
+			}
+		})
+	}
+}
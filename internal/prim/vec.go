@@ -138,9 +138,9 @@ func (v *Vec4) String() string {
 }
 
 func (v *Vec4) Normalize() *Vec4 {
-	magnitude := math.Sqrt(v.W*v.X + v.X*v.X + v.Y*v.Y + v.Z*v.Z)
+	magnitude := math.Sqrt(v.W*v.W + v.X*v.X + v.Y*v.Y + v.Z*v.Z)
 	return &Vec4{
-		W: v.Y / magnitude,
+		W: v.W / magnitude,
 		X: v.X / magnitude,
 		Y: v.Y / magnitude,
 		Z: v.Z / magnitude,
@@ -182,6 +182,12 @@ func QMul(q1, q2 *Vec4) *Vec4 {
 }
 
 func QuatToMat(q *Vec4) *Mat4 {
+	m := quatToMat(q)
+	return &m
+}
+
+// quatToMat is QuatToMat, returning the matrix by value.
+func quatToMat(q *Vec4) Mat4 {
 	q = q.Normalize()
 	x, y, z, w := q.X, q.Y, q.Z, q.W
 
@@ -189,7 +195,7 @@ func QuatToMat(q *Vec4) *Mat4 {
 	xy, xz, yz := x*y, x*z, y*z
 	wx, wy, wz := w*x, w*y, w*z
 
-	return &Mat4{
+	return Mat4{
 		[4]float64{1 - 2*(yy+zz), 2 * (xy + wz), 2 * (xz - wy), 0},
 		[4]float64{2 * (xy - wz), 1 - 2*(xx+zz), 2 * (yz + wx), 0},
 		[4]float64{2 * (xz + wy), 2 * (yz - wx), 1 - 2*(xx+yy), 0},
@@ -197,6 +203,73 @@ func QuatToMat(q *Vec4) *Mat4 {
 	}
 }
 
+// MatToQuat returns the quaternion for a rotation matrix. It is the inverse
+// of QuatToMat.
+func MatToQuat(m *Mat4) *Vec4 {
+	// QuatToMat builds the transpose of the usual matrix, so the indexes
+	// here are transposed too.
+	trace := m[0][0] + m[1][1] + m[2][2]
+	switch {
+	case trace > 0:
+		s := 2 * math.Sqrt(trace+1)
+		return &Vec4{
+			W: s / 4,
+			X: (m[1][2] - m[2][1]) / s,
+			Y: (m[2][0] - m[0][2]) / s,
+			Z: (m[0][1] - m[1][0]) / s,
+		}
+	case m[0][0] > m[1][1] && m[0][0] > m[2][2]:
+		s := 2 * math.Sqrt(1+m[0][0]-m[1][1]-m[2][2])
+		return &Vec4{
+			W: (m[1][2] - m[2][1]) / s,
+			X: s / 4,
+			Y: (m[1][0] + m[0][1]) / s,
+			Z: (m[2][0] + m[0][2]) / s,
+		}
+	case m[1][1] > m[2][2]:
+		s := 2 * math.Sqrt(1+m[1][1]-m[0][0]-m[2][2])
+		return &Vec4{
+			W: (m[2][0] - m[0][2]) / s,
+			X: (m[1][0] + m[0][1]) / s,
+			Y: s / 4,
+			Z: (m[2][1] + m[1][2]) / s,
+		}
+	default:
+		s := 2 * math.Sqrt(1+m[2][2]-m[0][0]-m[1][1])
+		return &Vec4{
+			W: (m[0][1] - m[1][0]) / s,
+			X: (m[2][0] + m[0][2]) / s,
+			Y: (m[2][1] + m[1][2]) / s,
+			Z: s / 4,
+		}
+	}
+}
+
+// QSlerp interpolates between two rotations along the shortest arc.
+func QSlerp(q1, q2 *Vec4, t float64) Vec4 {
+	dot := q1.X*q2.X + q1.Y*q2.Y + q1.Z*q2.Z + q1.W*q2.W
+	end := *q2
+	if dot < 0 {
+		// q and -q are the same rotation; go the short way round.
+		dot = -dot
+		end = Vec4{X: -q2.X, Y: -q2.Y, Z: -q2.Z, W: -q2.W}
+	}
+	a, b := 1-t, t
+	if dot < 0.9995 {
+		theta := math.Acos(dot)
+		sin := math.Sin(theta)
+		a = math.Sin((1-t)*theta) / sin
+		b = math.Sin(t*theta) / sin
+	}
+	q := Vec4{
+		X: a*q1.X + b*end.X,
+		Y: a*q1.Y + b*end.Y,
+		Z: a*q1.Z + b*end.Z,
+		W: a*q1.W + b*end.W,
+	}
+	return *q.Normalize()
+}
+
 func (q *Vec4) QInv() *Vec4 {
 	return &Vec4{
 		W: q.W,
@@ -255,6 +328,61 @@ func (t *XForm) ToMat4() *Mat4 {
 
 type Mat4 [4][4]float64
 
+// Decompose splits an affine transformation into a translation, a rotation
+// and a remaining stretch, so that the matrix is T * R * S. S is symmetric
+// but not necessarily diagonal, since the matrix may include shear.
+//
+// Unlike matrices, the parts can be interpolated separately to animate a
+// transformation.
+func (m *Mat4) Decompose() (t Vec3, r Vec4, s Mat4) {
+	t = Vec3{X: m[0][3], Y: m[1][3], Z: m[2][3]}
+
+	// Find the rotation by polar decomposition: average the matrix with
+	// its inverse transpose until it converges.
+	rot := *m
+	rot[0][3], rot[1][3], rot[2][3] = 0, 0, 0
+	for range 100 {
+		next := rot.Inverse().Transpose()
+		var diff float64
+		for i := range 3 {
+			for j := range 3 {
+				next[i][j] = 0.5 * (rot[i][j] + next[i][j])
+				diff = max(diff, math.Abs(next[i][j]-rot[i][j]))
+			}
+		}
+		rot = *next
+		if diff < 1e-12 {
+			break
+		}
+	}
+	// Negative scales leave a reflection in the rotation, which can't be
+	// represented by a quaternion, so move it into the stretch.
+	if rot.det3() < 0 {
+		rot = *rot.MulScalar(-1)
+		rot[3][3] = 1
+	}
+
+	r = *MatToQuat(&rot)
+	s = *rot.Transpose().MulMat(m)
+	s[0][3], s[1][3], s[2][3] = 0, 0, 0
+	return t, r, s
+}
+
+// Recompose is the inverse of Decompose. It does not allocate.
+func Recompose(t Vec3, r Vec4, s Mat4) Mat4 {
+	rot := quatToMat(&r)
+	m := *rot.MulMat(&s)
+	m[0][3], m[1][3], m[2][3] = t.X, t.Y, t.Z
+	return m
+}
+
+// det3 returns the determinant of the upper left 3x3 part of the matrix.
+func (m *Mat4) det3() float64 {
+	return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+}
+
 func (m *Mat4) MulMat(n *Mat4) *Mat4 {
 	var product Mat4
 	for i := range 4 {
@@ -312,11 +440,31 @@ func (m *Mat4) MulDir(v Vec3) Vec3 {
 	}
 }
 
+// MulDirTransposed multiplies the transpose of the matrix by a direction,
+// without computing the transpose.
+func (m *Mat4) MulDirTransposed(v Vec3) Vec3 {
+	return Vec3{
+		X: m[0][0]*v.X + m[1][0]*v.Y + m[2][0]*v.Z,
+		Y: m[0][1]*v.X + m[1][1]*v.Y + m[2][1]*v.Z,
+		Z: m[0][2]*v.X + m[1][2]*v.Y + m[2][2]*v.Z,
+	}
+}
+
 // Inverse computes the inverse of the matrix.
 //
 // This currently assumes that the matrix is an affine transformation,
 // and will not work for general purpose matrices.
 func (m *Mat4) Inverse() *Mat4 {
+	inv, ok := m.AffineInverse()
+	if !ok {
+		return nil
+	}
+	return &inv
+}
+
+// AffineInverse is Inverse, returning the inverse by value so that it does
+// not allocate. ok is false if the matrix has no inverse.
+func (m *Mat4) AffineInverse() (inv Mat4, ok bool) {
 	// An affine transformation matrix should have this form:
 
 	// | L T |
@@ -343,11 +491,11 @@ func (m *Mat4) Inverse() *Mat4 {
 	if det == 0.0 {
 		// Not sure if this is possible for the matrices we expect
 		// to generate.
-		return nil
+		return Mat4{}, false
 	}
 
 	// Compute the transpose of the cofactor matrix
-	inv := &Mat4{
+	inv = Mat4{
 		{(e*i - f*h) / det, (c*h - b*i) / det, (b*f - c*e) / det, 0.0},
 		{(f*g - d*i) / det, (a*i - c*g) / det, (c*d - a*f) / det, 0.0},
 		{(d*h - e*g) / det, (b*g - a*h) / det, (a*e - b*d) / det, 0.0},
@@ -361,7 +509,7 @@ func (m *Mat4) Inverse() *Mat4 {
 	inv[1][3] = -(inv[1][0]*m[0][3] + inv[1][1]*m[1][3] + inv[1][2]*m[2][3])
 	inv[2][3] = -(inv[2][0]*m[0][3] + inv[2][1]*m[1][3] + inv[2][2]*m[2][3])
 
-	return inv
+	return inv, true
 }
 
 func IdentityMatrix() Mat4 {
@@ -224,3 +224,90 @@ func TestMulMat(t *testing.T) {
 		})
 	}
 }
+
+func TestVec4Normalize(t *testing.T) {
+	got := (&Vec4{X: 1, Y: 2, Z: 2, W: 4}).Normalize()
+	want := &Vec4{X: 0.2, Y: 0.4, Z: 0.4, W: 0.8}
+	if diff := cmp.Diff(want, got, vec4Approx); diff != "" {
+		t.Errorf("Normalize() mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestMatToQuat(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *Mat4
+	}{
+		{"identity", QuatToMat(QIdentity())},
+		{"x", Mat4RotateX(0.3)},
+		{"y half turn", Mat4RotateY(math.Pi)},
+		{"z", Mat4RotateZ(-2.5)},
+		{"combined", Mat4RotateX(1).MulMat(Mat4RotateY(2)).MulMat(Mat4RotateZ(3))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := QuatToMat(MatToQuat(tt.m))
+			if diff := cmp.Diff(*tt.m, *got, approxOpts); diff != "" {
+				t.Errorf("QuatToMat(MatToQuat(m)) mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+func TestQSlerp(t *testing.T) {
+	zAxis := Vec3{Z: 1}
+	start := Rotation(&zAxis, 0.2)
+	end := Rotation(&zAxis, 1.0)
+	tests := []struct {
+		t    float64
+		want *Vec4
+	}{
+		{0, start},
+		{0.5, Rotation(&zAxis, 0.6)},
+		{1, end},
+	}
+	for _, tt := range tests {
+		got := QSlerp(start, end, tt.t)
+		if diff := cmp.Diff(*tt.want, got, vec4Approx); diff != "" {
+			t.Errorf("QSlerp(%v) mismatch (-want +got):\n%s", tt.t, diff)
+		}
+	}
+
+	// -end is the same rotation as end, and should take the same path.
+	negEnd := &Vec4{X: -end.X, Y: -end.Y, Z: -end.Z, W: -end.W}
+	slerped := QSlerp(start, negEnd, 0.5)
+	got := QuatToMat(&slerped)
+	want := QuatToMat(Rotation(&zAxis, 0.6))
+	if diff := cmp.Diff(*want, *got, approxOpts); diff != "" {
+		t.Errorf("QSlerp to -end mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestDecompose(t *testing.T) {
+	tests := []struct {
+		name string
+		m    *Mat4
+	}{
+		{"identity", QuatToMat(QIdentity())},
+		{"translate", Mat4Translate(Vec3{X: 1, Y: 2, Z: 3})},
+		{"trs", Mat4Translate(Vec3{X: 1}).MulMat(Mat4RotateY(0.7)).MulMat(Mat4Scale(1, 2, 3))},
+		{"shear", Mat4Scale(1, 0.5, 1).MulMat(Mat4RotateZ(0.8))},
+		{"mirror", Mat4RotateX(0.4).MulMat(Mat4Scale(-1, 1, 1))},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr, r, s := tt.m.Decompose()
+			for i := range 3 {
+				for j := range 3 {
+					if math.Abs(s[i][j]-s[j][i]) > 1e-7 {
+						t.Fatalf("stretch is not symmetric: %v", s)
+					}
+				}
+			}
+			got := Recompose(tr, r, s)
+			if diff := cmp.Diff(*tt.m, got, approxOpts); diff != "" {
+				t.Errorf("Recompose(Decompose(m)) mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
@@ -0,0 +1,206 @@
+// Package service is an HTTP service that renders GML programs.
+//
+// A client POSTs the source of a GML program, which must render exactly one
+// image, to /render and gets back the image as a PNG. The query parameters
+// width, height and samples override the size of the image and the number
+// of samples per pixel. Errors are reported as JSON objects, which give the
+// position in the program of the error if it is known:
+//
+//	{"error": "...", "line": 3, "col": 12}
+//
+// GET /healthz reports whether the service is up, and how busy it is.
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"image/png"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/timdestan/go-raytracer"
+	"github.com/timdestan/go-raytracer/internal/gml"
+)
+
+// Options configures a Server. Zero fields get the defaults given below.
+type Options struct {
+	// MaxJobs is the number of programs rendered at once. Each render
+	// uses all of the machine's cores, so it is 1 by default. Requests
+	// wait for a free slot until their timeout.
+	MaxJobs int
+	// Timeout is how long a request can wait for a slot and render before
+	// it is stopped. It is a minute by default.
+	Timeout time.Duration
+	// MaxProgramBytes is the largest program accepted. It is 1 MiB by
+	// default.
+	MaxProgramBytes int64
+	// MaxSize is the largest width or height a request can ask for, and
+	// its square is the most pixels an image can have, whether the request
+	// or the program sets its size. It is 4096 by default.
+	MaxSize int
+	// MaxSamples is the most samples per pixel a request can ask for. It
+	// is 64 by default.
+	MaxSamples int
+}
+
+// Server is an http.Handler that renders GML programs.
+type Server struct {
+	opts Options
+	mux  *http.ServeMux
+	// jobs holds a value for each render in progress.
+	jobs chan struct{}
+}
+
+func NewServer(opts Options) *Server {
+	if opts.MaxJobs <= 0 {
+		opts.MaxJobs = 1
+	}
+	if opts.Timeout <= 0 {
+		opts.Timeout = time.Minute
+	}
+	if opts.MaxProgramBytes <= 0 {
+		opts.MaxProgramBytes = 1 << 20
+	}
+	if opts.MaxSize <= 0 {
+		opts.MaxSize = 4096
+	}
+	if opts.MaxSamples <= 0 {
+		opts.MaxSamples = 64
+	}
+	s := &Server{
+		opts: opts,
+		mux:  http.NewServeMux(),
+		jobs: make(chan struct{}, opts.MaxJobs),
+	}
+	s.mux.HandleFunc("POST /render", s.handleRender)
+	s.mux.HandleFunc("GET /healthz", s.handleHealth)
+	return s
+}
+
+func (s *Server) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(rw, r)
+}
+
+// errorResponse is the body of every response that is not a success.
+type errorResponse struct {
+	Error string `json:"error"`
+	// Line and Col are the position of the error in the program, if it is
+	// known.
+	Line int `json:"line,omitempty"`
+	Col  int `json:"col,omitempty"`
+}
+
+func writeJSON(rw http.ResponseWriter, status int, v any) {
+	rw.Header().Set("Content-Type", "application/json")
+	rw.WriteHeader(status)
+	if err := json.NewEncoder(rw).Encode(v); err != nil {
+		log.Printf("WARN: writing response: %v\n", err)
+	}
+}
+
+func writeError(rw http.ResponseWriter, status int, err error) {
+	resp := errorResponse{Error: err.Error()}
+	if pos, ok := gml.ErrorPosition(err); ok {
+		resp.Line, resp.Col = pos.Line, pos.Col
+	}
+	writeJSON(rw, status, &resp)
+}
+
+func (s *Server) handleRender(rw http.ResponseWriter, r *http.Request) {
+	opts, err := s.renderOptions(r)
+	if err != nil {
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+	program, err := io.ReadAll(http.MaxBytesReader(rw, r.Body, s.opts.MaxProgramBytes))
+	if err != nil {
+		if maxErr := (*http.MaxBytesError)(nil); errors.As(err, &maxErr) {
+			writeError(rw, http.StatusRequestEntityTooLarge, fmt.Errorf("program is longer than %d bytes", maxErr.Limit))
+			return
+		}
+		writeError(rw, http.StatusBadRequest, fmt.Errorf("reading program: %w", err))
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), s.opts.Timeout)
+	defer cancel()
+	select {
+	case s.jobs <- struct{}{}:
+	case <-ctx.Done():
+		writeError(rw, http.StatusServiceUnavailable, errors.New("too many renders in progress, try again later"))
+		return
+	}
+	// Renders only return once their workers have stopped, so the slot
+	// is not freed while the workers are still using the machine.
+	img, _, err := raytracer.ParseAndRenderGMLWithOptions(ctx, string(program), opts)
+	<-s.jobs
+
+	switch {
+	case errors.Is(err, context.DeadlineExceeded):
+		writeError(rw, http.StatusGatewayTimeout, fmt.Errorf("render took longer than %v", s.opts.Timeout))
+		return
+	case errors.Is(err, context.Canceled):
+		// The client has gone away.
+		return
+	case err != nil:
+		writeError(rw, http.StatusBadRequest, err)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		writeError(rw, http.StatusInternalServerError, fmt.Errorf("encoding image: %w", err))
+		return
+	}
+	rw.Header().Set("Content-Type", "image/png")
+	rw.Write(buf.Bytes())
+}
+
+// renderOptions returns the options for rendering the request's program.
+// Programs may not include or read files, since they would be files on the
+// server.
+func (s *Server) renderOptions(r *http.Request) (raytracer.RenderOptions, error) {
+	opts := raytracer.RenderOptions{NoIncludes: true, NoFiles: true, MaxPixels: s.opts.MaxSize * s.opts.MaxSize}
+	query := r.URL.Query()
+	for _, param := range []struct {
+		name  string
+		max   int
+		value *int
+	}{
+		{"width", s.opts.MaxSize, &opts.Width},
+		{"height", s.opts.MaxSize, &opts.Height},
+		{"samples", s.opts.MaxSamples, &opts.Samples},
+	} {
+		text := query.Get(param.name)
+		if text == "" {
+			continue
+		}
+		n, err := strconv.Atoi(text)
+		if err != nil || n < 1 || n > param.max {
+			return opts, fmt.Errorf("%s must be an integer from 1 to %d, got %q", param.name, param.max, text)
+		}
+		*param.value = n
+	}
+	return opts, nil
+}
+
+// healthResponse is the body of a response to /healthz.
+type healthResponse struct {
+	Status  string `json:"status"`
+	Jobs    int    `json:"jobs"`
+	MaxJobs int    `json:"max_jobs"`
+}
+
+func (s *Server) handleHealth(rw http.ResponseWriter, r *http.Request) {
+	writeJSON(rw, http.StatusOK, &healthResponse{
+		Status:  "ok",
+		Jobs:    len(s.jobs),
+		MaxJobs: cap(s.jobs),
+	})
+}
@@ -0,0 +1,213 @@
+package service
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"image"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/timdestan/go-raytracer"
+)
+
+const testProgram = `
+	{ /v /u /face u v 0.5 point 1.0 0.3 1.0 } sphere 0.0 0.0 4.0 translate
+	{ /v /u /face 0.5 0.5 0.5 point 1.0 0.0 1.0 } plane 0.0 -1.0 0.0 translate
+	union /scene
+	0.2 0.2 0.2 point [ 0.0 5.0 0.0 point 1.0 1.0 1.0 point pointlight ]
+	scene 3 90.0 40 30 "out.ppm" render`
+
+func post(t *testing.T, s *Server, query, program string) *httptest.ResponseRecorder {
+	t.Helper()
+	req := httptest.NewRequest(http.MethodPost, "/render"+query, strings.NewReader(program))
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	return rec
+}
+
+func decodeError(t *testing.T, rec *httptest.ResponseRecorder) errorResponse {
+	t.Helper()
+	if got := rec.Header().Get("Content-Type"); got != "application/json" {
+		t.Errorf("Content-Type = %q, want application/json", got)
+	}
+	var resp errorResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil {
+		t.Fatalf("decoding error response %q: %v", rec.Body, err)
+	}
+	return resp
+}
+
+func TestRender(t *testing.T) {
+	s := NewServer(Options{})
+	for _, tt := range []struct {
+		query string
+		opts  raytracer.RenderOptions
+	}{
+		{query: ""},
+		{query: "?width=20&height=10&samples=2", opts: raytracer.RenderOptions{Width: 20, Height: 10, Samples: 2}},
+	} {
+		rec := post(t, s, tt.query, testProgram)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("POST /render%s: status %d: %s", tt.query, rec.Code, rec.Body)
+		}
+		if got := rec.Header().Get("Content-Type"); got != "image/png" {
+			t.Errorf("POST /render%s: Content-Type = %q, want image/png", tt.query, got)
+		}
+		got, err := png.Decode(rec.Body)
+		if err != nil {
+			t.Fatalf("POST /render%s: decoding PNG: %v", tt.query, err)
+		}
+		want, _, err := raytracer.ParseAndRenderGMLWithOptions(context.Background(), testProgram, tt.opts)
+		if err != nil {
+			t.Fatalf("ParseAndRenderGMLWithOptions: %v", err)
+		}
+		if got.Bounds() != want.Bounds() || !bytes.Equal(got.(*image.RGBA).Pix, want.(*image.RGBA).Pix) {
+			t.Errorf("POST /render%s: image differs from the image rendered locally", tt.query)
+		}
+	}
+}
+
+func TestRenderErrors(t *testing.T) {
+	s := NewServer(Options{MaxProgramBytes: 1000, MaxSize: 100})
+	for _, tt := range []struct {
+		name       string
+		query      string
+		program    string
+		wantStatus int
+		want       errorResponse
+	}{
+		{
+			name:       "parse error",
+			program:    "1 2\n  { addi",
+			wantStatus: http.StatusBadRequest,
+			want:       errorResponse{Line: 2, Col: 9},
+		},
+		{
+			name:       "eval error",
+			program:    "1\n2.0 addi",
+			wantStatus: http.StatusBadRequest,
+			want:       errorResponse{Line: 2, Col: 5},
+		},
+		{
+			name:       "include",
+			program:    `#include "secrets.gml"`,
+			wantStatus: http.StatusBadRequest,
+			want:       errorResponse{Line: 1, Col: 1},
+		},
+		{
+			name: "environment map",
+			program: strings.Replace(testProgram, `"out.ppm" render`,
+				`"out.ppm" "../../testdata/goldens/example_sphere.png" 0.0 0.0 renderWithEnvMap`, 1),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			// The surface function fails while rendering, in a worker.
+			name: "surface function error",
+			program: strings.Replace(testProgram, "{ /v /u /face u v 0.5 point 1.0 0.3 1.0 }",
+				"{ /v /u /face u 0.5 lessf { [ ] 0 get } { 1.0 1.0 1.0 point } if 1.0 0.0 1.0 }", 1),
+			wantStatus: http.StatusBadRequest,
+			want:       errorResponse{Line: 2, Col: 36},
+		},
+		{
+			name:       "runaway recursion",
+			program:    "{ /f f f apply } /f f f apply",
+			wantStatus: http.StatusBadRequest,
+			want:       errorResponse{Line: 1, Col: 10},
+		},
+		{
+			name:       "no image",
+			program:    "1 2 addi",
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "image too large",
+			program:    strings.Replace(testProgram, "40 30", "1000 1000", 1),
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "bad width",
+			query:      "?width=abc",
+			program:    testProgram,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "width too large",
+			query:      "?width=101",
+			program:    testProgram,
+			wantStatus: http.StatusBadRequest,
+		},
+		{
+			name:       "program too long",
+			program:    strings.Repeat(" ", 1001),
+			wantStatus: http.StatusRequestEntityTooLarge,
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			rec := post(t, s, tt.query, tt.program)
+			if rec.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", rec.Code, tt.wantStatus)
+			}
+			got := decodeError(t, rec)
+			if got.Error == "" {
+				t.Error("response has no error message")
+			}
+			got.Error = ""
+			if diff := cmp.Diff(tt.want, got); diff != "" {
+				t.Errorf("error position mismatch (-want +got):\n%s", diff)
+			}
+		})
+	}
+}
+
+// slowProgram takes far longer than the tests' timeouts to render.
+var slowProgram = strings.Replace(testProgram, "40 30", "4000 4000", 1)
+
+func TestRenderTimeout(t *testing.T) {
+	s := NewServer(Options{Timeout: 100 * time.Millisecond, MaxSize: 4000})
+	start := time.Now()
+	rec := post(t, s, "?samples=16", slowProgram)
+	if rec.Code != http.StatusGatewayTimeout {
+		t.Fatalf("status = %d, want %d: %s", rec.Code, http.StatusGatewayTimeout, rec.Body)
+	}
+	decodeError(t, rec)
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("request took %v with a %v timeout", elapsed, s.opts.Timeout)
+	}
+	// The render's slot is only freed once its workers have stopped.
+	if len(s.jobs) != 0 {
+		t.Errorf("%d jobs still running after the timeout", len(s.jobs))
+	}
+}
+
+func TestRenderBusy(t *testing.T) {
+	s := NewServer(Options{MaxJobs: 1, Timeout: 50 * time.Millisecond})
+	s.jobs <- struct{}{}
+	rec := post(t, s, "", testProgram)
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Errorf("status = %d, want %d", rec.Code, http.StatusServiceUnavailable)
+	}
+	decodeError(t, rec)
+}
+
+func TestHealth(t *testing.T) {
+	s := NewServer(Options{MaxJobs: 3})
+	s.jobs <- struct{}{}
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/healthz", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status = %d, want %d", rec.Code, http.StatusOK)
+	}
+	var got healthResponse
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatalf("decoding %q: %v", rec.Body, err)
+	}
+	if diff := cmp.Diff(healthResponse{Status: "ok", Jobs: 1, MaxJobs: 3}, got); diff != "" {
+		t.Errorf("health mismatch (-want +got):\n%s", diff)
+	}
+}
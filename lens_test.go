@@ -0,0 +1,99 @@
+package raytracer
+
+import (
+	"image"
+	"math"
+	"math/rand/v2"
+	"testing"
+
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+func TestLensRay(t *testing.T) {
+	scene := &Scene{ApertureRadius: 0.5, FocalDistance: 4}
+	eye := prim.Vec3{Z: -1}
+	rng := rand.New(rand.NewPCG(1, 2))
+	for range 100 {
+		screenPoint := prim.Vec3{X: rng.Float64()*2 - 1, Y: rng.Float64()*2 - 1}
+		pinhole := Ray{Origin: screenPoint, Direction: screenPoint.Sub(eye).Normalize()}
+		ray := scene.lensRay(pinhole, eye, rng)
+
+		if math.Abs(ray.Origin.Z) > 1e-9 {
+			t.Errorf("lens ray starts at %v, want a point on the screen", ray.Origin)
+		}
+		// Both rays pass through the same point on the focal plane.
+		focalZ := eye.Z + scene.FocalDistance
+		want := pinhole.Origin.Add(pinhole.Direction.Scale((focalZ - pinhole.Origin.Z) / pinhole.Direction.Z))
+		got := ray.Origin.Add(ray.Direction.Scale((focalZ - ray.Origin.Z) / ray.Direction.Z))
+		if got.Sub(want).Length() > 1e-9 {
+			t.Errorf("lens ray meets the focal plane at %v, want %v", got, want)
+		}
+		// And the lens ray came from a point on the lens.
+		lensPoint := ray.Origin.Add(ray.Direction.Scale((eye.Z - ray.Origin.Z) / ray.Direction.Z))
+		if d := lensPoint.Sub(eye).Length(); d > scene.ApertureRadius+1e-9 {
+			t.Errorf("lens ray comes from %v, %v from the eye, want within %v", lensPoint, d, scene.ApertureRadius)
+		}
+	}
+}
+
+// blurredPixels counts the pixels in columns [xmin, xmax) that differ
+// noticeably between a pinhole and a lens render.
+func blurredPixels(pinhole, lens image.Image, xmin, xmax int) int {
+	n := 0
+	for y := pinhole.Bounds().Min.Y; y < pinhole.Bounds().Max.Y; y++ {
+		for x := xmin; x < xmax; x++ {
+			r1, _, _, _ := pinhole.At(x, y).RGBA()
+			r2, _, _, _ := lens.At(x, y).RGBA()
+			if math.Abs(float64(r1)-float64(r2)) > 0x4000 {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestRenderWithLens(t *testing.T) {
+	// A white sphere on the left, 5 units from the eye, and one on the
+	// right, 15 units from the eye.
+	const scene = `
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere
+		-2.0 0.0 4.0 translate
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere
+		2.5 0.0 14.0 translate 2.0 uscale union /scene
+		1.0 1.0 1.0 point [ ] scene 1 90.0 64 48 "out.ppm"`
+	const nearMin, nearMax, farMin, farMax = 8, 30, 30, 48
+
+	pinhole, err := ParseAndRenderGML(scene + ` render`)
+	if err != nil {
+		t.Fatalf("ParseAndRenderGML: %v", err)
+	}
+	nearFocus, err := ParseAndRenderGML(scene + ` 1.0 5.0 renderWithLens`)
+	if err != nil {
+		t.Fatalf("ParseAndRenderGML: %v", err)
+	}
+	farFocus, err := ParseAndRenderGML(scene + ` 1.0 15.0 renderWithLens`)
+	if err != nil {
+		t.Fatalf("ParseAndRenderGML: %v", err)
+	}
+
+	// Each sphere should be much blurrier when the other one is in focus.
+	if inFocus, outOfFocus := blurredPixels(pinhole, nearFocus, nearMin, nearMax), blurredPixels(pinhole, farFocus, nearMin, nearMax); 2*inFocus >= outOfFocus {
+		t.Errorf("near sphere has %d blurred pixels in focus, %d out of focus", inFocus, outOfFocus)
+	}
+	if inFocus, outOfFocus := blurredPixels(pinhole, farFocus, farMin, farMax), blurredPixels(pinhole, nearFocus, farMin, farMax); 2*inFocus >= outOfFocus {
+		t.Errorf("far sphere has %d blurred pixels in focus, %d out of focus", inFocus, outOfFocus)
+	}
+}
+
+func TestRenderWithLensErrors(t *testing.T) {
+	const scene = `
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere
+		0.0 0.0 4.0 translate /scene
+		1.0 1.0 1.0 point [ ] scene 1 90.0 8 8 "out.ppm"`
+	if _, err := ParseAndRenderGML(scene + ` -1.0 5.0 renderWithLens`); err == nil {
+		t.Error("expected an error for a negative aperture")
+	}
+	if _, err := ParseAndRenderGML(scene + ` 0.1 0.0 renderWithLens`); err == nil {
+		t.Error("expected an error for a zero focal distance")
+	}
+}
@@ -0,0 +1,117 @@
+package raytracer
+
+import (
+	"image"
+	"math"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+	"github.com/google/go-cmp/cmp/cmpopts"
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+func TestMotionObjectToWorld(t *testing.T) {
+	start := prim.Mat4Translate(prim.Vec3{Z: 5})
+	end := prim.Mat4Translate(prim.Vec3{X: 2, Z: 5}).MulMat(prim.Mat4RotateY(math.Pi / 2)).MulMat(prim.Mat4Scale(3, 1, 1))
+	motion := newMotion(start, end)
+
+	tests := []struct {
+		time float64
+		want *prim.Mat4
+	}{
+		{0, start},
+		{0.5, prim.Mat4Translate(prim.Vec3{X: 1, Z: 5}).MulMat(prim.Mat4RotateY(math.Pi / 4)).MulMat(prim.Mat4Scale(2, 1, 1))},
+		{1, end},
+	}
+	for _, tt := range tests {
+		got := motion.ObjectToWorld(tt.time)
+		if diff := cmp.Diff(*tt.want, got, cmpopts.EquateApprox(0, 1e-9)); diff != "" {
+			t.Errorf("ObjectToWorld(%v) mismatch (-want +got):\n%s", tt.time, diff)
+		}
+	}
+}
+
+// partialPixels counts the pixels that are neither black nor white.
+func partialPixels(img image.Image) int {
+	n := 0
+	for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+		for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+			r, _, _, _ := img.At(x, y).RGBA()
+			if r > 0x1000 && r < 0xf000 {
+				n++
+			}
+		}
+	}
+	return n
+}
+
+func TestRenderMotion(t *testing.T) {
+	// A white sphere on a black background, which is blurred when it
+	// moves from left to right.
+	const prefix = `
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere /s`
+	const suffix = `
+		/scene
+		1.0 1.0 1.0 point [ ] scene 1 90.0 48 32 "out.ppm"
+		0.0 0.0 0.0 point 0.0 0.0 0.0 point renderWithBgGradient`
+
+	still, err := ParseAndRenderGML(prefix + ` s -1.5 0.0 5.0 translate` + suffix)
+	if err != nil {
+		t.Fatalf("ParseAndRenderGML: %v", err)
+	}
+	moving, err := ParseAndRenderGML(prefix + ` s -1.5 0.0 5.0 translate s 1.5 0.0 5.0 translate motion` + suffix)
+	if err != nil {
+		t.Fatalf("ParseAndRenderGML: %v", err)
+	}
+
+	if stillPartial, movingPartial := partialPixels(still), partialPixels(moving); movingPartial <= 3*stillPartial {
+		t.Errorf("moving sphere has %d partially covered pixels, still sphere has %d; want the moving sphere to be blurred", movingPartial, stillPartial)
+	}
+}
+
+func TestConvertMovingUnion(t *testing.T) {
+	scene, err := ParseGMLScene(`
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } cube union /u
+		u 0.0 0.0 5.0 translate u 0.0 1.0 5.0 translate 30.0 rotatey motion /scene
+		1.0 1.0 1.0 point [ ] scene 1 90.0 8 8 "out.ppm" render`)
+	if err != nil {
+		t.Fatalf("ParseGMLScene: %v", err)
+	}
+	if !scene.MotionBlur {
+		t.Error("MotionBlur not set for a scene with a moving union")
+	}
+	if len(scene.Objects) != 1 {
+		t.Fatalf("got %d objects, want 1", len(scene.Objects))
+	}
+	inst, ok := scene.Objects[0].(*Instance)
+	if !ok || inst.Motion == nil {
+		t.Fatalf("got %T, want a moving *Instance", scene.Objects[0])
+	}
+	if len(inst.Prototype.Objects) != 2 {
+		t.Errorf("prototype has %d objects, want 2", len(inst.Prototype.Objects))
+	}
+}
+
+func TestMotionErrors(t *testing.T) {
+	for _, program := range []string{
+		// Different objects.
+		`{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere
+		 { /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } cube motion`,
+		// Spheres with different surfaces.
+		`{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere
+		 { /v /u /face 1.0 0.0 0.0 point 1.0 0.0 1.0 } sphere motion`,
+		`{ /v /u /face u v 0.0 point 1.0 0.0 1.0 } sphere
+		 { /v /u /face v u 0.0 point 1.0 0.0 1.0 } sphere motion`,
+		// A moving union containing a transformed union.
+		`{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere
+		 { /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } cube union 1.0 uscale
+		 { /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } cube union /u
+		 u 0.0 0.0 0.0 translate u 1.0 0.0 0.0 translate motion`,
+	} {
+		if _, err := ParseGMLScene(program + ` /scene
+			1.0 1.0 1.0 point [ ] scene 1 90.0 8 8 "out.ppm" render`); err == nil {
+			t.Errorf("expected an error for %q", program)
+		}
+	}
+}
@@ -0,0 +1,7 @@
+//go:build race
+
+package raytracer
+
+// raceEnabled is whether the race detector is on. It makes allocations of
+// its own, so allocation counts are only checked without it.
+const raceEnabled = true
@@ -1,13 +1,19 @@
 package raytracer
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"image"
+	"image/draw"
 	"log"
 	"math"
 	"math/rand/v2"
+	"os"
+	"runtime"
+	"slices"
 	"sync"
+	"time"
 
 	"github.com/timdestan/go-raytracer/internal/gml"
 	"github.com/timdestan/go-raytracer/internal/prim"
@@ -16,6 +22,9 @@ import (
 type Ray struct {
 	Origin    prim.Vec3
 	Direction prim.Vec3
+	// Time is when the ray was cast, from 0 when the shutter opens to 1
+	// when it closes. It only matters for moving objects.
+	Time float64
 }
 
 type Hit struct {
@@ -25,6 +34,21 @@ type Hit struct {
 	// Face indicates which face was hit, only relevant for objects
 	// with multiple faces.
 	Face int
+	// Instance is the instance that Object was hit through, if any. Object
+	// and PointObj are then relative to the instance's prototype.
+	Instance *Instance
+	// Time is the time of the ray, which is needed to place moving
+	// instances.
+	Time float64
+}
+
+// ComputeSurfaceProps computes the surface properties of the object at the
+// hit.
+func (hit *Hit) ComputeSurfaceProps(evalState *gml.EvalState) (HitEx, error) {
+	if hit.Instance != nil {
+		return hit.Instance.ComputeSurfaceProps(*hit, evalState)
+	}
+	return hit.Object.ComputeSurfaceProps(*hit, evalState)
 }
 
 // HitEx extends hit with additional computed surface properties.
@@ -32,17 +56,27 @@ type HitEx struct {
 	Hit
 	PointWorld  prim.Vec3
 	NormalWorld prim.Vec3
-	Material    *gml.Material
+	Material    gml.Material
 }
 
+// SceneObject is a piece of geometry in the scene.
+//
+// Scene objects are shared between render threads, so they must not be
+// modified during rendering. Anything that is needed to evaluate surface
+// functions is passed in by the calling thread.
 type SceneObject interface {
-	Intersect(ray Ray) *Hit
-	ComputeSurfaceProps(hit Hit) (HitEx, error)
+	// Intersect reports whether the ray hits the object, and if so, fills
+	// in hit with the closest hit in front of the ray origin. hit is left
+	// unspecified if there is no hit.
+	//
+	// Intersect is on the hot path of the renderer, so it must not
+	// allocate.
+	Intersect(ray Ray, hit *Hit) bool
+	ComputeSurfaceProps(hit Hit, evalState *gml.EvalState) (HitEx, error)
 }
 
 type Sphere struct {
 	SurfaceFn     gml.VSurfaceFn
-	EvalState     *gml.EvalState
 	ObjectToWorld prim.Mat4
 	WorldToObject prim.Mat4
 	NormalMat     prim.Mat4
@@ -52,12 +86,23 @@ func rayToObjectSpace(ray Ray, worldToObject *prim.Mat4) Ray {
 	var localRay Ray
 	localRay.Origin = worldToObject.MulPoint(ray.Origin)
 	localRay.Direction = worldToObject.MulDir(ray.Direction)
+	localRay.Time = ray.Time
 	return localRay
 }
 
-func (sphere *Sphere) Intersect(ray Ray) *Hit {
-	ray = rayToObjectSpace(ray, &sphere.WorldToObject)
+func (sphere *Sphere) Intersect(ray Ray, hit *Hit) bool {
+	return sphere.intersectObject(rayToObjectSpace(ray, &sphere.WorldToObject), hit)
+}
+
+func (sphere *Sphere) transforms() (objectToWorld, worldToObject *prim.Mat4) {
+	return &sphere.ObjectToWorld, &sphere.WorldToObject
+}
+
+func (sphere *Sphere) objectBounds() bounds {
+	return bounds{min: prim.Vec3{X: -1, Y: -1, Z: -1}, max: prim.Vec3{X: 1, Y: 1, Z: 1}}
+}
 
+func (sphere *Sphere) intersectObject(ray Ray, hit *Hit) bool {
 	// Note: ray.Direction is not necessarily unit length here, since
 	// WorldToObject may include a scale. We can't use the simplified
 	// unit-direction geometric formula (t_ca, t_hc) in that case, so solve
@@ -83,47 +128,49 @@ func (sphere *Sphere) Intersect(ray Ray) *Hit {
 
 	discriminant := halfB*halfB - a*c
 	if discriminant < 0.0 {
-		return nil
+		return false
 	}
 	sqrtD := math.Sqrt(discriminant)
 
 	t0 := (-halfB - sqrtD) / a
 	if t0 > 0.0 {
-		return &Hit{
+		*hit = Hit{
 			Object:   sphere,
 			T:        t0,
 			PointObj: ray.Origin.Add(ray.Direction.Scale(t0)),
 		}
+		return true
 	}
 	// TODO: Should we include these far hits?
 	// t1 := (-halfB + sqrtD) / a
 	// if t1 > 0.0 {
 	// 	 ...
 	// }
-	return nil
+	return false
 }
 
-func (sphere *Sphere) ComputeSurfaceProps(hit Hit) (HitEx, error) {
-	material, err := computeSphereSurfaceMaterial(sphere, hit.PointObj)
+func (sphere *Sphere) ComputeSurfaceProps(hit Hit, evalState *gml.EvalState) (HitEx, error) {
+	normalObj, material, err := sphere.surfaceObject(hit, evalState)
 	if err != nil {
 		return HitEx{}, err
 	}
-	// TODO: Skipping this transformation and using hit.PointObj breaks if
-	// we ever add non-uniform scales.
-
-	// We would need to subtract sphere center from point but it's always 0
-	// normalDir := sphere.NormalMat.MulDir(hit.PointObj)
 	return HitEx{
 		Hit:         hit,
 		PointWorld:  sphere.ObjectToWorld.MulPoint(hit.PointObj),
-		NormalWorld: hit.PointObj,
+		NormalWorld: sphere.NormalMat.MulDir(normalObj).Normalize(),
 		Material:    material,
 	}, nil
 }
 
-func computeSphereSurfaceMaterial(sphere *Sphere, point prim.Vec3) (*gml.Material, error) {
+func (sphere *Sphere) surfaceObject(hit Hit, evalState *gml.EvalState) (prim.Vec3, gml.Material, error) {
+	material, err := computeSphereSurfaceMaterial(sphere, hit.PointObj, evalState)
+	// The center is always 0, so the object space normal is just the point.
+	return hit.PointObj, material, err
+}
+
+func computeSphereSurfaceMaterial(sphere *Sphere, point prim.Vec3, evalState *gml.EvalState) (gml.Material, error) {
 	if sphere.SurfaceFn.Material != nil {
-		return sphere.SurfaceFn.Material, nil
+		return *sphere.SurfaceFn.Material, nil
 	}
 
 	// Need to pass the face (always 0) and u and v coordinates on the stack.
@@ -140,47 +187,56 @@ func computeSphereSurfaceMaterial(sphere *Sphere, point prim.Vec3) (*gml.Materia
 	// GML spheres are always unit spheres (the transformation matrix may
 	// scale and move them).
 	if math.Abs(point.Y) > 1 {
-		return nil, fmt.Errorf("expected |pt.Y| <= 1 in sphere surface, got %v", point)
+		return gml.Material{}, fmt.Errorf("expected |pt.Y| <= 1 in sphere surface, got %v", point)
 	}
 
 	v := (point.Y + 1.0) / 2.0
 	u := math.Acos(point.Z/math.Sqrt(1.0-point.Y*point.Y)) / (2.0 * math.Pi)
 
-	return gml.EvalSurfaceFn(0, u, v, sphere.EvalState, &sphere.SurfaceFn)
+	return gml.EvalSurfaceFn(0, u, v, evalState, &sphere.SurfaceFn)
 }
 
 type Plane struct {
-	Side          prim.CubeSide // always 0 if not part of cube
 	Normal        prim.Vec3
 	D             float64
 	NormalWorld   prim.Vec3
 	SurfaceFn     gml.VSurfaceFn
-	EvalState     *gml.EvalState
 	ObjectToWorld prim.Mat4
 	WorldToObject prim.Mat4
 	// We don't need NormalMat since we precompute NormalWorld
 }
 
-func (p *Plane) Intersect(ray Ray) *Hit {
-	ray = rayToObjectSpace(ray, &p.WorldToObject)
+func (p *Plane) Intersect(ray Ray, hit *Hit) bool {
+	return p.intersectObject(rayToObjectSpace(ray, &p.WorldToObject), hit)
+}
+
+func (p *Plane) transforms() (objectToWorld, worldToObject *prim.Mat4) {
+	return &p.ObjectToWorld, &p.WorldToObject
+}
+
+func (p *Plane) objectBounds() bounds {
+	return infiniteBounds
+}
 
+func (p *Plane) intersectObject(ray Ray, hit *Hit) bool {
 	denom := p.Normal.Dot(ray.Direction)
 	if math.Abs(denom) < 1e-6 {
-		return nil
+		return false
 	}
 	t := (-p.D - p.Normal.Dot(ray.Origin)) / denom
 	if t <= 0.0 {
-		return nil
+		return false
 	}
-	return &Hit{
+	*hit = Hit{
 		Object:   p,
 		T:        t,
 		PointObj: ray.Origin.Add(ray.Direction.Scale(t)),
 	}
+	return true
 }
 
-func (p *Plane) ComputeSurfaceProps(hit Hit) (HitEx, error) {
-	material, err := computePlaneSurfaceMaterial(p, hit.PointObj)
+func (p *Plane) ComputeSurfaceProps(hit Hit, evalState *gml.EvalState) (HitEx, error) {
+	material, err := computePlaneSurfaceMaterial(p, hit.PointObj, evalState)
 	if err != nil {
 		return HitEx{}, err
 	}
@@ -193,7 +249,12 @@ func (p *Plane) ComputeSurfaceProps(hit Hit) (HitEx, error) {
 	}, nil
 }
 
-func computePlaneSurfaceMaterial(plane *Plane, point prim.Vec3) (*gml.Material, error) {
+func (p *Plane) surfaceObject(hit Hit, evalState *gml.EvalState) (prim.Vec3, gml.Material, error) {
+	material, err := computePlaneSurfaceMaterial(p, hit.PointObj, evalState)
+	return p.Normal, material, err
+}
+
+func computePlaneSurfaceMaterial(plane *Plane, point prim.Vec3, evalState *gml.EvalState) (gml.Material, error) {
 	// Need to pass the face (always 0) and u and v coordinates on the stack.
 	//
 	// (0, u, v) <=> (u, 0, v)
@@ -201,64 +262,119 @@ func computePlaneSurfaceMaterial(plane *Plane, point prim.Vec3) (*gml.Material,
 	u := point.X
 	v := point.Z
 
-	return gml.EvalSurfaceFn(int(plane.Side), u, v, plane.EvalState, &plane.SurfaceFn)
+	return gml.EvalSurfaceFn(0, u, v, evalState, &plane.SurfaceFn)
 }
 
+// Cube is a unit cube: 0 <= x, y, z <= 1.
 type Cube struct {
-	Faces         [prim.NUM_CUBE_SIDES]Plane
+	SurfaceFn     gml.VSurfaceFn
 	ObjectToWorld prim.Mat4
 	WorldToObject prim.Mat4
-	// A lot of data is duplicated in each Plane.
+	// NormalsWorld holds the world space normal of each face, indexed by
+	// prim.CubeSide.
+	NormalsWorld [prim.NUM_CUBE_SIDES]prim.Vec3
 }
 
-func (c *Cube) Intersect(ray Ray) *Hit {
-	// ray = rayToObjectSpace(ray, &c.WorldToObject)
+// intersectUnitBox intersects the ray with the unit cube using the slab
+// method. It returns the distances along the ray at which it enters and
+// exits the cube, and the faces it enters and exits through. The distances
+// may be negative if the cube is (partly) behind the ray origin. ok is false
+// if the ray misses the cube.
+func intersectUnitBox(ray Ray) (tEnter, tExit float64, enterFace, exitFace prim.CubeSide, ok bool) {
+	// The faces at 0 and 1 along each axis.
+	slabs := [3]struct {
+		origin, dir float64
+		lo, hi      prim.CubeSide
+	}{
+		{ray.Origin.X, ray.Direction.X, prim.CubeLeft, prim.CubeRight},
+		{ray.Origin.Y, ray.Direction.Y, prim.CubeBottom, prim.CubeTop},
+		{ray.Origin.Z, ray.Direction.Z, prim.CubeFront, prim.CubeBack},
+	}
 
-	var minHit *Hit
-	for faceIndex, face := range c.Faces {
-		hit := face.Intersect(ray)
-		if hit == nil || hit.T < 0.0 {
+	tEnter, tExit = math.Inf(-1), math.Inf(1)
+	for _, slab := range slabs {
+		if slab.dir == 0 {
+			// Parallel to the slab, so either always or never inside it.
+			if slab.origin < 0 || slab.origin > 1 {
+				return 0, 0, 0, 0, false
+			}
 			continue
 		}
-
-		pt := hit.PointObj
-		// Is the hit within the bounds of the cube?
-		// We may want to not check the dimension of our side to avoid floating
-		// point precision issues.
-		if pt.X < 0 || pt.X > 1 || pt.Y < 0 || pt.Y > 1 || pt.Z < 0 || pt.Z > 1 {
-			continue
+		t0 := -slab.origin / slab.dir
+		t1 := (1 - slab.origin) / slab.dir
+		near, far := slab.lo, slab.hi
+		if t0 > t1 {
+			t0, t1 = t1, t0
+			near, far = far, near
 		}
-
-		hit.Object = c
-		hit.Face = faceIndex
-
-		if minHit == nil || hit.T < minHit.T {
-			minHit = hit
+		if t0 > tEnter {
+			tEnter, enterFace = t0, near
+		}
+		if t1 < tExit {
+			tExit, exitFace = t1, far
 		}
 	}
-	return minHit
+	if tEnter > tExit {
+		return 0, 0, 0, 0, false
+	}
+	return tEnter, tExit, enterFace, exitFace, true
 }
 
-func (c *Cube) ComputeSurfaceProps(hit Hit) (HitEx, error) {
-	if hit.Face < 0 || hit.Face >= int(prim.NUM_CUBE_SIDES) {
-		return HitEx{}, fmt.Errorf("face index out of range: %d", hit.Face)
-	}
+func (c *Cube) Intersect(ray Ray, hit *Hit) bool {
+	return c.intersectObject(rayToObjectSpace(ray, &c.WorldToObject), hit)
+}
 
-	face := c.Faces[hit.Face]
+func (c *Cube) transforms() (objectToWorld, worldToObject *prim.Mat4) {
+	return &c.ObjectToWorld, &c.WorldToObject
+}
+
+func (c *Cube) objectBounds() bounds {
+	return bounds{max: prim.Vec3{X: 1, Y: 1, Z: 1}}
+}
+
+func (c *Cube) intersectObject(ray Ray, hit *Hit) bool {
+	tEnter, tExit, enterFace, exitFace, ok := intersectUnitBox(ray)
+	if !ok || tExit <= 0.0 {
+		return false
+	}
+	t, face := tEnter, enterFace
+	if t <= 0.0 {
+		// The ray starts inside the cube.
+		t, face = tExit, exitFace
+	}
+	*hit = Hit{
+		Object:   c,
+		T:        t,
+		PointObj: ray.Origin.Add(ray.Direction.Scale(t)),
+		Face:     int(face),
+	}
+	return true
+}
 
-	material, err := computePlaneSurfaceMaterial(&face, hit.PointObj)
+func (c *Cube) ComputeSurfaceProps(hit Hit, evalState *gml.EvalState) (HitEx, error) {
+	_, material, err := c.surfaceObject(hit, evalState)
 	if err != nil {
 		return HitEx{}, err
 	}
 
 	return HitEx{
 		Hit:         hit,
-		PointWorld:  face.ObjectToWorld.MulPoint(hit.PointObj),
-		NormalWorld: face.NormalWorld,
+		PointWorld:  c.ObjectToWorld.MulPoint(hit.PointObj),
+		NormalWorld: c.NormalsWorld[hit.Face],
 		Material:    material,
 	}, nil
 }
 
+func (c *Cube) surfaceObject(hit Hit, evalState *gml.EvalState) (prim.Vec3, gml.Material, error) {
+	if hit.Face < 0 || hit.Face >= int(prim.NUM_CUBE_SIDES) {
+		return prim.Vec3{}, gml.Material{}, fmt.Errorf("face index out of range: %d", hit.Face)
+	}
+
+	// As for planes, (u, v) = (x, z).
+	material, err := gml.EvalSurfaceFn(hit.Face, hit.PointObj.X, hit.PointObj.Z, evalState, &c.SurfaceFn)
+	return prim.PlanesForUnitCube()[hit.Face].Normal, material, err
+}
+
 // Cylinder faces, matching the face indices passed to GML surface functions.
 const (
 	CylinderSide   = 0
@@ -270,15 +386,24 @@ const (
 // the cylinder along the Y-axis.
 type Cylinder struct {
 	SurfaceFn     gml.VSurfaceFn
-	EvalState     *gml.EvalState
 	ObjectToWorld prim.Mat4
 	WorldToObject prim.Mat4
 	NormalMat     prim.Mat4
 }
 
-func (c *Cylinder) Intersect(ray Ray) *Hit {
-	ray = rayToObjectSpace(ray, &c.WorldToObject)
+func (c *Cylinder) Intersect(ray Ray, hit *Hit) bool {
+	return c.intersectObject(rayToObjectSpace(ray, &c.WorldToObject), hit)
+}
+
+func (c *Cylinder) transforms() (objectToWorld, worldToObject *prim.Mat4) {
+	return &c.ObjectToWorld, &c.WorldToObject
+}
 
+func (c *Cylinder) objectBounds() bounds {
+	return bounds{min: prim.Vec3{X: -1, Z: -1}, max: prim.Vec3{X: 1, Y: 1, Z: 1}}
+}
+
+func (c *Cylinder) intersectObject(ray Ray, hit *Hit) bool {
 	bestT := math.Inf(1)
 	bestFace := -1
 	var bestPoint prim.Vec3
@@ -326,17 +451,32 @@ func (c *Cylinder) Intersect(ray Ray) *Hit {
 	}
 
 	if bestFace == -1 {
-		return nil
+		return false
 	}
-	return &Hit{
+	*hit = Hit{
 		Object:   c,
 		T:        bestT,
 		PointObj: bestPoint,
 		Face:     bestFace,
 	}
+	return true
+}
+
+func (c *Cylinder) ComputeSurfaceProps(hit Hit, evalState *gml.EvalState) (HitEx, error) {
+	normalObj, material, err := c.surfaceObject(hit, evalState)
+	if err != nil {
+		return HitEx{}, err
+	}
+
+	return HitEx{
+		Hit:         hit,
+		PointWorld:  c.ObjectToWorld.MulPoint(hit.PointObj),
+		NormalWorld: c.NormalMat.MulDir(normalObj).Normalize(),
+		Material:    material,
+	}, nil
 }
 
-func (c *Cylinder) ComputeSurfaceProps(hit Hit) (HitEx, error) {
+func (c *Cylinder) surfaceObject(hit Hit, evalState *gml.EvalState) (prim.Vec3, gml.Material, error) {
 	var normalObj prim.Vec3
 	var u, v float64
 	switch hit.Face {
@@ -353,79 +493,325 @@ func (c *Cylinder) ComputeSurfaceProps(hit Hit) (HitEx, error) {
 		u = hit.PointObj.X
 		v = hit.PointObj.Z
 	default:
-		return HitEx{}, fmt.Errorf("invalid cylinder face: %d", hit.Face)
+		return prim.Vec3{}, gml.Material{}, fmt.Errorf("invalid cylinder face: %d", hit.Face)
 	}
 
-	material, err := gml.EvalSurfaceFn(hit.Face, u, v, c.EvalState, &c.SurfaceFn)
+	material, err := gml.EvalSurfaceFn(hit.Face, u, v, evalState, &c.SurfaceFn)
+	return normalObj, material, err
+}
+
+// primitive is a scene object with a shape in its own object space, placed
+// by a transform.
+type primitive interface {
+	SceneObject
+	transforms() (objectToWorld, worldToObject *prim.Mat4)
+	// objectBounds returns the bounds of the shape in object space.
+	objectBounds() bounds
+	// intersectObject is Intersect for a ray in object space.
+	intersectObject(ray Ray, hit *Hit) bool
+	// surfaceObject returns the object space normal and the material at
+	// the hit.
+	surfaceObject(hit Hit, evalState *gml.EvalState) (prim.Vec3, gml.Material, error)
+}
+
+// Prototype is a group of objects that is shared by many instances.
+type Prototype struct {
+	Objects []primitive
+}
+
+// Instance is a transformed copy of a prototype. The prototype's objects are
+// only stored once however many instances there are.
+//
+// As for transformed primitives, the instance's transform is applied before
+// the transform of each object, so rays are moved into an object's space
+// and then through the inverse of the instance's transform. The objects
+// have no space in common once the instance's transform is applied, so the
+// bounds of an instance are in world space rather than the prototype's.
+type Instance struct {
+	Prototype     *Prototype
+	ObjectToWorld prim.Mat4
+	WorldToObject prim.Mat4
+	NormalMat     prim.Mat4
+
+	// bounds contains the instance's objects in world space. Rays that miss
+	// them aren't tested with the objects.
+	bounds bounds
+
+	// Motion is set if the instance moves, in which case the transform
+	// depends on the time of the ray and the matrices above are only used
+	// when the shutter opens.
+	Motion *Motion
+	// motionIndex numbers the moving instances in a scene, so that each
+	// thread can cache where they are.
+	motionIndex int
+}
+
+// Motion interpolates a transform while the shutter is open. Each part of
+// the transform is interpolated separately, so that rotations stay rigid.
+type Motion struct {
+	startT, endT prim.Vec3
+	startR, endR prim.Vec4
+	startS, endS prim.Mat4
+}
+
+func newMotion(start, end *prim.Mat4) *Motion {
+	m := &Motion{}
+	m.startT, m.startR, m.startS = start.Decompose()
+	m.endT, m.endR, m.endS = end.Decompose()
+	return m
+}
+
+// ObjectToWorld returns the transform at the given time.
+func (m *Motion) ObjectToWorld(time float64) prim.Mat4 {
+	var s prim.Mat4
+	for i := range 4 {
+		for j := range 4 {
+			s[i][j] = m.startS[i][j] + (m.endS[i][j]-m.startS[i][j])*time
+		}
+	}
+	return prim.Recompose(m.startT.Lerp(m.endT, time), prim.QSlerp(&m.startR, &m.endR, time), s)
+}
+
+// motionTransforms is where a moving instance is at some time.
+type motionTransforms struct {
+	time                         float64
+	objectToWorld, worldToObject prim.Mat4
+	// valid is set once a cached entry has been filled in.
+	valid bool
+}
+
+// at returns the transforms at the given time, without allocating.
+func (m *Motion) at(time float64) motionTransforms {
+	objectToWorld := m.ObjectToWorld(time)
+	worldToObject, _ := objectToWorld.AffineInverse()
+	return motionTransforms{time: time, objectToWorld: objectToWorld, worldToObject: worldToObject, valid: true}
+}
+
+// motionAt returns the transforms of a moving instance at the given time.
+// They are cached in st, if it is not nil, since all the rays traced for a
+// sample share its time.
+func (inst *Instance) motionAt(time float64, st *SceneThreadState) motionTransforms {
+	if st == nil {
+		return inst.Motion.at(time)
+	}
+	if inst.motionIndex >= len(st.motions) {
+		st.motions = append(st.motions, make([]motionTransforms, inst.motionIndex+1-len(st.motions))...)
+	}
+	cached := &st.motions[inst.motionIndex]
+	if !cached.valid || cached.time != time {
+		*cached = inst.Motion.at(time)
+	}
+	return *cached
+}
+
+func newMovingInstance(prototype *Prototype, start, end prim.Mat4) *Instance {
+	inst := newInstance(prototype, start)
+	inst.Motion = newMotion(&start, &end)
+	// The bounds would have to cover the whole motion, so moving instances
+	// aren't culled.
+	inst.bounds = infiniteBounds
+	return inst
+}
+
+func newInstance(prototype *Prototype, objectToWorld prim.Mat4) *Instance {
+	worldToObject := *objectToWorld.Inverse()
+	instBounds := emptyBounds
+	for _, obj := range prototype.Objects {
+		toWorld, _ := obj.transforms()
+		instBounds = instBounds.union(obj.objectBounds().transform(toWorld.MulMat(&objectToWorld)))
+	}
+	return &Instance{
+		Prototype:     prototype,
+		ObjectToWorld: objectToWorld,
+		WorldToObject: worldToObject,
+		NormalMat:     *worldToObject.Transpose(),
+		bounds:        instBounds,
+	}
+}
+
+func (inst *Instance) Intersect(ray Ray, hit *Hit) bool {
+	return inst.intersect(ray, hit, nil, nil)
+}
+
+// intersect is Intersect for the thread st, if it is not nil, which also
+// counts the tests with the prototype's objects. The prototype's object
+// skip, if not nil, is not tested.
+func (inst *Instance) intersect(ray Ray, hit *Hit, st *SceneThreadState, skip SceneObject) bool {
+	if !inst.bounds.hit(ray) {
+		return false
+	}
+
+	// T is the same in all spaces, so hits can be compared with hits on
+	// other objects directly.
+	instToObject := &inst.WorldToObject
+	if inst.Motion != nil {
+		at := inst.motionAt(ray.Time, st)
+		instToObject = &at.worldToObject
+	}
+
+	found := false
+	var closest Hit
+	for _, obj := range inst.Prototype.Objects {
+		if obj == skip {
+			continue
+		}
+		if st != nil {
+			st.Stats.countIntersect(obj)
+		}
+		_, worldToObject := obj.transforms()
+		if !obj.intersectObject(rayToObjectSpace(rayToObjectSpace(ray, worldToObject), instToObject), hit) {
+			continue
+		}
+		if !found || hit.T < closest.T {
+			closest = *hit
+			found = true
+		}
+	}
+	if !found {
+		return false
+	}
+	*hit = closest
+	hit.Instance = inst
+	hit.Time = ray.Time
+	return true
+}
+
+func (inst *Instance) ComputeSurfaceProps(hit Hit, evalState *gml.EvalState) (HitEx, error) {
+	return inst.computeSurfaceProps(hit, evalState, nil)
+}
+
+// computeSurfaceProps is ComputeSurfaceProps for the thread st, if it is
+// not nil.
+func (inst *Instance) computeSurfaceProps(hit Hit, evalState *gml.EvalState, st *SceneThreadState) (HitEx, error) {
+	obj, ok := hit.Object.(primitive)
+	if !ok {
+		return HitEx{}, fmt.Errorf("instance hit has no primitive: %T", hit.Object)
+	}
+	normalObj, material, err := obj.surfaceObject(hit, evalState)
 	if err != nil {
 		return HitEx{}, err
 	}
-
+	var point, normal prim.Vec3
+	if inst.Motion != nil {
+		at := inst.motionAt(hit.Time, st)
+		point = at.objectToWorld.MulPoint(hit.PointObj)
+		normal = at.worldToObject.MulDirTransposed(normalObj)
+	} else {
+		point = inst.ObjectToWorld.MulPoint(hit.PointObj)
+		normal = inst.NormalMat.MulDir(normalObj)
+	}
+	objectToWorld, worldToObject := obj.transforms()
 	return HitEx{
 		Hit:         hit,
-		PointWorld:  c.ObjectToWorld.MulPoint(hit.PointObj),
-		NormalWorld: c.NormalMat.MulDir(normalObj).Normalize(),
+		PointWorld:  objectToWorld.MulPoint(point),
+		NormalWorld: worldToObject.MulDirTransposed(normal).Normalize(),
 		Material:    material,
 	}, nil
 }
 
-func computeLighting(hit *HitEx, scene *Scene, objects []SceneObject, ray Ray) prim.Vec3 {
+func computeLighting(hit *HitEx, scene *Scene, threadState *SceneThreadState, ray Ray) (prim.Vec3, error) {
 	V := ray.Direction.Neg() // view vector = opposite of ray
 
 	mat := hit.Material
-	result := scene.AmbientLight.Scale(mat.Kd)
-
-	for _, light := range scene.Lights {
-		lightToHit := light.Position.Sub(hit.PointWorld)
-		distToLight := lightToHit.Length()
-		lightDir := lightToHit.Normalize()
+	ambient := scene.AmbientLight
+	if scene.EnvMap != nil && scene.EnvMap.AmbientScale > 0 {
+		ambient = scene.EnvMap.Ambient(hit.NormalWorld)
+	}
+	result := ambient.Scale(mat.Kd)
 
-		if inShadow(hit, objects, lightDir, distToLight, ray) {
-			continue
+	addLight := func(lightDir prim.Vec3, distToLight float64, color prim.Vec3) error {
+		transmittance, err := shadowTransmittance(hit, scene.Objects, threadState, lightDir, distToLight, ray)
+		if err != nil {
+			return err
 		}
+		if transmittance.IsZero() {
+			return nil
+		}
+		lightColor := *color.Mul(&transmittance)
 
 		// Diffuse term. Clamp to 0 so surfaces facing away from the light
 		// don't get a negative contribution that eats into the ambient term.
 		nDotL := math.Max(0, hit.NormalWorld.Dot(lightDir))
-		diffuse := light.Color.Scale(nDotL * mat.Kd)
+		diffuse := lightColor.Scale(nDotL * mat.Kd)
 
 		// Specular term (Blinn-Phong reflection)
 		H := V.Add(lightDir).Normalize()
 		spec := math.Max(0, hit.NormalWorld.Dot(H))
-		specular := light.Color.Scale(mat.Ks * math.Pow(spec, mat.SpecularExponent))
+		specular := lightColor.Scale(mat.Ks * math.Pow(spec, mat.SpecularExponent))
 
 		result = result.Add(diffuse).Add(specular)
+		return nil
 	}
 
-	return result
+	for _, light := range scene.Lights {
+		lightToHit := light.Position.Sub(hit.PointWorld)
+		if err := addLight(lightToHit.Normalize(), lightToHit.Length(), light.Color); err != nil {
+			return prim.Vec3{}, err
+		}
+	}
+	for _, light := range scene.DirectionalLights {
+		if err := addLight(light.Direction, math.Inf(1), light.Color); err != nil {
+			return prim.Vec3{}, err
+		}
+	}
+
+	return result, nil
 }
 
-// inShadow checks if the point hit by the ray is in the shadow of the light
-// source, by tracing a ray from the hit point to the light and checking if
-// there are any intersections with other objects.
+// shadowTransmittance traces a ray from the point hit by the ray towards the
+// light source, and returns the fraction of the light (per color channel)
+// that reaches the point.
+//
+// Opaque occluders block the light completely. Transparent occluders let
+// through a fraction of the light given by their transparency, tinted by
+// their color, so e.g. a red glass sphere casts a faint red shadow. Each
+// occluder is counted once, however many times the shadow ray crosses its
+// surface.
 //
 // The ray is offset by a small amount in the direction of the normal so that
 // the intersection with the current object is not counted.
 //
 // lightDir is assumed to be a normal vector.
-func inShadow(hit *HitEx, objects []SceneObject, lightDir prim.Vec3, distToLight float64, ray Ray) bool {
+func shadowTransmittance(hit *HitEx, objects []SceneObject, threadState *SceneThreadState, lightDir prim.Vec3, distToLight float64, ray Ray) (prim.Vec3, error) {
 	const epsilon = 1e-4
 	shadowOrigin := hit.PointWorld.Add(hit.NormalWorld.Scale(epsilon))
-	shadowRay := Ray{Origin: shadowOrigin, Direction: lightDir}
+	shadowRay := Ray{Origin: shadowOrigin, Direction: lightDir, Time: ray.Time}
+	transmittance := prim.Vec3{X: 1, Y: 1, Z: 1}
+	shadowHit := &threadState.scratchHit
+	threadState.Stats.ShadowRays++
 	for _, obj := range objects {
 		if obj == hit.Object {
 			continue
 		}
-		shadowHit := obj.Intersect(shadowRay)
-		if shadowHit == nil {
+		// Only the object that was hit is skipped, not the rest of its
+		// instance, which may still cast a shadow on it.
+		var skip SceneObject
+		if hit.Instance != nil && obj == SceneObject(hit.Instance) {
+			skip = hit.Object
+		}
+		if !threadState.intersect(obj, shadowRay, shadowHit, skip) {
 			continue
 		}
 		// Check if the intersection is between the hit point and the light.
-		if shadowHit.T*ray.Direction.Length() < distToLight {
-			return true
+		if shadowHit.T*ray.Direction.Length() >= distToLight {
+			continue
+		}
+		// The occluder's surface function decides how much light gets
+		// through, so we need to evaluate it at the shadow hit point.
+		occluder, err := threadState.computeSurfaceProps(shadowHit)
+		if err != nil {
+			return prim.Vec3{}, fmt.Errorf("error computing shadow hit properties of %+v: %w", shadowHit, err)
+		}
+		mat := &occluder.Material
+		if mat.Transparency <= 0 {
+			return prim.Vec3{}, nil
+		}
+		transmittance = mat.Color.Mul(&transmittance).Scale(mat.Transparency)
+		if transmittance.IsZero() {
+			return prim.Vec3{}, nil
 		}
 	}
-	return false
+	return transmittance, nil
 }
 
 // refract computes the direction of a refracted ray.
@@ -466,20 +852,33 @@ func fresnel(normal, incident prim.Vec3, ior float64) float64 {
 	return r0 + (1-r0)*math.Pow(1-cost, 5) // Schlick's approximation
 }
 
-func closestHit(objects []SceneObject, ray Ray) *Hit {
-	var minHit *Hit
-	// PERF: We currently compute the surface function as part of Intersect,
-	// but we really only need to do this for the closest hit.
+// closestHit returns the closest hit of the ray with any of the objects, or
+// nil if there is none. The hit is only valid until the next call.
+func (st *SceneThreadState) closestHit(objects []SceneObject, ray Ray) *Hit {
+	found := false
 	for _, obj := range objects {
-		hit := obj.Intersect(ray)
-		if hit == nil {
+		if !st.intersect(obj, ray, &st.scratchHit, nil) {
 			continue
 		}
-		if minHit == nil || hit.T < minHit.T {
-			minHit = hit
+		if !found || st.scratchHit.T < st.closest.T {
+			st.closest = st.scratchHit
+			found = true
 		}
 	}
-	return minHit
+	if !found {
+		return nil
+	}
+	return &st.closest
+}
+
+// computeSurfaceProps computes the surface properties at the hit, counting
+// the surface function evaluation.
+func (st *SceneThreadState) computeSurfaceProps(hit *Hit) (HitEx, error) {
+	st.Stats.countSurfaceFnEval(hit)
+	if hit.Instance != nil {
+		return hit.Instance.computeSurfaceProps(*hit, st.EvalState, st)
+	}
+	return hit.ComputeSurfaceProps(st.EvalState)
 }
 
 // traceRay returns the color of the closest object hit by the ray, or nil
@@ -489,20 +888,32 @@ func traceRay(scene *Scene, threadState *SceneThreadState, ray Ray, depth int) p
 		// Recursion limit
 		return prim.Vec3{}
 	}
-	hit := closestHit(threadState.Objects, ray)
+	threadState.Stats.MaxDepth = max(threadState.Stats.MaxDepth, scene.recursionDepth()-depth+1)
+	hit := threadState.closestHit(scene.Objects, ray)
 	if hit == nil {
+		if scene.EnvMap != nil {
+			return scene.EnvMap.Sample(ray.Direction).Clamp()
+		}
+		if scene.Sky != nil {
+			return scene.Sky.Color(ray.Direction)
+		}
 		// Calculate background color (linear gradient).
 		t := 0.5 * (ray.Direction.Y + 1.0)
 		return scene.BgColorStart.Lerp(scene.BgColorEnd, t)
 	}
-	hitEx, err := hit.Object.ComputeSurfaceProps(*hit)
+	hitEx, err := threadState.computeSurfaceProps(hit)
 	if err != nil {
-		panic(fmt.Errorf("error computing hit properties of %+v: %w", hit, err))
+		threadState.fail(fmt.Errorf("error computing hit properties of %+v: %w", hit, err))
+		return prim.Vec3{}
 	}
 
-	lighting := computeLighting(&hitEx, scene, threadState.Objects, ray)
+	lighting, err := computeLighting(&hitEx, scene, threadState, ray)
+	if err != nil {
+		threadState.fail(fmt.Errorf("error computing lighting of %+v: %w", hit, err))
+		return prim.Vec3{}
+	}
 
-	mat := hitEx.Material
+	mat := &hitEx.Material
 	if mat.Reflectivity == 0 && mat.Transparency == 0 {
 		return lighting.Mul(&mat.Color).Clamp()
 	}
@@ -524,7 +935,9 @@ func traceRay(scene *Scene, threadState *SceneThreadState, ray Ray, depth int) p
 		reflectionRay := Ray{
 			Origin:    hitEx.PointWorld.Add(hitEx.NormalWorld.Scale(1e-4)),
 			Direction: reflectedDir.Normalize(),
+			Time:      ray.Time,
 		}
+		threadState.Stats.ReflectionRays++
 		reflectedColor = traceRay(scene, threadState, reflectionRay, depth-1)
 	}
 
@@ -548,9 +961,10 @@ func traceRay(scene *Scene, threadState *SceneThreadState, ray Ray, depth int) p
 
 		if !refractedDir.IsZero() {
 			// Create the refracted ray. We offset the origin slightly to avoid self-intersection.
-			refractedRay := Ray{Origin: hitEx.PointWorld.Sub(normal.Scale(1e-4)), Direction: refractedDir}
+			refractedRay := Ray{Origin: hitEx.PointWorld.Sub(normal.Scale(1e-4)), Direction: refractedDir, Time: ray.Time}
 
 			// Recursively trace the refracted ray
+			threadState.Stats.RefractionRays++
 			refractedColor = traceRay(scene, threadState, refractedRay, depth-1)
 		}
 	}
@@ -563,8 +977,31 @@ func traceRay(scene *Scene, threadState *SceneThreadState, ray Ray, depth int) p
 
 // SceneThreadState holds the per-thread evaluation state for a single thread.
 type SceneThreadState struct {
+	// EvalState is used to evaluate surface functions that could not be
+	// precomputed or compiled.
 	EvalState *gml.EvalState
-	Objects   []SceneObject
+
+	// Stats counts the work done by this thread. Phases is not used.
+	Stats RenderStats
+
+	// Hits passed to SceneObject.Intersect escape to the heap, so we keep
+	// them here rather than allocating them for every ray.
+	scratchHit, closest Hit
+
+	// motions caches the transforms of the moving instances, indexed by
+	// Instance.motionIndex.
+	motions []motionTransforms
+
+	// err is the first error from a surface function or lighting, which
+	// stops the render.
+	err error
+}
+
+// fail records err, if it is the thread's first error.
+func (st *SceneThreadState) fail(err error) {
+	if st.err == nil {
+		st.err = err
+	}
 }
 
 type Scene struct {
@@ -573,157 +1010,619 @@ type Scene struct {
 	Fov            float64
 	RecursionDepth int
 
-	// For now, lights do not reference the EvalState, so they can
-	// live outside of PerThreadStates.
+	// ApertureRadius is the radius of the camera lens. If it is 0, the
+	// camera is a pinhole and everything is in focus. Otherwise, objects
+	// are only in focus at FocalDistance from the eye.
+	ApertureRadius float64
+	FocalDistance  float64
 
-	Lights       []*gml.PointLight
-	AmbientLight prim.Vec3
+	// MotionBlur is set if anything in the scene moves, in which case each
+	// primary ray is cast at a random time while the shutter is open.
+	MotionBlur bool
+
+	// Objects is the scene geometry, which is shared by all threads.
+	Objects []SceneObject
+
+	Lights            []*gml.PointLight
+	DirectionalLights []DirectionalLight
+	AmbientLight      prim.Vec3
 
 	// BgColorStart and BgColorEnd define the 2 ends of the gradient
 	// background color.
 	BgColorStart, BgColorEnd prim.Vec3
 
+	// EnvMap, if set, replaces the background gradient, and optionally the
+	// ambient light.
+	EnvMap *EnvMap
+
+	// Sky, if set, replaces the background gradient. The sun should also
+	// be added to DirectionalLights.
+	Sky *Sky
+
+	RenderOptions
+
+	// PerThreadStates has a state for each worker, which Render adds to
+	// if there are too few.
 	PerThreadStates []SceneThreadState
 }
 
-func Render(scene *Scene) image.Image {
-	img := image.NewRGBA(image.Rect(0, 0, scene.WidthPx, scene.HeightPx))
+// RenderOptions controls how the work of rendering a scene is split up,
+// and which part of the image is rendered. Apart from Width, Height and
+// Samples, none of the options change the color of any pixel.
+type RenderOptions struct {
+	// Width and Height, if set, override the size of the image given by
+	// the GML program.
+	Width, Height int
+	// Samples is the number of samples per pixel, for antialiasing. If it
+	// is 0, 4 samples are used.
+	Samples int
+
+	// Workers is the number of threads to render with. If it is 0,
+	// runtime.GOMAXPROCS threads are used.
+	Workers int
+	// TileSize is the width and height of the tiles that are handed out to
+	// workers. If it is 0, 16 pixel tiles are used.
+	TileSize  int
+	TileOrder TileOrder
+
+	// Region, if set, limits rendering to part of the image. The rest of
+	// the image is left transparent, unless Crop is set, in which case the
+	// image only covers the region. Either way, pixels keep the coordinates
+	// they have in the full image.
+	Region *Region
+	Crop   bool
+
+	// CheckpointFile, if set, is where the samples rendered so far are
+	// saved every CheckpointInterval (or every minute if it is 0), and
+	// when the render finishes.
+	CheckpointFile     string
+	CheckpointInterval time.Duration
+	// Resume continues the render from CheckpointFile, if it exists. The
+	// result is the same as if the render had not been interrupted.
+	Resume bool
+
+	// NoIncludes makes #include directives in the GML program an error,
+	// NoFiles makes reading any other local file an error, such as an
+	// environment map, and MaxPixels, if set, limits the size of the images
+	// it renders, for programs from sources that must not read local files
+	// or use up all the memory.
+	NoIncludes bool
+	NoFiles    bool
+	MaxPixels  int
+	// FilesDir, if set, is the only directory files other than the program
+	// can be read from, and relative file names in a program given as text
+	// are resolved against it. Names that are absolute or lead out of it,
+	// even through symbolic links, are errors.
+	FilesDir string
+
+	// TileDone, if set, is called with the pixels of each tile as soon as
+	// it is rendered. Workers call it concurrently.
+	TileDone func(tile *image.RGBA)
+}
 
-	var recursionLimit = scene.RecursionDepth
-	if recursionLimit <= 0 {
-		recursionLimit = 3
+// pixelsToRender returns the part of the image to render.
+func (scene *Scene) pixelsToRender() (image.Rectangle, error) {
+	if scene.Region == nil {
+		return image.Rect(0, 0, scene.WidthPx, scene.HeightPx), nil
 	}
+	return scene.Region.Pixels(scene.WidthPx, scene.HeightPx)
+}
 
-	if scene.Fov <= 0.0 {
-		log.Printf("WARN: fov not specified, using default of 90 degrees\n")
-		scene.Fov = 90.0
+// samples returns the number of samples per pixel.
+func (opts *RenderOptions) samples() int {
+	if opts.Samples <= 0 {
+		return defaultSamples
 	}
-	fovRadians := scene.Fov * math.Pi / 180.0
-	viewportWidth := 2.0 / math.Tan(fovRadians/2.0)
-	viewportHeight := viewportWidth * (float64(scene.HeightPx) / float64(scene.WidthPx))
+	return opts.Samples
+}
+
+// recursionDepth returns the limit on the depth of traced rays, which is 3
+// if the scene doesn't set one.
+func (scene *Scene) recursionDepth() int {
+	if scene.RecursionDepth <= 0 {
+		return 3
+	}
+	return scene.RecursionDepth
+}
 
-	eyePosition := prim.Vec3{
-		X: 0.0,
-		Y: 0.0,
-		Z: -1.0,
+// threadStates returns a state for each worker.
+func (scene *Scene) threadStates() []SceneThreadState {
+	workers := scene.Workers
+	if workers <= 0 {
+		workers = runtime.GOMAXPROCS(0)
+	}
+	for len(scene.PerThreadStates) < workers {
+		scene.PerThreadStates = append(scene.PerThreadStates, SceneThreadState{
+			EvalState: scene.PerThreadStates[0].EvalState.Clone(),
+		})
+	}
+	return scene.PerThreadStates[:workers]
+}
+
+// lensRay turns a pinhole camera ray through the eye into a ray through a
+// random point on the lens, which meets the pinhole ray on the focal plane.
+func (scene *Scene) lensRay(ray Ray, eyePosition prim.Vec3, rng *rand.Rand) Ray {
+	focalPoint := eyePosition.Add(ray.Direction.Scale(scene.FocalDistance / ray.Direction.Z))
+
+	// Sample the lens disk uniformly.
+	r := scene.ApertureRadius * math.Sqrt(rng.Float64())
+	theta := 2 * math.Pi * rng.Float64()
+	lensPoint := eyePosition.Add(prim.Vec3{X: r * math.Cos(theta), Y: r * math.Sin(theta)})
+
+	// Like the pinhole rays, start the ray on the screen.
+	direction := focalPoint.Sub(lensPoint).Normalize()
+	return Ray{
+		Origin:    lensPoint.Add(direction.Scale((ray.Origin.Z - lensPoint.Z) / direction.Z)),
+		Direction: direction,
+		Time:      ray.Time,
+	}
+}
+
+func Render(scene *Scene) image.Image {
+	img, _ := RenderWithStats(scene)
+	return img
+}
+
+// RenderWithStats renders the scene like Render, and also returns the work
+// done by all the threads and the time it took to render. If the scene's
+// Region is invalid, it logs the error and returns no image.
+func RenderWithStats(scene *Scene) (image.Image, RenderStats) {
+	img, stats, err := RenderWithContext(context.Background(), scene)
+	if err != nil {
+		log.Printf("WARN: %v\n", err)
+	}
+	return img, stats
+}
+
+// RenderWithContext is RenderWithStats, but stops rendering when ctx is
+// done. In that case it returns ctx's error and no image, after writing a
+// checkpoint of the pixels rendered so far if a CheckpointFile is set. An
+// invalid Region, and the first error from a surface function, are also
+// returned as errors.
+func RenderWithContext(ctx context.Context, scene *Scene) (image.Image, RenderStats, error) {
+	start := time.Now()
+	// Hash the scene before filling in defaults, to match checkResume.
+	var sceneHash string
+	if scene.CheckpointFile != "" {
+		sceneHash = scene.Hash()
+	}
+	region, err := scene.pixelsToRender()
+	if err != nil {
+		return nil, RenderStats{}, err
 	}
 
-	type workItem struct {
-		x, ymin, ymax int // ymax is exclusive
+	cam := scene.camera()
+
+	// The first error from a worker cancels the render, and is returned
+	// instead of the context's error.
+	ctx, cancel := context.WithCancelCause(ctx)
+	defer cancel(nil)
+	var renderErr error
+	var failOnce sync.Once
+
+	// Pixels are written straight to the output image, unless the render
+	// is checkpointed. Then the samples are also kept in a framebuffer,
+	// which can be written to the checkpoint and resumed.
+	var out *image.RGBA
+	if scene.Crop {
+		out = image.NewRGBA(region)
+	} else {
+		out = image.NewRGBA(image.Rect(0, 0, scene.WidthPx, scene.HeightPx))
+	}
+	var fb *framebuffer
+	if scene.CheckpointFile != "" {
+		fb = newFramebuffer(scene.WidthPx, scene.HeightPx)
+		if scene.Resume {
+			resumed, err := scene.loadCheckpoint(sceneHash)
+			if err != nil {
+				log.Printf("WARN: %v, starting from scratch\n", err)
+			} else if resumed != nil {
+				fb = resumed
+			}
+		}
 	}
 
-	workChan := make(chan workItem, 256)
+	tileSize := scene.TileSize
+	if tileSize <= 0 {
+		tileSize = 16
+	}
+	samples := scene.samples()
+	workChan := make(chan image.Rectangle, 256)
 
+	threadStates := scene.threadStates()
 	var wg sync.WaitGroup
-	for _, st := range scene.PerThreadStates {
+	for i := range threadStates {
+		st := &threadStates[i]
+		st.Stats, st.err = RenderStats{}, nil
 		wg.Add(1)
 
 		go func() {
 			defer wg.Done()
 
-			for item := range workChan {
-				x, ymin, ymax := item.x, item.ymin, item.ymax
-
-				// For determinism, we create a new random generator state
-				// seeded deterministically from the x, y coordinates. PCG only
-				// has 128 bits of internal state and does no expensive work
-				// on construction so this should be fine for performance.
-
-				seed1 := 0xDEAD ^ uint64(x)
-				seed2 := 0xBEEF ^ uint64(ymin)
-				rng := rand.New(rand.NewPCG(seed1, seed2))
-
-				for y := ymin; y < ymax; y++ {
-					// Subsample for antialiasing
-					totalColor := prim.Vec3{}
-					const numSamples = 4
-					for range numSamples {
-						// Map pixel coordinates to world coordinates.
-						dx := rng.Float64() - 0.5
-						dy := rng.Float64() - 0.5
-						u := (float64(x)+dx)/float64(scene.WidthPx-1)*viewportWidth - viewportWidth/2.0
-						v := (float64(y)+dy)/float64(scene.HeightPx-1)*viewportHeight - viewportHeight/2.0
-
-						var ray Ray
-						ray.Origin = prim.Vec3{X: u, Y: -v, Z: 0.0} // screen point
-						ray.Direction = ray.Origin.Sub(eyePosition).Normalize()
-
-						totalColor = totalColor.Add(traceRay(scene, &st, ray, recursionLimit))
+			pcg := rand.NewPCG(0, 0)
+			rng := rand.New(pcg)
+			for tile := range workChan {
+				if fb != nil {
+					fb.mu.RLock()
+				}
+				for y := tile.Min.Y; y < tile.Max.Y; y++ {
+					if ctx.Err() != nil {
+						// Leave the rest of the tile unrendered, so that
+						// it is rendered when the checkpoint is resumed.
+						break
+					}
+					for x := tile.Min.X; x < tile.Max.X; x++ {
+						if fb != nil && fb.counts[fb.index(x, y)] != 0 {
+							// Already rendered before resuming.
+							out.Set(x, y, fb.color(x, y))
+							continue
+						}
+						// For determinism, we reseed the random generator
+						// from the pixel coordinates, so that the image does
+						// not depend on which worker renders which tile, or
+						// in what order. PCG only has 128 bits of internal
+						// state, so this is cheap.
+						pcg.Seed(0xDEAD^uint64(x), 0xBEEF^uint64(y))
+
+						// SAFETY: Workers set distinct pixels, so they only
+						// need to coordinate with checkpoints.
+						sum := renderPixel(scene, st, &cam, rng, x, y)
+						if st.err != nil {
+							failOnce.Do(func() {
+								renderErr = st.err
+								cancel(st.err)
+							})
+							break
+						}
+						if fb != nil {
+							i := fb.index(x, y)
+							fb.sums[i] = sum
+							fb.counts[i] = int32(samples)
+						}
+						out.Set(x, y, sum.Scale(1.0/float64(samples)))
+					}
+				}
+				if fb != nil {
+					fb.mu.RUnlock()
+				}
+				// TileDone can be slow, so it is called without holding
+				// the lock, which would hold up checkpoints and, waiting
+				// for them, the other workers.
+				if scene.TileDone != nil && ctx.Err() == nil {
+					pixels := image.NewRGBA(tile)
+					draw.Draw(pixels, tile, out, tile.Min, draw.Src)
+					scene.TileDone(pixels)
+				}
+			}
+		}()
+	}
+
+	checkpointsDone := make(chan struct{})
+	var checkpointer sync.WaitGroup
+	if scene.CheckpointFile != "" {
+		interval := scene.CheckpointInterval
+		if interval <= 0 {
+			interval = time.Minute
+		}
+		checkpointer.Add(1)
+		go func() {
+			defer checkpointer.Done()
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-checkpointsDone:
+					return
+				case <-ticker.C:
+					if err := scene.writeCheckpoint(fb, sceneHash); err != nil {
+						log.Printf("WARN: %v\n", err)
 					}
-					// SAFETY: We should be able to set distinct pixel coordinates
-					// of the image without coordination (since we preallocate the
-					// entire raster buffer at the start).
-					img.Set(x, y, totalColor.Scale(1.0/float64(numSamples)))
 				}
 			}
 		}()
 	}
 
 	go func() {
-		const batchSize = 20
-		for x := range scene.WidthPx {
-			y := 0
-			for y < scene.HeightPx {
-				ymax := min(y+batchSize, scene.HeightPx)
-				workChan <- workItem{
-					x:    x,
-					ymin: y,
-					ymax: ymax,
-				}
-				y = ymax
+		defer close(workChan)
+		for _, tile := range tiles(region, tileSize, scene.TileOrder) {
+			select {
+			case workChan <- tile:
+			case <-ctx.Done():
+				return
 			}
 		}
-		close(workChan)
 	}()
 
 	wg.Wait()
+	close(checkpointsDone)
+	checkpointer.Wait()
+	if scene.CheckpointFile != "" {
+		if err := scene.writeCheckpoint(fb, sceneHash); err != nil {
+			log.Printf("WARN: %v\n", err)
+		}
+	}
 
-	return img
+	var stats RenderStats
+	for i := range threadStates {
+		stats.Add(&threadStates[i].Stats)
+	}
+	if renderErr != nil {
+		stats.Phases.Render = time.Since(start)
+		return nil, stats, renderErr
+	}
+	if err := ctx.Err(); err != nil {
+		stats.Phases.Render = time.Since(start)
+		return nil, stats, err
+	}
+
+	stats.Phases.Render = time.Since(start)
+	return out, stats, nil
+}
+
+// camera maps pixels to primary rays.
+type camera struct {
+	viewportWidth, viewportHeight float64
+	eyePosition                   prim.Vec3
+}
+
+func (scene *Scene) camera() camera {
+	if scene.Fov <= 0.0 {
+		log.Printf("WARN: fov not specified, using default of 90 degrees\n")
+		scene.Fov = 90.0
+	}
+	fovRadians := scene.Fov * math.Pi / 180.0
+	viewportWidth := 2.0 / math.Tan(fovRadians/2.0)
+	return camera{
+		viewportWidth:  viewportWidth,
+		viewportHeight: viewportWidth * (float64(scene.HeightPx) / float64(scene.WidthPx)),
+		eyePosition:    prim.Vec3{X: 0.0, Y: 0.0, Z: -1.0},
+	}
+}
+
+// defaultSamples is the number of samples per pixel if
+// RenderOptions.Samples is not set.
+const defaultSamples = 4
+
+// renderPixel returns the sum of the colors of the samples of the pixel at
+// x, y.
+func renderPixel(scene *Scene, st *SceneThreadState, cam *camera, rng *rand.Rand, x, y int) prim.Vec3 {
+	totalColor := prim.Vec3{}
+	for range scene.samples() {
+		// Map pixel coordinates to world coordinates.
+		dx := rng.Float64() - 0.5
+		dy := rng.Float64() - 0.5
+		u := (float64(x)+dx)/float64(scene.WidthPx-1)*cam.viewportWidth - cam.viewportWidth/2.0
+		v := (float64(y)+dy)/float64(scene.HeightPx-1)*cam.viewportHeight - cam.viewportHeight/2.0
+
+		var ray Ray
+		ray.Origin = prim.Vec3{X: u, Y: -v, Z: 0.0} // screen point
+		ray.Direction = ray.Origin.Sub(cam.eyePosition).Normalize()
+		if scene.MotionBlur {
+			ray.Time = rng.Float64()
+		}
+		if scene.ApertureRadius > 0 {
+			ray = scene.lensRay(ray, cam.eyePosition, rng)
+		}
+
+		st.Stats.PrimaryRays++
+		totalColor = totalColor.Add(traceRay(scene, st, ray, scene.recursionDepth()))
+	}
+	return totalColor
 }
 
 func ParseAndRenderGML(programText string) (image.Image, error) {
+	img, _, err := ParseAndRenderGMLWithOptions(context.Background(), programText, RenderOptions{})
+	return img, err
+}
+
+// ParseAndRenderGMLWithOptions is ParseAndRenderGML, rendering with the
+// given options and also returning statistics about the render. Evaluation
+// and rendering stop with ctx's error when ctx is done.
+func ParseAndRenderGMLWithOptions(ctx context.Context, programText string, opts RenderOptions) (image.Image, *RenderStats, error) {
 	state := gml.NewEvalState()
-	return renderFromEvalState(state, func() error { return state.ParseAndEval(programText) })
+	return renderFromEvalState(ctx, state, opts, func() (gml.TokenList, error) { return state.Parse(programText) })
+}
+
+// ParseGMLScene runs the GML program, which should render one image, and
+// returns the scene instead of rendering it.
+func ParseGMLScene(programText string) (*Scene, error) {
+	return ParseGMLSceneInDir(programText, "")
+}
+
+// ParseGMLSceneInDir is ParseGMLScene, resolving relative file names in the
+// program, like environment maps, against dir.
+func ParseGMLSceneInDir(programText, dir string) (*Scene, error) {
+	return parseGMLScene(programText, dir, RenderOptions{})
+}
+
+// ParseGMLSceneWithOptions is ParseGMLScene for a scene to render with
+// opts, which also limit what the program can do as they do for
+// ParseAndRenderGMLWithOptions.
+func ParseGMLSceneWithOptions(programText string, opts RenderOptions) (*Scene, error) {
+	return parseGMLScene(programText, "", opts)
+}
+
+func parseGMLScene(programText, dir string, opts RenderOptions) (*Scene, error) {
+	var scene *Scene
+	state := gml.NewEvalState()
+	state.Dir = dir
+	state.NoIncludes = opts.NoIncludes
+	state.Render = func(state *gml.EvalState, args *gml.RenderArgs) error {
+		if scene != nil {
+			return errors.New("multiple images were rendered by the GML program")
+		}
+		var err error
+		scene, err = convertWithOptions(args, state, opts)
+		return err
+	}
+	if err := state.ParseAndEval(programText); err != nil {
+		return nil, err
+	}
+	if scene == nil {
+		return nil, errors.New("no image was rendered by the GML program")
+	}
+	return scene, nil
 }
 
 // ParseAndRenderGMLFile parses and renders the GML program at path,
 // resolving any #include directives it contains relative to path's
 // directory.
 func ParseAndRenderGMLFile(path string) (image.Image, error) {
+	img, _, err := ParseAndRenderGMLFileWithOptions(context.Background(), path, RenderOptions{})
+	return img, err
+}
+
+// ParseAndRenderGMLFileWithOptions is ParseAndRenderGMLFile, rendering with
+// the given options and also returning statistics about the render.
+func ParseAndRenderGMLFileWithOptions(ctx context.Context, path string, opts RenderOptions) (image.Image, *RenderStats, error) {
 	state := gml.NewEvalState()
-	return renderFromEvalState(state, func() error { return state.ParseAndEvalFile(path) })
+	return renderFromEvalState(ctx, state, opts, func() (gml.TokenList, error) { return state.ParseFile(path) })
+}
+
+// ParseAndRenderGMLFileImages is ParseAndRenderGMLFileWithOptions for
+// programs that render any number of images, which it returns in the
+// order they were rendered.
+func ParseAndRenderGMLFileImages(ctx context.Context, path string, opts RenderOptions) ([]image.Image, *RenderStats, error) {
+	state := gml.NewEvalState()
+	rendered, stats, err := renderImagesFromEvalState(ctx, state, opts, func() (gml.TokenList, error) { return state.ParseFile(path) })
+	if err != nil {
+		return nil, nil, err
+	}
+	images := make([]image.Image, len(rendered))
+	for i, r := range rendered {
+		images[i] = r.img
+	}
+	return images, stats, nil
 }
 
-func renderFromEvalState(state *gml.EvalState, run func() error) (image.Image, error) {
-	images := make(map[string]image.Image)
+func renderFromEvalState(ctx context.Context, state *gml.EvalState, opts RenderOptions, parse func() (gml.TokenList, error)) (image.Image, *RenderStats, error) {
+	images, stats, err := renderImagesFromEvalState(ctx, state, opts, parse)
+	if err != nil {
+		return nil, nil, err
+	}
+	files := make(map[string]bool)
+	for _, img := range images {
+		files[img.file] = true
+	}
+	if len(files) > 1 {
+		// ParseAndRenderGMLFileImages returns all of them.
+		return nil, nil, errors.New("multiple images were rendered by the GML program")
+	}
+	if len(images) == 0 {
+		return nil, nil, errors.New("no image was rendered by the GML program")
+	}
+	// The program may render the same file more than once, in which case
+	// the last render wins.
+	return images[len(images)-1].img, stats, nil
+}
+
+// renderedImage is an image rendered by a GML program, and the file the
+// program asked for it to be written to.
+type renderedImage struct {
+	file string
+	img  image.Image
+}
+
+func renderImagesFromEvalState(ctx context.Context, state *gml.EvalState, opts RenderOptions, parse func() (gml.TokenList, error)) ([]renderedImage, *RenderStats, error) {
+	var images []renderedImage
+	stats := &RenderStats{}
+	state.NoIncludes = opts.NoIncludes
+
+	if ctx.Done() != nil {
+		// GML programs can loop forever, so evaluation has to be stopped
+		// too, not just rendering.
+		state.Debugger = func() gml.DebuggerSignal {
+			if ctx.Err() != nil {
+				return gml.DbgAbort
+			}
+			return gml.DbgContinue
+		}
+	}
 
 	state.Render = func(state *gml.EvalState, args *gml.RenderArgs) error {
-		scene, err := ConvertRenderArgsToScene(args, state)
+		start := time.Now()
+		scene, err := convertWithOptions(args, state, opts)
 		if err != nil {
 			return err
 		}
+		stats.Phases.Convert += time.Since(start)
+		// Rendering checks ctx itself, and would fail if a surface
+		// function were aborted.
+		scene.PerThreadStates[0].EvalState.Debugger = nil
 
-		images[args.File] = Render(scene)
+		img, renderStats, err := RenderWithContext(ctx, scene)
+		stats.Add(&renderStats)
+		if err != nil {
+			return err
+		}
+		images = append(images, renderedImage{args.File, img})
 		return nil
 	}
 
-	if err := run(); err != nil {
+	start := time.Now()
+	program, err := parse()
+	if err != nil {
+		return nil, nil, err
+	}
+	stats.Phases.Parse = time.Since(start)
+
+	start = time.Now()
+	if err := state.Eval(program); err != nil {
+		if ctxErr := ctx.Err(); ctxErr != nil {
+			return nil, nil, ctxErr
+		}
+		return nil, nil, err
+	}
+	stats.Phases.Eval = time.Since(start) - stats.Phases.Convert - stats.Phases.Render
+	return images, stats, nil
+}
+
+// convertWithOptions converts the render arguments to a scene to render
+// with opts, checking that the program keeps to their limits.
+func convertWithOptions(args *gml.RenderArgs, state *gml.EvalState, opts RenderOptions) (*Scene, error) {
+	open := os.Open
+	switch {
+	case opts.NoFiles && args.EnvMap != nil:
+		// Don't say whether the file exists.
+		return nil, errors.New("environment maps are not allowed")
+	case opts.FilesDir != "":
+		root, err := os.OpenRoot(opts.FilesDir)
+		if err != nil {
+			return nil, err
+		}
+		defer root.Close()
+		open = root.Open
+	}
+	scene, err := convertRenderArgsToScene(args, state, open)
+	if err != nil {
 		return nil, err
 	}
-	if len(images) > 1 {
-		// We could easily support this if we wanted to.
-		return nil, errors.New("multiple images were rendered by the GML program")
+	scene.RenderOptions = opts
+	if opts.Width > 0 {
+		scene.WidthPx = opts.Width
 	}
-	// Return first (only) image.
-	for _, img := range images {
-		return img, nil
+	if opts.Height > 0 {
+		scene.HeightPx = opts.Height
+	}
+	if opts.MaxPixels > 0 && scene.WidthPx*scene.HeightPx > opts.MaxPixels {
+		return nil, fmt.Errorf("%dx%d image has more than %d pixels", scene.WidthPx, scene.HeightPx, opts.MaxPixels)
 	}
-	return nil, errors.New("no image was rendered by the GML program")
+	if _, err := scene.pixelsToRender(); err != nil {
+		return nil, err
+	}
+	if err := scene.checkResume(); err != nil {
+		return nil, err
+	}
+	return scene, nil
 }
 
 func ConvertRenderArgsToScene(args *gml.RenderArgs, state *gml.EvalState) (*Scene, error) {
-	numRenderThreads := 8
+	return convertRenderArgsToScene(args, state, os.Open)
+}
 
+// convertRenderArgsToScene is ConvertRenderArgsToScene, opening files with
+// open.
+func convertRenderArgsToScene(args *gml.RenderArgs, state *gml.EvalState, open func(name string) (*os.File, error)) (*Scene, error) {
 	scene := &Scene{
 		WidthPx:        args.Width,
 		HeightPx:       args.Height,
@@ -735,25 +1634,78 @@ func ConvertRenderArgsToScene(args *gml.RenderArgs, state *gml.EvalState) (*Scen
 		BgColorEnd:     args.BgColorEnd,
 	}
 
-	scene.PerThreadStates = make([]SceneThreadState, numRenderThreads)
-	for i := range scene.PerThreadStates {
-		state := state.Clone()
+	if args.EnvMap != nil {
+		envMap, err := loadEnvMap(args.EnvMap, open)
+		if err != nil {
+			return nil, fmt.Errorf("loading environment map: %w", err)
+		}
+		scene.EnvMap = envMap
+	}
 
-		// PERF: We duplicate the conversion of GML objects for each thread
-		// (the only difference is the cloned EvalState)
-		convertedObjects, err := convertGMLSceneObjects([]gml.SceneObject{args.Scene}, state)
+	if args.Sky != nil {
+		sky, err := NewSky(args.Sky.SunDirection, args.Sky.Turbidity)
 		if err != nil {
 			return nil, err
 		}
+		scene.Sky = sky
+		if sun, ok := sky.SunLight(); ok {
+			scene.DirectionalLights = append(scene.DirectionalLights, sun)
+		}
+	}
+
+	if args.Lens != nil {
+		if args.Lens.ApertureRadius < 0 {
+			return nil, fmt.Errorf("aperture radius must not be negative, got %v", args.Lens.ApertureRadius)
+		}
+		if args.Lens.FocalDistance <= 0 {
+			return nil, fmt.Errorf("focal distance must be positive, got %v", args.Lens.FocalDistance)
+		}
+		scene.ApertureRadius = args.Lens.ApertureRadius
+		scene.FocalDistance = args.Lens.FocalDistance
+	}
 
-		scene.PerThreadStates[i].EvalState = state
-		scene.PerThreadStates[i].Objects = convertedObjects
+	objects, err := convertGMLSceneObjects([]gml.SceneObject{args.Scene})
+	if err != nil {
+		return nil, err
+	}
+	scene.Objects = objects
+	for _, obj := range objects {
+		if inst, ok := obj.(*Instance); ok && inst.Motion != nil {
+			scene.MotionBlur = true
+		}
 	}
 
+	// Render adds more states if it uses more than one worker.
+	scene.PerThreadStates = []SceneThreadState{{EvalState: state.Clone()}}
+
 	return scene, nil
 }
 
-func convertGMLSceneObjects(sceneObjects []gml.SceneObject, evalState *gml.EvalState) ([]SceneObject, error) {
+// ErrUnsupportedObject is returned when a GML scene has an object that the
+// renderer can't draw yet.
+var ErrUnsupportedObject = errors.New("unsupported scene object")
+
+// sceneConverter converts GML scene objects into SceneObjects.
+type sceneConverter struct {
+	// prototypes holds the converted objects of each union that has been
+	// instanced, so that they are only converted once.
+	prototypes map[*gml.Union]*Prototype
+	// moving counts the moving instances.
+	moving int
+}
+
+func convertGMLSceneObjects(sceneObjects []gml.SceneObject) ([]SceneObject, error) {
+	c := &sceneConverter{prototypes: map[*gml.Union]*Prototype{}}
+	results, err := c.convertPrimitives(sceneObjects)
+	if err != nil {
+		return nil, err
+	}
+	return c.addInstances(results, sceneObjects, prim.IdentityMatrix())
+}
+
+// convertPrimitives converts the primitives in sceneObjects, flattening
+// unions. Instances are skipped; see addInstances.
+func (c *sceneConverter) convertPrimitives(sceneObjects []gml.SceneObject) ([]SceneObject, error) {
 	createMatrices := func(xform *prim.Mat4) (objectToWorld, worldToObject prim.Mat4) {
 		if xform == nil {
 			return prim.IdentityMatrix(), prim.IdentityMatrix()
@@ -767,13 +1719,12 @@ func convertGMLSceneObjects(sceneObjects []gml.SceneObject, evalState *gml.EvalS
 			NormalWorld:   worldToObject.Transpose().MulDir(normal).Normalize(),
 			D:             -normal.Dot(point),
 			SurfaceFn:     surfaceFn,
-			EvalState:     evalState,
 			ObjectToWorld: objectToWorld,
 			WorldToObject: worldToObject,
 		}
 	}
 
-	toVisit := sceneObjects
+	toVisit := slices.Clone(sceneObjects)
 	var results []SceneObject
 	for len(toVisit) > 0 {
 		sceneObject := toVisit[0]
@@ -784,7 +1735,6 @@ func convertGMLSceneObjects(sceneObjects []gml.SceneObject, evalState *gml.EvalS
 
 			results = append(results, &Sphere{
 				SurfaceFn:     typedObject.SurfaceFn,
-				EvalState:     evalState,
 				ObjectToWorld: objectToWorld,
 				WorldToObject: worldToObject,
 				NormalMat:     *worldToObject.Transpose(),
@@ -793,13 +1743,12 @@ func convertGMLSceneObjects(sceneObjects []gml.SceneObject, evalState *gml.EvalS
 			objectToWorld, worldToObject := createMatrices(typedObject.TransformMat)
 
 			cube := &Cube{
+				SurfaceFn:     typedObject.SurfaceFn,
 				ObjectToWorld: objectToWorld,
 				WorldToObject: worldToObject,
 			}
 			for i, side := range prim.PlanesForUnitCube() {
-				plane := createPlane(side.Point, side.Normal, objectToWorld, worldToObject, typedObject.SurfaceFn)
-				plane.Side = prim.CubeSide(i)
-				cube.Faces[i] = plane
+				cube.NormalsWorld[i] = worldToObject.Transpose().MulDir(side.Normal).Normalize()
 			}
 
 			results = append(results, cube)
@@ -808,7 +1757,6 @@ func convertGMLSceneObjects(sceneObjects []gml.SceneObject, evalState *gml.EvalS
 
 			results = append(results, &Cylinder{
 				SurfaceFn:     typedObject.SurfaceFn,
-				EvalState:     evalState,
 				ObjectToWorld: objectToWorld,
 				WorldToObject: worldToObject,
 				NormalMat:     *worldToObject.Transpose(),
@@ -820,11 +1768,150 @@ func convertGMLSceneObjects(sceneObjects []gml.SceneObject, evalState *gml.EvalS
 
 			results = append(results, &plane)
 		case *gml.Union:
-			// Right now we just flatten everything...
 			toVisit = append(toVisit, typedObject.Objects...)
+		case *gml.Instance, *gml.Motion:
+			// Handled by addInstances.
 		default:
-			return nil, fmt.Errorf("unknown scene object type %T", sceneObject)
+			return nil, fmt.Errorf("%w: %T", ErrUnsupportedObject, sceneObject)
 		}
 	}
 	return results, nil
 }
+
+// addInstances appends an Instance to results for each instance in
+// sceneObjects, with the instance's transform composed with toWorld in the
+// same order as Transform composes transforms.
+//
+// Instances in a prototype are lifted out of it and added to results
+// directly, with their transforms combined, so instances never contain
+// other instances.
+func (c *sceneConverter) addInstances(results []SceneObject, sceneObjects []gml.SceneObject, toWorld prim.Mat4) ([]SceneObject, error) {
+	for _, sceneObject := range sceneObjects {
+		var err error
+		switch typedObject := sceneObject.(type) {
+		case *gml.Union:
+			results, err = c.addInstances(results, typedObject.Objects, toWorld)
+		case *gml.Instance:
+			objectToWorld := *typedObject.TransformMat.MulMat(&toWorld)
+			var prototype *Prototype
+			prototype, err = c.prototype(typedObject.Prototype)
+			if err != nil {
+				return nil, err
+			}
+			if len(prototype.Objects) > 0 {
+				results = append(results, newInstance(prototype, objectToWorld))
+			}
+			results, err = c.addInstances(results, typedObject.Prototype.Objects, objectToWorld)
+		case *gml.Motion:
+			var inst *Instance
+			inst, err = c.movingInstance(typedObject, toWorld)
+			if err == nil {
+				results = append(results, inst)
+			}
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	return results, nil
+}
+
+// movingInstance converts a moving object into an instance that moves
+// between the object's start and end transforms.
+func (c *sceneConverter) movingInstance(motion *gml.Motion, toWorld prim.Mat4) (*Instance, error) {
+	prototype, start, err := c.untransformed(motion.Start)
+	if err != nil {
+		return nil, err
+	}
+	_, end, err := c.untransformed(motion.End)
+	if err != nil {
+		return nil, err
+	}
+	inst := newMovingInstance(prototype, *start.MulMat(&toWorld), *end.MulMat(&toWorld))
+	inst.motionIndex = c.moving
+	c.moving++
+	return inst, nil
+}
+
+// untransformed splits a primitive or instance into a prototype and a
+// transform.
+func (c *sceneConverter) untransformed(sceneObject gml.SceneObject) (*Prototype, prim.Mat4, error) {
+	var object gml.SceneObject
+	var xform *prim.Mat4
+	switch typedObject := sceneObject.(type) {
+	case *gml.Sphere:
+		copy := *typedObject
+		copy.TransformMat, xform = nil, typedObject.TransformMat
+		object = &copy
+	case *gml.Cube:
+		copy := *typedObject
+		copy.TransformMat, xform = nil, typedObject.TransformMat
+		object = &copy
+	case *gml.Cylinder:
+		copy := *typedObject
+		copy.TransformMat, xform = nil, typedObject.TransformMat
+		object = &copy
+	case *gml.Plane:
+		copy := *typedObject
+		copy.TransformMat, xform = nil, typedObject.TransformMat
+		object = &copy
+	case *gml.Instance:
+		if containsInstances(typedObject.Prototype) {
+			return nil, prim.Mat4{}, fmt.Errorf("moving unions must not contain transformed unions or moving objects")
+		}
+		prototype, err := c.prototype(typedObject.Prototype)
+		return prototype, *typedObject.TransformMat, err
+	default:
+		return nil, prim.Mat4{}, fmt.Errorf("can't move scene object of type %T", sceneObject)
+	}
+
+	objects, err := c.convertPrimitives([]gml.SceneObject{object})
+	if err != nil {
+		return nil, prim.Mat4{}, err
+	}
+	objectToWorld := prim.IdentityMatrix()
+	if xform != nil {
+		objectToWorld = *xform
+	}
+	return newPrototype(objects), objectToWorld, nil
+}
+
+// newPrototype returns a prototype of objects, which must all be
+// primitives, as convertPrimitives returns.
+func newPrototype(objects []SceneObject) *Prototype {
+	prototype := &Prototype{Objects: make([]primitive, len(objects))}
+	for i, obj := range objects {
+		prototype.Objects[i] = obj.(primitive)
+	}
+	return prototype
+}
+
+// containsInstances reports whether a union contains any instances or
+// moving objects, which addInstances would lift out of it.
+func containsInstances(union *gml.Union) bool {
+	for _, obj := range union.Objects {
+		switch obj := obj.(type) {
+		case *gml.Instance, *gml.Motion:
+			return true
+		case *gml.Union:
+			if containsInstances(obj) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// prototype returns the converted primitives of an instanced union.
+func (c *sceneConverter) prototype(union *gml.Union) (*Prototype, error) {
+	if prototype, ok := c.prototypes[union]; ok {
+		return prototype, nil
+	}
+	objects, err := c.convertPrimitives(union.Objects)
+	if err != nil {
+		return nil, err
+	}
+	prototype := newPrototype(objects)
+	c.prototypes[union] = prototype
+	return prototype, nil
+}
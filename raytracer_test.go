@@ -2,12 +2,15 @@ package raytracer
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"flag"
 	"fmt"
 	"image"
 	"image/png"
 	"os"
 	"testing"
+	"time"
 
 	"github.com/timdestan/go-raytracer/internal/gml"
 	"github.com/timdestan/go-raytracer/internal/prim"
@@ -92,6 +95,25 @@ func TestRenderCube(t *testing.T) {
 	compareImages(t, got, "testdata/goldens/example_cube.png")
 }
 
+// TestRenderSquashedSphere and TestRenderShearedCylinder check lighting on
+// objects with non-uniform scales, whose normals have to be transformed by
+// the inverse transpose of the object's transform.
+func TestRenderSquashedSphere(t *testing.T) {
+	got, err := ParseAndRenderGML(gml.MustReadTestdataFile("testdata/squashed-sphere.gml"))
+	if err != nil {
+		t.Fatalf("ParseAndRenderGML: %v", err)
+	}
+	compareImages(t, got, "testdata/goldens/example_squashed_sphere.png")
+}
+
+func TestRenderShearedCylinder(t *testing.T) {
+	got, err := ParseAndRenderGML(gml.MustReadTestdataFile("testdata/sheared-cylinder.gml"))
+	if err != nil {
+		t.Fatalf("ParseAndRenderGML: %v", err)
+	}
+	compareImages(t, got, "testdata/goldens/example_sheared_cylinder.png")
+}
+
 // TestRenderCylinder renders all four views produced by the original
 // contest fixture testdata/cylinder.gml: the front view (lateral surface,
 // textured based on face/u/v), the bottom and top caps (solid colors), and
@@ -163,3 +185,162 @@ func BenchmarkCube(b *testing.B) {
 		}
 	}
 }
+
+// clearCompiledSurfaceFns strips the compiled surface functions from the
+// scene, so that the interpreter is used instead.
+func clearCompiledSurfaceFns(obj gml.SceneObject) {
+	switch obj := obj.(type) {
+	case *gml.Sphere:
+		obj.SurfaceFn.Compiled = nil
+	case *gml.Cube:
+		obj.SurfaceFn.Compiled = nil
+	case *gml.Cylinder:
+		obj.SurfaceFn.Compiled = nil
+	case *gml.Plane:
+		obj.SurfaceFn.Compiled = nil
+	case *gml.Union:
+		for _, o := range obj.Objects {
+			clearCompiledSurfaceFns(o)
+		}
+	case *gml.Instance:
+		clearCompiledSurfaceFns(obj.Prototype)
+	case *gml.Motion:
+		clearCompiledSurfaceFns(obj.Start)
+		clearCompiledSurfaceFns(obj.End)
+	}
+}
+
+// BenchmarkCubeSurfaceFns compares rendering the cube scene (which has a
+// textured plane) with interpreted and compiled surface functions.
+func BenchmarkCubeSurfaceFns(b *testing.B) {
+	program := gml.MustReadTestdataFile("testdata/cube.gml")
+	for _, bb := range []struct {
+		name     string
+		compiled bool
+	}{
+		{"interpreted", false},
+		{"compiled", true},
+	} {
+		b.Run(bb.name, func(b *testing.B) {
+			for b.Loop() {
+				state := gml.NewEvalState()
+				state.Render = func(state *gml.EvalState, args *gml.RenderArgs) error {
+					if !bb.compiled {
+						clearCompiledSurfaceFns(args.Scene)
+					}
+					scene, err := ConvertRenderArgsToScene(args, state)
+					if err != nil {
+						return err
+					}
+					Render(scene)
+					return nil
+				}
+				if err := state.ParseAndEval(program); err != nil {
+					b.Fatalf("BenchmarkCubeSurfaceFns: %v", err)
+				}
+			}
+		})
+	}
+}
+
+// largeSceneArgs returns render arguments for a scene with n spheres.
+func largeSceneArgs(n int) *gml.RenderArgs {
+	union := &gml.Union{}
+	for i := range n {
+		sphere := &gml.Sphere{
+			Radius:    1,
+			SurfaceFn: gml.VSurfaceFn{Material: &gml.Material{Color: prim.RGB(1, 1, 1)}},
+		}
+		union.Objects = append(union.Objects, sphere.Transform(prim.Mat4Translate(prim.Vec3{X: float64(i)})))
+	}
+	return &gml.RenderArgs{
+		AmbientLight: &prim.Vec3{},
+		Scene:        union,
+		Width:        1,
+		Height:       1,
+	}
+}
+
+func TestConvertRenderArgsToSceneSharesObjects(t *testing.T) {
+	scene, err := ConvertRenderArgsToScene(largeSceneArgs(3), gml.NewEvalState())
+	if err != nil {
+		t.Fatalf("ConvertRenderArgsToScene: %v", err)
+	}
+	if len(scene.Objects) != 3 {
+		t.Fatalf("got %d objects, want 3", len(scene.Objects))
+	}
+	objects := &scene.Objects[0]
+	scene.Workers = 4
+	threadStates := scene.threadStates()
+	if len(threadStates) != 4 {
+		t.Fatalf("got %d thread states, want 4", len(threadStates))
+	}
+	evalStates := map[*gml.EvalState]bool{}
+	for _, st := range threadStates {
+		evalStates[st.EvalState] = true
+	}
+	if len(evalStates) != len(threadStates) {
+		t.Errorf("got %d distinct eval states for %d threads", len(evalStates), len(threadStates))
+	}
+	if &scene.Objects[0] != objects || len(scene.Objects) != 3 {
+		t.Errorf("adding threads copied the %d objects", len(scene.Objects))
+	}
+}
+
+func TestRenderOptionsOverrideSizeAndSamples(t *testing.T) {
+	const program = `
+		{ /v /u /face u v 0.5 point 1.0 0.3 1.0 } sphere 0.0 0.0 4.0 translate /scene
+		0.2 0.2 0.2 point [ ] scene 3 90.0 40 30 "out.ppm" render`
+	img, stats, err := ParseAndRenderGMLWithOptions(context.Background(), program, RenderOptions{Width: 20, Height: 10, Samples: 2})
+	if err != nil {
+		t.Fatalf("ParseAndRenderGMLWithOptions: %v", err)
+	}
+	if got, want := img.Bounds(), image.Rect(0, 0, 20, 10); got != want {
+		t.Errorf("bounds = %v, want %v", got, want)
+	}
+	if got, want := stats.PrimaryRays, int64(20*10*2); got != want {
+		t.Errorf("traced %d primary rays, want %d", got, want)
+	}
+}
+
+func TestRenderStopsWhenContextIsDone(t *testing.T) {
+	const program = `
+		{ /v /u /face u v 0.5 point 1.0 0.3 1.0 } sphere 0.0 0.0 4.0 translate /scene
+		0.2 0.2 0.2 point [ ] scene 3 90.0 4000 4000 "out.ppm" render`
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, _, err := ParseAndRenderGMLWithOptions(ctx, program, RenderOptions{Samples: 16})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("ParseAndRenderGMLWithOptions error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("render took %v after its deadline", elapsed)
+	}
+}
+
+func TestRenderReturnsSurfaceFunctionErrors(t *testing.T) {
+	// The surface function fails on the left half of the sphere, in one
+	// of the workers.
+	const program = `
+		{ /v /u /face u 0.5 lessf { [ ] 0 get } { 1.0 1.0 1.0 point } if 1.0 0.0 1.0 }
+		sphere 0.0 0.0 4.0 translate /scene
+		0.2 0.2 0.2 point [ ] scene 3 90.0 200 200 "out.ppm" render`
+	img, _, err := ParseAndRenderGMLWithOptions(context.Background(), program, RenderOptions{})
+	if !errors.Is(err, gml.ErrArrayIndexOutOfBounds) {
+		t.Errorf("ParseAndRenderGMLWithOptions error = %v, want %v", err, gml.ErrArrayIndexOutOfBounds)
+	}
+	if img != nil {
+		t.Error("ParseAndRenderGMLWithOptions returned an image for a failed render")
+	}
+}
+
+func BenchmarkConvertLargeScene(b *testing.B) {
+	args := largeSceneArgs(100_000)
+	state := gml.NewEvalState()
+	for b.Loop() {
+		if _, err := ConvertRenderArgsToScene(args, state); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
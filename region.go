@@ -0,0 +1,89 @@
+package raytracer
+
+import (
+	"fmt"
+	"image"
+	"math"
+	"strconv"
+	"strings"
+)
+
+// Region is a rectangle of the image to render, either in pixels or in
+// normalised coordinates that go from 0 to 1 across the image. Like
+// image.Rectangle, the minimum is inclusive and the maximum is exclusive.
+type Region struct {
+	X0, Y0, X1, Y1 float64
+	Normalized     bool
+}
+
+// ParseRegion parses a region from "x0,y0,x1,y1". The coordinates are in
+// pixels if they are all integers, like "10,20,110,70", and normalised if
+// they all have a decimal point, like "0.25,0.25,0.5,0.5". x1 and y1 must be
+// greater than x0 and y0.
+func ParseRegion(s string) (Region, error) {
+	parts := strings.Split(s, ",")
+	if len(parts) != 4 {
+		return Region{}, fmt.Errorf("region %q should be x0,y0,x1,y1", s)
+	}
+	var coords [4]float64
+	decimals := 0
+	for i, part := range parts {
+		part = strings.TrimSpace(part)
+		v, err := strconv.ParseFloat(part, 64)
+		if err != nil {
+			return Region{}, fmt.Errorf("region %q: %w", s, err)
+		}
+		if strings.Contains(part, ".") {
+			decimals++
+		}
+		coords[i] = v
+	}
+	if decimals != 0 && decimals != len(parts) {
+		return Region{}, fmt.Errorf("region %q mixes pixel and normalised coordinates", s)
+	}
+	r := Region{
+		X0: coords[0], Y0: coords[1], X1: coords[2], Y1: coords[3],
+		Normalized: decimals != 0,
+	}
+	if err := r.checkCorners(); err != nil {
+		return Region{}, err
+	}
+	return r, nil
+}
+
+// checkCorners returns an error if the region's maximum is not below and to
+// the right of its minimum. image.Rect would swap the corners instead.
+func (r Region) checkCorners() error {
+	if r.X1 <= r.X0 || r.Y1 <= r.Y0 {
+		return fmt.Errorf("region %v is empty or has its corners reversed", r)
+	}
+	return nil
+}
+
+func (r Region) String() string {
+	if r.Normalized {
+		return fmt.Sprintf("%g,%g,%g,%g (normalized)", r.X0, r.Y0, r.X1, r.Y1)
+	}
+	return fmt.Sprintf("%g,%g,%g,%g", r.X0, r.Y0, r.X1, r.Y1)
+}
+
+// Pixels returns the pixels of a width by height image that are in the
+// region. Normalised regions include every pixel they partly cover.
+func (r Region) Pixels(width, height int) (image.Rectangle, error) {
+	if err := r.checkCorners(); err != nil {
+		return image.Rectangle{}, err
+	}
+	bounds := image.Rect(0, 0, width, height)
+	var rect image.Rectangle
+	if r.Normalized {
+		rect = image.Rect(
+			int(math.Floor(r.X0*float64(width))), int(math.Floor(r.Y0*float64(height))),
+			int(math.Ceil(r.X1*float64(width))), int(math.Ceil(r.Y1*float64(height))))
+	} else {
+		rect = image.Rect(int(r.X0), int(r.Y0), int(r.X1), int(r.Y1))
+	}
+	if !rect.In(bounds) || rect.Empty() {
+		return image.Rectangle{}, fmt.Errorf("region %v is empty or not inside the %dx%d image", r, width, height)
+	}
+	return rect, nil
+}
@@ -0,0 +1,132 @@
+package raytracer
+
+import (
+	"context"
+	"image"
+	"image/color"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestParseRegion(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Region
+		wantErr bool
+	}{
+		{in: "10,20,110,70", want: Region{X0: 10, Y0: 20, X1: 110, Y1: 70}},
+		{in: "0.25, 0.5, 0.75, 1.0", want: Region{X0: 0.25, Y0: 0.5, X1: 0.75, Y1: 1, Normalized: true}},
+		{in: "0.25,0.5,1,1", wantErr: true},
+		{in: "1,2,3", wantErr: true},
+		{in: "a,b,c,d", wantErr: true},
+		{in: "100,100,10,10", wantErr: true},
+		{in: "10,20,110,20", wantErr: true},
+		{in: "0.5,0.25,0.25,0.5", wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := ParseRegion(tt.in)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("ParseRegion(%q) error = %v, want error: %v", tt.in, err, tt.wantErr)
+			continue
+		}
+		if diff := cmp.Diff(tt.want, got); diff != "" {
+			t.Errorf("ParseRegion(%q) mismatch (-want +got):\n%s", tt.in, diff)
+		}
+	}
+}
+
+func TestRegionPixels(t *testing.T) {
+	tests := []struct {
+		region  Region
+		want    image.Rectangle
+		wantErr bool
+	}{
+		{region: Region{X0: 10, Y0: 20, X1: 30, Y1: 40}, want: image.Rect(10, 20, 30, 40)},
+		{region: Region{X0: 0.25, Y0: 0, X1: 0.5, Y1: 0.3, Normalized: true}, want: image.Rect(25, 0, 50, 15)},
+		{region: Region{X0: 0, Y0: 0, X1: 1, Y1: 1, Normalized: true}, want: image.Rect(0, 0, 100, 50)},
+		{region: Region{X0: 90, Y0: 0, X1: 110, Y1: 10}, wantErr: true},
+		{region: Region{X0: 10, Y0: 10, X1: 10, Y1: 20}, wantErr: true},
+		{region: Region{X0: 30, Y0: 40, X1: 10, Y1: 20}, wantErr: true},
+	}
+	for _, tt := range tests {
+		got, err := tt.region.Pixels(100, 50)
+		if (err != nil) != tt.wantErr {
+			t.Errorf("%v.Pixels() error = %v, want error: %v", tt.region, err, tt.wantErr)
+			continue
+		}
+		if got != tt.want {
+			t.Errorf("%v.Pixels() = %v, want %v", tt.region, got, tt.want)
+		}
+	}
+}
+
+func TestRenderRegionMatchesFullRender(t *testing.T) {
+	const program = `
+		{ /v /u /face u v 0.5 point 1.0 0.3 1.0 } sphere 0.0 0.0 4.0 translate
+		{ /v /u /face 0.5 0.5 0.5 point 1.0 0.0 1.0 } plane 0.0 -1.0 0.0 translate
+		union /scene
+		0.2 0.2 0.2 point [ 0.0 5.0 0.0 point 1.0 1.0 1.0 point pointlight ]
+		scene 3 90.0 40 30 "out.ppm" render`
+	region := Region{X0: 0.3, Y0: 0.25, X1: 0.8, Y1: 0.9, Normalized: true}
+	rect, err := region.Pixels(40, 30)
+	if err != nil {
+		t.Fatalf("Pixels: %v", err)
+	}
+
+	full, _, err := ParseAndRenderGMLWithOptions(context.Background(), program, RenderOptions{})
+	if err != nil {
+		t.Fatalf("ParseAndRenderGMLWithOptions: %v", err)
+	}
+	for _, crop := range []bool{false, true} {
+		img, _, err := ParseAndRenderGMLWithOptions(context.Background(), program, RenderOptions{Region: &region, Crop: crop})
+		if err != nil {
+			t.Fatalf("ParseAndRenderGMLWithOptions(crop: %v): %v", crop, err)
+		}
+		wantBounds := full.Bounds()
+		if crop {
+			wantBounds = rect
+		}
+		if img.Bounds() != wantBounds {
+			t.Errorf("crop: %v: bounds = %v, want %v", crop, img.Bounds(), wantBounds)
+		}
+		for y := img.Bounds().Min.Y; y < img.Bounds().Max.Y; y++ {
+			for x := img.Bounds().Min.X; x < img.Bounds().Max.X; x++ {
+				want := full.At(x, y)
+				if !image.Pt(x, y).In(rect) {
+					want = color.RGBA{}
+				}
+				if got := img.At(x, y); got != want {
+					t.Fatalf("crop: %v: pixel (%d, %d) = %v, want %v", crop, x, y, got, want)
+				}
+			}
+		}
+	}
+}
+
+func TestRenderRegionOutsideImage(t *testing.T) {
+	_, _, err := ParseAndRenderGMLWithOptions(context.Background(), `
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere /scene
+		1.0 1.0 1.0 point [ ] scene 1 90.0 8 8 "out.ppm" render`,
+		RenderOptions{Region: &Region{X0: 4, Y0: 4, X1: 12, Y1: 8}})
+	if err == nil {
+		t.Error("expected an error for a region outside the image")
+	}
+}
+
+func TestRenderWithContextInvalidRegion(t *testing.T) {
+	scene, err := ParseGMLScene(`
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere /scene
+		1.0 1.0 1.0 point [ ] scene 1 90.0 8 8 "out.ppm" render`)
+	if err != nil {
+		t.Fatalf("ParseGMLScene: %v", err)
+	}
+	scene.Region = &Region{X0: 4, Y0: 4, X1: 12, Y1: 8}
+	img, _, err := RenderWithContext(context.Background(), scene)
+	if err == nil {
+		t.Error("RenderWithContext succeeded for a region outside the image, want an error")
+	}
+	if img != nil {
+		t.Error("RenderWithContext rendered an image for a region outside the image")
+	}
+}
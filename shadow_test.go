@@ -0,0 +1,105 @@
+package raytracer
+
+import (
+	"testing"
+
+	"github.com/timdestan/go-raytracer/internal/gml"
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+func newSphereAt(center prim.Vec3, material *gml.Material) *Sphere {
+	objectToWorld := *prim.Mat4Translate(center)
+	worldToObject := *objectToWorld.Inverse()
+	return &Sphere{
+		SurfaceFn:     gml.VSurfaceFn{Material: material},
+		ObjectToWorld: objectToWorld,
+		WorldToObject: worldToObject,
+		NormalMat:     *worldToObject.Transpose(),
+	}
+}
+
+func TestShadowTransmittance(t *testing.T) {
+	// The shaded point is at the origin, facing up towards a light at
+	// (0, 10, 0). Occluders are placed on the line between them.
+	hit := &HitEx{
+		PointWorld:  prim.Vec3{},
+		NormalWorld: prim.Vec3{Y: 1},
+	}
+	lightDir := prim.Vec3{Y: 1}
+	const distToLight = 10.0
+	ray := Ray{Direction: prim.Vec3{Y: -1}}
+
+	redGlass := &gml.Material{Color: prim.RGB(1, 0, 0), Transparency: 0.5}
+	greyGlass := &gml.Material{Color: prim.RGB(0.5, 0.5, 0.5), Transparency: 0.8}
+	steel := &gml.Material{Color: prim.RGB(0.7, 0.7, 0.7)}
+
+	for _, tt := range []struct {
+		name    string
+		objects []SceneObject
+		want    prim.Vec3
+	}{
+		{
+			name: "no occluders",
+			want: prim.RGB(1, 1, 1),
+		},
+		{
+			name:    "opaque occluder",
+			objects: []SceneObject{newSphereAt(prim.Vec3{Y: 5}, steel)},
+			want:    prim.Vec3{},
+		},
+		{
+			name:    "transparent occluder",
+			objects: []SceneObject{newSphereAt(prim.Vec3{Y: 5}, redGlass)},
+			want:    prim.RGB(0.5, 0, 0),
+		},
+		{
+			name: "multiple transparent occluders",
+			objects: []SceneObject{
+				newSphereAt(prim.Vec3{Y: 3}, greyGlass),
+				newSphereAt(prim.Vec3{Y: 6}, greyGlass),
+			},
+			want: prim.RGB(0.16, 0.16, 0.16),
+		},
+		{
+			name:    "occluder beyond the light",
+			objects: []SceneObject{newSphereAt(prim.Vec3{Y: 20}, steel)},
+			want:    prim.RGB(1, 1, 1),
+		},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := shadowTransmittance(hit, tt.objects, &SceneThreadState{}, lightDir, distToLight, ray)
+			if err != nil {
+				t.Fatalf("shadowTransmittance: %v", err)
+			}
+			if got.Sub(tt.want).Length() > 1e-9 {
+				t.Errorf("shadowTransmittance = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+// TestShadowTransmittanceSkipsInstancedObject checks that a point on an
+// object in an instance is not shadowed by the object itself, but is by the
+// rest of the instance.
+func TestShadowTransmittanceSkipsInstancedObject(t *testing.T) {
+	steel := &gml.Material{Color: prim.RGB(0.7, 0.7, 0.7)}
+	redGlass := &gml.Material{Color: prim.RGB(1, 0, 0), Transparency: 0.5}
+	self := newSphereAt(prim.Vec3{}, steel)
+	inst := newInstance(&Prototype{Objects: []primitive{self, newSphereAt(prim.Vec3{Y: 5}, redGlass)}}, *prim.Mat4Translate(prim.Vec3{X: 2}))
+
+	// The shaded point is at the bottom of the first sphere, and the light
+	// is above it, so the shadow ray goes through the sphere.
+	hit := &HitEx{
+		Hit:         Hit{Object: self, Instance: inst},
+		PointWorld:  prim.Vec3{X: 2, Y: -1},
+		NormalWorld: prim.Vec3{Y: -1},
+	}
+	ray := Ray{Direction: prim.Vec3{Y: 1}}
+	got, err := shadowTransmittance(hit, []SceneObject{inst}, &SceneThreadState{}, prim.Vec3{Y: 1}, 10, ray)
+	if err != nil {
+		t.Fatalf("shadowTransmittance: %v", err)
+	}
+	if want := prim.RGB(0.5, 0, 0); got.Sub(want).Length() > 1e-9 {
+		t.Errorf("shadowTransmittance = %v, want %v", got, want)
+	}
+}
@@ -0,0 +1,142 @@
+package raytracer
+
+import (
+	"fmt"
+	"math"
+
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+// DirectionalLight is a light source infinitely far away, such as the sun.
+type DirectionalLight struct {
+	// Direction is the unit vector pointing from the scene towards the light.
+	Direction prim.Vec3
+	Color     prim.Vec3
+}
+
+// Sky is an analytic daylight sky, using the model from Preetham, Shirley &
+// Smits, "A Practical Analytic Model for Daylight".
+type Sky struct {
+	// SunDirection is the unit vector pointing towards the sun.
+	SunDirection prim.Vec3
+	Turbidity    float64
+
+	// Luminance (Y) and chromaticity (x, y) at the zenith.
+	zenith [3]float64
+	// Perez distribution coefficients (A-E) for Y, x and y.
+	perez [3][5]float64
+	// exposure maps sky luminance to display values.
+	exposure float64
+}
+
+// NewSky creates a sky for the given sun direction and turbidity (roughly
+// 2 for a very clear sky, up to 10 for a hazy one).
+func NewSky(sunDirection prim.Vec3, turbidity float64) (*Sky, error) {
+	if sunDirection.IsZero() {
+		return nil, fmt.Errorf("sun direction must be non-zero")
+	}
+	if turbidity < 1.0 {
+		return nil, fmt.Errorf("turbidity must be >= 1, got %v", turbidity)
+	}
+	sky := &Sky{
+		SunDirection: sunDirection.Normalize(),
+		Turbidity:    turbidity,
+	}
+	T := turbidity
+	// The model is only defined for the sun above the horizon.
+	thetaS := math.Acos(min(max(sky.SunDirection.Y, 0), 1))
+
+	chi := (4.0/9.0 - T/120.0) * (math.Pi - 2.0*thetaS)
+	zenithY := (4.0453*T-4.9710)*math.Tan(chi) - 0.2155*T + 2.4192
+
+	theta2 := thetaS * thetaS
+	theta3 := theta2 * thetaS
+	T2 := T * T
+	zenithX := T2*(0.00166*theta3-0.00375*theta2+0.00209*thetaS) +
+		T*(-0.02903*theta3+0.06377*theta2-0.03202*thetaS+0.00394) +
+		(0.11693*theta3 - 0.21196*theta2 + 0.06052*thetaS + 0.25886)
+	zenithYc := T2*(0.00275*theta3-0.00610*theta2+0.00317*thetaS) +
+		T*(-0.04214*theta3+0.08970*theta2-0.04153*thetaS+0.00516) +
+		(0.15346*theta3 - 0.26756*theta2 + 0.06670*thetaS + 0.26688)
+
+	sky.perez = [3][5]float64{
+		{0.1787*T - 1.4630, -0.3554*T + 0.4275, -0.0227*T + 5.3251, 0.1206*T - 2.5771, -0.0670*T + 0.3703},
+		{-0.0193*T - 0.2592, -0.0665*T + 0.0008, -0.0004*T + 0.2125, -0.0641*T - 0.8989, -0.0033*T + 0.0452},
+		{-0.0167*T - 0.2608, -0.0950*T + 0.0092, -0.0079*T + 0.2102, -0.0441*T - 1.6537, -0.0109*T + 0.0529},
+	}
+
+	// The model gives values relative to the zenith, so divide out the
+	// distribution at the zenith.
+	for i, z := range [3]float64{zenithY, zenithX, zenithYc} {
+		sky.zenith[i] = z / perezF(&sky.perez[i], 0, thetaS)
+	}
+	// Scale so that the zenith is a mid-tone.
+	sky.exposure = 0.7 / zenithY
+	return sky, nil
+}
+
+// perezF evaluates the Perez sky distribution function for a view direction
+// at zenith angle theta and angle gamma away from the sun.
+func perezF(coeffs *[5]float64, theta, gamma float64) float64 {
+	A, B, C, D, E := coeffs[0], coeffs[1], coeffs[2], coeffs[3], coeffs[4]
+	cosGamma := math.Cos(gamma)
+	return (1.0 + A*math.Exp(B/math.Cos(theta))) * (1.0 + C*math.Exp(D*gamma) + E*cosGamma*cosGamma)
+}
+
+// Color returns the display color of the sky in the given direction, which
+// does not need to be normalized. Directions below the horizon get the
+// color of the horizon.
+func (s *Sky) Color(dir prim.Vec3) prim.Vec3 {
+	dir = dir.Normalize()
+	// Clamp slightly above the horizon, since the model blows up at 1/cos(90°).
+	cosTheta := math.Max(dir.Y, 0.01)
+	theta := math.Acos(cosTheta)
+	gamma := math.Acos(min(max(dir.Dot(s.SunDirection), -1), 1))
+
+	lum := s.zenith[0] * perezF(&s.perez[0], theta, gamma)
+	x := s.zenith[1] * perezF(&s.perez[1], theta, gamma)
+	y := s.zenith[2] * perezF(&s.perez[2], theta, gamma)
+
+	// xyY -> XYZ -> linear sRGB.
+	X := x / y * lum
+	Z := (1.0 - x - y) / y * lum
+	rgb := prim.RGB(
+		3.2406*X-1.5372*lum-0.4986*Z,
+		-0.9689*X+1.8758*lum+0.0415*Z,
+		0.0557*X-0.2040*lum+1.0570*Z,
+	)
+
+	// Simple exponential tone mapping into [0, 1].
+	toneMap := func(c float64) float64 {
+		return 1.0 - math.Exp(-math.Max(c, 0)*s.exposure)
+	}
+	return prim.RGB(toneMap(rgb.X), toneMap(rgb.Y), toneMap(rgb.Z))
+}
+
+// SunLight returns the sun as a directional light, or false if the sun is
+// below the horizon.
+//
+// The color of the sun is white, attenuated by Rayleigh and aerosol
+// scattering along its path through the atmosphere, so it reddens as it
+// nears the horizon or as turbidity increases.
+func (s *Sky) SunLight() (DirectionalLight, bool) {
+	if s.SunDirection.Y <= 0 {
+		return DirectionalLight{}, false
+	}
+	thetaS := math.Acos(s.SunDirection.Y)
+	// Relative optical air mass (Kasten & Young).
+	thetaDeg := thetaS * 180.0 / math.Pi
+	airMass := 1.0 / (math.Cos(thetaS) + 0.50572*math.Pow(96.07995-thetaDeg, -1.6364))
+
+	// Ångström turbidity coefficient, from Preetham et al.
+	beta := 0.04608*s.Turbidity - 0.04586
+	transmittance := func(wavelengthMicrons float64) float64 {
+		rayleigh := 0.008735 * math.Pow(wavelengthMicrons, -4.08)
+		aerosol := beta * math.Pow(wavelengthMicrons, -1.3)
+		return math.Exp(-airMass * (rayleigh + aerosol))
+	}
+	return DirectionalLight{
+		Direction: s.SunDirection,
+		Color:     prim.RGB(transmittance(0.68), transmittance(0.55), transmittance(0.45)),
+	}, true
+}
@@ -0,0 +1,99 @@
+package raytracer
+
+import (
+	"testing"
+
+	"github.com/timdestan/go-raytracer/internal/prim"
+)
+
+func TestSkyColor(t *testing.T) {
+	sky, err := NewSky(prim.Vec3{X: 1, Y: 1, Z: 1}, 3.0)
+	if err != nil {
+		t.Fatalf("NewSky: %v", err)
+	}
+
+	zenith := sky.Color(prim.Vec3{Y: 1})
+	if !(zenith.Z > zenith.Y && zenith.Y > zenith.X) {
+		t.Errorf("zenith color = %v, want blue", zenith)
+	}
+	for _, c := range []prim.Vec3{zenith, sky.Color(prim.Vec3{Z: 1}), sky.Color(prim.Vec3{Y: -1})} {
+		if c != c.Clamp() {
+			t.Errorf("sky color %v out of range", c)
+		}
+	}
+
+	nearSun := sky.Color(prim.Vec3{X: 1, Y: 1.1, Z: 1})
+	awayFromSun := sky.Color(prim.Vec3{X: -1, Y: 1.1, Z: -1})
+	if nearSun.Length() <= awayFromSun.Length() {
+		t.Errorf("sky near sun (%v) should be brighter than away from the sun (%v)", nearSun, awayFromSun)
+	}
+}
+
+func TestSkySunLight(t *testing.T) {
+	highSky, err := NewSky(prim.Vec3{Y: 1}, 3.0)
+	if err != nil {
+		t.Fatalf("NewSky: %v", err)
+	}
+	high, ok := highSky.SunLight()
+	if !ok {
+		t.Fatal("expected a sun light for a sun at the zenith")
+	}
+	if high.Direction != (prim.Vec3{Y: 1}) {
+		t.Errorf("sun direction = %v, want [0, 1, 0]", high.Direction)
+	}
+
+	lowSky, err := NewSky(prim.Vec3{Y: 0.1, Z: 1}, 3.0)
+	if err != nil {
+		t.Fatalf("NewSky: %v", err)
+	}
+	low, ok := lowSky.SunLight()
+	if !ok {
+		t.Fatal("expected a sun light for a sun above the horizon")
+	}
+	// A low sun is dimmer, and redder.
+	if low.Color.Length() >= high.Color.Length() {
+		t.Errorf("low sun (%v) should be dimmer than high sun (%v)", low.Color, high.Color)
+	}
+	if low.Color.Z/low.Color.X >= high.Color.Z/high.Color.X {
+		t.Errorf("low sun (%v) should be redder than high sun (%v)", low.Color, high.Color)
+	}
+
+	setSky, err := NewSky(prim.Vec3{Y: -1, Z: 1}, 3.0)
+	if err != nil {
+		t.Fatalf("NewSky: %v", err)
+	}
+	if _, ok := setSky.SunLight(); ok {
+		t.Error("expected no sun light for a sun below the horizon")
+	}
+}
+
+func TestNewSkyErrors(t *testing.T) {
+	if _, err := NewSky(prim.Vec3{}, 3.0); err == nil {
+		t.Error("expected an error for a zero sun direction")
+	}
+	if _, err := NewSky(prim.Vec3{Y: 1}, 0.5); err == nil {
+		t.Error("expected an error for turbidity < 1")
+	}
+}
+
+func TestRenderWithSky(t *testing.T) {
+	img, err := ParseAndRenderGML(`
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } plane
+		0.0 -1.0 0.0 translate /ground
+		0.0 0.0 0.0 point [ ] ground 3 90.0 32 32 "out.ppm"
+		0.0 1.0 1.0 point 3.0 renderWithSky`)
+	if err != nil {
+		t.Fatalf("ParseAndRenderGML: %v", err)
+	}
+
+	// The top of the frame is sky.
+	r, _, b, _ := img.At(16, 0).RGBA()
+	if b <= r {
+		t.Errorf("sky color = %v, want blue", img.At(16, 0))
+	}
+	// The white ground is lit by the sun, with no ambient or point lights.
+	r, g, b, _ := img.At(16, 31).RGBA()
+	if r == 0 || g == 0 || b == 0 {
+		t.Errorf("ground color = %v, want lit by the sun", img.At(16, 31))
+	}
+}
@@ -0,0 +1,175 @@
+package raytracer
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/timdestan/go-raytracer/internal/gml"
+)
+
+// RenderStats records how much work went into rendering a GML program, and
+// how long each phase took.
+type RenderStats struct {
+	PrimaryRays    int64 `json:"primary_rays"`
+	ShadowRays     int64 `json:"shadow_rays"`
+	ReflectionRays int64 `json:"reflection_rays"`
+	RefractionRays int64 `json:"refraction_rays"`
+
+	IntersectionTests IntersectionCounts `json:"intersection_tests"`
+	SurfaceFnEvals    SurfaceFnCounts    `json:"surface_fn_evals"`
+
+	// MaxDepth is the deepest level of recursion reached, where primary
+	// rays are at depth 1.
+	MaxDepth int `json:"max_depth"`
+
+	Phases PhaseTimes `json:"phases"`
+}
+
+// IntersectionCounts counts ray intersection tests by the kind of object
+// tested. Tests against an instance's prototype are counted under the
+// kind of each object in the prototype, as well as once for the instance.
+type IntersectionCounts struct {
+	Sphere   int64 `json:"sphere"`
+	Plane    int64 `json:"plane"`
+	Cube     int64 `json:"cube"`
+	Cylinder int64 `json:"cylinder"`
+	Instance int64 `json:"instance"`
+}
+
+// SurfaceFnCounts counts surface function evaluations by how the surface
+// function was evaluated.
+type SurfaceFnCounts struct {
+	// Constant surface functions were precomputed, for the whole object
+	// or per face.
+	Constant    int64 `json:"constant"`
+	Compiled    int64 `json:"compiled"`
+	Interpreted int64 `json:"interpreted"`
+}
+
+// PhaseTimes is the wall-clock time spent in each phase. Evaluation time
+// does not include the scene conversion and rendering that the GML program
+// triggers.
+type PhaseTimes struct {
+	Parse   time.Duration `json:"parse_ns"`
+	Eval    time.Duration `json:"eval_ns"`
+	Convert time.Duration `json:"convert_ns"`
+	Render  time.Duration `json:"render_ns"`
+}
+
+// Add adds the counts and times in other to s.
+func (s *RenderStats) Add(other *RenderStats) {
+	s.PrimaryRays += other.PrimaryRays
+	s.ShadowRays += other.ShadowRays
+	s.ReflectionRays += other.ReflectionRays
+	s.RefractionRays += other.RefractionRays
+
+	s.IntersectionTests.Sphere += other.IntersectionTests.Sphere
+	s.IntersectionTests.Plane += other.IntersectionTests.Plane
+	s.IntersectionTests.Cube += other.IntersectionTests.Cube
+	s.IntersectionTests.Cylinder += other.IntersectionTests.Cylinder
+	s.IntersectionTests.Instance += other.IntersectionTests.Instance
+
+	s.SurfaceFnEvals.Constant += other.SurfaceFnEvals.Constant
+	s.SurfaceFnEvals.Compiled += other.SurfaceFnEvals.Compiled
+	s.SurfaceFnEvals.Interpreted += other.SurfaceFnEvals.Interpreted
+
+	s.MaxDepth = max(s.MaxDepth, other.MaxDepth)
+
+	s.Phases.Parse += other.Phases.Parse
+	s.Phases.Eval += other.Phases.Eval
+	s.Phases.Convert += other.Phases.Convert
+	s.Phases.Render += other.Phases.Render
+}
+
+func (s *RenderStats) String() string {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "phases: parse %v, eval %v, convert %v, render %v\n",
+		s.Phases.Parse, s.Phases.Eval, s.Phases.Convert, s.Phases.Render)
+	fmt.Fprintf(&sb, "rays: primary %d, shadow %d, reflection %d, refraction %d\n",
+		s.PrimaryRays, s.ShadowRays, s.ReflectionRays, s.RefractionRays)
+	tests := &s.IntersectionTests
+	fmt.Fprintf(&sb, "intersection tests: sphere %d, plane %d, cube %d, cylinder %d, instance %d\n",
+		tests.Sphere, tests.Plane, tests.Cube, tests.Cylinder, tests.Instance)
+	evals := &s.SurfaceFnEvals
+	fmt.Fprintf(&sb, "surface functions: constant %d, compiled %d, interpreted %d\n",
+		evals.Constant, evals.Compiled, evals.Interpreted)
+	fmt.Fprintf(&sb, "max depth: %d\n", s.MaxDepth)
+	return sb.String()
+}
+
+// Format writes the statistics to w, either as text like String or as
+// indented JSON, depending on whether format is "text" or "json".
+func (s *RenderStats) Format(w io.Writer, format string) error {
+	switch format {
+	case "text":
+		_, err := io.WriteString(w, s.String())
+		return err
+	case "json":
+		out, err := json.MarshalIndent(s, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s\n", out)
+		return err
+	default:
+		return fmt.Errorf("unknown stats format %q, want \"text\" or \"json\"", format)
+	}
+}
+
+// intersect tests obj with the ray like obj.Intersect, counting the tests
+// in st.Stats. If obj is an instance, the object skip in its prototype is
+// not tested.
+func (st *SceneThreadState) intersect(obj SceneObject, ray Ray, hit *Hit, skip SceneObject) bool {
+	st.Stats.countIntersect(obj)
+	if inst, ok := obj.(*Instance); ok {
+		return inst.intersect(ray, hit, st, skip)
+	}
+	return obj.Intersect(ray, hit)
+}
+
+// countIntersect counts a test of obj. Tests of the objects in an
+// instance's prototype are counted as they are made.
+func (s *RenderStats) countIntersect(obj SceneObject) {
+	switch obj.(type) {
+	case *Instance:
+		s.IntersectionTests.Instance++
+	case *Sphere:
+		s.IntersectionTests.Sphere++
+	case *Plane:
+		s.IntersectionTests.Plane++
+	case *Cube:
+		s.IntersectionTests.Cube++
+	case *Cylinder:
+		s.IntersectionTests.Cylinder++
+	}
+}
+
+// countSurfaceFnEval counts the evaluation of the surface function of the
+// object that was hit, which must mirror the order of the checks in
+// gml.EvalSurfaceFn.
+func (s *RenderStats) countSurfaceFnEval(hit *Hit) {
+	var surfaceFn *gml.VSurfaceFn
+	switch obj := hit.Object.(type) {
+	case *Sphere:
+		surfaceFn = &obj.SurfaceFn
+	case *Plane:
+		surfaceFn = &obj.SurfaceFn
+	case *Cube:
+		surfaceFn = &obj.SurfaceFn
+	case *Cylinder:
+		surfaceFn = &obj.SurfaceFn
+	default:
+		return
+	}
+	switch {
+	case surfaceFn.Material != nil, hit.Face >= 0 && hit.Face < len(surfaceFn.Faces):
+		s.SurfaceFnEvals.Constant++
+	case surfaceFn.Compiled != nil:
+		s.SurfaceFnEvals.Compiled++
+	default:
+		s.SurfaceFnEvals.Interpreted++
+	}
+}
@@ -0,0 +1,156 @@
+package raytracer
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"testing"
+
+	"github.com/google/go-cmp/cmp"
+)
+
+func TestRenderStats(t *testing.T) {
+	// A reflective sphere above a plane, lit by a point light.
+	const program = `
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.5 1.0 } sphere 0.0 0.0 5.0 translate
+		{ /v /u /face u v 0.0 point 1.0 0.0 1.0 } plane 0.0 -1.0 0.0 translate
+		union /scene
+		0.2 0.2 0.2 point [ 0.0 5.0 0.0 point 1.0 1.0 1.0 point pointlight ]
+		scene 3 90.0 16 12 "out.ppm" render`
+
+	_, stats, err := ParseAndRenderGMLWithOptions(context.Background(), program, RenderOptions{})
+	if err != nil {
+		t.Fatalf("ParseAndRenderGMLWithOptions: %v", err)
+	}
+
+	if want := int64(16 * 12 * 4); stats.PrimaryRays != want {
+		t.Errorf("PrimaryRays = %d, want %d", stats.PrimaryRays, want)
+	}
+	if stats.ShadowRays == 0 {
+		t.Error("ShadowRays = 0, want > 0")
+	}
+	if stats.ReflectionRays == 0 {
+		t.Error("ReflectionRays = 0, want > 0")
+	}
+	if stats.RefractionRays != 0 {
+		t.Errorf("RefractionRays = %d, want 0 with no transparent objects", stats.RefractionRays)
+	}
+	// Every primary and reflection ray is tested against both objects.
+	if wantMin := stats.PrimaryRays + stats.ReflectionRays; stats.IntersectionTests.Sphere < wantMin || stats.IntersectionTests.Plane < wantMin {
+		t.Errorf("IntersectionTests = %+v, want at least %d for the sphere and plane", stats.IntersectionTests, wantMin)
+	}
+	if stats.IntersectionTests.Cube != 0 || stats.IntersectionTests.Cylinder != 0 {
+		t.Errorf("IntersectionTests = %+v, want no cube or cylinder tests", stats.IntersectionTests)
+	}
+	if stats.SurfaceFnEvals.Constant == 0 {
+		t.Errorf("SurfaceFnEvals = %+v, want constant evaluations for the sphere", stats.SurfaceFnEvals)
+	}
+	if stats.MaxDepth < 2 || stats.MaxDepth > 3 {
+		t.Errorf("MaxDepth = %d, want 2 or 3", stats.MaxDepth)
+	}
+	if stats.Phases.Parse <= 0 || stats.Phases.Eval < 0 || stats.Phases.Convert <= 0 || stats.Phases.Render <= 0 {
+		t.Errorf("Phases = %+v, want all phases to be timed", stats.Phases)
+	}
+}
+
+func TestRenderStatsInstance(t *testing.T) {
+	_, stats, err := ParseAndRenderGMLWithOptions(context.Background(), `
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } cube union
+		0.0 0.0 5.0 translate /scene
+		1.0 1.0 1.0 point [ ] scene 1 90.0 8 8 "out.ppm" render`, RenderOptions{})
+	if err != nil {
+		t.Fatalf("ParseAndRenderGMLWithOptions: %v", err)
+	}
+	// Only the rays that pass through the instance's bounds are tested with
+	// its objects.
+	tests := stats.IntersectionTests
+	if tests.Instance != stats.PrimaryRays {
+		t.Errorf("IntersectionTests.Instance = %d, want %d", tests.Instance, stats.PrimaryRays)
+	}
+	if tests.Sphere == 0 || tests.Sphere >= stats.PrimaryRays || tests.Cube != tests.Sphere {
+		t.Errorf("IntersectionTests = %+v, want the same number of sphere and cube tests, fewer than %d", tests, stats.PrimaryRays)
+	}
+}
+
+func TestRenderStatsInstanceCulled(t *testing.T) {
+	// The instance is behind the camera, so every ray misses its bounds.
+	_, stats, err := ParseAndRenderGMLWithOptions(context.Background(), `
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } cube union
+		0.0 0.0 -5.0 translate /scene
+		1.0 1.0 1.0 point [ ] scene 1 90.0 8 8 "out.ppm" render`, RenderOptions{})
+	if err != nil {
+		t.Fatalf("ParseAndRenderGMLWithOptions: %v", err)
+	}
+	want := IntersectionCounts{Instance: stats.PrimaryRays}
+	if diff := cmp.Diff(want, stats.IntersectionTests); diff != "" {
+		t.Errorf("IntersectionTests mismatch (-want +got):\n%s", diff)
+	}
+}
+
+func TestRenderStatsJSON(t *testing.T) {
+	stats := RenderStats{
+		PrimaryRays:       4,
+		IntersectionTests: IntersectionCounts{Cube: 2},
+		SurfaceFnEvals:    SurfaceFnCounts{Interpreted: 1},
+		MaxDepth:          1,
+		Phases:            PhaseTimes{Render: 3},
+	}
+	got, err := json.Marshal(&stats)
+	if err != nil {
+		t.Fatalf("json.Marshal: %v", err)
+	}
+	const want = `{"primary_rays":4,"shadow_rays":0,"reflection_rays":0,"refraction_rays":0,` +
+		`"intersection_tests":{"sphere":0,"plane":0,"cube":2,"cylinder":0,"instance":0},` +
+		`"surface_fn_evals":{"constant":0,"compiled":0,"interpreted":1},"max_depth":1,` +
+		`"phases":{"parse_ns":0,"eval_ns":0,"convert_ns":0,"render_ns":3}}`
+	if string(got) != want {
+		t.Errorf("json.Marshal(stats) = %s, want %s", got, want)
+	}
+}
+
+func TestRenderStatsFormat(t *testing.T) {
+	stats := RenderStats{PrimaryRays: 4, MaxDepth: 1}
+
+	var text bytes.Buffer
+	if err := stats.Format(&text, "text"); err != nil {
+		t.Fatalf("Format(text): %v", err)
+	}
+	if text.String() != stats.String() {
+		t.Errorf("Format(text) = %q, want %q", text.String(), stats.String())
+	}
+
+	var out bytes.Buffer
+	if err := stats.Format(&out, "json"); err != nil {
+		t.Fatalf("Format(json): %v", err)
+	}
+	var got RenderStats
+	if err := json.Unmarshal(out.Bytes(), &got); err != nil {
+		t.Fatalf("json.Unmarshal: %v", err)
+	}
+	if diff := cmp.Diff(stats, got); diff != "" {
+		t.Errorf("Format(json) round trip mismatch (-want +got):\n%s", diff)
+	}
+
+	if err := stats.Format(&out, "yaml"); err == nil {
+		t.Error("Format(yaml) succeeded, want an error")
+	}
+}
+
+func TestRenderWithStatsLeavesSceneUnchanged(t *testing.T) {
+	// A depth of 0 is rendered with the default depth.
+	scene, err := ParseGMLScene(`
+		{ /v /u /face 1.0 1.0 1.0 point 1.0 0.0 1.0 } sphere 0.0 0.0 5.0 translate /scene
+		1.0 1.0 1.0 point [ ] scene 0 90.0 4 4 "out.ppm" render`)
+	if err != nil {
+		t.Fatalf("ParseGMLScene: %v", err)
+	}
+	_, stats := RenderWithStats(scene)
+	if scene.RecursionDepth != 0 {
+		t.Errorf("RecursionDepth = %d after rendering, want 0", scene.RecursionDepth)
+	}
+	if stats.MaxDepth != 1 {
+		t.Errorf("MaxDepth = %d, want 1", stats.MaxDepth)
+	}
+}
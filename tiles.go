@@ -0,0 +1,126 @@
+package raytracer
+
+import (
+	"cmp"
+	"fmt"
+	"image"
+	"math"
+	"slices"
+)
+
+// TileOrder is the order in which tiles of the image are rendered. It does
+// not affect the rendered image, only which parts of it are done first.
+type TileOrder int
+
+const (
+	// TileOrderScanline renders rows of tiles from top to bottom.
+	TileOrderScanline TileOrder = iota
+	// TileOrderHilbert follows a Hilbert curve over the tiles, so that
+	// consecutive tiles are always adjacent.
+	TileOrderHilbert
+	// TileOrderSpiral spirals outwards from the centre of the image.
+	TileOrderSpiral
+)
+
+var tileOrderNames = []string{
+	TileOrderScanline: "scanline",
+	TileOrderHilbert:  "hilbert",
+	TileOrderSpiral:   "spiral",
+}
+
+func (o TileOrder) String() string {
+	if o < 0 || int(o) >= len(tileOrderNames) {
+		return fmt.Sprintf("TileOrder(%d)", int(o))
+	}
+	return tileOrderNames[o]
+}
+
+// ParseTileOrder returns the tile order with the given name.
+func ParseTileOrder(name string) (TileOrder, error) {
+	i := slices.Index(tileOrderNames, name)
+	if i < 0 {
+		return 0, fmt.Errorf("unknown tile order %q, want one of %v", name, tileOrderNames)
+	}
+	return TileOrder(i), nil
+}
+
+// tiles splits bounds into square tiles of the given size, clipped to the
+// bounds, and returns them in the given order.
+func tiles(bounds image.Rectangle, size int, order TileOrder) []image.Rectangle {
+	cols := (bounds.Dx() + size - 1) / size
+	rows := (bounds.Dy() + size - 1) / size
+	tile := func(col, row int) image.Rectangle {
+		topLeft := bounds.Min.Add(image.Pt(col*size, row*size))
+		return image.Rectangle{Min: topLeft, Max: topLeft.Add(image.Pt(size, size))}.Intersect(bounds)
+	}
+
+	result := make([]image.Rectangle, 0, cols*rows)
+	switch order {
+	case TileOrderHilbert:
+		n := 1
+		for n < cols || n < rows {
+			n *= 2
+		}
+		for d := range n * n {
+			col, row := hilbertPoint(n, d)
+			if col < cols && row < rows {
+				result = append(result, tile(col, row))
+			}
+		}
+	case TileOrderSpiral:
+		type ringTile struct {
+			ring  float64
+			angle float64
+			col   int
+			row   int
+		}
+		centreCol, centreRow := float64(cols-1)/2, float64(rows-1)/2
+		var ringTiles []ringTile
+		for row := range rows {
+			for col := range cols {
+				dx, dy := float64(col)-centreCol, float64(row)-centreRow
+				ringTiles = append(ringTiles, ringTile{
+					ring:  math.Max(math.Abs(dx), math.Abs(dy)),
+					angle: math.Atan2(dy, dx),
+					col:   col,
+					row:   row,
+				})
+			}
+		}
+		slices.SortStableFunc(ringTiles, func(a, b ringTile) int {
+			if a.ring != b.ring {
+				return cmp.Compare(a.ring, b.ring)
+			}
+			return cmp.Compare(a.angle, b.angle)
+		})
+		for _, t := range ringTiles {
+			result = append(result, tile(t.col, t.row))
+		}
+	default:
+		for row := range rows {
+			for col := range cols {
+				result = append(result, tile(col, row))
+			}
+		}
+	}
+	return result
+}
+
+// hilbertPoint returns the coordinates of the d'th point along a Hilbert
+// curve filling an n by n grid, where n is a power of 2.
+func hilbertPoint(n, d int) (x, y int) {
+	for s := 1; s < n; s *= 2 {
+		rx := 1 & (d / 2)
+		ry := 1 & (d ^ rx)
+		if ry == 0 {
+			if rx == 1 {
+				x, y = s-1-x, s-1-y
+			}
+			x, y = y, x
+		}
+		x += s * rx
+		y += s * ry
+		d /= 4
+	}
+	return x, y
+}
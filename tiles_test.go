@@ -0,0 +1,174 @@
+package raytracer
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/draw"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestTilesCoverImage(t *testing.T) {
+	bounds := image.Rect(0, 0, 37, 21)
+	for _, order := range []TileOrder{TileOrderScanline, TileOrderHilbert, TileOrderSpiral} {
+		t.Run(order.String(), func(t *testing.T) {
+			covered := make(map[image.Point]int)
+			for _, tile := range tiles(bounds, 8, order) {
+				if !tile.In(bounds) || tile.Empty() {
+					t.Errorf("tile %v is empty or not in %v", tile, bounds)
+				}
+				for y := tile.Min.Y; y < tile.Max.Y; y++ {
+					for x := tile.Min.X; x < tile.Max.X; x++ {
+						covered[image.Pt(x, y)]++
+					}
+				}
+			}
+			for y := bounds.Min.Y; y < bounds.Max.Y; y++ {
+				for x := bounds.Min.X; x < bounds.Max.X; x++ {
+					if n := covered[image.Pt(x, y)]; n != 1 {
+						t.Fatalf("pixel (%d, %d) is in %d tiles, want 1", x, y, n)
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestTilesHilbertIsContinuous(t *testing.T) {
+	// With a power of 2 number of tiles in each direction, every tile is
+	// next to the previous one.
+	ts := tiles(image.Rect(0, 0, 64, 64), 8, TileOrderHilbert)
+	for i := 1; i < len(ts); i++ {
+		d := ts[i].Min.Sub(ts[i-1].Min)
+		if abs(d.X)+abs(d.Y) != 8 {
+			t.Errorf("tile %d at %v is not next to tile %d at %v", i, ts[i].Min, i-1, ts[i-1].Min)
+		}
+	}
+}
+
+func abs(x int) int {
+	if x < 0 {
+		return -x
+	}
+	return x
+}
+
+func TestTilesSpiralStartsInCentre(t *testing.T) {
+	ts := tiles(image.Rect(0, 0, 50, 50), 10, TileOrderSpiral)
+	if !image.Pt(25, 25).In(ts[0]) {
+		t.Errorf("first tile is %v, want the centre tile", ts[0])
+	}
+	if last := ts[len(ts)-1]; last.Min.X > 0 && last.Min.Y > 0 && last.Max.X < 50 && last.Max.Y < 50 {
+		t.Errorf("last tile is %v, want a tile on the edge of the image", last)
+	}
+}
+
+func TestParseTileOrder(t *testing.T) {
+	for _, order := range []TileOrder{TileOrderScanline, TileOrderHilbert, TileOrderSpiral} {
+		got, err := ParseTileOrder(order.String())
+		if err != nil || got != order {
+			t.Errorf("ParseTileOrder(%q) = %v, %v, want %v", order.String(), got, err, order)
+		}
+	}
+	if _, err := ParseTileOrder("zigzag"); err == nil {
+		t.Error("ParseTileOrder(\"zigzag\") succeeded, want an error")
+	}
+}
+
+func TestRenderIsIndependentOfScheduling(t *testing.T) {
+	// Exercise everything that uses the random generator: antialiasing,
+	// depth of field and motion blur.
+	const program = `
+		{ /v /u /face u v 0.5 point 1.0 0.3 1.0 } sphere /s
+		s -1.0 0.0 4.0 translate s 1.0 0.0 4.0 translate motion
+		{ /v /u /face 0.5 0.5 0.5 point 1.0 0.0 1.0 } plane 0.0 -1.0 0.0 translate
+		union /scene
+		0.2 0.2 0.2 point [ 0.0 5.0 0.0 point 1.0 1.0 1.0 point pointlight ]
+		scene 3 90.0 41 23 "out.ppm" 0.05 4.0 renderWithLens`
+
+	var want []byte
+	for _, opts := range []RenderOptions{
+		{Workers: 1},
+		{Workers: 3, TileOrder: TileOrderHilbert},
+		{Workers: 8, TileSize: 5, TileOrder: TileOrderSpiral},
+		{Workers: 2, TileSize: 64},
+	} {
+		t.Run(fmt.Sprintf("%+v", opts), func(t *testing.T) {
+			scene, err := ParseGMLScene(program)
+			if err != nil {
+				t.Fatalf("ParseGMLScene: %v", err)
+			}
+			scene.RenderOptions = opts
+			got := Render(scene).(*image.RGBA).Pix
+			if want == nil {
+				want = got
+				return
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("image differs from the image rendered with one worker")
+			}
+		})
+	}
+}
+
+func TestTileDone(t *testing.T) {
+	const program = `
+		{ /v /u /face u v 0.5 point 1.0 0.3 1.0 } sphere 0.0 0.0 4.0 translate /scene
+		0.2 0.2 0.2 point [ ] scene 3 90.0 41 23 "out.ppm" render`
+	scene, err := ParseGMLScene(program)
+	if err != nil {
+		t.Fatalf("ParseGMLScene: %v", err)
+	}
+	var mu sync.Mutex
+	assembled := image.NewRGBA(image.Rect(0, 0, 41, 23))
+	pixels := 0
+	scene.RenderOptions = RenderOptions{Workers: 4, TileSize: 8, TileDone: func(tile *image.RGBA) {
+		mu.Lock()
+		defer mu.Unlock()
+		draw.Draw(assembled, tile.Bounds(), tile, tile.Bounds().Min, draw.Src)
+		pixels += tile.Bounds().Dx() * tile.Bounds().Dy()
+	}}
+	img := Render(scene).(*image.RGBA)
+	if want := 41 * 23; pixels != want {
+		t.Errorf("tiles had %d pixels, want %d", pixels, want)
+	}
+	if !bytes.Equal(assembled.Pix, img.Pix) {
+		t.Error("image assembled from tiles differs from the rendered image")
+	}
+}
+
+func TestTileDoneDoesNotBlockCheckpoints(t *testing.T) {
+	scene, err := ParseGMLScene(`
+		{ /v /u /face u v 0.5 point 1.0 0.3 1.0 } sphere 0.0 0.0 4.0 translate /scene
+		0.2 0.2 0.2 point [ ] scene 3 90.0 16 16 "out.ppm" render`)
+	if err != nil {
+		t.Fatalf("ParseGMLScene: %v", err)
+	}
+	checkpointFile := filepath.Join(t.TempDir(), "checkpoint")
+	var once sync.Once
+	scene.RenderOptions = RenderOptions{
+		Workers:            1,
+		TileSize:           8,
+		CheckpointFile:     checkpointFile,
+		CheckpointInterval: time.Millisecond,
+		// The first tile waits for a checkpoint, which can't be written
+		// while a worker holds on to the framebuffer.
+		TileDone: func(*image.RGBA) {
+			once.Do(func() {
+				deadline := time.Now().Add(5 * time.Second)
+				for time.Now().Before(deadline) {
+					if _, err := os.Stat(checkpointFile); err == nil {
+						return
+					}
+					time.Sleep(time.Millisecond)
+				}
+				t.Error("no checkpoint was written while TileDone was running")
+			})
+		},
+	}
+	Render(scene)
+}